@@ -1,5 +1,11 @@
 package controllers
 
+import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
 // ReconcilerConfig stores shared configuration for VirtualMachineReconciler and
 // VirtualMachineMigrationReconciler.
 type ReconcilerConfig struct {
@@ -15,6 +21,26 @@ type ReconcilerConfig struct {
 	// This is defined as a config option so we can do a gradual rollout of this change.
 	UseContainerMgr bool
 
+	// RunnerPriorityClassName, if not empty, sets the PriorityClassName of new VM runner pods.
+	//
+	// This allows VM pods to be given priority over other workloads (or vice versa) when the
+	// cluster is under pressure.
+	RunnerPriorityClassName string
+
+	// RunnerTolerations are added to the tolerations of new VM runner pods, in addition to any
+	// tolerations set on the VirtualMachine itself.
+	//
+	// This allows VM pods to be scheduled onto dedicated (tainted) nodes without requiring every
+	// VirtualMachine object to set the tolerations explicitly.
+	RunnerTolerations []corev1.Toleration
+
+	// OrphanedRunnerPodGracePeriod, if not zero, enables deleting runner pods that are still
+	// controlled by a VirtualMachine that no longer exists, once they've been orphaned for at least
+	// this long.
+	//
+	// Otherwise, those pods are left running, and must be cleaned up manually.
+	OrphanedRunnerPodGracePeriod time.Duration
+
 	MaxConcurrentReconciles int
 }
 
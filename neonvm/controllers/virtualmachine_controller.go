@@ -60,6 +60,10 @@ import (
 
 const (
 	virtualmachineFinalizer = "vm.neon.tech/finalizer"
+
+	// orphanedRunnerPodAnnotation is set on runner pods whose VirtualMachine no longer exists, with
+	// the time at which we first noticed. See cleanupOrphanedRunnerPods for more.
+	orphanedRunnerPodAnnotation = "vm.neon.tech/orphaned-since"
 )
 
 // Definitions to manage status conditions
@@ -116,6 +120,9 @@ func (r *VirtualMachineReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 		// Error reading the object - requeue the request.
 		if notfound := client.IgnoreNotFound(err); notfound == nil {
 			log.Info("virtualmachine resource not found. Ignoring since object must be deleted")
+			if r.Config.OrphanedRunnerPodGracePeriod != 0 {
+				return r.cleanupOrphanedRunnerPods(ctx, req.NamespacedName)
+			}
 			return ctrl.Result{}, nil
 		}
 		log.Error(err, "Unable to fetch VirtualMachine")
@@ -919,6 +926,96 @@ func (r *VirtualMachineReconciler) deleteRunnerPodIfEnabled(
 	return nil
 }
 
+// cleanupOrphanedRunnerPods deletes runner pods that are still controlled by the VirtualMachine,
+// even though it no longer exists (e.g. because of an issue with finalizers).
+//
+// Orphaned pods are first annotated with the time we noticed them, and are only deleted once
+// they've been orphaned for at least r.Config.OrphanedRunnerPodGracePeriod. Until then, the VM is
+// requeued for when the grace period is up.
+func (r *VirtualMachineReconciler) cleanupOrphanedRunnerPods(
+	ctx context.Context,
+	vmName types.NamespacedName,
+) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	var pods corev1.PodList
+	err := r.List(ctx, &pods, client.InNamespace(vmName.Namespace), client.MatchingLabels{
+		vmv1.VirtualMachineNameLabel: vmName.Name,
+	})
+	if err != nil {
+		log.Error(err, "Failed to list runner pods for VirtualMachine")
+		return ctrl.Result{}, err
+	}
+
+	gracePeriod := r.Config.OrphanedRunnerPodGracePeriod
+	now := time.Now()
+
+	var requeueAfter time.Duration
+	requeueFor := func(d time.Duration) {
+		if requeueAfter == 0 || d < requeueAfter {
+			requeueAfter = d
+		}
+	}
+
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+
+		// Only consider pods that are still controlled by the VM. During a migration, the source
+		// pod is controlled by the VirtualMachineMigration instead.
+		owner := metav1.GetControllerOf(pod)
+		if owner == nil || owner.APIVersion != vmv1.SchemeGroupVersion.String() ||
+			owner.Kind != "VirtualMachine" || owner.Name != vmName.Name {
+			continue
+		} else if !pod.DeletionTimestamp.IsZero() {
+			continue
+		}
+
+		orphanedSince, err := time.Parse(time.RFC3339, pod.Annotations[orphanedRunnerPodAnnotation])
+		if err != nil {
+			log.Info("Found orphaned runner pod", "Pod.Namespace", pod.Namespace, "Pod.Name", pod.Name)
+			patchData, err := json.Marshal(map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{
+						orphanedRunnerPodAnnotation: now.Format(time.RFC3339),
+					},
+				},
+			})
+			if err != nil {
+				panic(fmt.Errorf("error marshalling merge patch: %w", err))
+			}
+			if err := r.Patch(ctx, pod, client.RawPatch(types.MergePatchType, patchData)); err != nil {
+				log.Error(err, "Failed to annotate orphaned runner pod", "Pod.Name", pod.Name)
+				return ctrl.Result{}, err
+			}
+			requeueFor(gracePeriod)
+			continue
+		}
+
+		if remaining := gracePeriod - now.Sub(orphanedSince); remaining > 0 {
+			requeueFor(remaining)
+			continue
+		}
+
+		var msg, eventReason string
+		if buildtag.NeverDeleteRunnerPods {
+			msg = fmt.Sprintf("Orphaned VM runner pod deletion was skipped due to '%s' build tag", buildtag.TagnameNeverDeleteRunnerPods)
+			eventReason = "DeleteSkipped"
+		} else {
+			if err := r.Delete(ctx, pod); client.IgnoreNotFound(err) != nil {
+				log.Error(err, "Failed to delete orphaned runner pod", "Pod.Name", pod.Name)
+				return ctrl.Result{}, err
+			}
+			msg = "Orphaned VM runner pod was deleted"
+			eventReason = "OrphanDeleted"
+		}
+		log.Info(msg, "Pod.Namespace", pod.Namespace, "Pod.Name", pod.Name, "OrphanedSince", orphanedSince)
+		r.Recorder.Event(pod, "Warning", eventReason,
+			fmt.Sprintf("%s: VirtualMachine %s no longer exists", msg, vmName.Name))
+	}
+
+	return ctrl.Result{RequeueAfter: requeueAfter}, nil
+}
+
 // updates the values of the runner pod's labels and annotations so that they are exactly equal to
 // the set of labels/annotations we expect - minus some that are ignored.
 //
@@ -1148,6 +1245,20 @@ func annotationsForVirtualMachine(virtualmachine *vmv1.VirtualMachine) map[strin
 	return a
 }
 
+// tolerationsForVirtualMachine returns the tolerations for the VM's runner pod: those set on the
+// VirtualMachine itself, followed by any configured with ReconcilerConfig.RunnerTolerations.
+func tolerationsForVirtualMachine(virtualmachine *vmv1.VirtualMachine, config *ReconcilerConfig) []corev1.Toleration {
+	if len(config.RunnerTolerations) == 0 {
+		return virtualmachine.Spec.Tolerations
+	}
+
+	// make a fresh slice so that we don't modify the VirtualMachine's spec
+	t := make([]corev1.Toleration, 0, len(virtualmachine.Spec.Tolerations)+len(config.RunnerTolerations))
+	t = append(t, virtualmachine.Spec.Tolerations...)
+	t = append(t, config.RunnerTolerations...)
+	return t
+}
+
 func affinityForVirtualMachine(virtualmachine *vmv1.VirtualMachine) *corev1.Affinity {
 	a := virtualmachine.Spec.Affinity
 	if a == nil {
@@ -1264,6 +1375,7 @@ func podSpec(virtualmachine *vmv1.VirtualMachine, sshSecret *corev1.Secret, conf
 	labels := labelsForVirtualMachine(virtualmachine, &runnerVersion)
 	annotations := annotationsForVirtualMachine(virtualmachine)
 	affinity := affinityForVirtualMachine(virtualmachine)
+	tolerations := tolerationsForVirtualMachine(virtualmachine, config)
 
 	// Get the Operand image
 	image, err := imageForVmRunner()
@@ -1295,9 +1407,10 @@ func podSpec(virtualmachine *vmv1.VirtualMachine, sshSecret *corev1.Secret, conf
 			TerminationGracePeriodSeconds: virtualmachine.Spec.TerminationGracePeriodSeconds,
 			NodeSelector:                  virtualmachine.Spec.NodeSelector,
 			ImagePullSecrets:              virtualmachine.Spec.ImagePullSecrets,
-			Tolerations:                   virtualmachine.Spec.Tolerations,
+			Tolerations:                   tolerations,
 			ServiceAccountName:            virtualmachine.Spec.ServiceAccountName,
 			SchedulerName:                 virtualmachine.Spec.SchedulerName,
+			PriorityClassName:             config.RunnerPriorityClassName,
 			Affinity:                      affinity,
 			InitContainers: []corev1.Container{
 				{
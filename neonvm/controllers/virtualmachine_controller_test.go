@@ -23,12 +23,14 @@ import (
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 
 	vmv1 "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
 )
@@ -100,9 +102,12 @@ var _ = Describe("VirtualMachine controller", func() {
 				Scheme:   k8sClient.Scheme(),
 				Recorder: nil,
 				Config: &ReconcilerConfig{
-					IsK3s:                   false,
-					UseContainerMgr:         true,
-					MaxConcurrentReconciles: 1,
+					IsK3s:                        false,
+					UseContainerMgr:              true,
+					RunnerPriorityClassName:      "",
+					RunnerTolerations:            nil,
+					OrphanedRunnerPodGracePeriod: 0,
+					MaxConcurrentReconciles:      1,
 				},
 			}
 
@@ -133,5 +138,164 @@ var _ = Describe("VirtualMachine controller", func() {
 				}, time.Minute, time.Second).Should(Succeed())
 			*/
 		})
+
+		It("should set the configured priority class on the runner pod", func() {
+			cpu := vmv1.MilliCPU(1000)
+			virtualmachine := &vmv1.VirtualMachine{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      VirtualMachineName,
+					Namespace: namespace.Name,
+				},
+				Spec: vmv1.VirtualMachineSpec{
+					QMP:           1,
+					RestartPolicy: "Never",
+					RunnerPort:    1,
+					Guest:         vmv1.Guest{CPUs: vmv1.CPUs{Min: &cpu, Max: &cpu, Use: &cpu}},
+				},
+			}
+
+			By("Leaving the priority class empty by default")
+			pod, err := podSpec(virtualmachine, nil, &ReconcilerConfig{
+				IsK3s:                        false,
+				UseContainerMgr:              false,
+				RunnerPriorityClassName:      "",
+				RunnerTolerations:            nil,
+				OrphanedRunnerPodGracePeriod: 0,
+				MaxConcurrentReconciles:      1,
+			})
+			Expect(err).To(Not(HaveOccurred()))
+			Expect(pod.Spec.PriorityClassName).To(BeEmpty())
+
+			By("Setting the priority class from the reconciler config")
+			pod, err = podSpec(virtualmachine, nil, &ReconcilerConfig{
+				IsK3s:                        false,
+				UseContainerMgr:              false,
+				RunnerPriorityClassName:      "vm-runner",
+				RunnerTolerations:            nil,
+				OrphanedRunnerPodGracePeriod: 0,
+				MaxConcurrentReconciles:      1,
+			})
+			Expect(err).To(Not(HaveOccurred()))
+			Expect(pod.Spec.PriorityClassName).To(Equal("vm-runner"))
+		})
+
+		It("should add the configured tolerations to the runner pod", func() {
+			cpu := vmv1.MilliCPU(1000)
+			vmToleration := corev1.Toleration{
+				Key:      "vm-specific",
+				Operator: corev1.TolerationOpExists,
+				Effect:   corev1.TaintEffectNoSchedule,
+			}
+			runnerToleration := corev1.Toleration{
+				Key:      "dedicated",
+				Operator: corev1.TolerationOpEqual,
+				Value:    "vm-runners",
+				Effect:   corev1.TaintEffectNoSchedule,
+			}
+			virtualmachine := &vmv1.VirtualMachine{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      VirtualMachineName,
+					Namespace: namespace.Name,
+				},
+				Spec: vmv1.VirtualMachineSpec{
+					QMP:           1,
+					RestartPolicy: "Never",
+					RunnerPort:    1,
+					Guest:         vmv1.Guest{CPUs: vmv1.CPUs{Min: &cpu, Max: &cpu, Use: &cpu}},
+					Tolerations:   []corev1.Toleration{vmToleration},
+				},
+			}
+
+			By("Using only the VirtualMachine's tolerations by default")
+			pod, err := podSpec(virtualmachine, nil, &ReconcilerConfig{
+				IsK3s:                        false,
+				UseContainerMgr:              false,
+				RunnerPriorityClassName:      "",
+				RunnerTolerations:            nil,
+				OrphanedRunnerPodGracePeriod: 0,
+				MaxConcurrentReconciles:      1,
+			})
+			Expect(err).To(Not(HaveOccurred()))
+			Expect(pod.Spec.Tolerations).To(Equal([]corev1.Toleration{vmToleration}))
+
+			By("Appending the tolerations from the reconciler config")
+			pod, err = podSpec(virtualmachine, nil, &ReconcilerConfig{
+				IsK3s:                        false,
+				UseContainerMgr:              false,
+				RunnerPriorityClassName:      "",
+				RunnerTolerations:            []corev1.Toleration{runnerToleration},
+				OrphanedRunnerPodGracePeriod: 0,
+				MaxConcurrentReconciles:      1,
+			})
+			Expect(err).To(Not(HaveOccurred()))
+			Expect(pod.Spec.Tolerations).To(Equal([]corev1.Toleration{vmToleration, runnerToleration}))
+			Expect(virtualmachine.Spec.Tolerations).To(Equal([]corev1.Toleration{vmToleration}))
+		})
+
+		It("should clean up runner pods whose VirtualMachine no longer exists", func() {
+			By("Creating a runner pod owned by a VirtualMachine that doesn't exist")
+			orphanedVMName := types.NamespacedName{Name: "orphaned-virtualmachine", Namespace: namespace.Name}
+			controller := true
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "orphaned-runner",
+					Namespace: namespace.Name,
+					Labels:    map[string]string{vmv1.VirtualMachineNameLabel: orphanedVMName.Name},
+					OwnerReferences: []metav1.OwnerReference{{
+						APIVersion: vmv1.SchemeGroupVersion.String(),
+						Kind:       "VirtualMachine",
+						Name:       orphanedVMName.Name,
+						UID:        "00000000-0000-0000-0000-000000000000",
+						Controller: &controller,
+					}},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "neonvm-runner", Image: "runner:test"}},
+				},
+			}
+			err := k8sClient.Create(ctx, pod)
+			Expect(err).To(Not(HaveOccurred()))
+
+			gracePeriod := 2 * time.Second
+			recorder := record.NewFakeRecorder(10)
+			virtualmachineReconciler := &VirtualMachineReconciler{
+				Client:   k8sClient,
+				Scheme:   k8sClient.Scheme(),
+				Recorder: recorder,
+				Config: &ReconcilerConfig{
+					IsK3s:                        false,
+					UseContainerMgr:              false,
+					RunnerPriorityClassName:      "",
+					RunnerTolerations:            nil,
+					OrphanedRunnerPodGracePeriod: gracePeriod,
+					MaxConcurrentReconciles:      1,
+				},
+			}
+
+			By("Marking the pod as orphaned, without deleting it yet")
+			result, err := virtualmachineReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: orphanedVMName,
+			})
+			Expect(err).To(Not(HaveOccurred()))
+			Expect(result.RequeueAfter).To(Equal(gracePeriod))
+
+			found := &corev1.Pod{}
+			err = k8sClient.Get(ctx, client.ObjectKeyFromObject(pod), found)
+			Expect(err).To(Not(HaveOccurred()))
+			Expect(found.Annotations).To(HaveKey(orphanedRunnerPodAnnotation))
+
+			By("Deleting the pod once the grace period has passed")
+			time.Sleep(gracePeriod)
+			_, err = virtualmachineReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: orphanedVMName,
+			})
+			Expect(err).To(Not(HaveOccurred()))
+
+			Eventually(func() bool {
+				err := k8sClient.Get(ctx, client.ObjectKeyFromObject(pod), &corev1.Pod{})
+				return errors.IsNotFound(err)
+			}, time.Minute, time.Second).Should(BeTrue())
+			Expect(recorder.Events).To(Receive(ContainSubstring("OrphanDeleted")))
+		})
 	})
 })
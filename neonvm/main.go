@@ -18,6 +18,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
@@ -32,6 +33,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
@@ -93,6 +95,9 @@ func main() {
 	var probeAddr string
 	var concurrencyLimit int
 	var enableContainerMgr bool
+	var runnerPriorityClassName string
+	var runnerTolerationsJSON string
+	var orphanedRunnerPodGracePeriod time.Duration
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
@@ -100,6 +105,11 @@ func main() {
 			"Enabling this will ensure there is only one active controller manager.")
 	flag.IntVar(&concurrencyLimit, "concurrency-limit", 1, "Maximum number of concurrent reconcile operations")
 	flag.BoolVar(&enableContainerMgr, "enable-container-mgr", false, "Enable crictl-based container-mgr alongside each VM")
+	flag.StringVar(&runnerPriorityClassName, "runner-priority-class-name", "", "PriorityClassName to set on VM runner pods, if not empty")
+	flag.StringVar(&runnerTolerationsJSON, "runner-tolerations", "",
+		"JSON-encoded list of tolerations to add to VM runner pods, if not empty")
+	flag.DurationVar(&orphanedRunnerPodGracePeriod, "orphaned-runner-pod-grace-period", 0,
+		"Delete runner pods whose VM no longer exists after this long. If zero, they are not deleted")
 
 	opts := zap.Options{ //nolint:exhaustruct // typical options struct; not all fields needed.
 		Development:     true,
@@ -110,6 +120,14 @@ func main() {
 	flag.Parse()
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+
+	var runnerTolerations []corev1.Toleration
+	if runnerTolerationsJSON != "" {
+		if err := json.Unmarshal([]byte(runnerTolerationsJSON), &runnerTolerations); err != nil {
+			setupLog.Error(err, "unable to parse runner tolerations")
+			os.Exit(1)
+		}
+	}
 	// define klog settings (used in LeaderElector)
 	klog.SetLogger(zap.New(zap.UseFlagOptions(&opts)).V(2))
 
@@ -152,9 +170,12 @@ func main() {
 	reconcilerMetrics := controllers.MakeReconcilerMetrics()
 
 	rc := &controllers.ReconcilerConfig{
-		IsK3s:                   isK3s,
-		UseContainerMgr:         enableContainerMgr,
-		MaxConcurrentReconciles: concurrencyLimit,
+		IsK3s:                        isK3s,
+		UseContainerMgr:              enableContainerMgr,
+		RunnerPriorityClassName:      runnerPriorityClassName,
+		RunnerTolerations:            runnerTolerations,
+		OrphanedRunnerPodGracePeriod: orphanedRunnerPodGracePeriod,
+		MaxConcurrentReconciles:      concurrencyLimit,
 	}
 
 	if err = (&controllers.VirtualMachineReconciler{
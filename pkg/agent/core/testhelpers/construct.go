@@ -66,6 +66,8 @@ func CreateVmInfo(config InitialVmInfoConfig, opts ...VmInfoOpt) api.VmInfo {
 		))
 	}
 
+	_, cuMemSlots := api.ResourcesToSlots(config.ComputeUnit, config.MemorySlotSize)
+
 	vm := api.VmInfo{
 		Name:      "test",
 		Namespace: "test",
@@ -76,9 +78,9 @@ func CreateVmInfo(config InitialVmInfoConfig, opts ...VmInfoOpt) api.VmInfo {
 		},
 		Mem: api.VmMemInfo{
 			SlotSize: config.MemorySlotSize,
-			Min:      config.MinCU * uint16(config.ComputeUnit.Mem/config.MemorySlotSize),
-			Use:      config.MinCU * uint16(config.ComputeUnit.Mem/config.MemorySlotSize),
-			Max:      config.MaxCU * uint16(config.ComputeUnit.Mem/config.MemorySlotSize),
+			Min:      config.MinCU * cuMemSlots,
+			Use:      config.MinCU * cuMemSlots,
+			Max:      config.MaxCU * cuMemSlots,
 		},
 		ScalingConfig:  nil,
 		AlwaysMigrate:  false,
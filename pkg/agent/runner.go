@@ -26,6 +26,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/lithammer/shortuuid"
 	"go.uber.org/zap"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -555,6 +556,8 @@ func (r *Runner) doMetricsRequest(
 }
 
 func (r *Runner) doNeonVMRequest(ctx context.Context, target api.Resources) error {
+	_, memSlots := api.ResourcesToSlots(target, r.memSlotSize)
+
 	patches := []patch.Operation{{
 		Op:    patch.OpReplace,
 		Path:  "/spec/guest/cpus/use",
@@ -562,7 +565,7 @@ func (r *Runner) doNeonVMRequest(ctx context.Context, target api.Resources) erro
 	}, {
 		Op:    patch.OpReplace,
 		Path:  "/spec/guest/memorySlots/use",
-		Value: uint32(target.Mem / r.memSlotSize),
+		Value: uint32(memSlots),
 	}}
 
 	patchPayload, err := json.Marshal(patches)
@@ -673,6 +676,8 @@ func (r *Runner) DoSchedulerRequest(
 		Resources:    resources,
 		LastPermit:   lastPermit,
 		Metrics:      metrics,
+
+		CorrelationID: shortuuid.New(),
 	}
 
 	// make sure we log any error we're returning:
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"reflect"
 
 	"go.uber.org/zap/zapcore"
@@ -78,9 +79,19 @@ const (
 	// * Memory quantities now use "number of bytes" instead of "number of memory slots"
 	// * Adds AgentRequest.ComputeUnit
 	//
-	// Currently the latest version.
+	// Currently used by the autoscaler-agent.
 	PluginProtoV4_0
 
+	// PluginProtoV5_0 represents v5.0 of the agent<->scheduler plugin protocol.
+	//
+	// Changes from v4.0:
+	//
+	// * Adds PluginResponse.Burst, which the scheduler plugin only reserves for agents that support
+	//   it, because the agent must report any use of it in its next request.
+	//
+	// Currently the latest version.
+	PluginProtoV5_0
+
 	// latestPluginProtoVersion represents the latest version of the agent<->scheduler plugin
 	// protocol
 	//
@@ -108,6 +119,8 @@ func (v PluginProtoVersion) String() string {
 		return "v3.0"
 	case PluginProtoV4_0:
 		return "v4.0"
+	case PluginProtoV5_0:
+		return "v5.0"
 	default:
 		diff := v - latestPluginProtoVersion
 		return fmt.Sprintf("<unknown = %v + %d>", latestPluginProtoVersion, diff)
@@ -155,6 +168,14 @@ func (v PluginProtoVersion) RepresentsMemoryAsBytes() bool {
 	return v >= PluginProtoV4_0
 }
 
+// SupportsBurst returns whether this version of the protocol allows the scheduler plugin to send
+// burst headroom in PluginResponse.Burst.
+//
+// This is true for version v5.0 and greater.
+func (v PluginProtoVersion) SupportsBurst() bool {
+	return v >= PluginProtoV5_0
+}
+
 // AgentRequest is the type of message sent from an autoscaler-agent to the scheduler plugin
 //
 // All AgentRequests expect a PluginResponse.
@@ -188,6 +209,12 @@ type AgentRequest struct {
 	//
 	// In some protocol versions, this field may be nil.
 	Metrics *Metrics `json:"metrics"`
+	// CorrelationID, if not empty, identifies this request in both the autoscaler-agent's and the
+	// scheduler plugin's logs, so that they can be matched up with each other.
+	//
+	// If the agent doesn't provide one, the scheduler plugin assigns its own. Older versions of the
+	// scheduler plugin ignore this field.
+	CorrelationID string `json:"correlationID,omitempty"`
 }
 
 // ProtocolRange returns a VersionRange exactly equal to r.ProtoVersion
@@ -350,6 +377,33 @@ func (r Resources) Mul(factor uint16) Resources {
 	}
 }
 
+// ResourcesToSlots returns the vCPU and the number of memory slots of size memSlotSize represented
+// by r. This is the representation used by VmInfo, and by versions of the agent<->scheduler plugin
+// protocol before v4.0.
+//
+// vCPU is represented the same way in both, so it's returned unchanged. The number of memory slots
+// is rounded down if r.Mem is not a multiple of memSlotSize, and is capped at math.MaxUint16.
+//
+// ResourcesFromSlots is the inverse of this function.
+func ResourcesToSlots(r Resources, memSlotSize Bytes) (vmapi.MilliCPU, uint16) {
+	memSlots := r.Mem / memSlotSize
+	if memSlots > math.MaxUint16 {
+		memSlots = math.MaxUint16
+	}
+	return r.VCPU, uint16(memSlots)
+}
+
+// ResourcesFromSlots returns the Resources represented by the vCPU and number of memory slots of
+// size memSlotSize.
+//
+// ResourcesToSlots is the inverse of this function.
+func ResourcesFromSlots(cpu vmapi.MilliCPU, memSlots uint16, memSlotSize Bytes) Resources {
+	return Resources{
+		VCPU: cpu,
+		Mem:  Bytes(memSlots) * memSlotSize,
+	}
+}
+
 // AbsDiff returns a new Resources with each field F as the absolute value of the difference between
 // r.F and cmp.F
 func (r Resources) AbsDiff(cmp Resources) Resources {
@@ -401,8 +455,54 @@ type PluginResponse struct {
 	//
 	// THIS FIELD IS DEPRECATED: See https://github.com/neondatabase/autoscaling/issues/706
 	ComputeUnit *Resources `json:"resourceUnit,omitempty"`
+
+	// RetryAfterSeconds, if present, is a hint from the scheduler plugin that the node is saturated
+	// and the requested increase could not be fully granted. Agents SHOULD wait at least this many
+	// seconds before requesting another increase.
+	//
+	// This field is purely advisory; agents that ignore it remain compatible.
+	RetryAfterSeconds *uint `json:"retryAfterSeconds,omitempty"`
+
+	// Burst, if present, gives additional resources above the Permit that the scheduler plugin has
+	// reserved for the VM. The autoscaler-agent MAY scale the VM up to Permit + Burst immediately,
+	// without first making a request, but MUST include any use of the Burst in its next request.
+	//
+	// This field is only present for protocol version v5.0 and greater.
+	Burst *Resources `json:"burst,omitempty"`
+
+	// SuggestedDownscale, if present, is a request from the scheduler plugin for the VM to
+	// downscale towards these resources, as far as its load allows. The node the VM is on has too
+	// much pressure, and downscaling may allow the scheduler to avoid migrating VMs away from it.
+	//
+	// This field is purely advisory; agents that ignore it remain compatible.
+	SuggestedDownscale *Resources `json:"suggestedDownscale,omitempty"`
+
+	// DenialCause, if present, gives the reason that the Permit doesn't include all of the requested
+	// increase. Agents MAY use it to adjust how they retry, e.g. not retrying while migrating.
+	//
+	// This field is purely advisory; agents that ignore it remain compatible.
+	DenialCause *PermitDenialCause `json:"denialCause,omitempty"`
 }
 
+// PermitDenialCause is the reason given in a PluginResponse for not granting all of a requested
+// increase
+type PermitDenialCause string
+
+const (
+	// PermitDeniedNodeFull means that the node doesn't have room for the increase. The agent
+	// should wait before retrying, e.g. for PluginResponse.RetryAfterSeconds.
+	PermitDeniedNodeFull PermitDenialCause = "node-full"
+	// PermitDeniedMigrating means that the VM is being migrated, and its resources can't change
+	// until the migration is complete
+	PermitDeniedMigrating PermitDenialCause = "migrating"
+	// PermitDeniedClusterBudget means that granting the increase would put total reservations
+	// across the cluster above the configured maximum
+	PermitDeniedClusterBudget PermitDenialCause = "cluster-budget"
+	// PermitDeniedGrowthLimit means that the increase was larger than a single request may grant.
+	// The agent may request the rest immediately.
+	PermitDeniedGrowthLimit PermitDenialCause = "growth-limit"
+)
+
 // MigrateResponse, when provided, is a notification to the autsocaler-agent that it will migrate
 //
 // After receiving a MigrateResponse, the autoscaler-agent MUST NOT change its resource allocation.
@@ -0,0 +1,107 @@
+package api_test
+
+import (
+	"math"
+	"testing"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+func TestResourcesSlotConversion(t *testing.T) {
+	const gib = api.Bytes(1 << 30)
+
+	cases := []struct {
+		name        string
+		resources   api.Resources
+		memSlotSize api.Bytes
+		// expected values from ResourcesToSlots
+		cpu      vmapi.MilliCPU
+		memSlots uint16
+		// roundTrip is whether converting back with ResourcesFromSlots should give the original
+		// resources
+		roundTrip bool
+	}{
+		{
+			name:        "Zero",
+			resources:   api.Resources{VCPU: 0, Mem: 0},
+			memSlotSize: gib,
+			cpu:         0,
+			memSlots:    0,
+			roundTrip:   true,
+		},
+		{
+			name:        "Aligned",
+			resources:   api.Resources{VCPU: 2000, Mem: 8 * gib},
+			memSlotSize: gib,
+			cpu:         2000,
+			memSlots:    8,
+			roundTrip:   true,
+		},
+		{
+			name:        "FractionalCPU",
+			resources:   api.Resources{VCPU: 250, Mem: gib},
+			memSlotSize: gib,
+			cpu:         250,
+			memSlots:    1,
+			roundTrip:   true,
+		},
+		{
+			name:        "LargeSlots",
+			resources:   api.Resources{VCPU: 1000, Mem: 8 * gib},
+			memSlotSize: 4 * gib,
+			cpu:         1000,
+			memSlots:    2,
+			roundTrip:   true,
+		},
+		{
+			name:        "NonAlignedRoundsDown",
+			resources:   api.Resources{VCPU: 1000, Mem: 3*gib - 1},
+			memSlotSize: gib,
+			cpu:         1000,
+			memSlots:    2,
+			roundTrip:   false,
+		},
+		{
+			name:        "LessThanOneSlot",
+			resources:   api.Resources{VCPU: 1000, Mem: gib / 2},
+			memSlotSize: gib,
+			cpu:         1000,
+			memSlots:    0,
+			roundTrip:   false,
+		},
+		{
+			name:        "MaxSlots",
+			resources:   api.Resources{VCPU: 1000, Mem: math.MaxUint16 * gib},
+			memSlotSize: gib,
+			cpu:         1000,
+			memSlots:    math.MaxUint16,
+			roundTrip:   true,
+		},
+		{
+			name:        "TooManySlotsIsCapped",
+			resources:   api.Resources{VCPU: 1000, Mem: (math.MaxUint16 + 1) * gib},
+			memSlotSize: gib,
+			cpu:         1000,
+			memSlots:    math.MaxUint16,
+			roundTrip:   false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cpu, memSlots := api.ResourcesToSlots(c.resources, c.memSlotSize)
+			if cpu != c.cpu || memSlots != c.memSlots {
+				t.Fatalf("expected ResourcesToSlots = (%d, %d), got (%d, %d)", c.cpu, c.memSlots, cpu, memSlots)
+			}
+
+			back := api.ResourcesFromSlots(cpu, memSlots, c.memSlotSize)
+			if (back == c.resources) != c.roundTrip {
+				t.Errorf("expected round trip = %v, but got %v from %v", c.roundTrip, back, c.resources)
+			}
+			if back.Mem%c.memSlotSize != 0 {
+				t.Errorf("expected ResourcesFromSlots memory to be a multiple of the slot size, got %v", back.Mem)
+			}
+		})
+	}
+}
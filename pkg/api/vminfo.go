@@ -18,11 +18,12 @@ import (
 )
 
 const (
-	LabelTestingOnlyAlwaysMigrate = "autoscaling.neon.tech/testing-only-always-migrate"
-	LabelEnableAutoscaling        = "autoscaling.neon.tech/enabled"
-	AnnotationAutoscalingBounds   = "autoscaling.neon.tech/bounds"
-	AnnotationAutoscalingConfig   = "autoscaling.neon.tech/config"
-	AnnotationBillingEndpointID   = "autoscaling.neon.tech/billing-endpoint-id"
+	LabelTestingOnlyAlwaysMigrate  = "autoscaling.neon.tech/testing-only-always-migrate"
+	LabelEnableAutoscaling         = "autoscaling.neon.tech/enabled"
+	LabelMemReservationGranularity = "autoscaling.neon.tech/mem-reservation-granularity"
+	AnnotationAutoscalingBounds    = "autoscaling.neon.tech/bounds"
+	AnnotationAutoscalingConfig    = "autoscaling.neon.tech/config"
+	AnnotationBillingEndpointID    = "autoscaling.neon.tech/billing-endpoint-id"
 )
 
 // HasAutoscalingEnabled returns true iff the object has the label that enables autoscaling
@@ -70,32 +71,22 @@ type VmMemInfo struct {
 
 // Using returns the Resources that this VmInfo says the VM is using
 func (vm VmInfo) Using() Resources {
-	return Resources{
-		VCPU: vm.Cpu.Use,
-		Mem:  vm.Mem.SlotSize * Bytes(vm.Mem.Use),
-	}
+	return ResourcesFromSlots(vm.Cpu.Use, vm.Mem.Use, vm.Mem.SlotSize)
 }
 
 // SetUsing sets the values of vm.{Cpu,Mem}.Use to those provided by r
 func (vm *VmInfo) SetUsing(r Resources) {
-	vm.Cpu.Use = r.VCPU
-	vm.Mem.Use = uint16(r.Mem / vm.Mem.SlotSize)
+	vm.Cpu.Use, vm.Mem.Use = ResourcesToSlots(r, vm.Mem.SlotSize)
 }
 
 // Min returns the Resources representing the minimum amount this VmInfo says the VM must reserve
 func (vm VmInfo) Min() Resources {
-	return Resources{
-		VCPU: vm.Cpu.Min,
-		Mem:  vm.Mem.SlotSize * Bytes(vm.Mem.Min),
-	}
+	return ResourcesFromSlots(vm.Cpu.Min, vm.Mem.Min, vm.Mem.SlotSize)
 }
 
 // Max returns the Resources representing the maximum amount this VmInfo says the VM may reserve
 func (vm VmInfo) Max() Resources {
-	return Resources{
-		VCPU: vm.Cpu.Max,
-		Mem:  vm.Mem.SlotSize * Bytes(vm.Mem.Max),
-	}
+	return ResourcesFromSlots(vm.Cpu.Max, vm.Mem.Max, vm.Mem.SlotSize)
 }
 
 func (vm VmInfo) NamespacedName() util.NamespacedName {
@@ -219,13 +210,15 @@ func (vm VmInfo) EqualScalingBounds(cmp VmInfo) bool {
 }
 
 func (vm *VmInfo) applyBounds(b ScalingBounds) {
-	vm.Cpu.Min = vmapi.MilliCPUFromResourceQuantity(b.Min.CPU)
-	vm.Cpu.Max = vmapi.MilliCPUFromResourceQuantity(b.Max.CPU)
-
-	// FIXME: this will be incorrect if b.{Min,Max}.Mem.Value() is greater than
-	// (2^16-1) * info.Mem.SlotSize.Value().
-	vm.Mem.Min = uint16(BytesFromResourceQuantity(b.Min.Mem) / vm.Mem.SlotSize)
-	vm.Mem.Max = uint16(BytesFromResourceQuantity(b.Max.Mem) / vm.Mem.SlotSize)
+	// Note: memory is capped at (2^16-1) slots, if b.{Min,Max}.Mem.Value() is larger than that.
+	vm.Cpu.Min, vm.Mem.Min = ResourcesToSlots(Resources{
+		VCPU: vmapi.MilliCPUFromResourceQuantity(b.Min.CPU),
+		Mem:  BytesFromResourceQuantity(b.Min.Mem),
+	}, vm.Mem.SlotSize)
+	vm.Cpu.Max, vm.Mem.Max = ResourcesToSlots(Resources{
+		VCPU: vmapi.MilliCPUFromResourceQuantity(b.Max.CPU),
+		Mem:  BytesFromResourceQuantity(b.Max.Mem),
+	}, vm.Mem.SlotSize)
 }
 
 // ScalingBounds is the type that we deserialize from the "autoscaling.neon.tech/bounds" annotation
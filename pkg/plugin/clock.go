@@ -0,0 +1,22 @@
+package plugin
+
+// defines the clock that the plugin's time-dependent behavior reads the current time from, so that
+// tests can control the passage of time instead of sleeping.
+
+import (
+	"time"
+)
+
+// clock provides the current time
+//
+// The plugin uses realClock; tests may substitute a clock that they advance manually.
+type clock interface {
+	Now() time.Time
+}
+
+// realClock is the clock that reads the system's wall-clock time
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
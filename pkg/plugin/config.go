@@ -6,12 +6,16 @@ import (
 	"fmt"
 	"os"
 
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/exp/constraints"
 	"golang.org/x/exp/slices"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 
 	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
 	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
 )
 
 //////////////////
@@ -24,9 +28,42 @@ type Config struct {
 	// This value is sent to autoscaler-agents in every response, as part of api.PluginResponse.
 	ComputeUnit api.Resources `json:"computeUnit"`
 
+	// StrictComputeUnitAlignment, if true, holds back increases in one resource when the other
+	// can't be increased to the same number of compute units, so that VMs' reserved resources
+	// stay aligned to the compute unit (unless they're at their minimum or maximum).
+	//
+	// By default, CPU and memory are granted independently, which may temporarily leave a VM with
+	// resources that are uneven w.r.t. the compute unit, but allows it to scale up faster.
+	StrictComputeUnitAlignment bool `json:"strictComputeUnitAlignment,omitempty"`
+
+	// MaxGrowthPerRequest, if nonzero, caps how many compute units a single request from an
+	// autoscaler-agent may increase a VM's reservation by. The rest is denied, but may be requested
+	// again immediately. This limits how quickly a misbehaving agent can take over a node.
+	//
+	// Unlike other denials, the excess isn't counted as capacity pressure, because the node may
+	// well have room for it.
+	MaxGrowthPerRequest uint32 `json:"maxGrowthPerRequest,omitempty"`
+
 	// NodeConfig defines our policies around node resources and scoring
 	NodeConfig nodeConfig `json:"nodeConfig"`
 
+	// IdleNodeStateExpirySeconds, if provided, gives the duration, in seconds, after which we drop
+	// our local state for a node that has had no pods. The state is rebuilt from the Node object the
+	// next time it's needed, so this just keeps long-idle nodes from lingering in memory and in the
+	// maximum node size used for scoring.
+	//
+	// If zero or not provided, node state is kept until the Node is deleted.
+	IdleNodeStateExpirySeconds uint `json:"idleNodeStateExpirySeconds,omitempty"`
+
+	// MaxNodeStateAgeSeconds, if provided, gives the maximum age, in seconds, of our view of a node's
+	// capacity when Reserve places a pod onto it. If it's any older, the Node is fetched directly
+	// from the API server (bypassing the informer's cache) and its capacity recalculated before the
+	// pod's resources are reserved.
+	//
+	// This trades some latency in Reserve for certainty that the node has the capacity we think it
+	// does. If zero or not provided, the cached state is always used.
+	MaxNodeStateAgeSeconds uint `json:"maxNodeStateAgeSeconds,omitempty"`
+
 	// SchedulerName informs the scheduler of its name, so that it can identify pods that a previous
 	// version handled.
 	SchedulerName string `json:"schedulerName"`
@@ -35,22 +72,185 @@ type Config struct {
 	// the range [minScore + 1, trueScore], instead of the trueScore
 	RandomizeScores bool `json:"randomizeScores"`
 
+	// ExposeScoreHeadroom, if true, causes Score to record the raw headroom of each candidate node
+	// in the scheduling cycle's CycleState, so that other plugins (e.g. an external ranker) can use
+	// it instead of only the normalized score. See ReadNodeHeadroom for more.
+	ExposeScoreHeadroom bool `json:"exposeScoreHeadroom,omitempty"`
+
+	// PlacementAnnotation, if true, causes the plugin to annotate each VM pod it binds with the
+	// reason it chose the node (the node's score and headroom, and whether scores were randomized).
+	// See AnnotationPlacementReason.
+	PlacementAnnotation bool `json:"placementAnnotation,omitempty"`
+
+	// ScorePressure, if provided, makes Score penalize nodes for their capacityPressure (i.e. the
+	// resources their VMs have asked for but couldn't be given), using a blend of the current value
+	// and a recent average. This way, nodes with sustained pressure are avoided more strongly than
+	// nodes that just had a brief spike.
+	ScorePressure *scorePressureConfig `json:"scorePressure,omitempty"`
+
+	// MinScoreHeadroom, if provided, makes Score heavily penalize nodes that would be left with less
+	// than the minimum headroom after placing the pod. Those nodes can still be chosen, but only if
+	// there's no better option, so that we keep a little room on the nodes we're packing.
+	MinScoreHeadroom *minScoreHeadroomConfig `json:"minScoreHeadroom,omitempty"`
+
 	// MigrationDeletionRetrySeconds gives the duration, in seconds, we should wait between retrying
 	// a failed attempt to delete a VirtualMachineMigration that's finished.
 	MigrationDeletionRetrySeconds uint `json:"migrationDeletionRetrySeconds"`
 
+	// MigrationTimeoutSeconds, if provided, gives the duration, in seconds, after which we consider an
+	// ongoing migration to have failed. When that happens, we stop accounting for the pressure it
+	// was expected to relieve, and the pod becomes eligible for migration again after
+	// MigrationFailureCooldownSeconds.
+	//
+	// If zero or not provided, migrations never time out.
+	MigrationTimeoutSeconds uint `json:"migrationTimeoutSeconds,omitempty"`
+
+	// MigrationFailureCooldownSeconds gives the duration, in seconds, that a pod whose migration
+	// failed must wait before it may be selected for migration again.
+	MigrationFailureCooldownSeconds uint `json:"migrationFailureCooldownSeconds,omitempty"`
+
+	// PressureAccountingCheck, if provided, enables periodically checking that each node's
+	// PressureAccountedFor matches the pods that are currently migrating. Drift there would
+	// otherwise silently suppress (or encourage) future migrations from the node.
+	PressureAccountingCheck *pressureAccountingCheckConfig `json:"pressureAccountingCheck,omitempty"`
+
 	// DoMigration, if provided, allows VM migration to be disabled
 	//
 	// This flag is intended to be temporary, just until NeonVM supports mgirations and we can
 	// re-enable it.
 	DoMigration *bool `json:"doMigration"`
 
+	// MigrationStrategy, if provided, sets how we relieve pressure on nodes that are above their
+	// watermark. Refer to the documentation on the individual migrationStrategy values for more.
+	//
+	// If not provided, this defaults to "migrate".
+	MigrationStrategy migrationStrategy `json:"migrationStrategy,omitempty"`
+
+	// MigrationTargetStrategy, if provided, sets how we choose the node that a migrating VM should
+	// be moved to. Refer to the documentation on the individual migrationTargetStrategy values for
+	// more.
+	//
+	// If not provided, we don't choose a node, and the migration's target pod is scheduled like any
+	// other pod.
+	MigrationTargetStrategy migrationTargetStrategy `json:"migrationTargetStrategy,omitempty"`
+
+	// RequireMigrationTarget, if true, skips migrating a VM if there's no other node that currently
+	// has room for it, because the migration would either fail or leave it pending until its
+	// current node frees up.
+	RequireMigrationTarget bool `json:"requireMigrationTarget,omitempty"`
+
+	// MigrationHeadroomMargin, if provided, skips migrating a VM unless some other node would have
+	// at least this much more headroom than the VM's current node, even after the VM was added to
+	// it. A node's headroom is the fraction of its CPU or memory that's still available to be
+	// reserved, whichever is smaller.
+	//
+	// In small clusters, migrating a VM away from a node with too much pressure may just move the
+	// pressure to another node (and later, back again). Skipping those migrations leaves the node
+	// to rely on VMs downscaling in place instead.
+	MigrationHeadroomMargin float64 `json:"migrationHeadroomMargin,omitempty"`
+
+	// MigrationVetoLoadFraction, if provided, allows a pod selected for migration to veto it if its
+	// 1-minute load average has since dropped below this fraction of what it was when it was last
+	// checked. A vetoed pod is still migrated if it remains the best candidate on its node.
+	//
+	// Migrating a VM that's become idle frees up less than we expected, so it's better to try
+	// another VM first.
+	MigrationVetoLoadFraction float64 `json:"migrationVetoLoadFraction,omitempty"`
+
+	// MaxConcurrentMigrationsPerNode, if provided, gives the maximum number of pods on a single node
+	// that may be migrating (to or from it) at once. Once a node reaches the limit, we don't start
+	// any more migrations away from it until one of the ongoing ones finishes.
+	//
+	// Without a limit, a sudden increase in pressure may cause many pods to be migrated away from
+	// the same node at once, saturating its network and disk.
+	MaxConcurrentMigrationsPerNode uint `json:"maxConcurrentMigrationsPerNode,omitempty"`
+
+	// MaxTotalConcurrentMigrations, if provided, gives the maximum number of migrations that may be
+	// ongoing across the whole cluster at once. Once it's reached, no more migrations are started
+	// until one of the ongoing ones finishes. This is in addition to MaxConcurrentMigrationsPerNode.
+	MaxTotalConcurrentMigrations uint `json:"maxTotalConcurrentMigrations,omitempty"`
+
+	// IncreaseDenialPolicy, if provided, sets what we do when a pod's increase is denied because
+	// its node is full. Refer to the documentation on the individual increaseDenialPolicy values
+	// for more.
+	//
+	// If not provided, this defaults to "deny-first".
+	IncreaseDenialPolicy increaseDenialPolicy `json:"increaseDenialPolicy,omitempty"`
+
+	// ScaleOutGracePeriodSeconds gives the duration, in seconds, that we wait for cluster-autoscaler
+	// to add a new node before migrating VMs off of a node with too much pressure.
+	//
+	// This field is required iff MigrationStrategy is "scale-out-then-migrate".
+	ScaleOutGracePeriodSeconds uint `json:"scaleOutGracePeriodSeconds,omitempty"`
+
+	// CapacityPressureDwellSeconds gives the duration, in seconds, that pods' capacityPressure must
+	// persist above the node's threshold before it counts towards the node having too much
+	// pressure. This keeps a single bursty request from triggering an unnecessary migration.
+	//
+	// Pressure from reserved resources alone is not delayed. If zero or not provided, there's no
+	// delay.
+	CapacityPressureDwellSeconds uint `json:"capacityPressureDwellSeconds,omitempty"`
+
+	// MetricsRetentionSeconds, if provided, gives the duration, in seconds, for which a pod's most
+	// recent metrics are kept when the autoscaler-agent sends a request without any (e.g. right after
+	// it reconnects), so that the pod doesn't drop out of the migration queue during transient
+	// agent disconnects. Metrics older than this are discarded as stale.
+	//
+	// If zero or not provided, a request without metrics always clears the pod's metrics.
+	MetricsRetentionSeconds uint `json:"metricsRetentionSeconds,omitempty"`
+
+	// ExemptPodsWithoutMetrics, if true, prevents VMs that haven't provided any metrics from being
+	// migrated to relieve pressure on their node.
+	//
+	// By default, those VMs are placed at the back of the migration queue, so that they're only
+	// migrated as a last resort, once there's no other VM left to migrate.
+	ExemptPodsWithoutMetrics bool `json:"exemptPodsWithoutMetrics,omitempty"`
+
+	// OverprovisionedMigrationWeight, if provided, makes VMs that are reserving much more than they
+	// use (i.e. with a large buffer) preferred for migration, because migrating them also frees up
+	// the unused part of their reservation.
+	//
+	// When ordering the migration queue, each VM's load average is reduced by this weight times the
+	// fraction of its reservation that's unused. So with a weight of 1, a VM that's only using half
+	// of what's reserved for it is treated as having 0.5 less load.
+	OverprovisionedMigrationWeight float64 `json:"overprovisionedMigrationWeight,omitempty"`
+
+	// DualPressureMigrationWeight, if provided, makes VMs that reserve a large share of both CPU and
+	// memory preferred for migration while their node is over the watermark for both, because
+	// migrating them relieves both kinds of pressure at once.
+	//
+	// When ordering the migration queue on such a node, each VM's load average is reduced by this
+	// weight times the smaller of its fractions of the node's total CPU and memory.
+	DualPressureMigrationWeight float64 `json:"dualPressureMigrationWeight,omitempty"`
+
+	// PreferLargerMigrations, if provided, sets whether the migration queue is ordered by the size
+	// of each VM's reservation first, so that the VMs that relieve the most pressure are migrated
+	// first. A VM's size is its reserved CPU plus its reserved memory, each measured in compute
+	// units.
+	//
+	// VMs of the same size are then ordered by load average (including the adjustments from
+	// OverprovisionedMigrationWeight and DualPressureMigrationWeight), and then by memory usage.
+	//
+	// If not provided, this defaults to true. If false, the size of each VM is ignored.
+	PreferLargerMigrations *bool `json:"preferLargerMigrations,omitempty"`
+
+	// DownscaleBeforeMigrate, if provided, enables asking low-load VMs on a node with too much
+	// pressure to downscale, and waiting for that to relieve the pressure before migrating any VMs
+	// away.
+	//
+	// If MigrationStrategy is "scale-out-then-migrate", the scale-out grace period only starts
+	// after we've finished waiting for VMs to downscale.
+	DownscaleBeforeMigrate *downscaleBeforeMigrateConfig `json:"downscaleBeforeMigrate,omitempty"`
+
 	// K8sNodeGroupLabel, if provided, gives the label to use when recording k8s node groups in the
 	// metrics (like for autoscaling_plugin_node_{cpu,mem}_resources_current)
 	K8sNodeGroupLabel string `json:"k8sNodeGroupLabel"`
 
 	// K8sAvailabilityZoneLabel, if provided, gives the label to use when recording nodes'
 	// availability zones in the metrics (like for autoscaling_plugin_node_{cpu,mem}_resources_current)
+	// and when aggregating capacity by zone.
+	//
+	// If not provided, it defaults to the well-known "topology.kubernetes.io/zone" label.
 	K8sAvailabilityZoneLabel string `json:"k8sAvailabilityZoneLabel"`
 
 	// IgnoreNamespaces, if provided, gives a list of namespaces that the plugin should completely
@@ -64,6 +264,133 @@ type Config struct {
 	// evicted, which will allow cluster-autoscaler to trigger scale-up.
 	IgnoreNamespaces []string `json:"ignoreNamespaces"`
 
+	// ExtendedResources, if provided, gives a list of extended resources (e.g. "example.com/fpga")
+	// that the plugin should track for each node and pod, in addition to CPU and memory. Pods that
+	// request more of these than is remaining on a node will be rejected by Filter.
+	//
+	// Extended resources that aren't listed here are ignored.
+	ExtendedResources []corev1.ResourceName `json:"extendedResources,omitempty"`
+
+	// EvictionThreshold, if provided, reduces the reservable memory of nodes that only report their
+	// capacity by the kubelet's memory eviction threshold, so that we never reserve memory in the
+	// band where crossing the threshold would cause the kubelet to start evicting pods (including VM
+	// runners).
+	//
+	// A node's allocatable memory already excludes its eviction threshold, so nodes that report it
+	// are unaffected.
+	EvictionThreshold *evictionThresholdConfig `json:"evictionThreshold,omitempty"`
+
+	// NodeCapacityBounds, if provided, gives the range of CPU and memory that we expect nodes to
+	// report. Nodes outside this range are treated as an error instead of being used, because it
+	// probably means that their resources were reported in units we don't expect.
+	NodeCapacityBounds *nodeCapacityBoundsConfig `json:"nodeCapacityBounds,omitempty"`
+
+	// MaxVMsPerNode, if provided, gives the maximum number of VM pods that may be placed on a single
+	// node, regardless of available resources. This exists because each VM has some fixed overhead
+	// (file descriptors, tap devices, etc.) that isn't captured by CPU or memory.
+	//
+	// If zero or not provided, there is no limit.
+	MaxVMsPerNode uint `json:"maxVMsPerNode,omitempty"`
+
+	// MaxClusterReservableCPU and MaxClusterReservableMem, if nonzero, cap the total CPU and memory
+	// that may be reserved across all nodes. Once the cap is reached, requests to increase are
+	// denied (and counted as capacity pressure), even if the VM's node has room.
+	//
+	// This only limits increases; new VMs can still be scheduled, and VMs that are already over the
+	// cap aren't made to shrink.
+	MaxClusterReservableCPU vmapi.MilliCPU `json:"maxClusterReservableCPU,omitempty"`
+	MaxClusterReservableMem api.Bytes      `json:"maxClusterReservableMem,omitempty"`
+
+	// MaxClusterBufferCPU and MaxClusterBufferMem, if nonzero, cap the total buffer that may be
+	// reserved across all nodes for VMs we haven't yet heard from. Once the cap is reached, VMs whose
+	// bounds change before contacting us are given only the buffer that's left under the cap,
+	// reserving closer to what they're using than to their maximum.
+	//
+	// Buffer from before the cap was reached isn't released.
+	MaxClusterBufferCPU vmapi.MilliCPU `json:"maxClusterBufferCPU,omitempty"`
+	MaxClusterBufferMem api.Bytes      `json:"maxClusterBufferMem,omitempty"`
+
+	// NonVMLimit, if provided, caps the fraction of each node's resources that may be reserved by
+	// non-VM pods, so that an influx of system pods can't quietly starve the VMs on a node.
+	NonVMLimit *nonVMLimitConfig `json:"nonVMLimit,omitempty"`
+
+	// NoisyNeighbors, if provided, keeps VM pods away from nodes running non-VM pods that are known
+	// to degrade VM performance (e.g. batch jobs), by either rejecting or penalizing those nodes.
+	//
+	// This is much cheaper than inter-pod anti-affinity, because we already track the non-VM pods
+	// on each node.
+	NoisyNeighbors *noisyNeighborsConfig `json:"noisyNeighbors,omitempty"`
+
+	// GuaranteedQoS, if provided, checks that VM pods' runner containers have requests equal to
+	// limits for CPU and memory (i.e. that they'd be given the Guaranteed QoS class), so that VMs
+	// aren't the first to be evicted under node pressure.
+	GuaranteedQoS *guaranteedQoSConfig `json:"guaranteedQoS,omitempty"`
+
+	// ZeroMaxVMs, if provided, sets how we handle VMs with a maximum of zero CPU or memory, which
+	// would otherwise be scheduled without ever being able to reserve anything.
+	ZeroMaxVMs *zeroMaxVMsConfig `json:"zeroMaxVMs,omitempty"`
+
+	// UnderReportedUsage, if provided, enables raising a VM's reserved memory to match its measured
+	// usage, when its metrics show that it's using more than we've reserved for it (e.g. because a
+	// previous scheduler granted more than the autoscaler-agent reported back to us).
+	UnderReportedUsage *underReportedUsageConfig `json:"underReportedUsage,omitempty"`
+
+	// TenantReservation, if provided, sets aside a portion of each node's resources for VMs belonging
+	// to a particular tenant. Pods from other tenants are not allowed to use the reserved portion,
+	// but the tenant's own pods may use both the reserved portion and the rest of the node.
+	TenantReservation *tenantReservationConfig `json:"tenantReservation,omitempty"`
+
+	// GrowthReserveFraction, if provided, is the fraction of each node's resources that's held back
+	// from new pods, so that the VMs already on the node can scale up into it without needing to
+	// be migrated. Filter treats the reserve as unavailable, but requests from existing VMs may use
+	// all of it.
+	GrowthReserveFraction float64 `json:"growthReserveFraction,omitempty"`
+
+	// Backpressure, if provided, enables sending a hint to autoscaler-agents whose requested
+	// increases were capped, suggesting how long they should wait before requesting more.
+	Backpressure *backpressureConfig `json:"backpressure,omitempty"`
+
+	// BurstBuffer, if provided, enables reserving a fraction of a compute unit for each VM as burst
+	// headroom above its permit, which the autoscaler-agent may use without first making a request.
+	BurstBuffer *burstBufferConfig `json:"burstBuffer,omitempty"`
+
+	// NodeFullEvents, if provided, enables emitting a Kubernetes Event on the Node (and a distinct log
+	// line) whenever a VM's requested increase is denied because the node is full, so that alerting
+	// can notice when the cluster needs more capacity.
+	NodeFullEvents *nodeFullEventsConfig `json:"nodeFullEvents,omitempty"`
+
+	// VerdictSummary, if provided, enables accumulating a summary of the requests handled for each
+	// node, which is periodically logged. While it's enabled, the verdicts for individual requests
+	// are only logged at debug level.
+	VerdictSummary *verdictSummaryConfig `json:"verdictSummary,omitempty"`
+
+	// MigrationAudit, if provided, enables writing a record of the start and end of every migration
+	// we observe to an append-only log file, for auditing.
+	MigrationAudit *migrationAuditConfig `json:"migrationAudit,omitempty"`
+
+	// ShutdownSummary, if provided, enables logging a final summary of each node's reservations and
+	// pressure (alongside ongoing migrations and the number of pods tracked) when the plugin shuts
+	// down, for investigating why the scheduler was restarted.
+	ShutdownSummary *shutdownSummaryConfig `json:"shutdownSummary,omitempty"`
+
+	// OrphanMetrics, if provided, enables briefly buffering metrics that autoscaler-agents send for
+	// pods we don't know about, applying them if the pod is registered shortly after. This avoids
+	// losing the agent's metrics across a scheduler restart or an out-of-order pod registration.
+	OrphanMetrics *orphanMetricsConfig `json:"orphanMetrics,omitempty"`
+
+	// MetricsScraping, if provided, enables periodically fetching metrics directly from each VM, in
+	// addition to the metrics sent by the autoscaler-agent. This gives migration decisions a source
+	// of metrics that doesn't depend on the agent.
+	MetricsScraping *metricsScrapingConfig `json:"metricsScraping,omitempty"`
+
+	// Logging, if provided, sends audit events and per-request verdicts to their own outputs,
+	// separate from the plugin's general logs.
+	Logging *loggingConfig `json:"logging,omitempty"`
+
+	// Pause, if provided, configures the plugin's paused mode, for maintenance. The plugin can be
+	// paused or resumed at runtime only if Pause.Port is set.
+	Pause *pauseConfig `json:"pause,omitempty"`
+
 	// DumpState, if provided, enables a server to dump internal state
 	DumpState *dumpStateConfig `json:"dumpState"`
 
@@ -75,6 +402,14 @@ type nodeConfig struct {
 	Cpu    resourceConfig `json:"cpu"`
 	Memory resourceConfig `json:"memory"`
 
+	// GlobalReserveFraction is the fraction of every node's resources that we never reserve for
+	// pods, as a simple safety margin on top of what the node itself holds back for the system
+	// (i.e. the difference between its capacity and allocatable resources).
+	//
+	// Each node's total is reduced by this fraction before anything else (e.g. the watermark) is
+	// calculated from it. If empty (or zero), nothing extra is held back.
+	GlobalReserveFraction float64 `json:"globalReserveFraction,omitempty"`
+
 	// Details about node scoring:
 	// See also: https://www.desmos.com/calculator/wg8s0yn63s
 	// In the desmos, the value f(x,s) gives the score (from 0 to 1) of a node that's x amount full
@@ -104,17 +439,391 @@ type resourceConfig struct {
 	// Watermark is the fraction of non-system resource allocation above which we should be
 	// migrating VMs away to reduce usage
 	//
-	// If empty, the watermark is set as equal to the "hard" limit from system resources.
+	// Exactly one of Watermark and AbsoluteWatermark must be set. A fraction of 1 sets the
+	// watermark equal to the "hard" limit from system resources.
 	//
 	// The word "watermark" was originally used by @zoete as a temporary stand-in term during a
 	// meeting, and so it has intentionally been made permanent to spite the concept of "temporary" 😛
 	Watermark float32 `json:"watermark,omitempty"`
+	// AbsoluteWatermark is the amount of the resource above which we should be migrating VMs away,
+	// regardless of the node's size, e.g. "28" for CPU or "112Gi" for memory. If it's more than the
+	// node's total, the watermark is the total instead.
+	//
+	// Exactly one of Watermark and AbsoluteWatermark must be set. Watermark is usually a better fit
+	// for clusters with a mix of node sizes.
+	AbsoluteWatermark *resource.Quantity `json:"absoluteWatermark,omitempty"`
+	// PressureMargin is the fraction of the node's total resources by which pressure must exceed
+	// what's already accounted for by ongoing migrations before we'll start another one.
+	//
+	// If empty, the margin is zero, so that any unaccounted-for pressure triggers migration. Setting
+	// a small nonzero value reduces migration thrash from small, transient increases in pressure.
+	PressureMargin float32 `json:"pressureMargin,omitempty"`
+	// HysteresisGap is the fraction of the node's total resources below Watermark that reserved
+	// resources must drop to before a node that has had too much pressure is no longer considered
+	// to.
+	//
+	// If empty, there's no gap, so the node stops migrating pods away as soon as its pressure is
+	// back to the watermark. Setting a nonzero value prevents nodes that are hovering around the
+	// watermark from repeatedly starting and stopping migrations.
+	HysteresisGap float32 `json:"hysteresisGap,omitempty"`
+	// DisableMigrationTrigger, if true, means that this resource being over its watermark does not
+	// by itself cause VMs to be migrated away from the node. For example, disabling it for CPU but
+	// not memory means that nodes only migrate VMs away under memory pressure, because CPU
+	// overcommit is tolerable.
+	//
+	// This only affects migration. Scoring and filtering still use the watermark as usual.
+	DisableMigrationTrigger bool `json:"disableMigrationTrigger,omitempty"`
+	// MaxOverage, if provided, is the fraction of the gap between Watermark and the node's total
+	// that pods may reserve beyond Watermark. Increases that would go past it are denied outright,
+	// instead of being added to the node's pressure, so that nodes waiting on migrations can't run
+	// arbitrarily hot.
+	//
+	// If not provided, pods may reserve up to the node's total, as usual.
+	MaxOverage *float32 `json:"maxOverage,omitempty"`
+}
+
+type migrationStrategy string
+
+const (
+	// migrationStrategyMigrate immediately migrates VMs away from nodes with too much pressure.
+	migrationStrategyMigrate migrationStrategy = "migrate"
+	// migrationStrategyScaleOutThenMigrate defers migrating VMs away from nodes with too much
+	// pressure for a grace period, signalling the pressure via metrics so that the node autoscaler
+	// (e.g., cluster-autoscaler) has the chance to add a new node first.
+	//
+	// If the node still has too much pressure after the grace period, we fall back to migration.
+	migrationStrategyScaleOutThenMigrate migrationStrategy = "scale-out-then-migrate"
+)
+
+type migrationTargetStrategy string
+
+const (
+	// migrationTargetEmptiest picks the node with the largest fraction of its resources remaining.
+	migrationTargetEmptiest migrationTargetStrategy = "emptiest"
+	// migrationTargetSameZone picks the emptiest node in the same availability zone as the source
+	// node, to minimize the network cost of migration. If there isn't one, this falls back to the
+	// emptiest node in any zone.
+	migrationTargetSameZone migrationTargetStrategy = "same-zone"
+	// migrationTargetDifferentZone picks the emptiest node in a different availability zone from
+	// the source node, to spread VMs out for resilience. If there isn't one, this falls back to the
+	// emptiest node in any zone.
+	migrationTargetDifferentZone migrationTargetStrategy = "different-zone"
+)
+
+type increaseDenialPolicy string
+
+const (
+	// increaseDenialDenyFirst only denies the increase, adding the remainder to the node's capacity
+	// pressure. Pods are migrated away once the node has too much pressure, as usual.
+	//
+	// This never migrates a pod before the node's pressure requires it, so short bursts of demand
+	// don't cause migrations. However, the denied pod can't grow until enough pressure builds up
+	// (and any dwell time passes), and the pod that's migrated then may well be the one that was
+	// trying to grow.
+	increaseDenialDenyFirst increaseDenialPolicy = "deny-first"
+	// increaseDenialMigrateToAccommodate also migrates the pod that's next in the node's migration
+	// queue (i.e., the cheapest one to move) without waiting for the node to have too much
+	// pressure, so that the denied pod can grow in place once the migration is done. The denied pod
+	// itself is never chosen for this.
+	//
+	// This lets the pod that's growing get its resources sooner, without being migrated itself, at
+	// the cost of more migrations: one may be started for a burst of demand that would have
+	// subsided on its own.
+	increaseDenialMigrateToAccommodate increaseDenialPolicy = "migrate-to-accommodate"
+)
+
+// tenantReservationConfig configures the resources on each node that are reserved for a single
+// tenant
+type tenantReservationConfig struct {
+	// LabelKey and LabelValue give the pod label identifying pods that belong to the tenant
+	LabelKey   string `json:"labelKey"`
+	LabelValue string `json:"labelValue"`
+
+	// Cpu and Memory give the fraction of each node's total resources that are reserved for the
+	// tenant
+	Cpu    float32 `json:"cpu"`
+	Memory float32 `json:"memory"`
+}
+
+// evictionThresholdConfig configures the kubelet memory eviction threshold that's held back from
+// each node's reservable memory
+type evictionThresholdConfig struct {
+	// Memory gives the eviction threshold for nodes that don't have their own threshold set by
+	// NodeAnnotation.
+	Memory api.Bytes `json:"memory"`
+	// NodeAnnotation, if provided, gives the annotation on each Node that sets that node's eviction
+	// threshold, as a quantity (e.g. "500Mi"). Nodes without the annotation use Memory instead.
+	NodeAnnotation string `json:"nodeAnnotation,omitempty"`
+}
+
+// nodeCapacityBoundsConfig configures the sanity check on each node's reported CPU and memory
+//
+// Nodes must always have at least one CPU.
+type nodeCapacityBoundsConfig struct {
+	// MaxCPU is the most CPU that we expect any node to have
+	MaxCPU vmapi.MilliCPU `json:"maxCPU"`
+	// MinMemory is the least memory that we expect any node to have
+	MinMemory api.Bytes `json:"minMemory"`
+}
+
+// scorePressureConfig configures how nodes' capacityPressure is taken into account when scoring
+//
+// Each node's score is scaled by one minus its blended capacityPressure, as a fraction of the node's
+// total resources.
+type scorePressureConfig struct {
+	// WindowSeconds is the time constant, in seconds, of the exponentially weighted moving average
+	// of each node's capacityPressure. Roughly, it's how long pressure is remembered for.
+	WindowSeconds uint `json:"windowSeconds"`
+	// InstantaneousWeight is the weight, from 0 to 1, given to the node's current capacityPressure
+	// when blending it with the recent average. The rest of the weight is given to the average.
+	InstantaneousWeight float64 `json:"instantaneousWeight"`
+}
+
+// pauseConfig configures the plugin's paused mode
+//
+// While paused, the plugin doesn't start any migrations, but still keeps track of everything in the
+// cluster, so that it's consistent when resumed.
+type pauseConfig struct {
+	// Paused, if true, starts the plugin paused
+	Paused bool `json:"paused"`
+	// RejectVMs, if true, causes Filter to reject all VM pods while paused, so that they're left
+	// pending until the plugin is resumed.
+	RejectVMs bool `json:"rejectVMs"`
+	// Port, if nonzero, starts a server with a "/pause" endpoint to pause or resume the plugin at
+	// runtime. It only listens on localhost, so it can't be reached from elsewhere in the cluster.
+	//
+	// If zero, the plugin can only be paused through this config.
+	Port uint16 `json:"port,omitempty"`
+}
+
+// minScoreHeadroomConfig configures the minimum headroom nodes should keep, below which they're
+// penalized in Score
+type minScoreHeadroomConfig struct {
+	// CPU and Mem are the minimum remaining reservable CPU and memory that a node should have after
+	// placing the pod. A node with less of either one is penalized.
+	CPU vmapi.MilliCPU `json:"cpu"`
+	Mem api.Bytes      `json:"mem"`
+	// Penalty is the fraction, from 0 to 1, by which the score of a node below the minimum headroom
+	// is reduced. A penalty of 1 gives those nodes the minimum score.
+	Penalty float64 `json:"penalty"`
+}
+
+// nonVMLimitConfig configures the cap on how much of a node's resources non-VM pods may reserve
+//
+// Because we only track non-VM pods rather than being responsible for all of them, exceeding the
+// limit is always logged and counted in the autoscaling_plugin_non_vm_limit_exceeded_total metric,
+// but non-VM pods are only rejected if Reject is true.
+type nonVMLimitConfig struct {
+	// MaxFraction is the fraction of each node's total CPU and memory that non-VM pods may reserve
+	MaxFraction float64 `json:"maxFraction"`
+	// Reject, if true, causes non-VM pods that would exceed the limit to be rejected when they're
+	// being scheduled by us.
+	Reject bool `json:"reject"`
+}
+
+// noisyNeighborsConfig configures how VM pods are kept away from nodes with noisy non-VM pods
+//
+// If Reject is true, Filter rejects VM pods for those nodes. Otherwise, Score reduces their score by
+// Penalty.
+type noisyNeighborsConfig struct {
+	// MatchLabels gives the labels identifying noisy non-VM pods. A pod matches if it has all of
+	// these labels, with the same values.
+	MatchLabels map[string]string `json:"matchLabels"`
+	// Reject, if true, causes VM pods to be rejected for nodes with a matching non-VM pod
+	Reject bool `json:"reject"`
+	// Penalty is the fraction, from 0 to 1, by which the score of a node with a matching non-VM pod
+	// is reduced. It's only used if Reject is false.
+	Penalty float64 `json:"penalty"`
+}
+
+// guaranteedQoSConfig configures the check that VM pods' runner containers are Guaranteed QoS
+//
+// Mismatched requests and limits are always logged, but VM pods are only rejected if Reject is
+// true.
+type guaranteedQoSConfig struct {
+	// Reject, if true, causes VM pods with mismatched requests and limits to be rejected when
+	// they're being scheduled by us.
+	Reject bool `json:"reject"`
+}
+
+// zeroMaxVMsConfig configures the handling of VMs with a maximum of zero CPU or memory
+//
+// Such VMs are always logged. If Reject is true, VM pods are rejected when they're being scheduled
+// by us; otherwise, the zero maximum is clamped up to one compute unit.
+type zeroMaxVMsConfig struct {
+	// Reject, if true, causes VM pods with a zero maximum to be rejected when they're being
+	// scheduled by us.
+	Reject bool `json:"reject"`
+}
+
+// underReportedUsageConfig configures how VMs using more memory than we've reserved for them are
+// reconciled
+//
+// Only memory is reconciled, because the VM's load average doesn't tell us how much CPU it has.
+// Each reconciliation is logged and counted in the
+// autoscaling_plugin_underreported_usage_reconciled_total metric.
+type underReportedUsageConfig struct {
+	// GraceFraction is how far the VM's measured memory usage may exceed its reserved memory, as a
+	// fraction of reserved, before it's reconciled. This allows for imprecision in the metrics.
+	GraceFraction float64 `json:"graceFraction"`
+}
+
+// backpressureConfig configures the suggested retry-after sent to autoscaler-agents when their
+// requests are capped because the node is full
+//
+// The suggested duration scales linearly from MinRetryAfterSeconds to MaxRetryAfterSeconds with
+// the fraction of the node's resources that are being denied to pods (i.e., its capacity pressure).
+type backpressureConfig struct {
+	MinRetryAfterSeconds uint `json:"minRetryAfterSeconds"`
+	MaxRetryAfterSeconds uint `json:"maxRetryAfterSeconds"`
+}
+
+// downscaleBeforeMigrateConfig configures asking VMs to downscale before migrating VMs off a node
+// with too much pressure
+type downscaleBeforeMigrateConfig struct {
+	// WaitSeconds gives the duration, in seconds, that we wait for VMs to downscale before falling
+	// back to migration.
+	WaitSeconds uint `json:"waitSeconds"`
+	// MaxLoadFraction is the highest load average, as a fraction of the VM's current vCPU, at which
+	// we'll ask the VM to downscale.
+	MaxLoadFraction float64 `json:"maxLoadFraction"`
+}
+
+// nodeFullEventsConfig configures the events emitted when a node is too full to grant an increase
+type nodeFullEventsConfig struct {
+	// MinIntervalSeconds gives the minimum duration, in seconds, between events for the same node.
+	// Denied increases in between are still logged.
+	MinIntervalSeconds uint `json:"minIntervalSeconds"`
+}
+
+// verdictSummaryConfig configures the periodic per-node summaries of handled requests
+type verdictSummaryConfig struct {
+	// IntervalSeconds gives the duration, in seconds, between logging each summary
+	IntervalSeconds uint `json:"intervalSeconds"`
+}
+
+// pressureAccountingCheckConfig configures the periodic check of nodes' PressureAccountedFor
+//
+// Drift is always logged and counted in the autoscaling_plugin_pressure_accounting_drift_total
+// metric, but only corrected if Correct is true.
+type pressureAccountingCheckConfig struct {
+	// IntervalSeconds gives the duration, in seconds, between each check
+	IntervalSeconds uint `json:"intervalSeconds"`
+	// Correct, if true, causes any drift to be corrected by setting PressureAccountedFor to the
+	// value recomputed from the migrating pods.
+	Correct bool `json:"correct"`
+}
+
+// migrationAuditConfig configures the log of migration records
+//
+// Records are written as JSON, one per line. Once the log reaches MaxRecords, it's moved to Path
+// with ".1" appended (replacing any previous one) and a new log is started, so that at most twice
+// MaxRecords are retained.
+type migrationAuditConfig struct {
+	// Path is the file to write records to
+	Path string `json:"path"`
+	// MaxRecords gives the maximum number of records in each log file
+	MaxRecords uint `json:"maxRecords"`
+	// FlushIntervalSeconds gives the duration, in seconds, between writing pending records to the
+	// log. Until they're written, at most MaxRecords pending records are kept.
+	FlushIntervalSeconds uint `json:"flushIntervalSeconds"`
+}
+
+// loggingConfig configures the separate outputs for audit events and per-request verdicts. Any
+// output that isn't provided is logged with the plugin's general logs, as usual.
+type loggingConfig struct {
+	// Audit configures the output for migrations we create and for denied reservations and
+	// increases.
+	Audit *logOutputConfig `json:"audit,omitempty"`
+	// Debug configures the output for the verdicts of individual requests from autoscaler-agents.
+	Debug *logOutputConfig `json:"debug,omitempty"`
+}
+
+// logOutputConfig configures a single log output
+type logOutputConfig struct {
+	// Level is the minimum level that's logged, e.g. "debug" or "info"
+	Level string `json:"level"`
+	// OutputPath is where the logs are written: either "stdout", "stderr", or a file path
+	OutputPath string `json:"outputPath"`
+}
+
+// burstBufferConfig configures the burst headroom reserved for each VM, in addition to what it's
+// been permitted
+//
+// The burst headroom is only reserved if there's room on the node. It is never more than the
+// difference between the VM's current allocation and its maximum.
+type burstBufferConfig struct {
+	// ComputeUnitFraction is the size of the burst headroom, as a fraction of the compute unit
+	ComputeUnitFraction float64 `json:"computeUnitFraction"`
 }
 
 func (c *Config) migrationEnabled() bool {
 	return c.DoMigration == nil || *c.DoMigration
 }
 
+func (c *Config) preferLargerMigrations() bool {
+	return c.PreferLargerMigrations == nil || *c.PreferLargerMigrations
+}
+
+// overprovisionedBonus returns the amount that the pod's load average should be reduced by when
+// ordering the migration queue, according to OverprovisionedMigrationWeight.
+//
+// The pod's unused fraction is the larger of its CPU and memory, because migrating it frees up
+// both.
+func (c *Config) overprovisionedBonus(pod *podState) float64 {
+	if c.OverprovisionedMigrationWeight == 0 {
+		return 0
+	}
+
+	unused := util.Max(unusedFraction(pod.cpu), unusedFraction(pod.mem))
+	return c.OverprovisionedMigrationWeight * unused
+}
+
+// dualReliefBonus returns the amount that the pod's load average should be reduced by when
+// ordering the migration queue, according to DualPressureMigrationWeight.
+//
+// The bonus is zero unless the pod's node is currently over pressure for both CPU and memory.
+func (c *Config) dualReliefBonus(pod *podState) float64 {
+	if c.DualPressureMigrationWeight == 0 || !pod.node.dualPressure() {
+		return 0
+	}
+
+	relief := util.Min(
+		totalFraction(pod.cpu.Reserved, pod.node.cpu.Total),
+		totalFraction(pod.mem.Reserved, pod.node.mem.Total),
+	)
+	return c.DualPressureMigrationWeight * relief
+}
+
+// migrationSize returns the size of the pod's reservation used to order the migration queue,
+// according to PreferLargerMigrations. It's zero if PreferLargerMigrations is false, so that all
+// pods are the same size.
+func (c *Config) migrationSize(pod *podState) float64 {
+	if !c.preferLargerMigrations() {
+		return 0
+	}
+
+	return pod.cpu.Reserved.AsFloat64()/c.ComputeUnit.VCPU.AsFloat64() +
+		pod.mem.Reserved.AsFloat64()/c.ComputeUnit.Mem.AsFloat64()
+}
+
+// totalFraction returns reserved / total, or zero if total is zero.
+func totalFraction[T constraints.Unsigned](reserved T, total T) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(reserved) / float64(total)
+}
+
+// unusedFraction returns the fraction of the pod's reservation that isn't effectively in use, i.e.
+// Buffer / Reserved.
+func unusedFraction[T constraints.Unsigned](s podResourceState[T]) float64 {
+	if s.Reserved == 0 {
+		return 0
+	}
+	return float64(s.Reserved-s.effectiveUsage()) / float64(s.Reserved)
+}
+
 ///////////////////////
 // CONFIG VALIDATION //
 ///////////////////////
@@ -133,16 +842,190 @@ func (c *Config) validate() (string, error) {
 		return "schedulerName", errors.New("string cannot be empty")
 	}
 
+	for i, name := range c.ExtendedResources {
+		if name == "" {
+			return fmt.Sprintf("extendedResources[%d]", i), errors.New("string cannot be empty")
+		} else if name == corev1.ResourceCPU || name == corev1.ResourceMemory {
+			return fmt.Sprintf("extendedResources[%d]", i), fmt.Errorf("%q is always tracked", name)
+		} else if slices.Contains(c.ExtendedResources[:i], name) {
+			return fmt.Sprintf("extendedResources[%d]", i), fmt.Errorf("duplicate resource %q", name)
+		}
+	}
+
+	if c.OverprovisionedMigrationWeight < 0 {
+		return "overprovisionedMigrationWeight", errors.New("value must be >= 0")
+	}
+
+	if c.DualPressureMigrationWeight < 0 {
+		return "dualPressureMigrationWeight", errors.New("value must be >= 0")
+	}
+
+	if c.MigrationHeadroomMargin < 0 || c.MigrationHeadroomMargin > 1 {
+		return "migrationHeadroomMargin", errors.New("value must be between 0 and 1")
+	}
+
+	if c.MigrationVetoLoadFraction < 0 || c.MigrationVetoLoadFraction > 1 {
+		return "migrationVetoLoadFraction", errors.New("value must be between 0 and 1")
+	}
+
+	if c.GrowthReserveFraction < 0 || c.GrowthReserveFraction >= 1 {
+		return "growthReserveFraction", errors.New("value must be >= 0 and < 1")
+	}
+
+	if c.TenantReservation != nil {
+		if path, err := c.TenantReservation.validate(); err != nil {
+			return fmt.Sprintf("tenantReservation.%s", path), err
+		}
+	}
+
+	if c.NonVMLimit != nil {
+		if path, err := c.NonVMLimit.validate(); err != nil {
+			return fmt.Sprintf("nonVMLimit.%s", path), err
+		}
+	}
+
+	if c.NoisyNeighbors != nil {
+		if path, err := c.NoisyNeighbors.validate(); err != nil {
+			return fmt.Sprintf("noisyNeighbors.%s", path), err
+		}
+	}
+
+	if c.EvictionThreshold != nil {
+		if path, err := c.EvictionThreshold.validate(); err != nil {
+			return fmt.Sprintf("evictionThreshold.%s", path), err
+		}
+	}
+
+	if c.NodeCapacityBounds != nil {
+		if path, err := c.NodeCapacityBounds.validate(); err != nil {
+			return fmt.Sprintf("nodeCapacityBounds.%s", path), err
+		}
+	}
+
+	if c.UnderReportedUsage != nil {
+		if path, err := c.UnderReportedUsage.validate(); err != nil {
+			return fmt.Sprintf("underReportedUsage.%s", path), err
+		}
+	}
+
+	if c.ScorePressure != nil {
+		if path, err := c.ScorePressure.validate(); err != nil {
+			return fmt.Sprintf("scorePressure.%s", path), err
+		}
+	}
+
+	if c.MinScoreHeadroom != nil {
+		if path, err := c.MinScoreHeadroom.validate(); err != nil {
+			return fmt.Sprintf("minScoreHeadroom.%s", path), err
+		}
+	}
+
+	if c.Backpressure != nil {
+		if path, err := c.Backpressure.validate(); err != nil {
+			return fmt.Sprintf("backpressure.%s", path), err
+		}
+	}
+
+	if c.DownscaleBeforeMigrate != nil {
+		if path, err := c.DownscaleBeforeMigrate.validate(); err != nil {
+			return fmt.Sprintf("downscaleBeforeMigrate.%s", path), err
+		}
+	}
+
+	if c.BurstBuffer != nil {
+		if path, err := c.BurstBuffer.validate(); err != nil {
+			return fmt.Sprintf("burstBuffer.%s", path), err
+		}
+	}
+
+	if c.NodeFullEvents != nil {
+		if path, err := c.NodeFullEvents.validate(); err != nil {
+			return fmt.Sprintf("nodeFullEvents.%s", path), err
+		}
+	}
+
+	if c.PressureAccountingCheck != nil {
+		if path, err := c.PressureAccountingCheck.validate(); err != nil {
+			return fmt.Sprintf("pressureAccountingCheck.%s", path), err
+		}
+	}
+
+	if c.VerdictSummary != nil {
+		if path, err := c.VerdictSummary.validate(); err != nil {
+			return fmt.Sprintf("verdictSummary.%s", path), err
+		}
+	}
+
+	if c.MigrationAudit != nil {
+		if path, err := c.MigrationAudit.validate(); err != nil {
+			return fmt.Sprintf("migrationAudit.%s", path), err
+		}
+	}
+
+	if c.ShutdownSummary != nil {
+		if path, err := c.ShutdownSummary.validate(); err != nil {
+			return fmt.Sprintf("shutdownSummary.%s", path), err
+		}
+	}
+
+	if c.OrphanMetrics != nil {
+		if path, err := c.OrphanMetrics.validate(); err != nil {
+			return fmt.Sprintf("orphanMetrics.%s", path), err
+		}
+	}
+
+	if c.Logging != nil {
+		if path, err := c.Logging.validate(); err != nil {
+			return fmt.Sprintf("logging.%s", path), err
+		}
+	}
+
+	if c.MetricsScraping != nil {
+		if path, err := c.MetricsScraping.validate(); err != nil {
+			return fmt.Sprintf("metricsScraping.%s", path), err
+		}
+	}
+
 	if c.DumpState != nil {
 		if path, err := c.DumpState.validate(); err != nil {
 			return fmt.Sprintf("dumpState.%s", path), err
 		}
 	}
 
+	if c.Pause != nil && c.Pause.Port != 0 && c.DumpState != nil && c.Pause.Port == c.DumpState.Port {
+		return "pause.port", errors.New("value must be different from dumpState.port")
+	}
+
 	if c.MigrationDeletionRetrySeconds == 0 {
 		return "migrationDeletionRetrySeconds", errors.New("value must be > 0")
 	}
 
+	switch c.MigrationStrategy {
+	case "", migrationStrategyMigrate:
+		if c.ScaleOutGracePeriodSeconds != 0 {
+			return "scaleOutGracePeriodSeconds", fmt.Errorf("field is only allowed with migrationStrategy %q", migrationStrategyScaleOutThenMigrate)
+		}
+	case migrationStrategyScaleOutThenMigrate:
+		if c.ScaleOutGracePeriodSeconds == 0 {
+			return "scaleOutGracePeriodSeconds", errors.New("value must be > 0")
+		}
+	default:
+		return "migrationStrategy", fmt.Errorf("unknown strategy %q", c.MigrationStrategy)
+	}
+
+	switch c.MigrationTargetStrategy {
+	case "", migrationTargetEmptiest:
+	case migrationTargetSameZone, migrationTargetDifferentZone:
+	default:
+		return "migrationTargetStrategy", fmt.Errorf("unknown strategy %q", c.MigrationTargetStrategy)
+	}
+
+	switch c.IncreaseDenialPolicy {
+	case "", increaseDenialDenyFirst, increaseDenialMigrateToAccommodate:
+	default:
+		return "increaseDenialPolicy", fmt.Errorf("unknown policy %q", c.IncreaseDenialPolicy)
+	}
+
 	return "", nil
 }
 
@@ -154,6 +1037,10 @@ func (c *nodeConfig) validate() (string, error) {
 		return fmt.Sprintf("memory.%s", path), err
 	}
 
+	if c.GlobalReserveFraction < 0 || c.GlobalReserveFraction >= 1 {
+		return "globalReserveFraction", errors.New("value must be >= 0 and < 1")
+	}
+
 	if c.MinUsageScore < 0 || c.MinUsageScore > 1 {
 		return "minUsageScore", errors.New("value must be between 0 and 1, inclusive")
 	} else if c.MaxUsageScore < 0 || c.MaxUsageScore > 1 {
@@ -166,10 +1053,235 @@ func (c *nodeConfig) validate() (string, error) {
 }
 
 func (c *resourceConfig) validate() (string, error) {
-	if c.Watermark <= 0.0 {
-		return "watermark", errors.New("value must be > 0")
-	} else if c.Watermark > 1.0 {
-		return "watermark", errors.New("value must be <= 1")
+	if c.Watermark != 0.0 && c.AbsoluteWatermark != nil {
+		return "absoluteWatermark", errors.New("field must not be set if watermark is provided")
+	} else if c.Watermark == 0.0 && c.AbsoluteWatermark == nil {
+		return "watermark", errors.New("exactly one of watermark or absoluteWatermark must be provided")
+	}
+
+	if c.Watermark < 0.0 || c.Watermark > 1.0 {
+		return "watermark", errors.New("value must be between 0 and 1, inclusive")
+	}
+
+	if c.AbsoluteWatermark != nil && c.AbsoluteWatermark.Sign() <= 0 {
+		return "absoluteWatermark", errors.New("value must be > 0")
+	}
+
+	if c.PressureMargin < 0.0 || c.PressureMargin > 1.0 {
+		return "pressureMargin", errors.New("value must be between 0 and 1, inclusive")
+	}
+
+	if c.HysteresisGap < 0.0 || c.HysteresisGap > 1.0 {
+		return "hysteresisGap", errors.New("value must be between 0 and 1, inclusive")
+	}
+
+	if c.MaxOverage != nil && (*c.MaxOverage < 0.0 || *c.MaxOverage > 1.0) {
+		return "maxOverage", errors.New("value must be between 0 and 1, inclusive")
+	}
+
+	return "", nil
+}
+
+func (c *nonVMLimitConfig) validate() (string, error) {
+	if c.MaxFraction <= 0 || c.MaxFraction > 1 {
+		return "maxFraction", errors.New("value must be > 0 and <= 1")
+	}
+
+	return "", nil
+}
+
+func (c *evictionThresholdConfig) validate() (string, error) {
+	if c.Memory == 0 && c.NodeAnnotation == "" {
+		return "memory", errors.New("value must be > 0 if nodeAnnotation is not provided")
+	}
+
+	return "", nil
+}
+
+func (c *nodeCapacityBoundsConfig) validate() (string, error) {
+	if c.MaxCPU < minNodeCPU {
+		return "maxCPU", fmt.Errorf("value must be >= %v", minNodeCPU)
+	} else if c.MinMemory == 0 {
+		return "minMemory", errors.New("value must be > 0")
+	}
+
+	return "", nil
+}
+
+func (c *underReportedUsageConfig) validate() (string, error) {
+	if c.GraceFraction < 0 {
+		return "graceFraction", errors.New("value must be >= 0")
+	}
+
+	return "", nil
+}
+
+func (c *scorePressureConfig) validate() (string, error) {
+	if c.WindowSeconds == 0 {
+		return "windowSeconds", errors.New("value must be > 0")
+	} else if c.InstantaneousWeight < 0 || c.InstantaneousWeight > 1 {
+		return "instantaneousWeight", errors.New("value must be between 0 and 1, inclusive")
+	}
+
+	return "", nil
+}
+
+func (c *minScoreHeadroomConfig) validate() (string, error) {
+	if c.CPU == 0 && c.Mem == 0 {
+		return "cpu", errors.New("value must be > 0 if mem is zero")
+	} else if c.Penalty <= 0 || c.Penalty > 1 {
+		return "penalty", errors.New("value must be > 0 and <= 1")
+	}
+
+	return "", nil
+}
+
+// penalty returns the fraction that a node's score should be reduced by, given the node's
+// remaining reservable CPU and memory after placing the pod. It's zero if the node has at least the
+// minimum headroom, or if c is nil.
+func (c *minScoreHeadroomConfig) penalty(cpuRemaining vmapi.MilliCPU, memRemaining api.Bytes) float64 {
+	if c == nil || (cpuRemaining >= c.CPU && memRemaining >= c.Mem) {
+		return 0
+	}
+	return c.Penalty
+}
+
+func (c *noisyNeighborsConfig) validate() (string, error) {
+	if len(c.MatchLabels) == 0 {
+		return "matchLabels", errors.New("map cannot be empty")
+	} else if c.Penalty < 0 || c.Penalty > 1 {
+		return "penalty", errors.New("value must be between 0 and 1, inclusive")
+	}
+
+	return "", nil
+}
+
+// matches returns whether the pod is a noisy non-VM pod, according to MatchLabels. It's false if c
+// is nil.
+func (c *noisyNeighborsConfig) matches(pod *podState) bool {
+	if c == nil || pod.vm != nil {
+		return false
+	}
+
+	for key, value := range c.MatchLabels {
+		if v, ok := pod.labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// penalty returns the fraction that the score of a node should be reduced by when placing a VM pod,
+// given whether the node has a noisy non-VM pod. It's zero if c is nil, or if Reject is true
+// (because Filter has already rejected those nodes).
+func (c *noisyNeighborsConfig) penalty(hasNoisyNeighbor bool) float64 {
+	if c == nil || c.Reject || !hasNoisyNeighbor {
+		return 0
+	}
+	return c.Penalty
+}
+
+func (c *backpressureConfig) validate() (string, error) {
+	if c.MinRetryAfterSeconds == 0 {
+		return "minRetryAfterSeconds", errors.New("value must be > 0")
+	} else if c.MaxRetryAfterSeconds < c.MinRetryAfterSeconds {
+		return "maxRetryAfterSeconds", errors.New("value must be >= minRetryAfterSeconds")
+	}
+
+	return "", nil
+}
+
+func (c *downscaleBeforeMigrateConfig) validate() (string, error) {
+	if c.WaitSeconds == 0 {
+		return "waitSeconds", errors.New("value must be > 0")
+	} else if c.MaxLoadFraction <= 0 {
+		return "maxLoadFraction", errors.New("value must be > 0")
+	}
+
+	return "", nil
+}
+
+func (c *nodeFullEventsConfig) validate() (string, error) {
+	if c.MinIntervalSeconds == 0 {
+		return "minIntervalSeconds", errors.New("value must be > 0")
+	}
+
+	return "", nil
+}
+
+func (c *verdictSummaryConfig) validate() (string, error) {
+	if c.IntervalSeconds == 0 {
+		return "intervalSeconds", errors.New("value must be > 0")
+	}
+
+	return "", nil
+}
+
+func (c *pressureAccountingCheckConfig) validate() (string, error) {
+	if c.IntervalSeconds == 0 {
+		return "intervalSeconds", errors.New("value must be > 0")
+	}
+
+	return "", nil
+}
+
+func (c *migrationAuditConfig) validate() (string, error) {
+	if c.Path == "" {
+		return "path", errors.New("string cannot be empty")
+	}
+	if c.MaxRecords == 0 {
+		return "maxRecords", errors.New("value must be > 0")
+	}
+	if c.FlushIntervalSeconds == 0 {
+		return "flushIntervalSeconds", errors.New("value must be > 0")
+	}
+
+	return "", nil
+}
+
+func (c *loggingConfig) validate() (string, error) {
+	if c.Audit != nil {
+		if path, err := c.Audit.validate(); err != nil {
+			return fmt.Sprintf("audit.%s", path), err
+		}
+	}
+	if c.Debug != nil {
+		if path, err := c.Debug.validate(); err != nil {
+			return fmt.Sprintf("debug.%s", path), err
+		}
+	}
+
+	return "", nil
+}
+
+func (c *logOutputConfig) validate() (string, error) {
+	if _, err := zapcore.ParseLevel(c.Level); err != nil {
+		return "level", err
+	}
+	if c.OutputPath == "" {
+		return "outputPath", errors.New("string cannot be empty")
+	}
+
+	return "", nil
+}
+
+func (c *burstBufferConfig) validate() (string, error) {
+	if c.ComputeUnitFraction <= 0 || c.ComputeUnitFraction > 1 {
+		return "computeUnitFraction", errors.New("value must be > 0 and <= 1")
+	}
+
+	return "", nil
+}
+
+func (c *tenantReservationConfig) validate() (string, error) {
+	if c.LabelKey == "" {
+		return "labelKey", errors.New("string cannot be empty")
+	}
+
+	if c.Cpu < 0 || c.Cpu > 1 {
+		return "cpu", errors.New("value must be between 0 and 1, inclusive")
+	} else if c.Memory < 0 || c.Memory > 1 {
+		return "memory", errors.New("value must be between 0 and 1, inclusive")
 	}
 
 	return "", nil
@@ -206,32 +1318,241 @@ func ReadConfig(path string) (*Config, error) {
 // HELPER METHODS FOR USING CONFIGS //
 //////////////////////////////////////
 
+// deferMigrationForScaleOut returns whether we should wait for the node autoscaler to add a new
+// node before migrating VMs away from nodes with too much pressure.
+func (c *Config) deferMigrationForScaleOut() bool {
+	return c.MigrationStrategy == migrationStrategyScaleOutThenMigrate
+}
+
+// migrateToAccommodate returns whether we should migrate other pods away from a node to make room
+// for a pod whose increase was denied because the node was full.
+func (c *Config) migrateToAccommodate() bool {
+	return c.IncreaseDenialPolicy == increaseDenialMigrateToAccommodate
+}
+
+// vmCountLimitReached returns whether a node with the given number of VM pods already has the
+// maximum allowed by MaxVMsPerNode, if there is one.
+func (c *Config) vmCountLimitReached(count int) bool {
+	return c.MaxVMsPerNode != 0 && uint(count) >= c.MaxVMsPerNode
+}
+
+// withDefaults returns a copy of the config, with the values that are used in place of any unset
+// fields filled in.
+//
+// The copy is shallow, so pointer and slice fields are shared with c.
+func (c *Config) withDefaults() Config {
+	resolved := *c
+	if resolved.MigrationStrategy == "" {
+		resolved.MigrationStrategy = migrationStrategyMigrate
+	}
+	if resolved.IncreaseDenialPolicy == "" {
+		resolved.IncreaseDenialPolicy = increaseDenialDenyFirst
+	}
+	resolved.K8sAvailabilityZoneLabel = c.availabilityZoneLabel()
+	return resolved
+}
+
+// availabilityZoneLabel returns the node label that gives each node's availability zone, using
+// the well-known topology label if K8sAvailabilityZoneLabel wasn't set.
+func (c *Config) availabilityZoneLabel() string {
+	if c.K8sAvailabilityZoneLabel != "" {
+		return c.K8sAvailabilityZoneLabel
+	}
+	return corev1.LabelTopologyZone
+}
+
 // ignoredNamespace returns whether items in the namespace should be treated as if they don't exist
 func (c *Config) ignoredNamespace(namespace string) bool {
 	return slices.Contains(c.IgnoreNamespaces, namespace)
 }
 
+// retryAfterSeconds returns the suggested duration that autoscaler-agents should wait before
+// requesting more resources, given the fraction of the node's resources that are currently being
+// denied to pods.
+func (c *backpressureConfig) retryAfterSeconds(pressureFraction float64) uint {
+	pressureFraction = util.Max(0, util.Min(1, pressureFraction))
+	extra := float64(c.MaxRetryAfterSeconds-c.MinRetryAfterSeconds) * pressureFraction
+	return c.MinRetryAfterSeconds + uint(extra)
+}
+
+// burstForComputeUnit returns the burst headroom that should be reserved for each VM, given the
+// compute unit.
+//
+// The memory is rounded down to a multiple of memSlotSize, because VMs can only use memory in
+// increments of their memory slots. Likewise, if the autoscaler-agent doesn't support fractional
+// CPU, the CPU is rounded down to a whole number of CPUs.
+func (c *burstBufferConfig) burstForComputeUnit(
+	cu api.Resources,
+	memSlotSize api.Bytes,
+	supportsFractionalCPU bool,
+) api.Resources {
+	cpu := vmapi.MilliCPU(c.ComputeUnitFraction * cu.VCPU.AsFloat64())
+	if !supportsFractionalCPU {
+		cpu = (cpu / 1000) * 1000
+	}
+	mem := api.Bytes(c.ComputeUnitFraction * cu.Mem.AsFloat64())
+
+	cpu, memSlots := api.ResourcesToSlots(api.Resources{VCPU: cpu, Mem: mem}, memSlotSize)
+	return api.ResourcesFromSlots(cpu, memSlots, memSlotSize)
+}
+
+// memoryThreshold returns the memory eviction threshold for the node, using the value from
+// NodeAnnotation if it's set on the node.
+//
+// If the annotation's value is invalid, the configured Memory is returned alongside the error.
+func (c *evictionThresholdConfig) memoryThreshold(node *corev1.Node) (api.Bytes, error) {
+	if c.NodeAnnotation == "" {
+		return c.Memory, nil
+	}
+
+	value, ok := node.Annotations[c.NodeAnnotation]
+	if !ok {
+		return c.Memory, nil
+	}
+
+	q, err := resource.ParseQuantity(value)
+	if err != nil {
+		return c.Memory, fmt.Errorf("Error parsing annotation %q: %w", c.NodeAnnotation, err)
+	} else if q.Sign() < 0 {
+		return c.Memory, fmt.Errorf("Annotation %q must not be negative", c.NodeAnnotation)
+	}
+
+	return api.BytesFromResourceQuantity(q), nil
+}
+
+// tenantMatches returns whether a pod with the given labels belongs to the tenant with reserved
+// resources, if there is one
+func (c *Config) tenantMatches(labels map[string]string) bool {
+	if c.TenantReservation == nil {
+		return false
+	}
+
+	value, ok := labels[c.TenantReservation.LabelKey]
+	return ok && value == c.TenantReservation.LabelValue
+}
+
+// tenantReserved returns the resources on a node with the given totals that should be reserved for
+// the tenant, if there is one
+func (c *Config) tenantReserved(cpuTotal vmapi.MilliCPU, memTotal api.Bytes) api.Resources {
+	if c.TenantReservation == nil {
+		return api.Resources{VCPU: 0, Mem: 0}
+	}
+
+	return api.Resources{
+		VCPU: util.Min(vmapi.MilliCPU(c.TenantReservation.Cpu*float32(cpuTotal)), cpuTotal),
+		Mem:  util.Min(api.Bytes(c.TenantReservation.Memory*float32(memTotal)), memTotal),
+	}
+}
+
+// growthReserve returns the resources on a node with the given totals that should be held back from
+// new pods, according to GrowthReserveFraction.
+func (c *Config) growthReserve(cpuTotal vmapi.MilliCPU, memTotal api.Bytes) api.Resources {
+	return api.Resources{
+		VCPU: vmapi.MilliCPU(c.GrowthReserveFraction * float64(cpuTotal)),
+		Mem:  api.Bytes(c.GrowthReserveFraction * float64(memTotal)),
+	}
+}
+
+// clampZeroMax returns the VM's maximum resources, with any zero raised to the compute unit if
+// ZeroMaxVMs is set. See zeroMaxVMsConfig.
+func (c *Config) clampZeroMax(vmMax api.Resources) api.Resources {
+	if c.ZeroMaxVMs == nil {
+		return vmMax
+	}
+
+	if vmMax.VCPU == 0 {
+		vmMax.VCPU = c.ComputeUnit.VCPU
+	}
+	if vmMax.Mem == 0 {
+		vmMax.Mem = c.ComputeUnit.Mem
+	}
+	return vmMax
+}
+
+// watermarkForTotal returns the watermark for a node with the given total amount of the resource.
+// absolute is the resource's AbsoluteWatermark in the same units as the total, or nil if it's not
+// provided, in which case the fractional Watermark is used (defaulting to the total if that's not
+// provided either).
+//
+// The result is clamped so that neither a large AbsoluteWatermark nor floating-point imprecision
+// can ever put it above the total.
+func watermarkForTotal[T constraints.Unsigned](c resourceConfig, total T, absolute *T) T {
+	if absolute != nil {
+		return util.Min(*absolute, total)
+	}
+	if c.Watermark == 0.0 || c.Watermark >= 1.0 {
+		return total
+	}
+	return util.Min(T(c.Watermark*float32(total)), total)
+}
+
+// releaseThresholdForTotal returns the release threshold for a node with the given total amount of
+// the resource and watermark, i.e. the watermark minus the configured HysteresisGap.
+func releaseThresholdForTotal[T constraints.Unsigned](c resourceConfig, total T, watermark T) T {
+	return util.SaturatingSub(watermark, T(c.HysteresisGap*float32(total)))
+}
+
+// hardLimitForTotal returns the hard limit for a node with the given total amount of the resource
+// and watermark, i.e. the watermark plus MaxOverage of the remainder, or zero if MaxOverage is not
+// provided.
+func hardLimitForTotal[T constraints.Unsigned](c resourceConfig, total T, watermark T) T {
+	if c.MaxOverage == nil {
+		return 0
+	}
+	return util.Min(watermark+T(*c.MaxOverage*float32(total-watermark)), total)
+}
+
+// withoutGlobalReserve returns the amount of a resource with the given total that's left for pods
+// after holding back GlobalReserveFraction of it.
+func withoutGlobalReserve[T constraints.Unsigned](c *nodeConfig, total T) T {
+	return util.SaturatingSub(total, T(c.GlobalReserveFraction*float64(total)))
+}
+
 func (c *nodeConfig) vCpuLimits(total *resource.Quantity) nodeResourceState[vmapi.MilliCPU] {
-	totalMilli := total.MilliValue()
+	totalMilli := withoutGlobalReserve(c, vmapi.MilliCPU(total.MilliValue()))
+
+	var absolute *vmapi.MilliCPU
+	if c.Cpu.AbsoluteWatermark != nil {
+		milli := vmapi.MilliCPU(c.Cpu.AbsoluteWatermark.MilliValue())
+		absolute = &milli
+	}
+	watermark := watermarkForTotal(c.Cpu, totalMilli, absolute)
 
 	return nodeResourceState[vmapi.MilliCPU]{
-		Total:                vmapi.MilliCPU(totalMilli),
-		Watermark:            vmapi.MilliCPU(c.Cpu.Watermark * float32(totalMilli)),
+		Total:                totalMilli,
+		Watermark:            watermark,
+		ReleaseThreshold:     releaseThresholdForTotal(c.Cpu, totalMilli, watermark),
+		PressureMargin:       vmapi.MilliCPU(c.Cpu.PressureMargin * float32(totalMilli)),
+		NoMigrationTrigger:   c.Cpu.DisableMigrationTrigger,
+		HardLimit:            hardLimitForTotal(c.Cpu, totalMilli, watermark),
 		Reserved:             0,
 		Buffer:               0,
+		Burst:                0,
 		CapacityPressure:     0,
 		PressureAccountedFor: 0,
 	}
 }
 
 func (c *nodeConfig) memoryLimits(total *resource.Quantity) nodeResourceState[api.Bytes] {
-	totalBytes := total.Value()
+	totalBytes := withoutGlobalReserve(c, api.Bytes(total.Value()))
+
+	var absolute *api.Bytes
+	if c.Memory.AbsoluteWatermark != nil {
+		bytes := api.Bytes(c.Memory.AbsoluteWatermark.Value())
+		absolute = &bytes
+	}
+	watermark := watermarkForTotal(c.Memory, totalBytes, absolute)
 
 	return nodeResourceState[api.Bytes]{
-		Total:                api.Bytes(totalBytes),
-		Watermark:            api.Bytes(c.Memory.Watermark * float32(totalBytes)),
+		Total:                totalBytes,
+		Watermark:            watermark,
+		ReleaseThreshold:     releaseThresholdForTotal(c.Memory, totalBytes, watermark),
+		PressureMargin:       api.Bytes(c.Memory.PressureMargin * float32(totalBytes)),
+		NoMigrationTrigger:   c.Memory.DisableMigrationTrigger,
+		HardLimit:            hardLimitForTotal(c.Memory, totalBytes, watermark),
 		Reserved:             0,
 		Buffer:               0,
+		Burst:                0,
 		CapacityPressure:     0,
 		PressureAccountedFor: 0,
 	}
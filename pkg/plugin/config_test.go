@@ -0,0 +1,455 @@
+package plugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	corev1 "k8s.io/api/core/v1"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+// baseTestConfigJSON is a valid configuration, roughly matching what we use in deploy/
+const baseTestConfigJSON = `{
+	"computeUnit": { "vCPUs": 0.25, "mem": "1Gi" },
+	"nodeConfig": {
+		"cpu": { "watermark": 0.9 },
+		"memory": { "watermark": 0.9 },
+		"minUsageScore": 0.5,
+		"maxUsageScore": 0,
+		"scorePeak": 0.8
+	},
+	"schedulerName": "autoscale-scheduler",
+	"migrationDeletionRetrySeconds": 5,
+	"doMigration": false,
+	"randomizeScores": true
+}`
+
+// makeTestConfig returns a valid Config from baseTestConfigJSON, with modify applied to it
+func makeTestConfig(t *testing.T, modify func(*Config)) *Config {
+	var conf Config
+	if err := json.Unmarshal([]byte(baseTestConfigJSON), &conf); err != nil {
+		t.Fatalf("failed to decode base config: %s", err)
+	}
+	modify(&conf)
+	return &conf
+}
+
+func TestConfigValidateWatermarks(t *testing.T) {
+	cases := []struct {
+		name string
+		// modify changes the base config
+		modify func(*Config)
+		// expectedPath is the expected JSON path of the invalid value, or "" if the config should
+		// be valid.
+		expectedPath string
+	}{
+		{
+			name:         "Base",
+			modify:       func(c *Config) {},
+			expectedPath: "",
+		},
+		{
+			name:         "CPUWatermarkTooHigh",
+			modify:       func(c *Config) { c.NodeConfig.Cpu.Watermark = 1.5 },
+			expectedPath: "nodeConfig.cpu.watermark",
+		},
+		{
+			name:         "MemoryWatermarkTooHigh",
+			modify:       func(c *Config) { c.NodeConfig.Memory.Watermark = 1.5 },
+			expectedPath: "nodeConfig.memory.watermark",
+		},
+		{
+			name:         "NegativeWatermark",
+			modify:       func(c *Config) { c.NodeConfig.Cpu.Watermark = -0.1 },
+			expectedPath: "nodeConfig.cpu.watermark",
+		},
+		{
+			name:         "NegativePressureMargin",
+			modify:       func(c *Config) { c.NodeConfig.Memory.PressureMargin = -0.1 },
+			expectedPath: "nodeConfig.memory.pressureMargin",
+		},
+		{
+			name:         "HysteresisGapTooHigh",
+			modify:       func(c *Config) { c.NodeConfig.Cpu.HysteresisGap = 1.5 },
+			expectedPath: "nodeConfig.cpu.hysteresisGap",
+		},
+		{
+			name:         "GlobalReserveFractionOne",
+			modify:       func(c *Config) { c.NodeConfig.GlobalReserveFraction = 1 },
+			expectedPath: "nodeConfig.globalReserveFraction",
+		},
+		{
+			name:         "NegativeGlobalReserveFraction",
+			modify:       func(c *Config) { c.NodeConfig.GlobalReserveFraction = -0.1 },
+			expectedPath: "nodeConfig.globalReserveFraction",
+		},
+		{
+			name:         "NoWatermark",
+			modify:       func(c *Config) { c.NodeConfig.Cpu.Watermark = 0 },
+			expectedPath: "nodeConfig.cpu.watermark",
+		},
+		{
+			name:         "OneWatermark",
+			modify:       func(c *Config) { c.NodeConfig.Cpu.Watermark = 1 },
+			expectedPath: "",
+		},
+		{
+			name: "AbsoluteWatermark",
+			modify: func(c *Config) {
+				c.NodeConfig.Memory.Watermark = 0
+				c.NodeConfig.Memory.AbsoluteWatermark = resourcePtr("24Gi")
+			},
+			expectedPath: "",
+		},
+		{
+			name:         "BothWatermarks",
+			modify:       func(c *Config) { c.NodeConfig.Cpu.AbsoluteWatermark = resourcePtr("6") },
+			expectedPath: "nodeConfig.cpu.absoluteWatermark",
+		},
+		{
+			name: "ZeroAbsoluteWatermark",
+			modify: func(c *Config) {
+				c.NodeConfig.Cpu.Watermark = 0
+				c.NodeConfig.Cpu.AbsoluteWatermark = resourcePtr("0")
+			},
+			expectedPath: "nodeConfig.cpu.absoluteWatermark",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := makeTestConfig(t, c.modify)
+			path, err := conf.validate()
+			if c.expectedPath == "" && err != nil {
+				t.Errorf("expected valid config, got error at %s: %s", path, err)
+			} else if c.expectedPath != "" && err == nil {
+				t.Errorf("expected error at %s, got valid config", c.expectedPath)
+			} else if path != c.expectedPath {
+				t.Errorf("expected error at %s, got error at %s: %s", c.expectedPath, path, err)
+			}
+		})
+	}
+}
+
+func TestWatermarkBoundaries(t *testing.T) {
+	for _, fraction := range []float32{0, 1} {
+		conf := nodeConfig{
+			Cpu:                   resourceConfig{Watermark: fraction, PressureMargin: 0, HysteresisGap: 0, DisableMigrationTrigger: false},
+			Memory:                resourceConfig{Watermark: fraction, PressureMargin: 0, HysteresisGap: 0, DisableMigrationTrigger: false},
+			GlobalReserveFraction: 0,
+			MinUsageScore:         0.5,
+			MaxUsageScore:         0,
+			ScorePeak:             0.8,
+		}
+
+		// Both zero (i.e., "not provided") and one should set the watermark equal to the total.
+		cpu := conf.vCpuLimits(resourcePtr("7"))
+		if cpu.Watermark != cpu.Total {
+			t.Errorf("watermark fraction %v: expected CPU watermark %v, got %v", fraction, cpu.Total, cpu.Watermark)
+		}
+		mem := conf.memoryLimits(resourcePtr("12345678901"))
+		if mem.Watermark != mem.Total {
+			t.Errorf("watermark fraction %v: expected memory watermark %v, got %v", fraction, mem.Total, mem.Watermark)
+		}
+	}
+}
+
+func TestAbsoluteWatermark(t *testing.T) {
+	conf := makeTestConfig(t, func(c *Config) {
+		c.NodeConfig.Cpu.Watermark = 0
+		c.NodeConfig.Cpu.AbsoluteWatermark = resourcePtr("6")
+		c.NodeConfig.Cpu.HysteresisGap = 0.1
+		c.NodeConfig.Memory.Watermark = 0
+		c.NodeConfig.Memory.AbsoluteWatermark = resourcePtr("24Gi")
+	})
+	if path, err := conf.validate(); err != nil {
+		t.Fatalf("invalid config at %s: %s", path, err)
+	}
+
+	nodes := []struct {
+		cpu string
+		mem string
+
+		expectedCPU     vmapi.MilliCPU
+		expectedRelease vmapi.MilliCPU
+		expectedMem     api.Bytes
+	}{
+		// The watermark is the same regardless of the node's size...
+		{cpu: "8", mem: "32Gi", expectedCPU: 6000, expectedRelease: 5200, expectedMem: 24 << 30},
+		{cpu: "16", mem: "64Gi", expectedCPU: 6000, expectedRelease: 4400, expectedMem: 24 << 30},
+		// ... unless that's more than the node has.
+		{cpu: "4", mem: "16Gi", expectedCPU: 4000, expectedRelease: 3600, expectedMem: 16 << 30},
+	}
+
+	for _, n := range nodes {
+		cpu := conf.NodeConfig.vCpuLimits(resourcePtr(n.cpu))
+		mem := conf.NodeConfig.memoryLimits(resourcePtr(n.mem))
+
+		if cpu.Watermark != n.expectedCPU || mem.Watermark != n.expectedMem {
+			t.Errorf("node with %s CPU, %s mem: expected watermarks {%v, %v}, got {%v, %v}", n.cpu, n.mem, n.expectedCPU, n.expectedMem, cpu.Watermark, mem.Watermark)
+		}
+		// The hysteresis gap is still a fraction of the node's total
+		if cpu.ReleaseThreshold != n.expectedRelease {
+			t.Errorf("node with %s CPU: expected release threshold %v, got %v", n.cpu, n.expectedRelease, cpu.ReleaseThreshold)
+		}
+	}
+}
+
+func TestGlobalReserveFraction(t *testing.T) {
+	conf := makeTestConfig(t, func(c *Config) {
+		c.NodeConfig.GlobalReserveFraction = 0.1
+	})
+	if path, err := conf.validate(); err != nil {
+		t.Fatalf("invalid config at %s: %s", path, err)
+	}
+
+	nodes := []struct {
+		cpu string
+		mem string
+
+		expectedCPU vmapi.MilliCPU
+		expectedMem api.Bytes
+	}{
+		{cpu: "8", mem: "32Gi", expectedCPU: 7200, expectedMem: 32<<30 - 32<<30/10},
+		{cpu: "16", mem: "64Gi", expectedCPU: 14400, expectedMem: 64<<30 - 64<<30/10},
+		{cpu: "3", mem: "10Gi", expectedCPU: 2700, expectedMem: 10<<30 - 10<<30/10},
+	}
+
+	for _, n := range nodes {
+		cpu := conf.NodeConfig.vCpuLimits(resourcePtr(n.cpu))
+		mem := conf.NodeConfig.memoryLimits(resourcePtr(n.mem))
+
+		if cpu.Total != n.expectedCPU || mem.Total != n.expectedMem {
+			t.Errorf("node with %s CPU, %s mem: expected totals {%v, %v}, got {%v, %v}", n.cpu, n.mem, n.expectedCPU, n.expectedMem, cpu.Total, mem.Total)
+		}
+		// The watermark should be calculated from what's left after the global reserve
+		if expected := watermarkForTotal(conf.NodeConfig.Cpu, n.expectedCPU, nil); cpu.Watermark != expected {
+			t.Errorf("node with %s CPU: expected watermark %v, got %v", n.cpu, expected, cpu.Watermark)
+		}
+	}
+}
+
+func TestBackpressureRetryAfter(t *testing.T) {
+	conf := backpressureConfig{MinRetryAfterSeconds: 5, MaxRetryAfterSeconds: 25}
+
+	cases := []struct {
+		fraction float64
+		expected uint
+	}{
+		{fraction: -1, expected: 5},
+		{fraction: 0, expected: 5},
+		{fraction: 0.5, expected: 15},
+		{fraction: 1, expected: 25},
+		{fraction: 2, expected: 25},
+	}
+
+	for _, c := range cases {
+		if got := conf.retryAfterSeconds(c.fraction); got != c.expected {
+			t.Errorf("pressure fraction %v: expected retry-after %d, got %d", c.fraction, c.expected, got)
+		}
+	}
+}
+
+func TestConfigEndpoint(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) {
+		conf.MigrationTargetStrategy = migrationTargetSameZone
+	})
+	e := makeTestEnforcer(conf)
+
+	mux := http.NewServeMux()
+	e.addConfigHandler(zap.NewNop(), mux)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/config", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var got Config
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+
+	// The response should reflect the config that was loaded...
+	if got.SchedulerName != conf.SchedulerName || got.MigrationTargetStrategy != migrationTargetSameZone {
+		t.Errorf("expected response to match loaded config, got %+v", got)
+	}
+	// ... with defaults filled in for the fields that weren't set.
+	if got.MigrationStrategy != migrationStrategyMigrate {
+		t.Errorf("expected default migration strategy %q, got %q", migrationStrategyMigrate, got.MigrationStrategy)
+	}
+	if got.IncreaseDenialPolicy != increaseDenialDenyFirst {
+		t.Errorf("expected default increase denial policy %q, got %q", increaseDenialDenyFirst, got.IncreaseDenialPolicy)
+	}
+	if got.K8sAvailabilityZoneLabel != corev1.LabelTopologyZone {
+		t.Errorf("expected default availability zone label %q, got %q", corev1.LabelTopologyZone, got.K8sAvailabilityZoneLabel)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/config", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405 for POST, got %d", rec.Code)
+	}
+}
+
+func TestOverprovisionedMigrationWeight(t *testing.T) {
+	cases := []struct {
+		name                string
+		weight              float64
+		expectOverprovFirst bool
+	}{
+		{name: "Disabled", weight: 0, expectOverprovFirst: false},
+		{name: "Enabled", weight: 1, expectOverprovFirst: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := makeTestConfig(t, func(conf *Config) { conf.OverprovisionedMigrationWeight = c.weight })
+
+			node := makeTestNodeState(
+				conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+				conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+			)
+			// Both pods reserve the same amount, but half of the over-provisioned pod's reservation is
+			// buffer. It has slightly more load, so it'd normally be migrated second.
+			overprov := addTestPod(node, "overprovisioned", true, 2000, 8<<30)
+			overprov.cpu.Buffer, overprov.mem.Buffer = 1000, 4<<30
+			node.cpu.Buffer, node.mem.Buffer = 1000, 4<<30
+			rightSized := addTestPod(node, "right-sized", true, 2000, 8<<30)
+
+			overprov.vm.metrics = &api.Metrics{LoadAverage1Min: 0.4, LoadAverage5Min: 0.4, MemoryUsageBytes: 0}
+			rightSized.vm.metrics = &api.Metrics{LoadAverage1Min: 0.2, LoadAverage5Min: 0.2, MemoryUsageBytes: 0}
+
+			for _, pod := range []*podState{overprov, rightSized} {
+				pod.vm.overprovisionedBonus = conf.overprovisionedBonus(pod)
+				node.mq.addOrUpdate(pod.vm, time.Now())
+			}
+
+			expectedFirst := rightSized
+			if c.expectOverprovFirst {
+				expectedFirst = overprov
+			}
+			if !node.mq.isNextInQueue(expectedFirst.vm) {
+				t.Errorf("expected %v to be next in the migration queue", expectedFirst.name)
+			}
+		})
+	}
+}
+
+func TestDualPressureMigrationWeight(t *testing.T) {
+	cases := []struct {
+		name                 string
+		weight               float64
+		cpuReserved          vmapi.MilliCPU
+		expectBothHeavyFirst bool
+	}{
+		{name: "Disabled", weight: 0, cpuReserved: 7500, expectBothHeavyFirst: false},
+		{name: "Enabled", weight: 1, cpuReserved: 7500, expectBothHeavyFirst: true},
+		// Only memory is over the watermark, so there's no bonus for relieving both.
+		{name: "MemoryOnly", weight: 1, cpuReserved: 6500, expectBothHeavyFirst: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := makeTestConfig(t, func(conf *Config) { conf.DualPressureMigrationWeight = c.weight })
+
+			node := makeTestNodeState(
+				conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+				conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+			)
+			// The both-heavy pod reserves a large share of the node's CPU and memory. The others
+			// each reserve a large share of only one, and have less load. Memory is always over the
+			// watermark; CPU is only over it when cpuReserved is.
+			bothHeavy := addTestPod(node, "both-heavy", true, 2000, 12<<30)
+			cpuHeavy := addTestPod(node, "cpu-heavy", true, 4000, 4<<30)
+			memHeavy := addTestPod(node, "mem-heavy", true, 500, 14<<30)
+			node.cpu.Reserved = c.cpuReserved
+
+			bothHeavy.vm.metrics = &api.Metrics{LoadAverage1Min: 0.3, LoadAverage5Min: 0.3, MemoryUsageBytes: 0}
+			cpuHeavy.vm.metrics = &api.Metrics{LoadAverage1Min: 0.25, LoadAverage5Min: 0.25, MemoryUsageBytes: 0}
+			memHeavy.vm.metrics = &api.Metrics{LoadAverage1Min: 0.2, LoadAverage5Min: 0.2, MemoryUsageBytes: 0}
+
+			for _, pod := range []*podState{bothHeavy, cpuHeavy, memHeavy} {
+				pod.vm.dualReliefBonus = conf.dualReliefBonus(pod)
+				node.mq.addOrUpdate(pod.vm, time.Now())
+			}
+
+			expectedFirst := memHeavy
+			if c.expectBothHeavyFirst {
+				expectedFirst = bothHeavy
+			}
+			if !node.mq.isNextInQueue(expectedFirst.vm) {
+				t.Errorf("expected %v to be next in the migration queue", expectedFirst.name)
+			}
+		})
+	}
+}
+
+func TestPreferLargerMigrations(t *testing.T) {
+	enabled, disabled := true, false
+	cases := []struct {
+		name             string
+		preferLarger     *bool
+		expectLargeFirst bool
+	}{
+		{name: "Default", preferLarger: nil, expectLargeFirst: true},
+		{name: "Disabled", preferLarger: &disabled, expectLargeFirst: false},
+		{name: "Enabled", preferLarger: &enabled, expectLargeFirst: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := makeTestConfig(t, func(conf *Config) { conf.PreferLargerMigrations = c.preferLarger })
+
+			node := makeTestNodeState(
+				conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+				conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+			)
+			// The large pod has the most load, so it'd be migrated last if size were ignored. The small
+			// pods are all the same size; three of them have the same load, so only their memory
+			// usage and names differ.
+			large := addTestPod(node, "large", true, 4000, 16<<30)
+			smallA := addTestPod(node, "small-a", true, 1000, 4<<30)
+			smallB := addTestPod(node, "small-b", true, 1000, 4<<30)
+			smallBigMem := addTestPod(node, "small-big-mem", true, 1000, 4<<30)
+			smallIdle := addTestPod(node, "small-idle", true, 1000, 4<<30)
+
+			large.vm.metrics = &api.Metrics{LoadAverage1Min: 0.5, LoadAverage5Min: 0.5, MemoryUsageBytes: 0}
+			smallA.vm.metrics = &api.Metrics{LoadAverage1Min: 0.2, LoadAverage5Min: 0.2, MemoryUsageBytes: 1 << 30}
+			smallB.vm.metrics = &api.Metrics{LoadAverage1Min: 0.2, LoadAverage5Min: 0.2, MemoryUsageBytes: 1 << 30}
+			smallBigMem.vm.metrics = &api.Metrics{LoadAverage1Min: 0.2, LoadAverage5Min: 0.2, MemoryUsageBytes: 3 << 30}
+			smallIdle.vm.metrics = &api.Metrics{LoadAverage1Min: 0.1, LoadAverage5Min: 0.1, MemoryUsageBytes: 0}
+
+			for _, pod := range []*podState{large, smallA, smallB, smallBigMem, smallIdle} {
+				pod.vm.migrationSize = conf.migrationSize(pod)
+				node.mq.addOrUpdate(pod.vm, time.Now())
+			}
+
+			expectedFirst := smallIdle
+			if c.expectLargeFirst {
+				expectedFirst = large
+			}
+			if !node.mq.isNextInQueue(expectedFirst.vm) {
+				t.Errorf("expected %v to be next in the migration queue", expectedFirst.name)
+			}
+
+			// Among pods of the same size, load still decides, then memory usage, and then the name.
+			if !smallIdle.vm.isBetterMigrationTarget(smallA.vm) {
+				t.Errorf("expected %v to be a better migration target than %v", smallIdle.name, smallA.name)
+			}
+			if !smallB.vm.isBetterMigrationTarget(smallBigMem.vm) || smallBigMem.vm.isBetterMigrationTarget(smallB.vm) {
+				t.Errorf("expected %v to be a better migration target than %v", smallB.name, smallBigMem.name)
+			}
+			if !smallA.vm.isBetterMigrationTarget(smallB.vm) || smallB.vm.isBetterMigrationTarget(smallA.vm) {
+				t.Errorf("expected %v to be a better migration target than %v", smallA.name, smallB.name)
+			}
+		})
+	}
+}
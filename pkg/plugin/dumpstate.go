@@ -2,6 +2,7 @@ package plugin
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
@@ -11,6 +12,8 @@ import (
 	"go.uber.org/zap"
 	"golang.org/x/exp/slices"
 
+	corev1 "k8s.io/api/core/v1"
+
 	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
 	"github.com/neondatabase/autoscaling/pkg/api"
 	"github.com/neondatabase/autoscaling/pkg/util"
@@ -33,6 +36,7 @@ func (c *dumpStateConfig) validate() (string, error) {
 
 type stateDump struct {
 	Stopped   bool            `json:"stopped"`
+	Paused    bool            `json:"paused"`
 	BuildInfo util.BuildInfo  `json:"buildInfo"`
 	State     pluginStateDump `json:"state"`
 }
@@ -68,6 +72,10 @@ func (p *AutoscaleEnforcer) startDumpStateServer(shutdownCtx context.Context, lo
 
 			return state, 200, nil
 		})
+		p.addExplainMigrationHandler(logger, mux)
+		p.addConfigHandler(logger, mux)
+		p.addInspectStateHandlers(logger, mux)
+		p.addSimulatePlacementHandler(logger, mux)
 		// note: we don't shut down this server. It should be possible to continue fetching the
 		// internal state after shutdown has started.
 		server := &http.Server{Handler: mux}
@@ -79,6 +87,33 @@ func (p *AutoscaleEnforcer) startDumpStateServer(shutdownCtx context.Context, lo
 	return nil
 }
 
+// addConfigHandler adds the "/config" endpoint to the mux, which returns the config that the plugin
+// is currently using, with defaults filled in
+//
+// Unlike the full state dump, this doesn't need to acquire the state lock.
+func (p *AutoscaleEnforcer) addConfigHandler(logger *zap.Logger, mux *http.ServeMux) {
+	logger = logger.With(zap.String("endpoint", "/config"))
+
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			_, _ = w.Write([]byte("request method must be " + http.MethodGet))
+			return
+		}
+
+		body, err := json.Marshal(p.state.conf.withDefaults())
+		if err != nil {
+			logger.Error("Failed to marshal config", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", ContentTypeJSON)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(body)
+	})
+}
+
 func (p *AutoscaleEnforcer) dumpState(ctx context.Context, stopped bool) (*stateDump, error) {
 	state, err := p.state.dump(ctx)
 	if err != nil {
@@ -87,6 +122,7 @@ func (p *AutoscaleEnforcer) dumpState(ctx context.Context, stopped bool) (*state
 
 	return &stateDump{
 		Stopped:   stopped,
+		Paused:    p.isPaused(),
 		BuildInfo: util.GetBuildInfo(),
 		State:     *state,
 	}, nil
@@ -99,9 +135,12 @@ type keyed[K any, V any] struct {
 
 type pluginStateDump struct {
 	OngoingMigrationDeletions []keyed[util.NamespacedName, int] `json:"ongoingMigrationDeletions"`
+	OngoingMigrations         uint                              `json:"ongoingMigrations"`
 
 	Nodes []keyed[string, nodeStateDump] `json:"nodes"`
 
+	Zones []keyed[string, zoneCapacity] `json:"zones"`
+
 	Pods []podNameAndPointer `json:"pods"`
 
 	MaxTotalReservableCPU vmapi.MilliCPU `json:"maxTotalReservableCPU"`
@@ -118,23 +157,30 @@ type podNameAndPointer struct {
 type pointerString string
 
 type nodeStateDump struct {
-	Obj              pointerString                              `json:"obj"`
-	Name             string                                     `json:"name"`
-	NodeGroup        string                                     `json:"nodeGroup"`
-	AvailabilityZone string                                     `json:"availabilityZone"`
-	CPU              nodeResourceState[vmapi.MilliCPU]          `json:"cpu"`
-	Mem              nodeResourceState[api.Bytes]               `json:"mem"`
-	Pods             []keyed[util.NamespacedName, podStateDump] `json:"pods"`
-	Mq               []*podNameAndPointer                       `json:"mq"`
+	Obj                pointerString                                     `json:"obj"`
+	Name               string                                            `json:"name"`
+	NodeGroup          string                                            `json:"nodeGroup"`
+	AvailabilityZone   string                                            `json:"availabilityZone"`
+	CPU                nodeResourceState[vmapi.MilliCPU]                 `json:"cpu"`
+	Mem                nodeResourceState[api.Bytes]                      `json:"mem"`
+	TenantReserved     api.Resources                                     `json:"tenantReserved"`
+	Extended           map[corev1.ResourceName]nodeResourceState[uint64] `json:"extended"`
+	Pods               []keyed[util.NamespacedName, podStateDump]        `json:"pods"`
+	Mq                 []*podNameAndPointer                              `json:"mq"`
+	OverWatermarkSince *time.Time                                        `json:"overWatermarkSince"`
+	Unschedulable      bool                                              `json:"unschedulable"`
 }
 
 type podStateDump struct {
-	Obj  pointerString                    `json:"obj"`
-	Name util.NamespacedName              `json:"name"`
-	Node pointerString                    `json:"node"`
-	CPU  podResourceState[vmapi.MilliCPU] `json:"cpu"`
-	Mem  podResourceState[api.Bytes]      `json:"mem"`
-	VM   *vmPodStateDump                  `json:"vm"`
+	Obj      pointerString                                    `json:"obj"`
+	Name     util.NamespacedName                              `json:"name"`
+	Node     pointerString                                    `json:"node"`
+	CPU      podResourceState[vmapi.MilliCPU]                 `json:"cpu"`
+	Mem      podResourceState[api.Bytes]                      `json:"mem"`
+	Extended map[corev1.ResourceName]podResourceState[uint64] `json:"extended"`
+	Labels   map[string]string                                `json:"labels"`
+	VM       *vmPodStateDump                                  `json:"vm"`
+	Phase    podPhase                                         `json:"phase"`
 }
 
 type vmPodStateDump struct {
@@ -142,12 +188,24 @@ type vmPodStateDump struct {
 	TestingOnlyAlwaysMigrate bool                   `json:"testingOnlyAlwaysMigrate"`
 	MostRecentComputeUnit    *api.Resources         `json:"mostRecentComputeUnit"`
 	Metrics                  *api.Metrics           `json:"metrics"`
+	MetricsUpdatedAt         time.Time              `json:"metricsUpdatedAt"`
+	OverprovisionedBonus     float64                `json:"overprovisionedBonus"`
+	DualReliefBonus          float64                `json:"dualReliefBonus"`
+	MigrationSize            float64                `json:"migrationSize"`
 	MqIndex                  int                    `json:"mqIndex"`
+	MqEnqueuedAt             time.Time              `json:"mqEnqueuedAt"`
 	MigrationState           *podMigrationStateDump `json:"migrationState"`
+	MigrationCooldownUntil   time.Time              `json:"migrationCooldownUntil"`
+	PendingMigrationTarget   string                 `json:"pendingMigrationTarget"`
+	MigrationRequested       bool                   `json:"migrationRequested"`
+	MigrationCounted         bool                   `json:"migrationCounted"`
 }
 
 type podMigrationStateDump struct {
 	MigrationName util.NamespacedName `json:"migrationName"`
+	StartTime     time.Time           `json:"startTime"`
+	TargetNode    string              `json:"targetNode"`
+	Phase         vmapi.VmmPhase      `json:"phase"`
 }
 
 func makePointerString[T any](t *T) pointerString {
@@ -158,7 +216,10 @@ func sortSliceByPodName[T any](slice []T, name func(T) util.NamespacedName) {
 	slices.SortFunc(slice, func(a, b T) (less bool) {
 		aName := name(a)
 		bName := name(b)
-		return aName.Namespace < bName.Namespace && aName.Name < bName.Name
+		if aName.Namespace != bName.Namespace {
+			return aName.Namespace < bName.Namespace
+		}
+		return aName.Name < bName.Name
 	})
 }
 
@@ -182,6 +243,14 @@ func (s *pluginState) dump(ctx context.Context) (*pluginStateDump, error) {
 		return kvx.Key < kvy.Key
 	})
 
+	zones := make([]keyed[string, zoneCapacity], 0)
+	for zone, z := range s.zoneCapacities() {
+		zones = append(zones, keyed[string, zoneCapacity]{Key: zone, Value: z})
+	}
+	slices.SortFunc(zones, func(kvx, kvy keyed[string, zoneCapacity]) (less bool) {
+		return kvx.Key < kvy.Key
+	})
+
 	ongoingMigrationDeletions := make([]keyed[util.NamespacedName, int], 0, len(s.ongoingMigrationDeletions))
 	for k, count := range s.ongoingMigrationDeletions {
 		ongoingMigrationDeletions = append(ongoingMigrationDeletions, keyed[util.NamespacedName, int]{Key: k, Value: count})
@@ -190,7 +259,9 @@ func (s *pluginState) dump(ctx context.Context) (*pluginStateDump, error) {
 
 	return &pluginStateDump{
 		OngoingMigrationDeletions: ongoingMigrationDeletions,
+		OngoingMigrations:         s.ongoingMigrations,
 		Nodes:                     nodes,
+		Zones:                     zones,
 		Pods:                      pods,
 		MaxTotalReservableCPU:     s.maxTotalReservableCPU,
 		MaxTotalReservableMem:     s.maxTotalReservableMem,
@@ -215,15 +286,24 @@ func (s *nodeState) dump() nodeStateDump {
 		}
 	}
 
+	extended := make(map[corev1.ResourceName]nodeResourceState[uint64], len(s.extended))
+	for name, state := range s.extended {
+		extended[name] = *state
+	}
+
 	return nodeStateDump{
-		Obj:              makePointerString(s),
-		Name:             s.name,
-		NodeGroup:        s.nodeGroup,
-		AvailabilityZone: s.availabilityZone,
-		CPU:              s.cpu,
-		Mem:              s.mem,
-		Pods:             pods,
-		Mq:               mq,
+		Obj:                makePointerString(s),
+		Name:               s.name,
+		NodeGroup:          s.nodeGroup,
+		AvailabilityZone:   s.availabilityZone,
+		CPU:                s.cpu,
+		Mem:                s.mem,
+		TenantReserved:     s.tenantReserved,
+		Extended:           extended,
+		Pods:               pods,
+		Mq:                 mq,
+		OverWatermarkSince: s.overWatermarkSince,
+		Unschedulable:      s.unschedulable,
 	}
 }
 
@@ -234,13 +314,21 @@ func (s *podState) dump() podStateDump {
 		vm = &[]vmPodStateDump{s.vm.dump()}[0]
 	}
 
+	extended := make(map[corev1.ResourceName]podResourceState[uint64], len(s.extended))
+	for name, state := range s.extended {
+		extended[name] = *state
+	}
+
 	return podStateDump{
-		Obj:  makePointerString(s),
-		Name: s.name,
-		Node: makePointerString(s.node),
-		CPU:  s.cpu,
-		Mem:  s.mem,
-		VM:   vm,
+		Obj:      makePointerString(s),
+		Name:     s.name,
+		Node:     makePointerString(s.node),
+		CPU:      s.cpu,
+		Mem:      s.mem,
+		Extended: extended,
+		Labels:   s.labels,
+		VM:       vm,
+		Phase:    s.phase,
 	}
 }
 
@@ -260,6 +348,9 @@ func (s *vmPodState) dump() vmPodStateDump {
 	if s.migrationState != nil {
 		migrationState = &podMigrationStateDump{
 			MigrationName: s.migrationState.name,
+			StartTime:     s.migrationState.startTime,
+			TargetNode:    s.migrationState.targetNode,
+			Phase:         s.migrationState.phase,
 		}
 	}
 
@@ -268,7 +359,16 @@ func (s *vmPodState) dump() vmPodStateDump {
 		TestingOnlyAlwaysMigrate: s.testingOnlyAlwaysMigrate,
 		MostRecentComputeUnit:    mostRecentComputeUnit,
 		Metrics:                  metrics,
+		MetricsUpdatedAt:         s.metricsUpdatedAt,
+		OverprovisionedBonus:     s.overprovisionedBonus,
+		DualReliefBonus:          s.dualReliefBonus,
+		MigrationSize:            s.migrationSize,
 		MqIndex:                  s.mqIndex,
+		MqEnqueuedAt:             s.mqEnqueuedAt,
 		MigrationState:           migrationState,
+		MigrationCooldownUntil:   s.migrationCooldownUntil,
+		PendingMigrationTarget:   s.pendingMigrationTarget,
+		MigrationRequested:       s.migrationRequested,
+		MigrationCounted:         s.migrationCounted,
 	}
 }
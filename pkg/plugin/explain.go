@@ -0,0 +1,269 @@
+package plugin
+
+// Explaining why pods on a node are or aren't being migrated, served alongside the dump-state
+// endpoint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
+
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// migrationSkipReason describes why a VM pod isn't currently being migrated. The empty string means
+// that there's nothing stopping it.
+type migrationSkipReason string
+
+const (
+	// skipReasonCurrentlyMigrating means the pod is already being migrated.
+	skipReasonCurrentlyMigrating migrationSkipReason = "currently-migrating"
+	// skipReasonCooldown means a previous migration of the pod failed, and it's not yet eligible to
+	// be selected again. See Config.MigrationFailureCooldownSeconds.
+	skipReasonCooldown migrationSkipReason = "migration-cooldown"
+	// skipReasonNoMetrics means the pod hasn't provided any metrics, and Config.ExemptPodsWithoutMetrics
+	// is set.
+	skipReasonNoMetrics migrationSkipReason = "no-metrics"
+	// skipReasonNotQueued means the pod hasn't been added to the node's migration queue yet, because
+	// we haven't received a request or metrics from it.
+	skipReasonNotQueued migrationSkipReason = "not-queued"
+	// skipReasonLowerPriority means there's another pod ahead of this one in the node's migration
+	// queue. Only the first pod in the queue is migrated at a time.
+	skipReasonLowerPriority migrationSkipReason = "lower-priority"
+
+	// skipReasonMigrationDisabled means migration is disabled by Config.DoMigration.
+	skipReasonMigrationDisabled migrationSkipReason = "migration-disabled"
+	// skipReasonNoPressure means the node doesn't have too much pressure.
+	skipReasonNoPressure migrationSkipReason = "pressure-below-threshold"
+	// skipReasonPressureDwell means the node's pressure is only too much because of
+	// capacityPressure, and it hasn't persisted for Config.CapacityPressureDwellSeconds yet.
+	skipReasonPressureDwell migrationSkipReason = "below-pressure-dwell-time"
+	// skipReasonDownscalePending means we're still waiting for pods to downscale before migrating.
+	// See Config.DownscaleBeforeMigrate.
+	skipReasonDownscalePending migrationSkipReason = "downscale-pending"
+	// skipReasonScaleOutPending means we're still waiting for the node autoscaler to add capacity
+	// before migrating. See Config.ScaleOutGracePeriodSeconds.
+	skipReasonScaleOutPending migrationSkipReason = "scale-out-pending"
+	// skipReasonMigrationLimit means the node already has as many ongoing migrations as allowed by
+	// Config.MaxConcurrentMigrationsPerNode.
+	skipReasonMigrationLimit migrationSkipReason = "concurrent-migration-limit"
+	// skipReasonClusterMigrationLimit means there are already as many ongoing migrations across the
+	// cluster as allowed by Config.MaxTotalConcurrentMigrations.
+	skipReasonClusterMigrationLimit migrationSkipReason = "cluster-concurrent-migration-limit"
+	// skipReasonNoTarget means no other node has room for the pod, and
+	// Config.RequireMigrationTarget is set.
+	skipReasonNoTarget migrationSkipReason = "no-migration-target"
+)
+
+// migrationIneligibility returns the reason the pod can't be selected for migration at all, or the
+// empty string if it may be.
+func (s *vmPodState) migrationIneligibility(conf *Config, now time.Time) migrationSkipReason {
+	switch {
+	case s.currentlyMigrating():
+		return skipReasonCurrentlyMigrating
+	case s.inMigrationCooldown(now):
+		return skipReasonCooldown
+	case s.metrics == nil && conf.ExemptPodsWithoutMetrics:
+		return skipReasonNoMetrics
+	default:
+		return ""
+	}
+}
+
+// migrationDeferral returns the reason the first pod in the node's migration queue isn't being
+// migrated, or the empty string if it will be on its next request.
+//
+// Unlike tooMuchPressure and friends, this method does not modify the node; it only uses the state
+// recorded by the last request handled for the node.
+func (s *nodeState) migrationDeferral(conf *Config, now time.Time) migrationSkipReason {
+	if !conf.migrationEnabled() {
+		return skipReasonMigrationDisabled
+	}
+
+	if !s.inTooMuchPressure {
+		if s.pressureExceededSince != nil {
+			return skipReasonPressureDwell
+		}
+		return skipReasonNoPressure
+	}
+
+	if conf.DownscaleBeforeMigrate != nil && s.downscalePendingSince != nil {
+		wait := time.Second * time.Duration(conf.DownscaleBeforeMigrate.WaitSeconds)
+		if now.Sub(*s.downscalePendingSince) < wait {
+			return skipReasonDownscalePending
+		}
+	}
+
+	if conf.deferMigrationForScaleOut() && s.scaleOutPendingSince != nil {
+		gracePeriod := time.Second * time.Duration(conf.ScaleOutGracePeriodSeconds)
+		if now.Sub(*s.scaleOutPendingSince) < gracePeriod {
+			return skipReasonScaleOutPending
+		}
+	}
+
+	if s.migrationLimitReached(conf) {
+		return skipReasonMigrationLimit
+	}
+
+	return ""
+}
+
+type migrationExplanation struct {
+	Node            string `json:"node"`
+	TooMuchPressure bool   `json:"tooMuchPressure"`
+	// Candidates lists the VM pods on the node, with the pods in the migration queue first, in the
+	// order they'd be selected, followed by the pods that aren't in the queue.
+	Candidates []migrationCandidate `json:"candidates"`
+}
+
+type migrationCandidate struct {
+	Pod util.NamespacedName `json:"pod"`
+	VM  util.NamespacedName `json:"vm"`
+	// Queued is true if the pod is in the node's migration queue
+	Queued bool `json:"queued"`
+	// SkipReason gives why the pod isn't being migrated, if there's any reason
+	SkipReason migrationSkipReason `json:"skipReason,omitempty"`
+	// TargetNode gives the node that the pod would be migrated to, if Config.MigrationTargetStrategy
+	// is set and some other node has room for it.
+	TargetNode string `json:"targetNode,omitempty"`
+}
+
+// explainMigration returns a migrationExplanation for the node, or false if there's no such node
+func (s *pluginState) explainMigration(ctx context.Context, nodeName string, now time.Time) (_ *migrationExplanation, ok bool, _ error) {
+	if err := s.lock.TryLock(ctx); err != nil {
+		return nil, false, err
+	}
+	defer s.lock.Unlock()
+
+	node, ok := s.nodes[nodeName]
+	if !ok {
+		return nil, false, nil
+	}
+
+	queue := slices.Clone(node.mq)
+	slices.SortFunc(queue, func(x, y *vmPodState) (less bool) {
+		return x.isBetterMigrationTarget(y)
+	})
+
+	deferral := node.migrationDeferral(s.conf, now)
+	if deferral == "" && s.migrationLimitReached() {
+		deferral = skipReasonClusterMigrationLimit
+	}
+
+	vmPods := make(map[*vmPodState]*podState)
+	for _, pod := range node.pods {
+		if pod.vm != nil {
+			vmPods[pod.vm] = pod
+		}
+	}
+
+	candidates := make([]migrationCandidate, 0, len(vmPods))
+	for i, vm := range queue {
+		pod := vmPods[vm]
+		var targetNode string
+		if target := s.chooseMigrationTarget(pod); target != nil {
+			targetNode = target.name
+		}
+
+		reason := vm.migrationIneligibility(s.conf, now)
+		if reason == "" && i != 0 {
+			reason = skipReasonLowerPriority
+		} else if reason == "" {
+			reason = deferral
+		}
+		if reason == "" && s.conf.RequireMigrationTarget && !s.hasMigrationTarget(pod) {
+			reason = skipReasonNoTarget
+		}
+
+		candidates = append(candidates, migrationCandidate{
+			Pod:        pod.name,
+			VM:         vm.name,
+			Queued:     true,
+			SkipReason: reason,
+			TargetNode: targetNode,
+		})
+	}
+
+	var unqueued []migrationCandidate
+	for vm, pod := range vmPods {
+		if vm.mqIndex != -1 {
+			continue
+		}
+
+		reason := vm.migrationIneligibility(s.conf, now)
+		if reason == "" {
+			reason = skipReasonNotQueued
+		}
+
+		unqueued = append(unqueued, migrationCandidate{
+			Pod:        pod.name,
+			VM:         vm.name,
+			Queued:     false,
+			SkipReason: reason,
+			TargetNode: "",
+		})
+	}
+	sortSliceByPodName(unqueued, func(c migrationCandidate) util.NamespacedName { return c.Pod })
+
+	return &migrationExplanation{
+		Node:            node.name,
+		TooMuchPressure: node.inTooMuchPressure,
+		Candidates:      append(candidates, unqueued...),
+	}, true, nil
+}
+
+// addExplainMigrationHandler adds the "/explain/migration?node=<name>" endpoint to the mux
+func (p *AutoscaleEnforcer) addExplainMigrationHandler(logger *zap.Logger, mux *http.ServeMux) {
+	logger = logger.With(zap.String("endpoint", "/explain/migration"))
+
+	mux.HandleFunc("/explain/migration", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			_, _ = w.Write([]byte("request method must be " + http.MethodGet))
+			return
+		}
+
+		nodeName := r.URL.Query().Get("node")
+		if nodeName == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("missing 'node' query parameter"))
+			return
+		}
+
+		timeout := time.Duration(p.state.conf.DumpState.TimeoutSeconds) * time.Second
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		explanation, ok, err := p.state.explainMigration(ctx, nodeName, p.state.clock.Now())
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, context.DeadlineExceeded) {
+				status = http.StatusInternalServerError
+			}
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(fmt.Sprintf("error while getting state: %s", err)))
+			return
+		} else if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(fmt.Sprintf("node %q not found", nodeName)))
+			return
+		}
+
+		body, err := json.Marshal(explanation)
+		if err != nil {
+			logger.Error("Failed to marshal migration explanation", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", ContentTypeJSON)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(body)
+	})
+}
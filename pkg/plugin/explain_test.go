@@ -0,0 +1,75 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+)
+
+func TestExplainMigration(t *testing.T) {
+	conf := makeTestConfig(t, func(*Config) {})
+
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+		conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+	)
+	idle := addTestPod(node, "idle", true, 1000, 4<<30)
+	busy := addTestPod(node, "busy", true, 1000, 4<<30)
+	cooldown := addTestPod(node, "cooldown", true, 1000, 4<<30)
+	_ = addTestPod(node, "new", true, 1000, 4<<30)
+	_ = addTestPod(node, "non-vm", false, 1000, 4<<30)
+
+	now := time.Now()
+	idle.vm.metrics = &api.Metrics{LoadAverage1Min: 0.5, LoadAverage5Min: 0.5, MemoryUsageBytes: 0}
+	busy.vm.metrics = &api.Metrics{LoadAverage1Min: 2.0, LoadAverage5Min: 2.0, MemoryUsageBytes: 0}
+	cooldown.vm.migrationCooldownUntil = now.Add(time.Minute)
+	node.mq.addOrUpdate(busy.vm, time.Now())
+	node.mq.addOrUpdate(idle.vm, time.Now())
+
+	e := makeTestEnforcer(conf, node)
+
+	explain := func() []migrationCandidate {
+		explanation, ok, err := e.state.explainMigration(context.Background(), node.name, now)
+		if err != nil || !ok {
+			t.Fatalf("unexpected failure to explain migration: ok = %v, err = %v", ok, err)
+		}
+		return explanation.Candidates
+	}
+	checkReasons := func(candidates []migrationCandidate, expected map[string]migrationSkipReason) {
+		if len(candidates) != len(expected) {
+			t.Fatalf("expected %d candidates, got %+v", len(expected), candidates)
+		}
+		for _, c := range candidates {
+			if reason, ok := expected[c.Pod.Name]; !ok || c.SkipReason != reason {
+				t.Errorf("expected pod %q to have skip reason %q, got %q", c.Pod.Name, reason, c.SkipReason)
+			}
+		}
+	}
+
+	candidates := explain()
+	if candidates[0].Pod.Name != "idle" || candidates[1].Pod.Name != "busy" {
+		t.Fatalf("expected queued pods first, in migration order, got %+v", candidates)
+	}
+	checkReasons(candidates, map[string]migrationSkipReason{
+		"idle":     skipReasonNoPressure,
+		"busy":     skipReasonLowerPriority,
+		"cooldown": skipReasonCooldown,
+		"new":      skipReasonNotQueued,
+	})
+
+	// Once the node has too much pressure, the first pod in the queue should have nothing stopping
+	// it from migrating.
+	node.inTooMuchPressure = true
+	checkReasons(explain(), map[string]migrationSkipReason{
+		"idle":     "",
+		"busy":     skipReasonLowerPriority,
+		"cooldown": skipReasonCooldown,
+		"new":      skipReasonNotQueued,
+	})
+
+	if _, ok, err := e.state.explainMigration(context.Background(), "missing", now); ok || err != nil {
+		t.Errorf("expected unknown node to be reported as missing, got ok = %v, err = %v", ok, err)
+	}
+}
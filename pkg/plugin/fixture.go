@@ -0,0 +1,388 @@
+package plugin
+
+// Exporting and loading the plugin's resource accounting as a fixture, so that real cluster states
+// can be captured and replayed offline (e.g. in tests or a simulator).
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/exp/slices"
+
+	corev1 "k8s.io/api/core/v1"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// stateFixture is a snapshot of all the accounting in a pluginState, in a stable JSON format.
+//
+// Unlike pluginStateDump, which is intended for debugging, a stateFixture contains everything
+// required to reconstruct the state with loadFixture. Nodes, pods, and migration deletions are
+// sorted by name so that the same state always produces the same JSON.
+type stateFixture struct {
+	Nodes                     []nodeFixture                     `json:"nodes"`
+	OngoingMigrationDeletions []keyed[util.NamespacedName, int] `json:"ongoingMigrationDeletions"`
+}
+
+type nodeFixture struct {
+	Name             string                                            `json:"name"`
+	NodeGroup        string                                            `json:"nodeGroup"`
+	AvailabilityZone string                                            `json:"availabilityZone"`
+	CPU              nodeResourceState[vmapi.MilliCPU]                 `json:"cpu"`
+	Mem              nodeResourceState[api.Bytes]                      `json:"mem"`
+	TenantReserved   api.Resources                                     `json:"tenantReserved"`
+	Extended         map[corev1.ResourceName]nodeResourceState[uint64] `json:"extended"`
+	Pods             []podFixture                                      `json:"pods"`
+	// Mq gives the names of the pods in the node's migration queue, in the order they're stored in
+	// the heap, so that the queue can be reconstructed exactly.
+	Mq                    []util.NamespacedName `json:"mq"`
+	ScaleOutPendingSince  *time.Time            `json:"scaleOutPendingSince"`
+	ScaleOutFallenBack    bool                  `json:"scaleOutFallenBack,omitempty"`
+	DownscalePendingSince *time.Time            `json:"downscalePendingSince"`
+	OverWatermarkSince    *time.Time            `json:"overWatermarkSince"`
+	PressureExceededSince *time.Time            `json:"pressureExceededSince"`
+	InTooMuchPressure     bool                  `json:"inTooMuchPressure"`
+	// Accommodating, LastNodeFullEvent, and VerdictSummary may be omitted from older fixtures, in
+	// which case they're left unset.
+	Accommodating       *util.NamespacedName `json:"accommodating,omitempty"`
+	LastNodeFullEvent   time.Time            `json:"lastNodeFullEvent"`
+	VerdictSummary      nodeVerdictSummary   `json:"verdictSummary"`
+	EmptySince          *time.Time           `json:"emptySince"`
+	CapacityPressureAvg pressureAverage      `json:"capacityPressureAvg"`
+	// ScoreMultiplier may be omitted from older fixtures, in which case it's treated as 1.
+	ScoreMultiplier float64 `json:"scoreMultiplier,omitempty"`
+	// CapacityUpdatedAt may be omitted from older fixtures, in which case the node's capacity is
+	// treated as maximally stale.
+	CapacityUpdatedAt time.Time `json:"capacityUpdatedAt"`
+	Unschedulable     bool      `json:"unschedulable,omitempty"`
+}
+
+type podFixture struct {
+	Name     util.NamespacedName                              `json:"name"`
+	CPU      podResourceState[vmapi.MilliCPU]                 `json:"cpu"`
+	Mem      podResourceState[api.Bytes]                      `json:"mem"`
+	Extended map[corev1.ResourceName]podResourceState[uint64] `json:"extended"`
+	Labels   map[string]string                                `json:"labels,omitempty"`
+	VM       *vmPodFixture                                    `json:"vm"`
+	Phase    podPhase                                         `json:"phase"`
+}
+
+type vmPodFixture struct {
+	Name                     util.NamespacedName    `json:"name"`
+	MemSlotSize              api.Bytes              `json:"memSlotSize"`
+	MemGranularity           api.Bytes              `json:"memGranularity"`
+	TestingOnlyAlwaysMigrate bool                   `json:"testingOnlyAlwaysMigrate"`
+	MostRecentComputeUnit    *api.Resources         `json:"mostRecentComputeUnit"`
+	Metrics                  *api.Metrics           `json:"metrics"`
+	MetricsUpdatedAt         time.Time              `json:"metricsUpdatedAt"`
+	OverprovisionedBonus     float64                `json:"overprovisionedBonus"`
+	DualReliefBonus          float64                `json:"dualReliefBonus"`
+	MigrationSize            float64                `json:"migrationSize,omitempty"`
+	MqEnqueuedAt             time.Time              `json:"mqEnqueuedAt"`
+	MigrationState           *podMigrationStateDump `json:"migrationState"`
+	MigrationCooldownUntil   time.Time              `json:"migrationCooldownUntil"`
+	PendingMigrationTarget   string                 `json:"pendingMigrationTarget"`
+	MigrationRequested       bool                   `json:"migrationRequested,omitempty"`
+	MigrationCounted         bool                   `json:"migrationCounted,omitempty"`
+}
+
+// exportFixture returns a stateFixture capturing the current state
+//
+// This method must only be called while holding s.lock.
+func (s *pluginState) exportFixture() stateFixture {
+	nodes := make([]nodeFixture, 0, len(s.nodes))
+	for _, n := range s.nodes {
+		nodes = append(nodes, n.exportFixture())
+	}
+	slices.SortFunc(nodes, func(x, y nodeFixture) (less bool) {
+		return x.Name < y.Name
+	})
+
+	ongoingMigrationDeletions := make([]keyed[util.NamespacedName, int], 0, len(s.ongoingMigrationDeletions))
+	for k, count := range s.ongoingMigrationDeletions {
+		ongoingMigrationDeletions = append(ongoingMigrationDeletions, keyed[util.NamespacedName, int]{Key: k, Value: count})
+	}
+	sortSliceByPodName(ongoingMigrationDeletions, func(kv keyed[util.NamespacedName, int]) util.NamespacedName { return kv.Key })
+
+	return stateFixture{
+		Nodes:                     nodes,
+		OngoingMigrationDeletions: ongoingMigrationDeletions,
+	}
+}
+
+func (s *nodeState) exportFixture() nodeFixture {
+	pods := make([]podFixture, 0, len(s.pods))
+	podNames := make(map[*vmPodState]util.NamespacedName)
+	for name, p := range s.pods {
+		pods = append(pods, p.exportFixture())
+		if p.vm != nil {
+			podNames[p.vm] = name
+		}
+	}
+	sortSliceByPodName(pods, func(p podFixture) util.NamespacedName { return p.Name })
+
+	mq := make([]util.NamespacedName, 0, len(s.mq))
+	for _, vm := range s.mq {
+		mq = append(mq, podNames[vm])
+	}
+
+	extended := make(map[corev1.ResourceName]nodeResourceState[uint64], len(s.extended))
+	for name, state := range s.extended {
+		extended[name] = *state
+	}
+
+	return nodeFixture{
+		Name:                  s.name,
+		NodeGroup:             s.nodeGroup,
+		AvailabilityZone:      s.availabilityZone,
+		CPU:                   s.cpu,
+		Mem:                   s.mem,
+		TenantReserved:        s.tenantReserved,
+		Extended:              extended,
+		Pods:                  pods,
+		Mq:                    mq,
+		ScaleOutPendingSince:  copyTimePtr(s.scaleOutPendingSince),
+		ScaleOutFallenBack:    s.scaleOutFallenBack,
+		DownscalePendingSince: copyTimePtr(s.downscalePendingSince),
+		OverWatermarkSince:    copyTimePtr(s.overWatermarkSince),
+		PressureExceededSince: copyTimePtr(s.pressureExceededSince),
+		InTooMuchPressure:     s.inTooMuchPressure,
+		Accommodating:         copyNamePtr(s.accommodating),
+		LastNodeFullEvent:     s.lastNodeFullEvent,
+		VerdictSummary:        s.verdictSummary,
+		EmptySince:            copyTimePtr(s.emptySince),
+		CapacityPressureAvg:   s.capacityPressureAvg,
+		ScoreMultiplier:       s.scoreMultiplier,
+		CapacityUpdatedAt:     s.capacityUpdatedAt,
+		Unschedulable:         s.unschedulable,
+	}
+}
+
+func (s *podState) exportFixture() podFixture {
+	var vm *vmPodFixture
+	if s.vm != nil {
+		// Reuse dump() for copying the "may be nil" pointer fields
+		d := s.vm.dump()
+		vm = &vmPodFixture{
+			Name:                     d.Name,
+			MemSlotSize:              s.vm.memSlotSize,
+			MemGranularity:           s.vm.memGranularity,
+			TestingOnlyAlwaysMigrate: d.TestingOnlyAlwaysMigrate,
+			MostRecentComputeUnit:    d.MostRecentComputeUnit,
+			Metrics:                  d.Metrics,
+			MetricsUpdatedAt:         d.MetricsUpdatedAt,
+			OverprovisionedBonus:     d.OverprovisionedBonus,
+			DualReliefBonus:          d.DualReliefBonus,
+			MigrationSize:            d.MigrationSize,
+			MqEnqueuedAt:             d.MqEnqueuedAt,
+			MigrationState:           d.MigrationState,
+			MigrationCooldownUntil:   d.MigrationCooldownUntil,
+			PendingMigrationTarget:   d.PendingMigrationTarget,
+			MigrationRequested:       d.MigrationRequested,
+			MigrationCounted:         d.MigrationCounted,
+		}
+	}
+
+	extended := make(map[corev1.ResourceName]podResourceState[uint64], len(s.extended))
+	for name, state := range s.extended {
+		extended[name] = *state
+	}
+
+	return podFixture{
+		Name:     s.name,
+		CPU:      s.cpu,
+		Mem:      s.mem,
+		Extended: extended,
+		Labels:   s.labels,
+		VM:       vm,
+		Phase:    s.phase,
+	}
+}
+
+// loadFixture reconstructs the pluginState captured by exportFixture, using the given config
+//
+// The returned state is not associated with any metrics; callers that need them should call
+// updateMetrics on each node.
+func loadFixture(f stateFixture, conf *Config) (*pluginState, error) {
+	s := &pluginState{
+		lock:                      util.NewChanMutex(),
+		ongoingMigrationDeletions: make(map[util.NamespacedName]int),
+		ongoingMigrations:         0, // set from the pods below
+		pods:                      make(map[util.NamespacedName]*podState),
+		nodes:                     make(map[string]*nodeState),
+		maxTotalReservableCPU:     0,
+		maxTotalReservableMem:     0,
+		orphanMetrics:             make(map[util.NamespacedName]orphanMetrics),
+		conf:                      conf,
+		clock:                     realClock{},
+	}
+
+	for _, kv := range f.OngoingMigrationDeletions {
+		s.ongoingMigrationDeletions[kv.Key] = kv.Value
+	}
+
+	for _, nf := range f.Nodes {
+		if _, ok := s.nodes[nf.Name]; ok {
+			return nil, fmt.Errorf("duplicate node %q", nf.Name)
+		}
+
+		n, err := loadNodeFixture(nf)
+		if err != nil {
+			return nil, fmt.Errorf("node %q: %w", nf.Name, err)
+		}
+
+		for name, p := range n.pods {
+			if _, ok := s.pods[name]; ok {
+				return nil, fmt.Errorf("pod %v is on more than one node", name)
+			}
+			s.pods[name] = p
+			if p.vm != nil && p.vm.migrationCounted {
+				s.ongoingMigrations += 1
+			}
+		}
+		s.nodes[n.name] = n
+	}
+
+	s.updateMaxTotalReservable()
+	return s, nil
+}
+
+func loadNodeFixture(f nodeFixture) (*nodeState, error) {
+	extended := make(map[corev1.ResourceName]*nodeResourceState[uint64], len(f.Extended))
+	for name, state := range f.Extended {
+		state := state
+		extended[name] = &state
+	}
+
+	n := &nodeState{
+		name:                  f.Name,
+		nodeGroup:             f.NodeGroup,
+		availabilityZone:      f.AvailabilityZone,
+		cpu:                   f.CPU,
+		mem:                   f.Mem,
+		tenantReserved:        f.TenantReserved,
+		extended:              extended,
+		pods:                  make(map[util.NamespacedName]*podState, len(f.Pods)),
+		mq:                    make(migrationQueue, 0, len(f.Mq)),
+		scaleOutPendingSince:  copyTimePtr(f.ScaleOutPendingSince),
+		scaleOutFallenBack:    f.ScaleOutFallenBack,
+		downscalePendingSince: copyTimePtr(f.DownscalePendingSince),
+		overWatermarkSince:    copyTimePtr(f.OverWatermarkSince),
+		pressureExceededSince: copyTimePtr(f.PressureExceededSince),
+		inTooMuchPressure:     f.InTooMuchPressure,
+		accommodating:         copyNamePtr(f.Accommodating),
+		lastNodeFullEvent:     f.LastNodeFullEvent,
+		verdictSummary:        f.VerdictSummary,
+		emptySince:            copyTimePtr(f.EmptySince),
+		capacityPressureAvg:   f.CapacityPressureAvg,
+		scoreMultiplier:       f.ScoreMultiplier,
+		capacityUpdatedAt:     f.CapacityUpdatedAt,
+		unschedulable:         f.Unschedulable,
+	}
+
+	if n.scoreMultiplier == 0 {
+		n.scoreMultiplier = 1
+	}
+
+	for _, pf := range f.Pods {
+		if _, ok := n.pods[pf.Name]; ok {
+			return nil, fmt.Errorf("duplicate pod %v", pf.Name)
+		}
+		n.pods[pf.Name] = loadPodFixture(pf, n)
+	}
+
+	// Rebuild the migration queue in exactly the stored order, rather than re-pushing each pod, so
+	// that ties are preserved.
+	for i, name := range f.Mq {
+		p, ok := n.pods[name]
+		if !ok || p.vm == nil {
+			return nil, fmt.Errorf("migration queue entry %v is not a VM pod on the node", name)
+		} else if p.vm.mqIndex != -1 {
+			return nil, fmt.Errorf("duplicate migration queue entry %v", name)
+		}
+		p.vm.mqIndex = i
+		n.mq = append(n.mq, p.vm)
+	}
+
+	return n, nil
+}
+
+func loadPodFixture(f podFixture, node *nodeState) *podState {
+	var vm *vmPodState
+	if f.VM != nil {
+		var mostRecentComputeUnit *api.Resources
+		if f.VM.MostRecentComputeUnit != nil {
+			mrcu := *f.VM.MostRecentComputeUnit
+			mostRecentComputeUnit = &mrcu
+		}
+		var metrics *api.Metrics
+		if f.VM.Metrics != nil {
+			m := *f.VM.Metrics
+			metrics = &m
+		}
+		var migrationState *podMigrationState
+		if f.VM.MigrationState != nil {
+			migrationState = &podMigrationState{
+				name:       f.VM.MigrationState.MigrationName,
+				startTime:  f.VM.MigrationState.StartTime,
+				targetNode: f.VM.MigrationState.TargetNode,
+				phase:      f.VM.MigrationState.Phase,
+			}
+		}
+
+		vm = &vmPodState{
+			name:                     f.VM.Name,
+			memSlotSize:              f.VM.MemSlotSize,
+			memGranularity:           f.VM.MemGranularity,
+			testingOnlyAlwaysMigrate: f.VM.TestingOnlyAlwaysMigrate,
+			mostRecentComputeUnit:    mostRecentComputeUnit,
+			metrics:                  metrics,
+			metricsUpdatedAt:         f.VM.MetricsUpdatedAt,
+			overprovisionedBonus:     f.VM.OverprovisionedBonus,
+			dualReliefBonus:          f.VM.DualReliefBonus,
+			migrationSize:            f.VM.MigrationSize,
+			mqIndex:                  -1, // set by loadNodeFixture
+			mqEnqueuedAt:             f.VM.MqEnqueuedAt,
+			migrationState:           migrationState,
+			migrationCooldownUntil:   f.VM.MigrationCooldownUntil,
+			pendingMigrationTarget:   f.VM.PendingMigrationTarget,
+			migrationRequested:       f.VM.MigrationRequested,
+			migrationCounted:         f.VM.MigrationCounted,
+		}
+	}
+
+	extended := make(map[corev1.ResourceName]*podResourceState[uint64], len(f.Extended))
+	for name, state := range f.Extended {
+		state := state
+		extended[name] = &state
+	}
+
+	return &podState{
+		name:     f.Name,
+		node:     node,
+		cpu:      f.CPU,
+		mem:      f.Mem,
+		extended: extended,
+		labels:   f.Labels,
+		vm:       vm,
+		phase:    f.Phase,
+	}
+}
+
+func copyTimePtr(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	return &c
+}
+
+func copyNamePtr(n *util.NamespacedName) *util.NamespacedName {
+	if n == nil {
+		return nil
+	}
+	c := *n
+	return &c
+}
@@ -0,0 +1,143 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestFixtureRoundTrip(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) {
+		conf.ExtendedResources = []corev1.ResourceName{"example.com/fpga"}
+	})
+
+	// Times are fixed (and in UTC, without monotonic readings) so that they're exactly preserved
+	// through JSON.
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	a := makeTestNodeState(conf.NodeConfig.vCpuLimits(resourcePtr("8")), conf.NodeConfig.memoryLimits(resourcePtr("32Gi")))
+	a.name = "a"
+	a.nodeGroup = "group"
+	a.availabilityZone = "zone-a"
+	a.tenantReserved = api.Resources{VCPU: 1000, Mem: 4 << 30}
+	a.extended["example.com/fpga"] = &nodeResourceState[uint64]{
+		Total: 4, Watermark: 4, ReleaseThreshold: 4, PressureMargin: 0, NoMigrationTrigger: false, HardLimit: 0, Reserved: 1,
+		Buffer: 0, Burst: 0, CapacityPressure: 0, PressureAccountedFor: 0,
+	}
+	a.scaleOutPendingSince = &now
+	a.overWatermarkSince = &now
+	a.inTooMuchPressure = true
+
+	vm1 := addTestPod(a, "vm1", true, 3000, 12<<30)
+	vm1.cpu.Buffer, vm1.cpu.Burst, vm1.cpu.CapacityPressure = 250, 500, 100
+	vm1.mem.Min, vm1.mem.Max = 4<<30, 16<<30
+	vm1.extended["example.com/fpga"] = &podResourceState[uint64]{
+		Reserved: 1, Buffer: 0, Burst: 0, CapacityPressure: 0, Min: 1, Max: 1,
+	}
+	vm1.vm.mostRecentComputeUnit = &api.Resources{VCPU: 250, Mem: 1 << 30}
+	vm1.vm.metrics = &api.Metrics{LoadAverage1Min: 0.5, LoadAverage5Min: 0.25, MemoryUsageBytes: 1 << 30}
+	vm1.vm.migrationCooldownUntil = now.Add(time.Minute)
+	vm2 := addTestPod(a, "vm2", true, 2000, 8<<30)
+	vm2.vm.metrics = &api.Metrics{LoadAverage1Min: 1.5, LoadAverage5Min: 1, MemoryUsageBytes: 2 << 30}
+	vm2.vm.pendingMigrationTarget = "b"
+	vm2.vm.migrationRequested = true
+	a.mq.addOrUpdate(vm2.vm, now)
+	a.mq.addOrUpdate(vm1.vm, now)
+	_ = addTestPod(a, "system", false, 500, 1<<30)
+	a.accommodating = &vm2.vm.name
+	a.lastNodeFullEvent = now
+	a.verdictSummary = nodeVerdictSummary{
+		Requests:          3,
+		Granted:           api.Resources{VCPU: 500, Mem: 2 << 30},
+		Denied:            api.Resources{VCPU: 250, Mem: 1 << 30},
+		MigrationsStarted: 1,
+	}
+	a.capacityUpdatedAt = now
+
+	b := makeTestNodeState(conf.NodeConfig.vCpuLimits(resourcePtr("16")), conf.NodeConfig.memoryLimits(resourcePtr("64Gi")))
+	b.name = "b"
+	b.availabilityZone = "zone-b"
+	b.downscalePendingSince = &now
+	migrating := addTestPod(b, "migrating", true, 1000, 4<<30)
+	migrating.vm.migrationState = &podMigrationState{
+		name:       util.NamespacedName{Namespace: "default", Name: "migration"},
+		startTime:  now,
+		targetNode: "a",
+		phase:      "",
+	}
+
+	e := makeTestEnforcer(conf, a, b)
+	e.state.ongoingMigrationDeletions[util.NamespacedName{Namespace: "default", Name: "old-migration"}] = 2
+	e.state.countMigration(migrating.vm)
+
+	original := e.state.exportFixture()
+	originalJSON, err := json.Marshal(original)
+	if err != nil {
+		t.Fatalf("failed to marshal fixture: %s", err)
+	}
+
+	var decoded stateFixture
+	if err := json.Unmarshal(originalJSON, &decoded); err != nil {
+		t.Fatalf("failed to unmarshal fixture: %s", err)
+	}
+	loaded, err := loadFixture(decoded, conf)
+	if err != nil {
+		t.Fatalf("failed to load fixture: %s", err)
+	}
+
+	roundTripJSON, err := json.Marshal(loaded.exportFixture())
+	if err != nil {
+		t.Fatalf("failed to marshal round-tripped fixture: %s", err)
+	}
+	if !bytes.Equal(originalJSON, roundTripJSON) {
+		t.Fatalf("fixture changed after round trip:\noriginal:     %s\nround-tripped: %s", originalJSON, roundTripJSON)
+	}
+
+	// Beyond the fixture itself, the loaded state should match the original exactly.
+	if len(loaded.nodes) != len(e.state.nodes) {
+		t.Errorf("expected %d nodes, got %d", len(e.state.nodes), len(loaded.nodes))
+	}
+	for name, n := range e.state.nodes {
+		if !reflect.DeepEqual(loaded.nodes[name], n) {
+			t.Errorf("node %q differs after round trip", name)
+		}
+	}
+	if !reflect.DeepEqual(loaded.ongoingMigrationDeletions, e.state.ongoingMigrationDeletions) {
+		t.Errorf(
+			"expected ongoingMigrationDeletions %v after round trip, got %v",
+			e.state.ongoingMigrationDeletions, loaded.ongoingMigrationDeletions,
+		)
+	}
+
+	// Check the parts of the state that aren't directly part of the fixture.
+	if loaded.maxTotalReservableCPU != e.state.maxTotalReservableCPU || loaded.maxTotalReservableMem != e.state.maxTotalReservableMem {
+		t.Errorf("expected maxTotalReservable to be recomputed")
+	}
+	if loaded.ongoingMigrations != e.state.ongoingMigrations {
+		t.Errorf("expected %d ongoing migrations, got %d", e.state.ongoingMigrations, loaded.ongoingMigrations)
+	}
+	if len(loaded.pods) != len(e.state.pods) {
+		t.Errorf("expected %d pods in global map, got %d", len(e.state.pods), len(loaded.pods))
+	}
+	for name, p := range loaded.pods {
+		if p.node.pods[name] != p {
+			t.Errorf("pod %v is not correctly linked to its node", name)
+		}
+	}
+	loadedA := loaded.nodes["a"]
+	for i, vm := range loadedA.mq {
+		if vm.mqIndex != i {
+			t.Errorf("expected mqIndex %d for %v, got %d", i, vm.name, vm.mqIndex)
+		}
+	}
+	if !loadedA.mq.isNextInQueue(loadedA.pods[vm1.name].vm) {
+		t.Error("expected migration queue order to be preserved")
+	}
+}
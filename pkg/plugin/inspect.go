@@ -0,0 +1,181 @@
+package plugin
+
+// Inspecting the state of individual nodes and pods, served alongside the dump-state endpoint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// nodeSummaryDump is the response type for the "/state/nodes" endpoints: the node's resource
+// accounting and the names of its pods, without the rest of nodeStateDump.
+type nodeSummaryDump struct {
+	Name string                            `json:"name"`
+	CPU  nodeResourceState[vmapi.MilliCPU] `json:"cpu"`
+	Mem  nodeResourceState[api.Bytes]      `json:"mem"`
+	Pods []util.NamespacedName             `json:"pods"`
+}
+
+func (s *nodeState) summary() nodeSummaryDump {
+	pods := make([]util.NamespacedName, 0, len(s.pods))
+	for name := range s.pods {
+		pods = append(pods, name)
+	}
+	sortSliceByPodName(pods, func(name util.NamespacedName) util.NamespacedName { return name })
+
+	return nodeSummaryDump{
+		Name: s.name,
+		CPU:  s.cpu,
+		Mem:  s.mem,
+		Pods: pods,
+	}
+}
+
+// nodeSummaries returns the summary of every node, sorted by name
+//
+// The summaries are copies, so they can be serialized after the lock is released.
+func (s *pluginState) nodeSummaries(ctx context.Context) ([]nodeSummaryDump, error) {
+	if err := s.lock.TryLock(ctx); err != nil {
+		return nil, err
+	}
+	defer s.lock.Unlock()
+
+	nodes := make([]nodeSummaryDump, 0, len(s.nodes))
+	for _, n := range s.nodes {
+		nodes = append(nodes, n.summary())
+	}
+	slices.SortFunc(nodes, func(x, y nodeSummaryDump) (less bool) {
+		return x.Name < y.Name
+	})
+
+	return nodes, nil
+}
+
+func (s *pluginState) nodeSummary(ctx context.Context, nodeName string) (_ *nodeSummaryDump, ok bool, _ error) {
+	if err := s.lock.TryLock(ctx); err != nil {
+		return nil, false, err
+	}
+	defer s.lock.Unlock()
+
+	node, ok := s.nodes[nodeName]
+	if !ok {
+		return nil, false, nil
+	}
+
+	summary := node.summary()
+	return &summary, true, nil
+}
+
+func (s *pluginState) podDump(ctx context.Context, podName util.NamespacedName) (_ *podStateDump, ok bool, _ error) {
+	if err := s.lock.TryLock(ctx); err != nil {
+		return nil, false, err
+	}
+	defer s.lock.Unlock()
+
+	pod, ok := s.pods[podName]
+	if !ok {
+		return nil, false, nil
+	}
+
+	dump := pod.dump()
+	return &dump, true, nil
+}
+
+// addInspectStateHandlers adds the following endpoints to the mux:
+//
+//   - "/state/nodes", listing the summary of every node
+//   - "/state/nodes/<name>", for the summary of a single node
+//   - "/state/pods/<namespace>/<name>", for the state of a single pod
+func (p *AutoscaleEnforcer) addInspectStateHandlers(logger *zap.Logger, mux *http.ServeMux) {
+	nodesLogger := logger.With(zap.String("endpoint", "/state/nodes"))
+	nodesHandler := func(w http.ResponseWriter, r *http.Request) {
+		nodeName := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/state/nodes"), "/")
+		if nodeName == "" {
+			p.serveInspectedState(nodesLogger, w, r, "", func(ctx context.Context) (any, bool, error) {
+				nodes, err := p.state.nodeSummaries(ctx)
+				return nodes, true, err
+			})
+			return
+		}
+
+		p.serveInspectedState(nodesLogger, w, r, fmt.Sprintf("node %q", nodeName), func(ctx context.Context) (any, bool, error) {
+			return p.state.nodeSummary(ctx, nodeName)
+		})
+	}
+	mux.HandleFunc("/state/nodes", nodesHandler)
+	mux.HandleFunc("/state/nodes/", nodesHandler)
+
+	podsLogger := logger.With(zap.String("endpoint", "/state/pods"))
+	mux.HandleFunc("/state/pods/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/state/pods/"), "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("expected path /state/pods/<namespace>/<name>"))
+			return
+		}
+		podName := util.NamespacedName{Namespace: parts[0], Name: parts[1]}
+
+		p.serveInspectedState(podsLogger, w, r, fmt.Sprintf("pod %v", podName), func(ctx context.Context) (any, bool, error) {
+			return p.state.podDump(ctx, podName)
+		})
+	})
+}
+
+// serveInspectedState writes the JSON-encoded result of get as the response, using the same timeout
+// as the full state dump. If get returns ok = false, the response is a 404 saying that the object
+// described by what wasn't found.
+func (p *AutoscaleEnforcer) serveInspectedState(
+	logger *zap.Logger,
+	w http.ResponseWriter,
+	r *http.Request,
+	what string,
+	get func(context.Context) (_ any, ok bool, _ error),
+) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_, _ = w.Write([]byte("request method must be " + http.MethodGet))
+		return
+	}
+
+	timeout := time.Duration(p.state.conf.DumpState.TimeoutSeconds) * time.Second
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	value, ok, err := get(ctx)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, context.DeadlineExceeded) {
+			status = http.StatusInternalServerError
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(fmt.Sprintf("error while getting state: %s", err)))
+		return
+	} else if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(fmt.Sprintf("%s not found", what)))
+		return
+	}
+
+	body, err := json.Marshal(value)
+	if err != nil {
+		logger.Error("Failed to marshal state", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", ContentTypeJSON)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+}
@@ -0,0 +1,77 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestInspectStateEndpoints(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) {
+		conf.DumpState = &dumpStateConfig{Port: 10298, TimeoutSeconds: 1}
+	})
+
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+		conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+	)
+	addTestPod(node, "b", true, 1000, 2<<30)
+	pod := addTestPod(node, "a", true, 2000, 4<<30)
+	e := makeTestEnforcer(conf, node)
+
+	mux := http.NewServeMux()
+	e.addInspectStateHandlers(zap.NewNop(), mux)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	rec := get("/state/nodes")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var nodes []nodeSummaryDump
+	if err := json.Unmarshal(rec.Body.Bytes(), &nodes); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	if len(nodes) != 1 || nodes[0].Name != node.name || nodes[0].CPU.Reserved != node.cpu.Reserved {
+		t.Fatalf("unexpected node summaries: %+v", nodes)
+	}
+	if len(nodes[0].Pods) != 2 || nodes[0].Pods[0] != pod.name {
+		t.Errorf("expected pods to be listed in sorted order, got %v", nodes[0].Pods)
+	}
+
+	rec = get("/state/nodes/" + node.name)
+	var summary nodeSummaryDump
+	if err := json.Unmarshal(rec.Body.Bytes(), &summary); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	if summary.Mem.Reserved != node.mem.Reserved {
+		t.Errorf("expected mem reserved %v, got %v", node.mem.Reserved, summary.Mem.Reserved)
+	}
+
+	rec = get(fmt.Sprintf("/state/pods/%s/%s", pod.name.Namespace, pod.name.Name))
+	var podDump podStateDump
+	if err := json.Unmarshal(rec.Body.Bytes(), &podDump); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+	if podDump.Name != pod.name || podDump.CPU.Reserved != pod.cpu.Reserved {
+		t.Errorf("unexpected pod state: %+v", podDump)
+	}
+
+	if rec := get("/state/nodes/missing"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for missing node, got %d", rec.Code)
+	}
+	if rec := get("/state/pods/default/missing"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for missing pod, got %d", rec.Code)
+	}
+	if rec := get("/state/pods/default"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for malformed pod path, got %d", rec.Code)
+	}
+}
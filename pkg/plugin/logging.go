@@ -0,0 +1,70 @@
+package plugin
+
+// Separate log outputs for audit events and per-request verdicts. See Config.Logging.
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// buildLoggers returns the loggers for each of the configured outputs. Outputs that aren't
+// configured are returned as nil.
+func (c *loggingConfig) buildLoggers() (audit *zap.Logger, debug *zap.Logger, _ error) {
+	if c == nil {
+		return nil, nil, nil
+	}
+
+	var err error
+	if c.Audit != nil {
+		if audit, err = c.Audit.build("audit"); err != nil {
+			return nil, nil, fmt.Errorf("Error building audit logger: %w", err)
+		}
+	}
+	if c.Debug != nil {
+		if debug, err = c.Debug.build("debug"); err != nil {
+			return nil, nil, fmt.Errorf("Error building debug logger: %w", err)
+		}
+	}
+
+	return audit, debug, nil
+}
+
+func (c *logOutputConfig) build(name string) (*zap.Logger, error) {
+	level, err := zapcore.ParseLevel(c.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	// Same as the base logger, created in the scheduler's main()
+	conf := zap.NewProductionConfig()
+	conf.Sampling = nil
+	conf.Level = zap.NewAtomicLevelAt(level)
+	conf.OutputPaths = []string{c.OutputPath}
+
+	logger, err := conf.Build()
+	if err != nil {
+		return nil, err
+	}
+	return logger.Named("autoscale-scheduler").Named(name), nil
+}
+
+// auditLog returns the logger for audit events, with the given fields. If there's no separate audit
+// output, this is just the request's logger, which is expected to already have the fields.
+func (e *AutoscaleEnforcer) auditLog(logger *zap.Logger, fields ...zap.Field) *zap.Logger {
+	if e.auditLogger == nil {
+		return logger
+	}
+	return e.auditLogger.With(fields...)
+}
+
+// debugLog returns the logger for per-request verdicts, with the given fields. If there's no
+// separate debug output, this is just the request's logger, which is expected to already have the
+// fields.
+func (e *AutoscaleEnforcer) debugLog(logger *zap.Logger, fields ...zap.Field) *zap.Logger {
+	if e.debugLogger == nil {
+		return logger
+	}
+	return e.debugLogger.With(fields...)
+}
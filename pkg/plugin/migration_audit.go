@@ -0,0 +1,269 @@
+package plugin
+
+// Durable records of the migrations we observe, for auditing. See Config.MigrationAudit.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// migrationRecordVersion is the current version of the migrationRecord format. It must be
+// incremented for any incompatible change to the format.
+const migrationRecordVersion = 1
+
+type migrationRecordEvent string
+
+const (
+	migrationRecordStart migrationRecordEvent = "start"
+	migrationRecordEnd   migrationRecordEvent = "end"
+)
+
+type migrationRecordReason string
+
+const (
+	// migrationReasonNodePressure means we created the migration because the source node had too
+	// much pressure
+	migrationReasonNodePressure migrationRecordReason = "node-pressure"
+	// migrationReasonExternal means the migration was created by something other than us
+	migrationReasonExternal migrationRecordReason = "external"
+)
+
+type migrationRecordOutcome string
+
+const (
+	// migrationOutcomeSucceeded means the pod is no longer part of the migration, and the
+	// VirtualMachineMigration's phase was Succeeded
+	migrationOutcomeSucceeded migrationRecordOutcome = "succeeded"
+	// migrationOutcomeFailed means the pod is no longer part of the migration, and the
+	// VirtualMachineMigration's phase was Failed
+	migrationOutcomeFailed migrationRecordOutcome = "failed"
+	// migrationOutcomeEnded means the pod is no longer part of the migration, but we hadn't observed
+	// the VirtualMachineMigration reaching a final phase, so we don't know whether it succeeded.
+	migrationOutcomeEnded migrationRecordOutcome = "ended"
+	// migrationOutcomeTimedOut means we stopped tracking the migration because it exceeded
+	// Config.MigrationTimeoutSeconds
+	migrationOutcomeTimedOut migrationRecordOutcome = "timed-out"
+)
+
+// migrationRecord is a single entry in the migration audit log
+//
+// There's a record for each pod involved in the migration (i.e. both the source and the target),
+// at both the start and end of its involvement.
+type migrationRecord struct {
+	Version   int                  `json:"version"`
+	Event     migrationRecordEvent `json:"event"`
+	Time      time.Time            `json:"time"`
+	Migration util.NamespacedName  `json:"migration"`
+	VM        util.NamespacedName  `json:"vm"`
+	Pod       util.NamespacedName  `json:"pod"`
+	// Source is true if Pod is the migration's source pod, and false if it's the target pod
+	Source bool `json:"source"`
+	// SourceNode is the node the VM is being migrated from. It's only known for the source pod.
+	SourceNode string `json:"sourceNode,omitempty"`
+	// TargetNode is the node the VM is being migrated to, if known
+	TargetNode string                `json:"targetNode,omitempty"`
+	Reason     migrationRecordReason `json:"reason"`
+	// Outcome and DurationSeconds are only set for "end" records
+	Outcome         migrationRecordOutcome `json:"outcome,omitempty"`
+	DurationSeconds float64                `json:"durationSeconds,omitempty"`
+}
+
+// makeMigrationRecord returns the migrationRecord for the VM pod, which must currently be migrating
+func makeMigrationRecord(pod *podState, event migrationRecordEvent, now time.Time) migrationRecord {
+	state := pod.vm.migrationState
+
+	// Migrations never target the node the VM is already on, so the pod is the target pod exactly
+	// when its node is the target node.
+	source := state.targetNode != pod.node.name
+	var sourceNode string
+	if source {
+		sourceNode = pod.node.name
+	}
+
+	reason := migrationReasonExternal
+	if isPluginMigrationName(state.name) {
+		reason = migrationReasonNodePressure
+	}
+
+	return migrationRecord{
+		Version:         migrationRecordVersion,
+		Event:           event,
+		Time:            now,
+		Migration:       state.name,
+		VM:              pod.vm.name,
+		Pod:             pod.name,
+		Source:          source,
+		SourceNode:      sourceNode,
+		TargetNode:      state.targetNode,
+		Reason:          reason,
+		Outcome:         "",
+		DurationSeconds: 0,
+	}
+}
+
+// endOutcome returns the outcome to record when the pod is no longer part of the migration, based
+// on the most recently observed phase of the VirtualMachineMigration
+func (s *podMigrationState) endOutcome() migrationRecordOutcome {
+	switch s.phase {
+	case vmapi.VmmSucceeded:
+		return migrationOutcomeSucceeded
+	case vmapi.VmmFailed:
+		return migrationOutcomeFailed
+	default:
+		return migrationOutcomeEnded
+	}
+}
+
+// withOutcome returns a copy of the "end" record with the outcome and duration of the migration set
+func (r migrationRecord) withOutcome(outcome migrationRecordOutcome, startTime time.Time) migrationRecord {
+	r.Outcome = outcome
+	r.DurationSeconds = r.Time.Sub(startTime).Seconds()
+	return r
+}
+
+// migrationAuditLog buffers migrationRecords until they're written by flush
+//
+// All methods are safe to call on a nil *migrationAuditLog, which is used when
+// Config.MigrationAudit is not set.
+type migrationAuditLog struct {
+	conf *migrationAuditConfig
+
+	mu      sync.Mutex
+	pending []migrationRecord
+	// dropped is the number of records discarded since the last flush, because there were already
+	// MaxRecords pending
+	dropped uint
+	// written is the number of records in the current log file, or nil if we haven't checked yet
+	written *uint
+}
+
+func newMigrationAuditLog(conf *migrationAuditConfig) *migrationAuditLog {
+	if conf == nil {
+		return nil
+	}
+
+	return &migrationAuditLog{
+		conf:    conf,
+		mu:      sync.Mutex{},
+		pending: nil,
+		dropped: 0,
+		written: nil,
+	}
+}
+
+// add records the migrationRecord, to be written on the next call to flush
+func (l *migrationAuditLog) add(record migrationRecord) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if uint(len(l.pending)) >= l.conf.MaxRecords {
+		l.pending = l.pending[1:]
+		l.dropped += 1
+	}
+	l.pending = append(l.pending, record)
+}
+
+// flush writes all pending records to the log, rotating it as needed
+//
+// If there's an error, the records that weren't written are kept to try again on the next flush.
+func (l *migrationAuditLog) flush(logger *zap.Logger) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.dropped != 0 {
+		logger.Warn("Dropped migration records because too many were pending", zap.Uint("count", l.dropped))
+		l.dropped = 0
+	}
+
+	if len(l.pending) == 0 {
+		return nil
+	}
+
+	if l.written == nil {
+		count, err := countLines(l.conf.Path)
+		if err != nil {
+			return fmt.Errorf("Error reading existing log: %w", err)
+		}
+		l.written = &count
+	}
+
+	file, err := os.OpenFile(l.conf.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("Error opening log: %w", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	for len(l.pending) != 0 {
+		if *l.written >= l.conf.MaxRecords {
+			if err := file.Close(); err != nil {
+				return fmt.Errorf("Error closing log before rotation: %w", err)
+			}
+			if err := os.Rename(l.conf.Path, l.conf.Path+".1"); err != nil {
+				return fmt.Errorf("Error rotating log: %w", err)
+			}
+			*l.written = 0
+
+			file, err = os.OpenFile(l.conf.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+			if err != nil {
+				return fmt.Errorf("Error opening new log after rotation: %w", err)
+			}
+		}
+
+		line, err := json.Marshal(l.pending[0])
+		if err != nil {
+			return fmt.Errorf("Error marshaling record: %w", err)
+		}
+		if _, err := file.Write(append(line, '\n')); err != nil {
+			return fmt.Errorf("Error writing record: %w", err)
+		}
+
+		l.pending = l.pending[1:]
+		*l.written += 1
+	}
+
+	return file.Sync()
+}
+
+// countLines returns the number of lines in the file at the path, or zero if it doesn't exist
+func countLines(path string) (uint, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var count uint
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		count += 1
+	}
+	return count, scanner.Err()
+}
+
+// flushMigrationAudit writes any pending migration records, logging if that fails
+func (e *AutoscaleEnforcer) flushMigrationAudit(logger *zap.Logger) {
+	if err := e.migrationAudit.flush(logger); err != nil {
+		logger.Error("Failed to write migration records", zap.Error(err))
+	}
+}
@@ -0,0 +1,152 @@
+package plugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func readMigrationRecords(t *testing.T, path string) []migrationRecord {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open log: %s", err)
+	}
+	defer file.Close()
+
+	var records []migrationRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record migrationRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("failed to unmarshal record %q: %s", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("failed to read log: %s", err)
+	}
+	return records
+}
+
+func TestMigrationAuditRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "migrations.log")
+	conf := makeTestConfig(t, func(conf *Config) {
+		conf.MigrationAudit = &migrationAuditConfig{
+			Path:                 path,
+			MaxRecords:           10,
+			FlushIntervalSeconds: 1,
+		}
+	})
+
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+		conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+	)
+	pod := addTestPod(node, "migrating", true, 2000, 4<<30)
+
+	e := makeTestEnforcer(conf, node)
+	e.migrationAudit = newMigrationAuditLog(conf.MigrationAudit)
+
+	migrationName := util.NamespacedName{Namespace: "default", Name: pluginMigrationNamePrefix + pod.vm.name.Name}
+	pod.vm.pendingMigrationTarget = "other-node"
+	e.handlePodStartMigration(zap.NewNop(), pod.name, migrationName, true)
+
+	vmm := &vmapi.VirtualMachineMigration{}
+	vmm.Namespace = migrationName.Namespace
+	vmm.Name = migrationName.Name
+	vmm.Status.Phase = vmapi.VmmSucceeded
+	e.handleMigrationPhaseChanged(zap.NewNop(), vmm)
+
+	e.handlePodEndMigration(zap.NewNop(), pod.name, migrationName)
+
+	if err := e.migrationAudit.flush(zap.NewNop()); err != nil {
+		t.Fatalf("failed to flush: %s", err)
+	}
+
+	records := readMigrationRecords(t, path)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d: %+v", len(records), records)
+	}
+
+	start, end := records[0], records[1]
+	if start.Event != migrationRecordStart || end.Event != migrationRecordEnd {
+		t.Errorf("expected start and end records, got %q and %q", start.Event, end.Event)
+	}
+	for _, r := range records {
+		if r.Version != migrationRecordVersion {
+			t.Errorf("expected version %d, got %d", migrationRecordVersion, r.Version)
+		}
+		if r.Migration != migrationName || r.VM != pod.vm.name || r.Pod != pod.name {
+			t.Errorf("unexpected migration, VM, or pod in record: %+v", r)
+		}
+		if !r.Source || r.SourceNode != node.name || r.TargetNode != "other-node" {
+			t.Errorf("unexpected source or target in record: %+v", r)
+		}
+		if r.Reason != migrationReasonNodePressure {
+			t.Errorf("expected reason %q, got %q", migrationReasonNodePressure, r.Reason)
+		}
+	}
+	if start.Outcome != "" {
+		t.Errorf("expected no outcome for start record, got %q", start.Outcome)
+	}
+	if end.Outcome != migrationOutcomeSucceeded {
+		t.Errorf("expected outcome %q for end record, got %q", migrationOutcomeSucceeded, end.Outcome)
+	}
+}
+
+func TestMigrationAuditEndOutcome(t *testing.T) {
+	cases := []struct {
+		phase    vmapi.VmmPhase
+		expected migrationRecordOutcome
+	}{
+		{phase: "", expected: migrationOutcomeEnded},
+		{phase: vmapi.VmmRunning, expected: migrationOutcomeEnded},
+		{phase: vmapi.VmmSucceeded, expected: migrationOutcomeSucceeded},
+		{phase: vmapi.VmmFailed, expected: migrationOutcomeFailed},
+	}
+
+	for _, c := range cases {
+		state := podMigrationState{
+			name:       util.NamespacedName{Namespace: "default", Name: "migration"},
+			startTime:  time.Now(),
+			targetNode: "",
+			phase:      c.phase,
+		}
+		if outcome := state.endOutcome(); outcome != c.expected {
+			t.Errorf("phase %q: expected outcome %q, got %q", c.phase, c.expected, outcome)
+		}
+	}
+}
+
+func TestMigrationAuditRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "migrations.log")
+	log := newMigrationAuditLog(&migrationAuditConfig{
+		Path:                 path,
+		MaxRecords:           2,
+		FlushIntervalSeconds: 1,
+	})
+
+	for i := 0; i < 3; i++ {
+		log.add(migrationRecord{ //nolint:exhaustruct // only the version matters for the test
+			Version: migrationRecordVersion,
+		})
+		if err := log.flush(zap.NewNop()); err != nil {
+			t.Fatalf("failed to flush: %s", err)
+		}
+	}
+
+	if n := len(readMigrationRecords(t, path+".1")); n != 2 {
+		t.Errorf("expected 2 records in rotated log, got %d", n)
+	}
+	if n := len(readMigrationRecords(t, path)); n != 1 {
+		t.Errorf("expected 1 record in current log, got %d", n)
+	}
+}
@@ -0,0 +1,113 @@
+package plugin
+
+// Buffering metrics sent by autoscaler-agents for pods that we don't know about yet. See
+// Config.OrphanMetrics.
+
+import (
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// orphanMetricsConfig configures how metrics for unknown pods are buffered
+type orphanMetricsConfig struct {
+	// MaxPods gives the maximum number of pods that we'll buffer metrics for at any one time.
+	// Metrics for additional pods are dropped until older entries expire.
+	MaxPods uint `json:"maxPods"`
+	// RetentionSeconds gives the duration, in seconds, after which buffered metrics are considered
+	// stale and discarded instead of being applied.
+	RetentionSeconds uint `json:"retentionSeconds"`
+}
+
+func (c *orphanMetricsConfig) validate() (string, error) {
+	if c.MaxPods == 0 {
+		return "maxPods", errors.New("value must be > 0")
+	}
+	if c.RetentionSeconds == 0 {
+		return "retentionSeconds", errors.New("value must be > 0")
+	}
+
+	return "", nil
+}
+
+func (c *orphanMetricsConfig) retention() time.Duration {
+	return time.Second * time.Duration(c.RetentionSeconds)
+}
+
+// orphanMetrics is a single buffered set of metrics, for a pod we didn't know about when they were
+// received
+type orphanMetrics struct {
+	metrics    api.Metrics
+	receivedAt time.Time
+}
+
+// bufferOrphanMetrics stores metrics received for a pod we don't know about, so that they can be
+// applied if the pod is registered shortly after. This can happen when the autoscaler-agent sees
+// the pod before we do, or after the scheduler restarts.
+//
+// This method does nothing if Config.OrphanMetrics is not set.
+//
+// This method expects the caller to be holding s.lock.
+func (s *pluginState) bufferOrphanMetrics(logger *zap.Logger, podName util.NamespacedName, metrics api.Metrics) {
+	if s.conf.OrphanMetrics == nil {
+		return
+	}
+
+	now := s.clock.Now()
+	s.expireOrphanMetrics(now)
+
+	if _, ok := s.orphanMetrics[podName]; !ok && uint(len(s.orphanMetrics)) >= s.conf.OrphanMetrics.MaxPods {
+		logger.Warn(
+			"Dropping metrics for unknown Pod, buffer is full",
+			zap.Uint("maxPods", s.conf.OrphanMetrics.MaxPods),
+		)
+		return
+	}
+
+	logger.Info("Buffering metrics for unknown Pod, in case it's registered later")
+	s.orphanMetrics[podName] = orphanMetrics{
+		metrics:    metrics,
+		receivedAt: now,
+	}
+}
+
+// applyOrphanMetrics sets the VM's metrics from any unexpired metrics buffered for the pod, removing
+// them from the buffer. vm is nil for non-VM pods, in which case buffered metrics are just dropped.
+//
+// This method does nothing if Config.OrphanMetrics is not set.
+//
+// This method expects the caller to be holding s.lock.
+func (s *pluginState) applyOrphanMetrics(logger *zap.Logger, podName util.NamespacedName, vm *vmPodState) {
+	if s.conf.OrphanMetrics == nil {
+		return
+	}
+
+	s.expireOrphanMetrics(s.clock.Now())
+
+	entry, ok := s.orphanMetrics[podName]
+	if !ok {
+		return
+	}
+	delete(s.orphanMetrics, podName)
+
+	if vm != nil {
+		logger.Info("Applying metrics received before the Pod was registered", zap.Time("receivedAt", entry.receivedAt))
+		vm.setMetrics(&entry.metrics, entry.receivedAt, 0)
+	}
+}
+
+// expireOrphanMetrics removes all buffered metrics older than Config.OrphanMetrics.RetentionSeconds
+//
+// This method expects the caller to be holding s.lock.
+func (s *pluginState) expireOrphanMetrics(now time.Time) {
+	retention := s.conf.OrphanMetrics.retention()
+	for podName, entry := range s.orphanMetrics {
+		if now.Sub(entry.receivedAt) >= retention {
+			delete(s.orphanMetrics, podName)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package plugin
+
+// Pausing the plugin's activity for maintenance. See Config.Pause.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"go.uber.org/zap"
+
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// pauseRequest is the body of requests to the "/pause" endpoint, and the response to them
+type pauseRequest struct {
+	Paused bool `json:"paused"`
+}
+
+// isPaused returns whether the plugin is currently paused
+//
+// While paused, we don't start any migrations and, if Config.Pause.RejectVMs is set, Filter rejects
+// all VM pods. Everything else continues as normal, so that our state is still accurate when
+// resumed.
+func (e *AutoscaleEnforcer) isPaused() bool {
+	return e.paused.Load()
+}
+
+// setPaused pauses or resumes the plugin, logging if that changes anything
+func (e *AutoscaleEnforcer) setPaused(logger *zap.Logger, paused bool) {
+	if e.paused.Swap(paused) == paused {
+		return
+	}
+
+	if paused {
+		logger.Warn("Pausing plugin, no migrations will be started until resumed")
+	} else {
+		logger.Info("Resuming plugin")
+	}
+}
+
+// startPauseServer starts the server for the "/pause" endpoint, on Config.Pause.Port
+//
+// Unlike the dump-state server, pausing changes what the plugin does, so the server only listens on
+// localhost.
+func (e *AutoscaleEnforcer) startPauseServer(logger *zap.Logger) error {
+	addr := net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(e.state.conf.Pause.Port)}
+	listener, err := net.ListenTCP("tcp", &addr)
+	if err != nil {
+		return fmt.Errorf("Error binding to %v", addr)
+	}
+
+	go func() {
+		mux := http.NewServeMux()
+		e.addPauseHandler(logger, mux)
+		server := &http.Server{Handler: mux}
+		if err := server.Serve(listener); err != nil {
+			logger.Error("pause server exited", zap.Error(err))
+		}
+	}()
+
+	return nil
+}
+
+// addPauseHandler adds the "/pause" endpoint to the mux, which pauses or resumes the plugin
+func (e *AutoscaleEnforcer) addPauseHandler(logger *zap.Logger, mux *http.ServeMux) {
+	util.AddHandler(logger, mux, "/pause", http.MethodPost, "pauseRequest", func(_ context.Context, logger *zap.Logger, req *pauseRequest) (*pauseRequest, int, error) {
+		e.setPaused(logger, req.Paused)
+		return &pauseRequest{Paused: e.isPaused()}, 200, nil
+	})
+}
@@ -0,0 +1,122 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/kubernetes/pkg/scheduler/framework"
+)
+
+func TestPauseEndpoint(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) {
+		conf.Pause = &pauseConfig{Paused: false, RejectVMs: false, Port: 10299}
+	})
+	e := makeTestEnforcer(conf)
+
+	mux := http.NewServeMux()
+	e.addPauseHandler(zap.NewNop(), mux)
+
+	for _, paused := range []bool{true, false} {
+		body := strings.NewReader(fmt.Sprintf(`{"paused": %t}`, paused))
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/pause", body))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+
+		var resp pauseRequest
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to decode response: %s", err)
+		}
+		if resp.Paused != paused || e.isPaused() != paused {
+			t.Errorf("expected paused = %v, got response %v and state %v", paused, resp.Paused, e.isPaused())
+		}
+	}
+}
+
+func TestPauseConfigPort(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) {
+		conf.DumpState = &dumpStateConfig{Port: 10298, TimeoutSeconds: 5}
+		conf.Pause = &pauseConfig{Paused: false, RejectVMs: false, Port: 10299}
+	})
+	if path, err := conf.validate(); err != nil {
+		t.Fatalf("invalid config at %s: %s", path, err)
+	}
+
+	// The pause server can't share a port with the dump-state server, because they listen on
+	// different addresses.
+	conf.Pause.Port = conf.DumpState.Port
+	if path, err := conf.validate(); err == nil || path != "pause.port" {
+		t.Errorf("expected error at pause.port, got error at %q: %v", path, err)
+	}
+}
+
+func TestPausedSkipsMigrations(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) {
+		conf.Pause = &pauseConfig{Paused: true, RejectVMs: true, Port: 0}
+	})
+
+	source := makeTestNodeState(conf.NodeConfig.vCpuLimits(resourcePtr("8")), conf.NodeConfig.memoryLimits(resourcePtr("32Gi")))
+	source.name = "source"
+	pod := addTestPod(source, "migrating", true, 2000, 4<<30)
+
+	target := makeTestNodeState(conf.NodeConfig.vCpuLimits(resourcePtr("8")), conf.NodeConfig.memoryLimits(resourcePtr("32Gi")))
+	target.name = "target"
+
+	e := makeTestEnforcer(conf, source, target)
+	e.setPaused(zap.NewNop(), conf.Pause.Paused)
+
+	// NB: e.vmClient is nil, so this would panic if it tried to create the migration.
+	e.state.lock.Lock()
+	created, err := e.startMigration(context.Background(), zap.NewNop(), pod)
+	e.state.lock.Unlock()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if created {
+		t.Error("expected migration to be skipped while paused")
+	}
+	if pod.vm.currentlyMigrating() || pod.vm.pendingMigrationTarget != "" {
+		t.Error("expected pod's migration state to be unchanged")
+	}
+
+	// VM pods should be rejected by Filter while paused. This happens before the VM store is
+	// accessed, which isn't set up here.
+	k8sNode := &corev1.Node{}
+	k8sNode.Name = target.name
+	nodeInfo := framework.NewNodeInfo()
+	nodeInfo.SetNode(k8sNode)
+
+	vmPod := &corev1.Pod{}
+	vmPod.Namespace = "default"
+	vmPod.Name = "new-vm"
+	vmPod.Spec.SchedulerName = conf.SchedulerName
+	vmPod.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: "vm.neon.tech/v1",
+		Kind:       "VirtualMachine",
+		Name:       "new-vm",
+	}}
+	if status := e.Filter(context.Background(), nil, vmPod, nodeInfo); status.Code() != framework.Unschedulable {
+		t.Errorf("expected VM pod to be rejected as unschedulable while paused, got %v", status)
+	}
+
+	// Accounting should still happen while paused
+	_, _, _, _ = e.unreserveResources(zap.NewNop(), pod.name, false)
+	if source.cpu.Reserved != 0 || source.mem.Reserved != 0 {
+		t.Errorf("expected pod's resources to be released while paused, got {%v, %v}", source.cpu.Reserved, source.mem.Reserved)
+	}
+
+	e.setPaused(zap.NewNop(), false)
+	if e.isPaused() {
+		t.Error("expected plugin to be resumed")
+	}
+}
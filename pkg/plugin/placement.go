@@ -0,0 +1,141 @@
+package plugin
+
+// Recording why each VM pod was placed on its node, as an annotation on the pod. See
+// Config.PlacementAnnotation.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"go.uber.org/zap"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/kubernetes/pkg/scheduler/framework"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// AnnotationPlacementReason is the annotation that PostBind sets on VM pods, when
+// Config.PlacementAnnotation is enabled, describing why the pod was placed on its node.
+const AnnotationPlacementReason = "autoscaling.neon.tech/placement-reason"
+
+// maxPlacementReasonLength is the maximum length of the AnnotationPlacementReason value. The
+// annotation only has a fixed set of fields, so it shouldn't be reached in practice.
+const maxPlacementReasonLength = 256
+
+var _ framework.PostBindPlugin = (*AutoscaleEnforcer)(nil)
+
+// placementReason is the information recorded by Score (and NormalizeScore) for each node, which
+// PostBind uses to build the AnnotationPlacementReason for the node the pod was bound to.
+type placementReason struct {
+	// Score is the score that Score gave the node
+	Score int64
+	// FinalScore is the score after NormalizeScore, which may be randomized. It's equal to Score if
+	// scores aren't randomized.
+	FinalScore int64
+
+	RemainingReservableCPU vmapi.MilliCPU
+	RemainingReservableMem api.Bytes
+}
+
+// Clone implements framework.StateData
+func (r *placementReason) Clone() framework.StateData {
+	c := *r
+	return &c
+}
+
+// placementReasonStateKey returns the CycleState key that the placementReason for the node is
+// stored under. Like nodeHeadroomStateKey, each node gets its own key.
+func placementReasonStateKey(nodeName string) framework.StateKey {
+	return framework.StateKey(fmt.Sprintf("%s/placement-reason/%s", Name, nodeName))
+}
+
+// readPlacementReason returns the placementReason recorded for the node, or nil if there isn't one
+func readPlacementReason(state *framework.CycleState, nodeName string) *placementReason {
+	if state == nil {
+		return nil
+	}
+	data, err := state.Read(placementReasonStateKey(nodeName))
+	if err != nil {
+		return nil
+	}
+	reason, _ := data.(*placementReason)
+	return reason
+}
+
+// format returns the value of the AnnotationPlacementReason annotation for the reason
+//
+// If reason is nil, the node wasn't scored. Typically that's because it was the only node that
+// passed Filter, in which case the scheduler skips scoring.
+//
+// The scheduler's name is always included, so that placements by different instances of the plugin
+// (e.g. a canary) can be told apart.
+func (r *placementReason) format(schedulerName string, randomized bool) string {
+	var s string
+	if r == nil {
+		s = fmt.Sprintf("not-scored scheduler=%s", schedulerName)
+	} else {
+		tiebreak := "none"
+		if randomized {
+			tiebreak = "randomized"
+		}
+		s = fmt.Sprintf(
+			"score=%d final=%d headroom-cpu=%v headroom-mem=%v tiebreak=%s scheduler=%s",
+			r.Score, r.FinalScore, r.RemainingReservableCPU, r.RemainingReservableMem, tiebreak, schedulerName,
+		)
+	}
+
+	if len(s) > maxPlacementReasonLength {
+		s = s[:maxPlacementReasonLength]
+	}
+	return s
+}
+
+// PostBind sets the AnnotationPlacementReason annotation on VM pods after they've been bound, if
+// Config.PlacementAnnotation is enabled. Failures are only logged, because the pod has already been
+// bound by the time we're called.
+//
+// Required for framework.PostBindPlugin
+func (e *AutoscaleEnforcer) PostBind(
+	ctx context.Context,
+	state *framework.CycleState,
+	pod *corev1.Pod,
+	nodeName string,
+) {
+	if !e.state.conf.PlacementAnnotation || e.tryPodOwnerVirtualMachine(pod) == nil {
+		return
+	}
+
+	ignored := e.state.conf.ignoredNamespace(pod.Namespace)
+	e.metrics.IncMethodCall("PostBind", ignored)
+
+	logger := e.logger.With(zap.String("method", "PostBind"), zap.String("node", nodeName), util.PodNameFields(pod))
+
+	reason := readPlacementReason(state, nodeName)
+	value := reason.format(e.state.conf.SchedulerName, e.state.conf.RandomizeScores)
+
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{
+				AnnotationPlacementReason: value,
+			},
+		},
+	})
+	if err != nil {
+		panic(fmt.Errorf("Error marshalling annotation patch: %w", err))
+	}
+
+	_, err = e.handle.ClientSet().CoreV1().Pods(pod.Namespace).
+		Patch(ctx, pod.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		logger.Error("Failed to set placement reason annotation on pod", zap.String("reason", value), zap.Error(err))
+		return
+	}
+
+	logger.Info("Set placement reason annotation on pod", zap.String("reason", value))
+}
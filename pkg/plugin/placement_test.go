@@ -0,0 +1,83 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/kubernetes/pkg/scheduler/framework"
+)
+
+// fakeClientHandle is a framework.Handle that only supports ClientSet()
+type fakeClientHandle struct {
+	framework.Handle
+	client kubernetes.Interface
+}
+
+func (h fakeClientHandle) ClientSet() kubernetes.Interface {
+	return h.client
+}
+
+func TestPlacementAnnotation(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		conf := makeTestConfig(t, func(conf *Config) {
+			conf.PlacementAnnotation = enabled
+		})
+
+		node := makeTestNodeState(
+			conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+			conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+		)
+		_ = addTestPod(node, "other", true, 3000, 12<<30)
+		e := makeTestEnforcer(conf, node)
+
+		pod := &corev1.Pod{}
+		pod.Namespace = "default"
+		pod.Name = "pod"
+		pod.Spec.SchedulerName = conf.SchedulerName
+
+		client := fake.NewSimpleClientset(pod.DeepCopy())
+		e.handle = fakeClientHandle{Handle: nil, client: client}
+
+		// Score the pod before it's owned by a VM, so that we don't need a VM store to look it up.
+		state := framework.NewCycleState()
+		score, status := e.Score(context.Background(), state, pod, node.name)
+		if !status.IsSuccess() {
+			t.Fatalf("unexpected Score failure: %v", status)
+		}
+
+		pod.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: "vm.neon.tech/v1",
+			Kind:       "VirtualMachine",
+			Name:       "vm",
+		}}
+		e.PostBind(context.Background(), state, pod, node.name)
+
+		updated, err := client.CoreV1().Pods(pod.Namespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("failed to get pod: %s", err)
+		}
+		value, ok := updated.Annotations[AnnotationPlacementReason]
+		if !enabled {
+			if ok {
+				t.Errorf("expected no annotation when disabled, got %q", value)
+			}
+			continue
+		}
+
+		expected := fmt.Sprintf(
+			"score=%d final=%d headroom-cpu=%v headroom-mem=%v tiebreak=none scheduler=%s",
+			score, score, node.cpu.Total-3000, node.mem.Total-12<<30, conf.SchedulerName,
+		)
+		if value != expected {
+			t.Errorf("expected annotation %q, got %q", expected, value)
+		}
+		if len(value) > maxPlacementReasonLength {
+			t.Errorf("annotation is longer than %d bytes: %q", maxPlacementReasonLength, value)
+		}
+	}
+}
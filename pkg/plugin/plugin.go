@@ -5,10 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"sync/atomic"
 	"time"
 
 	"github.com/tychoish/fun/pubsub"
 	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -30,12 +32,34 @@ const ConfigMapName = "scheduler-plugin-config"
 const ConfigMapKey = "autoscaler-enforcer-config.json"
 const InitConfigMapTimeoutSeconds = 5
 
+// AnnotationNoVMSchedule is the annotation that, when set to "true" on a Node, prevents new VM pods
+// from being scheduled onto it. Existing pods on the node are unaffected, as are non-VM pods.
+const AnnotationNoVMSchedule = "autoscaling.neon.tech/no-vm-schedule"
+
+// AnnotationMigrationTargetOnly is the annotation that, when set to "true" on a Node, reserves it for
+// the target pods of VM migrations: new VM pods are not scheduled onto it, but migration target pods
+// (which are owned by their VirtualMachineMigration) still are.
+const AnnotationMigrationTargetOnly = "autoscaling.neon.tech/migration-target-only"
+
+// AnnotationNodeExtraReservedCPU and AnnotationNodeExtraReservedMem are annotations that can be set
+// on a Node to hold back an additional amount of CPU or memory from VMs, on top of the usual
+// reserves. Their values are parsed as resource quantities (e.g. "500m" or "2Gi").
+const (
+	AnnotationNodeExtraReservedCPU = "autoscaling.neon.tech/extra-reserved-cpu"
+	AnnotationNodeExtraReservedMem = "autoscaling.neon.tech/extra-reserved-mem"
+)
+
+// AnnotationNodeScoreMultiplier is an annotation that can be set on a Node to multiply its score, as
+// a positive float. Values above 1 bias placement towards the node, and values below 1 away from
+// it. This allows e.g. nodes with faster CPUs to be filled first.
+const AnnotationNodeScoreMultiplier = "autoscaling.neon.tech/score-multiplier"
+
 // AutoscaleEnforcer is the scheduler plugin to coordinate autoscaling
 type AutoscaleEnforcer struct {
 	logger *zap.Logger
 
 	handle   framework.Handle
-	vmClient *vmclient.Clientset
+	vmClient vmclient.Interface
 	state    pluginState
 	metrics  PromMetrics
 
@@ -47,6 +71,21 @@ type AutoscaleEnforcer struct {
 	vmStore IndexedVMStore
 	// nodeStore is doing roughly the same thing as with vmStore, but for Nodes.
 	nodeStore IndexedNodeStore
+
+	// predicates are the custom checks evaluated in Filter, supplied to NewAutoscaleEnforcerPlugin
+	predicates []FilterPredicate
+
+	// migrationAudit records the migrations we observe. It's nil if Config.MigrationAudit is not set.
+	migrationAudit *migrationAuditLog
+
+	// auditLogger and debugLogger are the separate outputs configured by Config.Logging, or nil if
+	// not configured. Use auditLog and debugLog instead of accessing them directly.
+	auditLogger *zap.Logger
+	debugLogger *zap.Logger
+
+	// paused is whether the plugin is currently paused. Use isPaused and setPaused instead of
+	// accessing it directly.
+	paused atomic.Bool
 }
 
 // abbreviations, because these types are pretty verbose
@@ -61,9 +100,16 @@ var _ framework.FilterPlugin = (*AutoscaleEnforcer)(nil)
 var _ framework.ScorePlugin = (*AutoscaleEnforcer)(nil)
 var _ framework.ReservePlugin = (*AutoscaleEnforcer)(nil)
 
-func NewAutoscaleEnforcerPlugin(ctx context.Context, logger *zap.Logger, config *Config) func(runtime.Object, framework.Handle) (framework.Plugin, error) {
+// NewAutoscaleEnforcerPlugin returns the constructor for the AutoscaleEnforcer plugin, with any
+// custom predicates to evaluate in Filter.
+func NewAutoscaleEnforcerPlugin(
+	ctx context.Context,
+	logger *zap.Logger,
+	config *Config,
+	predicates ...FilterPredicate,
+) func(runtime.Object, framework.Handle) (framework.Plugin, error) {
 	return func(obj runtime.Object, h framework.Handle) (framework.Plugin, error) {
-		return makeAutoscaleEnforcerPlugin(ctx, logger, obj, h, config)
+		return makeAutoscaleEnforcerPlugin(ctx, logger, obj, h, config, predicates)
 	}
 }
 
@@ -75,6 +121,7 @@ func makeAutoscaleEnforcerPlugin(
 	_obj runtime.Object,
 	h framework.Handle,
 	config *Config,
+	predicates []FilterPredicate,
 ) (framework.Plugin, error) {
 	// obj can be used for taking in configuration. it's a bit tricky to figure out, and we don't
 	// quite need it yet.
@@ -93,6 +140,11 @@ func makeAutoscaleEnforcerPlugin(
 		return nil, fmt.Errorf("Error creating NeonVM client: %w", err)
 	}
 
+	auditLogger, debugLogger, err := config.Logging.buildLoggers()
+	if err != nil {
+		return nil, err
+	}
+
 	p := AutoscaleEnforcer{
 		logger: logger.Named("plugin"),
 
@@ -102,11 +154,33 @@ func makeAutoscaleEnforcerPlugin(
 		state: pluginState{ //nolint:exhaustruct // see above.
 			lock:                      util.NewChanMutex(),
 			ongoingMigrationDeletions: make(map[util.NamespacedName]int),
+			orphanMetrics:             make(map[util.NamespacedName]orphanMetrics),
 			conf:                      config,
+			clock:                     realClock{},
 		},
 		metrics:   PromMetrics{},      //nolint:exhaustruct // set by makePrometheusRegistry
 		vmStore:   IndexedVMStore{},   //nolint:exhaustruct // set below
 		nodeStore: IndexedNodeStore{}, //nolint:exhaustruct // set below
+
+		predicates: predicates,
+
+		migrationAudit: newMigrationAuditLog(config.MigrationAudit),
+
+		auditLogger: auditLogger,
+		debugLogger: debugLogger,
+
+		paused: atomic.Bool{},
+	}
+
+	if config.Pause != nil && config.Pause.Paused {
+		p.setPaused(logger, true)
+	}
+
+	if config.Pause != nil && config.Pause.Port != 0 {
+		logger.Info("Starting 'pause' server")
+		if err := p.startPauseServer(logger.Named("pause")); err != nil {
+			return nil, fmt.Errorf("Error starting 'pause' server: %w", err)
+		}
 	}
 
 	if p.state.conf.DumpState != nil {
@@ -129,6 +203,9 @@ func makeAutoscaleEnforcerPlugin(
 		submitNodeDeletion: func(logger *zap.Logger, nodeName string) {
 			pushToQueue(logger, func() { p.handleNodeDeletion(hlogger, nodeName) })
 		},
+		submitNodeUpdate: func(logger *zap.Logger, node *corev1.Node) {
+			pushToQueue(logger, func() { p.handleNodeUpdate(hlogger, node) })
+		},
 	}
 	pwc := podWatchCallbacks{
 		submitStarted: func(logger *zap.Logger, pod *corev1.Pod) {
@@ -156,7 +233,11 @@ func makeAutoscaleEnforcerPlugin(
 		},
 	}
 	mwc := migrationWatchCallbacks{
+		submitPhaseChanged: func(logger *zap.Logger, vmm *vmapi.VirtualMachineMigration) {
+			pushToQueue(logger, func() { p.handleMigrationPhaseChanged(hlogger, vmm) })
+		},
 		submitMigrationFinished: func(vmm *vmapi.VirtualMachineMigration) {
+			pushToQueue(hlogger, func() { p.handleMigrationFinished(hlogger, vmm) })
 			// When cleaning up migrations, we don't want to process those events synchronously.
 			// So instead, we'll spawn a goroutine to delete the completed migration.
 			go p.cleanupMigration(hlogger, vmm)
@@ -225,6 +306,107 @@ func makeAutoscaleEnforcerPlugin(
 		return nil, fmt.Errorf("permit handler: %w", err)
 	}
 
+	if config.MigrationTimeoutSeconds != 0 {
+		go func() {
+			logger := logger.Named("migration-timeouts")
+			// Check a few times per timeout period, so that we notice within a reasonable time
+			// after the timeout's elapsed.
+			interval := time.Second * time.Duration(config.MigrationTimeoutSeconds) / 4
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					p.checkMigrationTimeouts(logger, p.state.clock.Now())
+				}
+			}
+		}()
+	}
+
+	if config.PressureAccountingCheck != nil {
+		go func() {
+			logger := logger.Named("pressure-accounting")
+			ticker := time.NewTicker(time.Second * time.Duration(config.PressureAccountingCheck.IntervalSeconds))
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					p.checkPressureAccounting(logger)
+				}
+			}
+		}()
+	}
+
+	if config.VerdictSummary != nil {
+		go func() {
+			logger := logger.Named("verdict-summary")
+			ticker := time.NewTicker(time.Second * time.Duration(config.VerdictSummary.IntervalSeconds))
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					p.flushVerdictSummaries(logger)
+				}
+			}
+		}()
+	}
+
+	if config.MigrationAudit != nil {
+		go func() {
+			logger := logger.Named("migration-audit")
+			ticker := time.NewTicker(time.Second * time.Duration(config.MigrationAudit.FlushIntervalSeconds))
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					// Write anything that's left before we exit
+					p.flushMigrationAudit(logger)
+					return
+				case <-ticker.C:
+					p.flushMigrationAudit(logger)
+				}
+			}
+		}()
+	}
+
+	if config.ShutdownSummary != nil {
+		go p.logSummaryOnShutdown(ctx, logger.Named("shutdown-summary"))
+	}
+
+	if config.IdleNodeStateExpirySeconds != 0 {
+		go func() {
+			logger := logger.Named("idle-nodes")
+			// As with migration timeouts, check a few times per expiry period.
+			interval := time.Second * time.Duration(config.IdleNodeStateExpirySeconds) / 4
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					p.evictIdleNodes(logger, p.state.clock.Now())
+				}
+			}
+		}()
+	}
+
+	if config.MetricsScraping != nil {
+		logger.Info("Starting VM metrics scraper")
+		go p.runMetricsScraper(ctx, logger.Named("metrics-scraper"))
+	}
+
 	// Periodically check that we're not deadlocked
 	go func() {
 		defer func() {
@@ -247,12 +429,32 @@ func (e *AutoscaleEnforcer) Name() string {
 	return Name
 }
 
+// tryPodOwnerVirtualMachine is like util.TryPodOwnerVirtualMachine, but also returns nil if the pod
+// belongs to a different scheduler.
+//
+// VM pods belonging to other schedulers are treated the same as non-VM pods: we still count their
+// resources, so that we don't overcommit the node, but we don't track any VM-specific state for
+// them, so we'll never handle autoscaler-agent requests for them or try to migrate them.
+func (e *AutoscaleEnforcer) tryPodOwnerVirtualMachine(pod *corev1.Pod) *util.NamespacedName {
+	if pod.Spec.SchedulerName != e.state.conf.SchedulerName {
+		return nil
+	}
+	return util.TryPodOwnerVirtualMachine(pod)
+}
+
 // getVmInfo is a helper for the plugin-related functions
 //
-// This function returns nil, nil if the pod is not associated with a NeonVM virtual machine.
+// This function returns nil, nil if the pod is not associated with a NeonVM virtual machine, or if
+// the pod belongs to a different scheduler.
 func (e *AutoscaleEnforcer) getVmInfo(logger *zap.Logger, pod *corev1.Pod, action string) (*api.VmInfo, error) {
-	vmName := util.TryPodOwnerVirtualMachine(pod)
+	vmName := e.tryPodOwnerVirtualMachine(pod)
 	if vmName == nil {
+		if util.TryPodOwnerVirtualMachine(pod) != nil {
+			logger.Info(
+				"Treating VM Pod as non-VM because it belongs to a different scheduler",
+				zap.String("schedulerName", pod.Spec.SchedulerName),
+			)
+		}
 		return nil, nil
 	}
 
@@ -322,6 +524,18 @@ func (e *AutoscaleEnforcer) checkSchedulerName(logger *zap.Logger, pod *corev1.P
 	return nil
 }
 
+// nodeExcludedFromVMs returns whether the node has the AnnotationNoVMSchedule annotation set, and
+// so should not have any new VM pods scheduled onto it.
+func nodeExcludedFromVMs(node *corev1.Node) bool {
+	return node.Annotations[AnnotationNoVMSchedule] == "true"
+}
+
+// nodeMigrationTargetOnly returns whether the node has the AnnotationMigrationTargetOnly annotation
+// set, and so should only have migration target pods scheduled onto it.
+func nodeMigrationTargetOnly(node *corev1.Node) bool {
+	return node.Annotations[AnnotationMigrationTargetOnly] == "true"
+}
+
 // PreFilter is called at the start of any Pod's filter cycle. We use it in combination with
 // PostFilter (which is only called on failure) to provide metrics for pods that are rejected by
 // this process.
@@ -398,6 +612,14 @@ func (e *AutoscaleEnforcer) Filter(
 		logger.Warn("Received Filter request for pod in ignored namespace, continuing anyways.")
 	}
 
+	// Check whether the node accepts VM pods at all before anything else. We use the Node object
+	// given to us by the scheduler, so that changes to its annotations take effect immediately.
+	isVM := e.tryPodOwnerVirtualMachine(pod) != nil
+	isMigrationTarget := util.TryPodOwnerVirtualMachineMigration(pod) != nil
+	if status := e.checkNodeAcceptsVMs(logger, nodeInfo.Node(), isVM, isMigrationTarget); status != nil {
+		return status
+	}
+
 	vmInfo, err := e.getVmInfo(logger, pod, "Filter")
 	if err != nil {
 		logger.Error("Error getting VM info for Pod", zap.Error(err))
@@ -413,6 +635,7 @@ func (e *AutoscaleEnforcer) Filter(
 	} else {
 		podResources = extractPodResources(pod)
 	}
+	podExtended := extractPodExtendedResources(pod, e.state.conf.ExtendedResources)
 
 	// Check that the SchedulerName matches what we're expecting
 	if status := e.checkSchedulerName(logger, pod); status != nil {
@@ -453,11 +676,25 @@ func (e *AutoscaleEnforcer) Filter(
 
 	var includedIgnoredPods []util.NamespacedName
 
+	// If some of the node is reserved for a particular tenant, we also need to know how much of
+	// that the tenant's pods are using.
+	var tenantTotal api.Resources
+
+	// ... and similarly for any extended resources that we're tracking.
+	nodeExtended := make(map[corev1.ResourceName]uint64)
+
 	for _, podInfo := range nodeInfo.Pods {
 		pn := util.NamespacedName{Name: podInfo.Pod.Name, Namespace: podInfo.Pod.Namespace}
 		if podState, ok := e.state.pods[pn]; ok {
 			nodeTotal.VCPU += podState.cpu.Reserved
 			nodeTotal.Mem += podState.mem.Reserved
+			for name, state := range podState.extended {
+				nodeExtended[name] += state.Reserved
+			}
+			if e.state.conf.tenantMatches(podInfo.Pod.Labels) {
+				tenantTotal.VCPU += podState.cpu.Reserved
+				tenantTotal.Mem += podState.mem.Reserved
+			}
 			delete(missedPods, pn)
 		} else {
 			name := util.GetNamespacedName(podInfo.Pod)
@@ -488,6 +725,13 @@ func (e *AutoscaleEnforcer) Filter(
 			resources := extractPodResources(podInfo.Pod)
 			nodeTotal.VCPU += resources.VCPU
 			nodeTotal.Mem += resources.Mem
+			for name, amount := range extractPodExtendedResources(podInfo.Pod, e.state.conf.ExtendedResources) {
+				nodeExtended[name] += amount
+			}
+			if e.state.conf.tenantMatches(podInfo.Pod.Labels) {
+				tenantTotal.VCPU += resources.VCPU
+				tenantTotal.Mem += resources.Mem
+			}
 		}
 	}
 
@@ -499,8 +743,126 @@ func (e *AutoscaleEnforcer) Filter(
 		logger.Warn("Some known Pods weren't included in Filter NodeInfo", zap.Objects("missedPods", missedPodsList))
 	}
 
+	return e.checkNodeFits(
+		logger.With(zap.Objects("includedIgnoredPods", includedIgnoredPods)),
+		nodeInfo.Node(),
+		node,
+		filterPod{
+			PredicatePod: PredicatePod{Pod: pod, VM: vmInfo, Resources: podResources},
+			extended:     podExtended,
+			isTenantPod:  e.state.conf.tenantMatches(pod.Labels),
+		},
+		nodeUsage{
+			reserved:      nodeTotal,
+			tenant:        tenantTotal,
+			extended:      nodeExtended,
+			vmCount:       node.vmCount(),
+			noisyNeighbor: node.hasNoisyNeighbor(e.state.conf),
+		},
+	)
+}
+
+// checkNodeAcceptsVMs returns a status rejecting the pod if it's a VM pod and the node doesn't
+// currently accept VM pods, either because of the node's annotations or because the plugin is
+// paused with Config.Pause.RejectVMs. Otherwise, it returns nil.
+//
+// These checks only depend on the Node object and the config, so Filter makes them before
+// anything else.
+func (e *AutoscaleEnforcer) checkNodeAcceptsVMs(
+	logger *zap.Logger,
+	node *corev1.Node,
+	isVM bool,
+	isMigrationTarget bool,
+) *framework.Status {
+	if !isVM {
+		return nil
+	}
+
+	if nodeExcludedFromVMs(node) {
+		logger.Warn(
+			"Rejecting VM Pod, node is excluded from VM scheduling",
+			zap.String("annotation", AnnotationNoVMSchedule),
+		)
+		return framework.NewStatus(framework.Unschedulable, "Node is excluded from VM scheduling")
+	}
+
+	// Similarly, nodes held for migration targets only accept VM pods that are the target of a
+	// migration.
+	if !isMigrationTarget && nodeMigrationTargetOnly(node) {
+		logger.Warn(
+			"Rejecting VM Pod, node is reserved for migration targets",
+			zap.String("annotation", AnnotationMigrationTargetOnly),
+		)
+		return framework.NewStatus(framework.Unschedulable, "Node is reserved for migration targets")
+	}
+
+	if e.isPaused() && e.state.conf.Pause != nil && e.state.conf.Pause.RejectVMs {
+		logger.Warn("Rejecting VM Pod, plugin is paused")
+		return framework.NewStatus(framework.Unschedulable, "Plugin is paused for maintenance")
+	}
+
+	return nil
+}
+
+// filterPod is the information about a pod that checkNodeFits needs
+type filterPod struct {
+	PredicatePod
+	// extended gives the amount of each of Config.ExtendedResources requested by the pod
+	extended map[corev1.ResourceName]uint64
+	// isTenantPod is whether the pod belongs to the tenant with reserved resources, if there is one.
+	// See Config.TenantReservation.
+	isTenantPod bool
+}
+
+// nodeUsage is what's already in use on a node, for checkNodeFits
+//
+// In Filter, the reserved resources are counted from the pods that the scheduler gave us, which may
+// not match our own state.
+type nodeUsage struct {
+	reserved api.Resources
+	// tenant is the part of reserved that's used by pods belonging to the tenant with reserved
+	// resources
+	tenant   api.Resources
+	extended map[corev1.ResourceName]uint64
+	// vmCount is the number of VM pods on the node
+	vmCount int
+	// noisyNeighbor is whether any of the non-VM pods on the node match Config.NoisyNeighbors
+	noisyNeighbor bool
+}
+
+// checkNodeFits makes the rest of Filter's checks, once we know the node's state and usage: the
+// limit on the number of VMs, noisy neighbors, whether there's room for the pod's resources, and
+// any custom predicates. It returns nil if the pod may be placed on the node.
+//
+// The node's state is only used for its totals, reserved amounts given to custom predicates, and
+// other fields that don't change with the pods on the node, so a copy may be used.
+func (e *AutoscaleEnforcer) checkNodeFits(
+	logger *zap.Logger,
+	k8sNode *corev1.Node,
+	node *nodeState,
+	pod filterPod,
+	usage nodeUsage,
+) *framework.Status {
+	conf := e.state.conf
+
+	// Independent of resources, check that there's room for another VM on the node.
+	if pod.VM != nil && conf.vmCountLimitReached(usage.vmCount) {
+		logger.Warn(
+			"Rejecting VM Pod, node has reached maximum VM count",
+			zap.Int("vmCount", usage.vmCount),
+			zap.Uint("maxVMsPerNode", conf.MaxVMsPerNode),
+		)
+		return framework.NewStatus(framework.Unschedulable, "Node has reached the maximum number of VMs")
+	}
+
+	// ... and that the node isn't running any non-VM pods that we've been told to keep VMs away from.
+	if pod.VM != nil && conf.NoisyNeighbors != nil && conf.NoisyNeighbors.Reject && usage.noisyNeighbor {
+		logger.Warn("Rejecting VM Pod, node has a noisy non-VM Pod")
+		return framework.NewStatus(framework.Unschedulable, "Node has a noisy non-VM pod")
+	}
+
 	var kind string
-	if vmInfo != nil {
+	if pod.VM != nil {
 		kind = "VM"
 	} else {
 		kind = "non-VM"
@@ -515,23 +877,54 @@ func (e *AutoscaleEnforcer) Filter(
 
 	allowing := true
 
+	// Pods that don't belong to the tenant with reserved resources (if there is one) can't use the
+	// part of the reservation that's not yet in use.
+	nodeMax := node.maxReservableFor(pod.isTenantPod, usage.tenant)
+	// ... and no new pods can use the growth reserve, which is kept for the pods already on the node.
+	growthReserve := conf.growthReserve(node.cpu.Total, node.mem.Total)
+	nodeMax.VCPU = util.SaturatingSub(nodeMax.VCPU, growthReserve.VCPU)
+	nodeMax.Mem = util.SaturatingSub(nodeMax.Mem, growthReserve.Mem)
+
 	var cpuCompare string
-	if nodeTotal.VCPU+podResources.VCPU > node.cpu.Total {
+	if usage.reserved.VCPU+pod.Resources.VCPU > nodeMax.VCPU {
 		cpuCompare = ">"
 		allowing = false
 	} else {
 		cpuCompare = "<="
 	}
-	cpuMsg := makeMsg("vCPU", cpuCompare, nodeTotal.VCPU, podResources.VCPU, node.cpu.Total)
+	cpuMsg := makeMsg("vCPU", cpuCompare, usage.reserved.VCPU, pod.Resources.VCPU, nodeMax.VCPU)
 
 	var memCompare string
-	if nodeTotal.Mem+podResources.Mem > node.mem.Total {
+	if usage.reserved.Mem+pod.Resources.Mem > nodeMax.Mem {
 		memCompare = ">"
 		allowing = false
 	} else {
 		memCompare = "<="
 	}
-	memMsg := makeMsg("vCPU", memCompare, nodeTotal.Mem, podResources.Mem, node.mem.Total)
+	memMsg := makeMsg("vCPU", memCompare, usage.reserved.Mem, pod.Resources.Mem, nodeMax.Mem)
+
+	// Go through the extended resources in a fixed order, so that the verdicts are stable.
+	extendedNames := make([]corev1.ResourceName, 0, len(pod.extended))
+	for name := range pod.extended {
+		extendedNames = append(extendedNames, name)
+	}
+	slices.Sort(extendedNames)
+
+	var extendedMsgs []string
+	for _, name := range extendedNames {
+		podUse := pod.extended[name]
+		nodeUse := usage.extended[name]
+		nodeMax := node.extendedTotal(name)
+
+		var compare string
+		if nodeUse+podUse > nodeMax {
+			compare = ">"
+			allowing = false
+		} else {
+			compare = "<="
+		}
+		extendedMsgs = append(extendedMsgs, makeMsg(string(name), compare, nodeUse, podUse, nodeMax))
+	}
 
 	var message string
 	var logFunc func(string, ...zap.Field)
@@ -545,18 +938,137 @@ func (e *AutoscaleEnforcer) Filter(
 
 	logFunc(
 		message,
-		zap.Objects("includedIgnoredPods", includedIgnoredPods),
 		zap.Object("verdict", verdictSet{
 			cpu: cpuMsg,
 			mem: memMsg,
 		}),
+		zap.Strings("extendedVerdicts", extendedMsgs),
 	)
 
 	if !allowing {
 		return framework.NewStatus(framework.Unschedulable, "Not enough resources for pod")
-	} else {
-		return nil
 	}
+
+	return e.checkFilterPredicates(
+		logger,
+		pod.PredicatePod,
+		PredicateNode{
+			Node:             k8sNode,
+			NodeGroup:        node.nodeGroup,
+			AvailabilityZone: node.availabilityZone,
+			Total:            api.Resources{VCPU: node.cpu.Total, Mem: node.mem.Total},
+			Reserved:         api.Resources{VCPU: node.cpu.Reserved, Mem: node.mem.Reserved},
+			VMCount:          usage.vmCount,
+		},
+	)
+}
+
+// FilterPredicate is a custom check that's evaluated in Filter, after the built-in checks have
+// passed. Predicates are supplied to NewAutoscaleEnforcerPlugin, so that deployment-specific
+// placement constraints (e.g. licensing limits or CPU model requirements) can be kept out of the
+// plugin itself.
+type FilterPredicate struct {
+	// Name identifies the predicate in logs
+	Name string
+	// Check returns whether the pod may be placed on the node. A nil or successful status allows
+	// it. Any other status rejects the pod, and is returned from Filter as-is.
+	//
+	// Check is called while holding the plugin's state lock, so it must not block. It must not
+	// modify any of its arguments.
+	Check func(pod PredicatePod, node PredicateNode) *framework.Status
+}
+
+// PredicatePod is the information about a pod that's given to a FilterPredicate
+type PredicatePod struct {
+	Pod *corev1.Pod
+	// VM is the information about the pod's VM, or nil if it's not a VM pod
+	VM *api.VmInfo
+	// Resources is the amount of CPU and memory that would be reserved for the pod
+	Resources api.Resources
+}
+
+// PredicateNode is the information about a node that's given to a FilterPredicate, taken from the
+// plugin's state for the node
+type PredicateNode struct {
+	Node             *corev1.Node
+	NodeGroup        string
+	AvailabilityZone string
+	// Total is the amount of CPU and memory that may be reserved on the node
+	Total api.Resources
+	// Reserved is the amount of CPU and memory currently reserved by pods on the node
+	Reserved api.Resources
+	// VMCount is the number of VM pods on the node
+	VMCount int
+}
+
+// checkFilterPredicates evaluates the custom predicates in order, returning the status from the
+// first one to reject the pod, or nil if none do.
+func (e *AutoscaleEnforcer) checkFilterPredicates(
+	logger *zap.Logger,
+	pod PredicatePod,
+	node PredicateNode,
+) *framework.Status {
+	for _, p := range e.predicates {
+		if status := p.Check(pod, node); !status.IsSuccess() {
+			logger.Warn(
+				"Rejecting Pod, custom predicate failed",
+				zap.String("predicate", p.Name),
+				zap.String("reason", status.Message()),
+			)
+			return status
+		}
+	}
+	return nil
+}
+
+// NodeHeadroom is the raw headroom on a candidate node, as computed by Score. It's only recorded if
+// ExposeScoreHeadroom is set in the config.
+//
+// NodeHeadroom implements framework.StateData, and can be fetched from the CycleState with
+// ReadNodeHeadroom.
+type NodeHeadroom struct {
+	Node string `json:"node"`
+
+	RemainingReservableCPU vmapi.MilliCPU `json:"remainingReservableCPU"`
+	RemainingReservableMem api.Bytes      `json:"remainingReservableMem"`
+	TotalCPU               vmapi.MilliCPU `json:"totalCPU"`
+	TotalMem               api.Bytes      `json:"totalMem"`
+
+	CapacityPressureCPU vmapi.MilliCPU `json:"capacityPressureCPU"`
+	CapacityPressureMem api.Bytes      `json:"capacityPressureMem"`
+	// TooMuchPressure is whether the node had too much pressure (i.e., we'd want to migrate VMs
+	// away from it) the last time it was checked.
+	TooMuchPressure bool `json:"tooMuchPressure"`
+}
+
+// Clone implements framework.StateData
+func (h *NodeHeadroom) Clone() framework.StateData {
+	c := *h
+	return &c
+}
+
+// nodeHeadroomStateKey returns the CycleState key that the NodeHeadroom for the node is stored
+// under. Each node gets its own key because Score may be called for multiple nodes in parallel.
+func nodeHeadroomStateKey(nodeName string) framework.StateKey {
+	return framework.StateKey(fmt.Sprintf("%s/headroom/%s", Name, nodeName))
+}
+
+// ReadNodeHeadroom returns the NodeHeadroom recorded by Score for the node during the current
+// scheduling cycle
+//
+// An error is returned if there isn't one, e.g. because ExposeScoreHeadroom isn't enabled or the
+// node wasn't scored.
+func ReadNodeHeadroom(state *framework.CycleState, nodeName string) (*NodeHeadroom, error) {
+	data, err := state.Read(nodeHeadroomStateKey(nodeName))
+	if err != nil {
+		return nil, err
+	}
+
+	headroom, ok := data.(*NodeHeadroom)
+	if !ok {
+		return nil, fmt.Errorf("unexpected type %T for node headroom", data)
+	}
+	return headroom, nil
 }
 
 // Score allows our plugin to express which nodes should be preferred for scheduling new pods onto
@@ -587,8 +1099,6 @@ func (e *AutoscaleEnforcer) Score(
 	logger := e.logger.With(zap.String("method", "Score"), zap.String("node", nodeName), util.PodNameFields(pod))
 	logger.Info("Handling Score request")
 
-	scoreLen := framework.MaxNodeScore - framework.MinNodeScore
-
 	// Double-check that the SchedulerName matches what we're expecting
 	if status := e.checkSchedulerName(logger, pod); status != nil {
 		return framework.MinNodeScore, status
@@ -608,8 +1118,13 @@ func (e *AutoscaleEnforcer) Score(
 	// Score by total resources available:
 	node, err := e.state.getOrFetchNodeState(ctx, logger, e.metrics, e.nodeStore, nodeName)
 	if err != nil {
-		logger.Error("Error getting node state", zap.Error(err))
-		return 0, framework.NewStatus(framework.Error, "Error fetching state for node")
+		// Failing here would fail the entire scheduling cycle, even though the other nodes can
+		// still be scored. So instead, we give the node the minimum score and carry on. If the
+		// failure persists, Reserve will reject the pod for this node anyways.
+		score := framework.MinNodeScore
+		logger.Error("Error getting node state, giving minimum score", zap.Int64("score", score), zap.Error(err))
+		e.metrics.nodeFetchFails.WithLabelValues("Score").Inc()
+		return score, nil
 	}
 
 	var resources api.Resources
@@ -619,6 +1134,27 @@ func (e *AutoscaleEnforcer) Score(
 		resources = extractPodResources(pod)
 	}
 
+	if e.state.conf.ExposeScoreHeadroom && state != nil {
+		state.Write(nodeHeadroomStateKey(nodeName), &NodeHeadroom{
+			Node:                   nodeName,
+			RemainingReservableCPU: node.remainingReservableCPU(),
+			RemainingReservableMem: node.remainingReservableMem(),
+			TotalCPU:               node.cpu.Total,
+			TotalMem:               node.mem.Total,
+			CapacityPressureCPU:    node.cpu.CapacityPressure,
+			CapacityPressureMem:    node.mem.CapacityPressure,
+			TooMuchPressure:        node.inTooMuchPressure,
+		})
+	}
+
+	// Special case: return minimum score if the node's been cordoned. The default scheduler plugins
+	// typically filter these out before we get here.
+	if node.unschedulable {
+		score := framework.MinNodeScore
+		logger.Info("Node is unschedulable, giving minimum score", zap.Int64("score", score))
+		return score, nil
+	}
+
 	// Special case: return minimum score if we don't have room
 	noRoom := resources.VCPU > node.remainingReservableCPU() ||
 		resources.Mem > node.remainingReservableMem()
@@ -628,6 +1164,42 @@ func (e *AutoscaleEnforcer) Score(
 		return score, nil
 	}
 
+	noisyNeighbor := vmInfo != nil && node.hasNoisyNeighbor(e.state.conf)
+	maxTotal := api.Resources{VCPU: e.state.maxTotalReservableCPU, Mem: e.state.maxTotalReservableMem}
+	score, verdict := scoreNode(e.state.conf, node, resources, noisyNeighbor, maxTotal, e.state.clock.Now())
+
+	if e.state.conf.PlacementAnnotation && state != nil {
+		state.Write(placementReasonStateKey(nodeName), &placementReason{
+			Score:                  score,
+			FinalScore:             score,
+			RemainingReservableCPU: node.remainingReservableCPU(),
+			RemainingReservableMem: node.remainingReservableMem(),
+		})
+	}
+
+	logger.Info("Scored pod placement for node", zap.Int64("score", score), zap.Object("verdict", verdict))
+
+	return score, nil
+}
+
+// scoreNode returns the score for placing a pod with the given resources on the node, assuming
+// that there's room for it, along with a summary of how the score was calculated, for logging.
+//
+// noisyNeighbor gives whether the pod is a VM pod and the node has a non-VM pod matching
+// Config.NoisyNeighbors. maxTotal is the largest total CPU and memory of any node, which scores are
+// scaled by.
+//
+// If Config.ScorePressure is set, this updates the node's capacityPressureAvg.
+func scoreNode(
+	conf *Config,
+	node *nodeState,
+	resources api.Resources,
+	noisyNeighbor bool,
+	maxTotal api.Resources,
+	now time.Time,
+) (int64, verdictSet) {
+	scoreLen := framework.MaxNodeScore - framework.MinNodeScore
+
 	cpuRemaining := node.remainingReservableCPU()
 	cpuTotal := node.cpu.Total
 	memRemaining := node.remainingReservableMem()
@@ -635,13 +1207,34 @@ func (e *AutoscaleEnforcer) Score(
 
 	cpuFraction := 1 - cpuRemaining.AsFloat64()/cpuTotal.AsFloat64()
 	memFraction := 1 - memRemaining.AsFloat64()/memTotal.AsFloat64()
-	cpuScale := node.cpu.Total.AsFloat64() / e.state.maxTotalReservableCPU.AsFloat64()
-	memScale := node.mem.Total.AsFloat64() / e.state.maxTotalReservableMem.AsFloat64()
+	cpuScale := node.cpu.Total.AsFloat64() / maxTotal.VCPU.AsFloat64()
+	memScale := node.mem.Total.AsFloat64() / maxTotal.Mem.AsFloat64()
+
+	// If configured, penalize the node for its capacityPressure. With no penalty, the pressure
+	// fractions are zero.
+	var cpuPressure, memPressure float64
+	if conf.ScorePressure != nil {
+		node.updateCapacityPressureAvg(conf, now)
+		cpuPressure, memPressure = node.blendedCapacityPressure(conf.ScorePressure)
+		cpuPressure = util.Min(1, cpuPressure/cpuTotal.AsFloat64())
+		memPressure = util.Min(1, memPressure/memTotal.AsFloat64())
+	}
+
+	// If configured, penalize the node if placing the pod would leave it with less than the minimum
+	// headroom. With no minimum, the penalty is zero.
+	penalty := conf.MinScoreHeadroom.penalty(cpuRemaining-resources.VCPU, memRemaining-resources.Mem)
 
-	nodeConf := e.state.conf.NodeConfig
+	// ... and similarly, penalize VM pods being placed next to noisy non-VM pods. Both penalties
+	// are combined into one, so that they can't take the score below zero.
+	if noisyNeighbor {
+		noisyPenalty := conf.NoisyNeighbors.penalty(true)
+		penalty = 1 - (1-penalty)*(1-noisyPenalty)
+	}
+
+	nodeConf := conf.NodeConfig
 
 	// Refer to the comments in nodeConfig for more. Also, see: https://www.desmos.com/calculator/wg8s0yn63s
-	calculateScore := func(fraction, scale float64) (float64, int64) {
+	calculateScore := func(fraction, scale, pressure, penalty float64) (float64, int64) {
 		y0 := nodeConf.MinUsageScore
 		y1 := nodeConf.MaxUsageScore
 		xp := nodeConf.ScorePeak
@@ -653,31 +1246,25 @@ func (e *AutoscaleEnforcer) Score(
 			score = y1 + (1-y1)/(1-xp)*(1-fraction)
 		}
 
-		score *= scale
+		score *= scale * (1 - pressure) * (1 - penalty) * node.scoreMultiplier
 
-		return score, framework.MinNodeScore + int64(float64(scoreLen)*score)
+		// With a score multiplier above 1, the score may be more than the maximum.
+		return score, util.Min(framework.MaxNodeScore, framework.MinNodeScore+int64(float64(scoreLen)*score))
 	}
 
-	cpuFScore, cpuIScore := calculateScore(cpuFraction, cpuScale)
-	memFScore, memIScore := calculateScore(memFraction, memScale)
-
-	score := util.Min(cpuIScore, memIScore)
-	logger.Info(
-		"Scored pod placement for node",
-		zap.Int64("score", score),
-		zap.Object("verdict", verdictSet{
-			cpu: fmt.Sprintf(
-				"%d remaining reservable of %d total => fraction=%g, scale=%g => score=(%g :: %d)",
-				cpuRemaining, cpuTotal, cpuFraction, cpuScale, cpuFScore, cpuIScore,
-			),
-			mem: fmt.Sprintf(
-				"%d remaining reservable of %d total => fraction=%g, scale=%g => score=(%g :: %d)",
-				memRemaining, memTotal, memFraction, memScale, memFScore, memIScore,
-			),
-		}),
-	)
-
-	return score, nil
+	cpuFScore, cpuIScore := calculateScore(cpuFraction, cpuScale, cpuPressure, penalty)
+	memFScore, memIScore := calculateScore(memFraction, memScale, memPressure, penalty)
+
+	return util.Min(cpuIScore, memIScore), verdictSet{
+		cpu: fmt.Sprintf(
+			"%d remaining reservable of %d total => fraction=%g, scale=%g, pressure=%g, penalty=%g, multiplier=%g => score=(%g :: %d)",
+			cpuRemaining, cpuTotal, cpuFraction, cpuScale, cpuPressure, penalty, node.scoreMultiplier, cpuFScore, cpuIScore,
+		),
+		mem: fmt.Sprintf(
+			"%d remaining reservable of %d total => fraction=%g, scale=%g, pressure=%g, penalty=%g, multiplier=%g => score=(%g :: %d)",
+			memRemaining, memTotal, memFraction, memScale, memPressure, penalty, node.scoreMultiplier, memFScore, memIScore,
+		),
+	}
 }
 
 // NormalizeScore weights scores uniformly in the range [minScore, trueScore], where
@@ -725,6 +1312,10 @@ func (e *AutoscaleEnforcer) NormalizeScore(
 			zap.Int64("trueScore", nodeScore),
 		)
 		node.Score = newScore
+
+		if reason := readPlacementReason(state, nodeName); reason != nil {
+			reason.FinalScore = newScore
+		}
 	}
 	return nil
 }
@@ -784,7 +1375,8 @@ func (e *AutoscaleEnforcer) Reserve(
 		logger.Info("Allowing reserve Pod", zap.Object("verdict", verdict))
 		return nil // nil is success
 	} else {
-		logger.Error("Rejecting reserve Pod (not enough resources)", zap.Object("verdict", verdict))
+		e.auditLog(logger, util.PodNameFields(pod), zap.String("node", nodeName)).
+			Error("Rejecting reserve Pod (not enough resources)", zap.Object("verdict", verdict))
 		return framework.NewStatus(framework.Unschedulable, "Not enough resources to reserve non-VM pod")
 	}
 }
@@ -816,7 +1408,7 @@ func (e *AutoscaleEnforcer) Unreserve(
 		return
 	}
 
-	logFields, kind, migrating, verdict := e.unreserveResources(logger, podName)
+	logFields, kind, migrating, verdict := e.unreserveResources(logger, podName, true)
 
 	logger.With(logFields...).Info(
 		fmt.Sprintf("Unreserved %s Pod", kind),
@@ -0,0 +1,607 @@
+package plugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/kubernetes/pkg/scheduler/framework"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestVMCountLimit(t *testing.T) {
+	cases := []struct {
+		name          string
+		maxVMsPerNode uint
+		expected      bool
+	}{
+		{name: "Unlimited", maxVMsPerNode: 0, expected: false},
+		{name: "BelowLimit", maxVMsPerNode: 3, expected: false},
+		{name: "AtLimit", maxVMsPerNode: 2, expected: true},
+		{name: "AboveLimit", maxVMsPerNode: 1, expected: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := makeTestConfig(t, func(conf *Config) { conf.MaxVMsPerNode = c.maxVMsPerNode })
+
+			// A node with plenty of CPU and memory remaining, with two small VMs and a non-VM pod
+			// that shouldn't count towards the limit.
+			node := makeTestNodeState(
+				conf.NodeConfig.vCpuLimits(resourcePtr("64")),
+				conf.NodeConfig.memoryLimits(resourcePtr("256Gi")),
+			)
+			addTestPod(node, "vm-1", true, 1000, 1<<30)
+			addTestPod(node, "vm-2", true, 1000, 1<<30)
+			addTestPod(node, "non-vm", false, 1000, 1<<30)
+
+			if got := node.vmCountLimitReached(conf); got != c.expected {
+				t.Errorf("expected vmCountLimitReached() = %v, got %v", c.expected, got)
+			}
+
+			// Filter should reject a new VM at the limit, even though it has room for it.
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			vm, pod := makeTestVM(conf, "new-vm", 1000, 1)
+			e := makeTestEnforcer(conf, node)
+			e.vmStore = makeTestVMStore(ctx, t, vm)
+
+			k8sNode := &corev1.Node{}
+			k8sNode.Name = node.name
+			nodeInfo := framework.NewNodeInfo()
+			nodeInfo.SetNode(k8sNode)
+
+			status := e.Filter(ctx, nil, pod, nodeInfo)
+			if c.expected {
+				if status.Code() != framework.Unschedulable {
+					t.Fatalf("expected VM pod to be rejected as unschedulable, got %v", status)
+				}
+				if msg := status.Message(); msg != "Node has reached the maximum number of VMs" {
+					t.Errorf("unexpected rejection message %q", msg)
+				}
+			} else if !status.IsSuccess() {
+				t.Errorf("expected VM pod to be allowed, got %v", status)
+			}
+		})
+	}
+}
+
+func TestNoisyNeighbors(t *testing.T) {
+	noisyLabels := map[string]string{"workload": "batch"}
+
+	conf := makeTestConfig(t, func(conf *Config) {
+		conf.NoisyNeighbors = &noisyNeighborsConfig{
+			MatchLabels: noisyLabels,
+			Reject:      false,
+			Penalty:     0.5,
+		}
+	})
+
+	makeNode := func() *nodeState {
+		return makeTestNodeState(
+			conf.NodeConfig.vCpuLimits(resourcePtr("64")),
+			conf.NodeConfig.memoryLimits(resourcePtr("256Gi")),
+		)
+	}
+
+	// A node hosting a noisy batch job alongside a VM
+	noisy := makeNode()
+	addTestPod(noisy, "vm", true, 1000, 1<<30)
+	addTestPod(noisy, "batch-job", false, 4000, 8<<30).labels = map[string]string{
+		"workload": "batch",
+		"team":     "analytics",
+	}
+
+	// A node where the only pods with matching labels are VMs, or don't match all the labels
+	quiet := makeNode()
+	addTestPod(quiet, "vm", true, 1000, 1<<30).labels = noisyLabels
+	addTestPod(quiet, "other-job", false, 4000, 8<<30).labels = map[string]string{"workload": "web"}
+
+	if !noisy.hasNoisyNeighbor(conf) {
+		t.Error("expected node with batch job to have a noisy neighbor")
+	}
+	if quiet.hasNoisyNeighbor(conf) {
+		t.Error("expected node without batch job not to have a noisy neighbor")
+	}
+
+	if p := conf.NoisyNeighbors.penalty(true); p != 0.5 {
+		t.Errorf("expected penalty = 0.5 for node with noisy neighbor, got %g", p)
+	}
+	if p := conf.NoisyNeighbors.penalty(false); p != 0 {
+		t.Errorf("expected no penalty for node without noisy neighbor, got %g", p)
+	}
+
+	// With Reject, Filter handles the node instead, so there's no penalty.
+	conf.NoisyNeighbors.Reject = true
+	if p := conf.NoisyNeighbors.penalty(true); p != 0 {
+		t.Errorf("expected no penalty when rejecting, got %g", p)
+	}
+
+	// Without any config, nothing is noisy.
+	conf.NoisyNeighbors = nil
+	if noisy.hasNoisyNeighbor(conf) {
+		t.Error("expected no noisy neighbors without config")
+	}
+}
+
+func TestMultipleSchedulerNames(t *testing.T) {
+	makeVMPod := func(name string, schedulerName string) *corev1.Pod {
+		pod := &corev1.Pod{}
+		pod.Namespace = "default"
+		pod.Name = name
+		pod.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: "vm.neon.tech/v1",
+			Kind:       "VirtualMachine",
+			Name:       name + "-vm",
+		}}
+		pod.Spec.SchedulerName = schedulerName
+		pod.Spec.Containers = []corev1.Container{{}}
+		pod.Spec.Containers[0].Resources.Requests = corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("1"),
+			corev1.ResourceMemory: resource.MustParse("2Gi"),
+		}
+		return pod
+	}
+
+	stablePod := makeVMPod("stable-pod", "autoscale-scheduler")
+	canaryPod := makeVMPod("canary-pod", "autoscale-scheduler-canary")
+
+	// Two instances of the plugin, running side-by-side, each owning the pods with their name
+	for _, c := range []struct {
+		schedulerName string
+		own           *corev1.Pod
+		other         *corev1.Pod
+	}{
+		{schedulerName: "autoscale-scheduler", own: stablePod, other: canaryPod},
+		{schedulerName: "autoscale-scheduler-canary", own: canaryPod, other: stablePod},
+	} {
+		t.Run(c.schedulerName, func(t *testing.T) {
+			conf := makeTestConfig(t, func(conf *Config) { conf.SchedulerName = c.schedulerName })
+
+			node := makeTestNodeState(
+				conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+				conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+			)
+			e := makeTestEnforcer(conf, node)
+			c.other.Spec.NodeName = node.name
+
+			if e.tryPodOwnerVirtualMachine(c.own) == nil {
+				t.Errorf("expected %v to be treated as our VM", c.own.Name)
+			}
+			if e.tryPodOwnerVirtualMachine(c.other) != nil {
+				t.Errorf("expected %v not to be treated as our VM", c.other.Name)
+			}
+
+			// The other instance's pod still takes up space on the node, so its resources are
+			// counted, but we don't track it as a VM. This doesn't access the VM store, which isn't
+			// set up here.
+			e.handleStarted(zap.NewNop(), c.other)
+			ps, ok := e.state.pods[util.GetNamespacedName(c.other)]
+			if !ok {
+				t.Fatalf("expected %v's resources to be tracked", c.other.Name)
+			}
+			if ps.vm != nil {
+				t.Errorf("expected %v not to have VM state", c.other.Name)
+			}
+
+			// Our own scheduling checks should refuse the other instance's pods
+			if status := e.checkSchedulerName(zap.NewNop(), c.other); status.IsSuccess() {
+				t.Errorf("expected scheduler name check to fail for %v", c.other.Name)
+			}
+			if status := e.checkSchedulerName(zap.NewNop(), c.own); !status.IsSuccess() {
+				t.Errorf("expected scheduler name check to pass for %v, got %v", c.own.Name, status)
+			}
+
+			// Placement annotations should say which instance placed the pod
+			if value := (*placementReason)(nil).format(conf.SchedulerName, false); !strings.Contains(value, "scheduler="+c.schedulerName) {
+				t.Errorf("expected placement annotation to include scheduler name, got %q", value)
+			}
+		})
+	}
+}
+
+func TestNoVMScheduleAnnotation(t *testing.T) {
+	conf := makeTestConfig(t, func(*Config) {})
+
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+		conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+	)
+	existing := addTestPod(node, "existing-vm", true, 1000, 1<<30)
+	e := makeTestEnforcer(conf, node)
+
+	k8sNode := &corev1.Node{}
+	k8sNode.Name = node.name
+	k8sNode.Annotations = map[string]string{AnnotationNoVMSchedule: "true"}
+	nodeInfo := framework.NewNodeInfo()
+	nodeInfo.SetNode(k8sNode)
+
+	makePod := func(name string, isVM bool) *corev1.Pod {
+		pod := &corev1.Pod{}
+		pod.Namespace = "default"
+		pod.Name = name
+		pod.Spec.SchedulerName = conf.SchedulerName
+		pod.Spec.Containers = []corev1.Container{{}}
+		pod.Spec.Containers[0].Resources.Requests = corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("1"),
+			corev1.ResourceMemory: resource.MustParse("1Gi"),
+		}
+		if isVM {
+			pod.OwnerReferences = []metav1.OwnerReference{{
+				APIVersion: "vm.neon.tech/v1",
+				Kind:       "VirtualMachine",
+				Name:       name,
+			}}
+		}
+		return pod
+	}
+
+	// VM pods should be rejected. This happens before the VM store is accessed, which isn't set up
+	// here.
+	status := e.Filter(context.Background(), nil, makePod("new-vm", true), nodeInfo)
+	if status.Code() != framework.Unschedulable {
+		t.Errorf("expected VM pod to be rejected as unschedulable, got %v", status)
+	}
+
+	// ... but non-VM pods should be allowed.
+	status = e.Filter(context.Background(), nil, makePod("non-vm", false), nodeInfo)
+	if !status.IsSuccess() {
+		t.Errorf("expected non-VM pod to be allowed, got %v", status)
+	}
+
+	// Existing pods on the node should still be tracked.
+	if _, ok := node.pods[existing.name]; !ok {
+		t.Error("expected existing VM pod to still be tracked on the node")
+	}
+
+	// Removing the annotation should allow VM pods again. We can't call Filter for this one, so
+	// just check the annotation itself.
+	k8sNode.Annotations[AnnotationNoVMSchedule] = "false"
+	if nodeExcludedFromVMs(k8sNode) {
+		t.Error("expected node not to be excluded with annotation set to \"false\"")
+	}
+}
+
+func TestMigrationTargetOnlyAnnotation(t *testing.T) {
+	conf := makeTestConfig(t, func(*Config) {})
+
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+		conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+	)
+	e := makeTestEnforcer(conf, node)
+
+	k8sNode := &corev1.Node{}
+	k8sNode.Name = node.name
+	k8sNode.Annotations = map[string]string{AnnotationMigrationTargetOnly: "true"}
+	nodeInfo := framework.NewNodeInfo()
+	nodeInfo.SetNode(k8sNode)
+
+	makePod := func(name string, ownerKind string) *corev1.Pod {
+		pod := &corev1.Pod{}
+		pod.Namespace = "default"
+		pod.Name = name
+		pod.Spec.SchedulerName = conf.SchedulerName
+		pod.Spec.Containers = []corev1.Container{{}}
+		pod.Spec.Containers[0].Resources.Requests = corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("1"),
+			corev1.ResourceMemory: resource.MustParse("1Gi"),
+		}
+		pod.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: "vm.neon.tech/v1",
+			Kind:       ownerKind,
+			Name:       name,
+		}}
+		return pod
+	}
+
+	// Normal VM pods should be rejected. This happens before the VM store is accessed, which isn't
+	// set up here.
+	status := e.Filter(context.Background(), nil, makePod("new-vm", "VirtualMachine"), nodeInfo)
+	if status.Code() != framework.Unschedulable {
+		t.Errorf("expected VM pod to be rejected as unschedulable, got %v", status)
+	}
+
+	// ... but the target pod of a migration should be allowed, and able to reserve resources.
+	target := makePod("target", "VirtualMachineMigration")
+	status = e.Filter(context.Background(), nil, target, nodeInfo)
+	if !status.IsSuccess() {
+		t.Errorf("expected migration target pod to be allowed, got %v", status)
+	}
+
+	target.Spec.NodeName = node.name
+	status = e.Reserve(context.Background(), nil, target, node.name)
+	if !status.IsSuccess() {
+		t.Errorf("expected migration target pod to be reserved, got %v", status)
+	}
+	if _, ok := node.pods[util.GetNamespacedName(target)]; !ok {
+		t.Error("expected migration target pod to be tracked on the node")
+	}
+
+	// Clearing the annotation should allow VM pods again.
+	delete(k8sNode.Annotations, AnnotationMigrationTargetOnly)
+	if nodeMigrationTargetOnly(k8sNode) {
+		t.Error("expected node not to be reserved for migration targets without the annotation")
+	}
+}
+
+func TestFilterPredicates(t *testing.T) {
+	conf := makeTestConfig(t, func(*Config) {})
+
+	var nodes []*nodeState
+	nodeInfos := make(map[string]*framework.NodeInfo)
+	for _, name := range []string{"allowed", "rejected"} {
+		node := makeTestNodeState(
+			conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+			conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+		)
+		node.name = name
+		nodes = append(nodes, node)
+
+		k8sNode := &corev1.Node{}
+		k8sNode.Name = name
+		nodeInfos[name] = framework.NewNodeInfo()
+		nodeInfos[name].SetNode(k8sNode)
+	}
+	e := makeTestEnforcer(conf, nodes...)
+
+	var checked []PredicateNode
+	e.predicates = []FilterPredicate{{
+		Name: "reject-node",
+		Check: func(pod PredicatePod, node PredicateNode) *framework.Status {
+			checked = append(checked, node)
+			if node.Node.Name == "rejected" {
+				return framework.NewStatus(framework.UnschedulableAndUnresolvable, "node is rejected")
+			}
+			return nil
+		},
+	}}
+
+	pod := &corev1.Pod{}
+	pod.Namespace = "default"
+	pod.Name = "pod"
+	pod.Spec.SchedulerName = conf.SchedulerName
+	pod.Spec.Containers = []corev1.Container{{}}
+	pod.Spec.Containers[0].Resources.Requests = corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("1"),
+		corev1.ResourceMemory: resource.MustParse("1Gi"),
+	}
+
+	status := e.Filter(context.Background(), nil, pod, nodeInfos["allowed"])
+	if !status.IsSuccess() {
+		t.Errorf("expected pod to be allowed on node, got %v", status)
+	}
+	status = e.Filter(context.Background(), nil, pod, nodeInfos["rejected"])
+	if status.Code() != framework.UnschedulableAndUnresolvable || status.Message() != "node is rejected" {
+		t.Errorf("expected pod to be rejected by predicate, got %v", status)
+	}
+
+	if len(checked) != 2 {
+		t.Fatalf("expected predicate to be called twice, got %d", len(checked))
+	}
+	expectedTotal := api.Resources{VCPU: 8000, Mem: 32 << 30}
+	if checked[0].Total != expectedTotal {
+		t.Errorf("expected predicate to get node total %v, got %v", expectedTotal, checked[0].Total)
+	}
+
+	// Pods that don't fit on the node are rejected before the predicates are evaluated.
+	pod.Spec.Containers[0].Resources.Requests[corev1.ResourceCPU] = resource.MustParse("9")
+	status = e.Filter(context.Background(), nil, pod, nodeInfos["allowed"])
+	if status.Code() != framework.Unschedulable {
+		t.Errorf("expected pod to be rejected for resources, got %v", status)
+	}
+	if len(checked) != 2 {
+		t.Errorf("expected predicate not to be called for pod that doesn't fit, got %d calls", len(checked))
+	}
+}
+
+func TestScoreHeadroom(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		conf := makeTestConfig(t, func(conf *Config) {
+			conf.ExposeScoreHeadroom = enabled
+		})
+
+		node := makeTestNodeState(
+			conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+			conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+		)
+		_ = addTestPod(node, "vm", true, 3000, 12<<30)
+		node.cpu.CapacityPressure = 500
+		e := makeTestEnforcer(conf, node)
+
+		pod := &corev1.Pod{}
+		pod.Namespace = "default"
+		pod.Name = "pod"
+		pod.Spec.SchedulerName = conf.SchedulerName
+
+		state := framework.NewCycleState()
+		if _, status := e.Score(context.Background(), state, pod, node.name); !status.IsSuccess() {
+			t.Fatalf("unexpected Score failure: %v", status)
+		}
+
+		headroom, err := ReadNodeHeadroom(state, node.name)
+		if !enabled {
+			if err == nil {
+				t.Errorf("expected no headroom to be recorded when disabled, got %+v", headroom)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("expected headroom to be recorded: %s", err)
+		}
+
+		expected := NodeHeadroom{
+			Node:                   node.name,
+			RemainingReservableCPU: node.cpu.Total - 3000,
+			RemainingReservableMem: node.mem.Total - 12<<30,
+			TotalCPU:               node.cpu.Total,
+			TotalMem:               node.mem.Total,
+			CapacityPressureCPU:    500,
+			CapacityPressureMem:    0,
+			TooMuchPressure:        false,
+		}
+		if *headroom != expected {
+			t.Errorf("expected headroom %+v, got %+v", expected, *headroom)
+		}
+	}
+}
+
+func TestScorePressureHistory(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) {
+		conf.ScorePressure = &scorePressureConfig{WindowSeconds: 60, InstantaneousWeight: 0.5}
+	})
+
+	makeNode := func(name string) *nodeState {
+		n := makeTestNodeState(conf.NodeConfig.vCpuLimits(resourcePtr("8")), conf.NodeConfig.memoryLimits(resourcePtr("32Gi")))
+		n.name = name
+		_ = addTestPod(n, name+"-vm", true, 2000, 8<<30)
+		return n
+	}
+
+	// Both nodes have the same current pressure, but "hot" has had it for much longer than the
+	// averaging window, while "spiky" only just got it.
+	now := time.Now()
+	hot := makeNode("hot")
+	spiky := makeNode("spiky")
+	hot.updateCapacityPressureAvg(conf, now.Add(-10*time.Minute))
+	spiky.updateCapacityPressureAvg(conf, now.Add(-10*time.Minute))
+	hot.cpu.CapacityPressure = 2000
+	hot.updateCapacityPressureAvg(conf, now.Add(-9*time.Minute))
+	spiky.updateCapacityPressureAvg(conf, now.Add(-1*time.Second))
+	spiky.cpu.CapacityPressure = 2000
+
+	if hot.cpu.CapacityPressure != spiky.cpu.CapacityPressure {
+		t.Fatal("expected nodes to have equal instantaneous pressure")
+	}
+	if hot.capacityPressureAvg.CPU <= spiky.capacityPressureAvg.CPU {
+		t.Fatalf(
+			"expected hot node to have higher average pressure, got hot = %g, spiky = %g",
+			hot.capacityPressureAvg.CPU, spiky.capacityPressureAvg.CPU,
+		)
+	}
+
+	e := makeTestEnforcer(conf, hot, spiky)
+
+	pod := &corev1.Pod{}
+	pod.Namespace = "default"
+	pod.Name = "pod"
+	pod.Spec.SchedulerName = conf.SchedulerName
+
+	hotScore, status := e.Score(context.Background(), nil, pod, hot.name)
+	if !status.IsSuccess() {
+		t.Fatalf("unexpected Score failure: %v", status)
+	}
+	spikyScore, status := e.Score(context.Background(), nil, pod, spiky.name)
+	if !status.IsSuccess() {
+		t.Fatalf("unexpected Score failure: %v", status)
+	}
+	if hotScore >= spikyScore {
+		t.Errorf("expected node with sustained pressure to score lower, got hot = %d, spiky = %d", hotScore, spikyScore)
+	}
+}
+
+func TestScoreMinHeadroom(t *testing.T) {
+	conf := makeTestConfig(t, func(*Config) {})
+
+	makeNode := func(name string, cpu vmapi.MilliCPU, mem api.Bytes) *nodeState {
+		n := makeTestNodeState(conf.NodeConfig.vCpuLimits(resourcePtr("8")), conf.NodeConfig.memoryLimits(resourcePtr("32Gi")))
+		n.name = name
+		_ = addTestPod(n, name+"-vm", true, cpu, mem)
+		return n
+	}
+
+	// Both nodes are below the score peak, so without a minimum headroom, the more packed node
+	// would be preferred.
+	packed := makeNode("packed", 6000, 24<<30)
+	other := makeNode("other", 5000, 20<<30)
+	e := makeTestEnforcer(conf, packed, other)
+
+	pod := &corev1.Pod{}
+	pod.Namespace = "default"
+	pod.Name = "pod"
+	pod.Spec.SchedulerName = conf.SchedulerName
+
+	scores := func() (packedScore, otherScore int64) {
+		packedScore, status := e.Score(context.Background(), nil, pod, packed.name)
+		if !status.IsSuccess() {
+			t.Fatalf("unexpected Score failure: %v", status)
+		}
+		otherScore, status = e.Score(context.Background(), nil, pod, other.name)
+		if !status.IsSuccess() {
+			t.Fatalf("unexpected Score failure: %v", status)
+		}
+		return packedScore, otherScore
+	}
+
+	if packedScore, otherScore := scores(); packedScore <= otherScore {
+		t.Fatalf(
+			"expected more packed node to score higher without minimum headroom, got packed = %d, other = %d",
+			packedScore, otherScore,
+		)
+	}
+
+	conf.MinScoreHeadroom = &minScoreHeadroomConfig{CPU: 2500, Mem: 10 << 30, Penalty: 0.9}
+	if path, err := conf.validate(); err != nil {
+		t.Fatalf("invalid config at %s: %s", path, err)
+	}
+	if packed.remainingReservableCPU() >= conf.MinScoreHeadroom.CPU || other.remainingReservableCPU() < conf.MinScoreHeadroom.CPU {
+		t.Fatalf(
+			"expected only packed node to be below minimum headroom, got packed = %v, other = %v",
+			packed.remainingReservableCPU(), other.remainingReservableCPU(),
+		)
+	}
+
+	if packedScore, otherScore := scores(); packedScore >= otherScore {
+		t.Errorf(
+			"expected node below minimum headroom to score lower, got packed = %d, other = %d",
+			packedScore, otherScore,
+		)
+	}
+}
+
+func TestScoreNodeFetchFailure(t *testing.T) {
+	conf := makeTestConfig(t, func(*Config) {})
+
+	known := makeTestNodeState(conf.NodeConfig.vCpuLimits(resourcePtr("8")), conf.NodeConfig.memoryLimits(resourcePtr("32Gi")))
+	known.name = "known"
+	_ = addTestPod(known, "other", false, 2000, 8<<30)
+	e := makeTestEnforcer(conf, known)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Use an empty cluster for the node store, so that fetching any node we don't already know
+	// about fails.
+	e.nodeStore = makeTestNodeStore(ctx, t)
+
+	pod := &corev1.Pod{}
+	pod.Namespace = "default"
+	pod.Name = "pod"
+	pod.Spec.SchedulerName = conf.SchedulerName
+
+	missingScore, status := e.Score(ctx, nil, pod, "missing")
+	if !status.IsSuccess() {
+		t.Fatalf("expected Score to succeed for node that couldn't be fetched, got %v", status)
+	}
+	if missingScore != framework.MinNodeScore {
+		t.Errorf("expected minimum score for node that couldn't be fetched, got %d", missingScore)
+	}
+
+	knownScore, status := e.Score(ctx, nil, pod, known.name)
+	if !status.IsSuccess() {
+		t.Fatalf("unexpected Score failure: %v", status)
+	}
+	if knownScore <= missingScore {
+		t.Errorf("expected known node to score above node that couldn't be fetched, got %d", knownScore)
+	}
+}
@@ -14,18 +14,43 @@ import (
 )
 
 type PromMetrics struct {
-	pluginCalls           *prometheus.CounterVec
-	pluginCallFails       *prometheus.CounterVec
-	resourceRequests      *prometheus.CounterVec
-	validResourceRequests *prometheus.CounterVec
-	nodeCPUResources      *prometheus.GaugeVec
-	nodeMemResources      *prometheus.GaugeVec
-	migrationCreations    prometheus.Counter
-	migrationDeletions    *prometheus.CounterVec
-	migrationCreateFails  prometheus.Counter
-	migrationDeleteFails  *prometheus.CounterVec
+	pluginCalls               *prometheus.CounterVec
+	pluginCallFails           *prometheus.CounterVec
+	resourceRequests          *prometheus.CounterVec
+	validResourceRequests     *prometheus.CounterVec
+	nodeCPUResources          *prometheus.GaugeVec
+	nodeMemResources          *prometheus.GaugeVec
+	nodeScaleOutPending       *prometheus.GaugeVec
+	migrationQueueDepth       *prometheus.GaugeVec
+	migrationQueueOldestWait  *prometheus.GaugeVec
+	nodeOverWatermarkDuration *prometheus.HistogramVec
+	podCPUResources           *prometheus.GaugeVec
+	podMemResources           *prometheus.GaugeVec
+	unevenComputeUnits        prometheus.Counter
+	nonVMLimitExceeded        *prometheus.CounterVec
+	nodeFetchFails            *prometheus.CounterVec
+	pressureAccountingDrift   *prometheus.CounterVec
+	underReportedUsage        *prometheus.CounterVec
+	metricsScrapes            *prometheus.CounterVec
+	migrationCreations        prometheus.Counter
+	migrationsSuppressed      *prometheus.CounterVec
+	migrationDeletions        *prometheus.CounterVec
+	migrationCreateFails      prometheus.Counter
+	migrationDeleteFails      *prometheus.CounterVec
+	migrationsStarted         *prometheus.CounterVec
+	migrationsSucceeded       *prometheus.CounterVec
+	migrationsFailed          *prometheus.CounterVec
 }
 
+// Values for the "reason" label of PromMetrics.migrationsFailed
+const (
+	// migrationFailReasonCreate means that our request to create the VirtualMachineMigration failed
+	migrationFailReasonCreate = "create-error"
+	// migrationFailReasonPhase means that the VirtualMachineMigration was created, but NeonVM
+	// reported that it failed
+	migrationFailReasonPhase = "migration-failed"
+)
+
 func (p *AutoscaleEnforcer) makePrometheusRegistry() *prometheus.Registry {
 	reg := prometheus.NewRegistry()
 
@@ -81,12 +106,104 @@ func (p *AutoscaleEnforcer) makePrometheusRegistry() *prometheus.Registry {
 			},
 			[]string{"node", "node_group", "availability_zone", "field"},
 		)),
+		nodeOverWatermarkDuration: util.RegisterMetric(reg, prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name: "autoscaling_plugin_node_over_watermark_duration_seconds",
+				Help: "Duration that nodes' reserved resources stayed above the watermark before dropping back below it",
+				// 1s to ~4.5h
+				Buckets: prometheus.ExponentialBuckets(1, 2, 15),
+			},
+			[]string{"node_group", "availability_zone"},
+		)),
+		podCPUResources: util.RegisterMetric(reg, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_plugin_pod_cpu_resources_current",
+				Help: "Current amount of CPU for 'podResourceState' fields",
+			},
+			[]string{"pod_namespace", "pod_name", "node", "field"},
+		)),
+		podMemResources: util.RegisterMetric(reg, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_plugin_pod_mem_resources_current",
+				Help: "Current amount of memory (in bytes) for 'podResourceState' fields",
+			},
+			[]string{"pod_namespace", "pod_name", "node", "field"},
+		)),
+		nodeScaleOutPending: util.RegisterMetric(reg, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_plugin_node_scale_out_pending",
+				Help: "Whether migrations off the node are deferred while waiting for the node autoscaler to add capacity",
+			},
+			[]string{"node", "node_group", "availability_zone"},
+		)),
+		migrationQueueDepth: util.RegisterMetric(reg, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_plugin_migration_queue_depth",
+				Help: "Number of VM pods in the node's migration queue",
+			},
+			[]string{"node", "node_group", "availability_zone"},
+		)),
+		migrationQueueOldestWait: util.RegisterMetric(reg, prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "autoscaling_plugin_migration_queue_oldest_wait_seconds",
+				Help: "Time that the longest-waiting VM pod in the node's migration queue has been there, in seconds",
+			},
+			[]string{"node", "node_group", "availability_zone"},
+		)),
+		unevenComputeUnits: util.RegisterMetric(reg, prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "autoscaling_plugin_uneven_compute_units_total",
+				Help: "Number of resource requests where the reserved CPU and memory were granted as different numbers of compute units",
+			},
+		)),
+		nonVMLimitExceeded: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_plugin_non_vm_limit_exceeded_total",
+				Help: "Number of non-VM pods that would put their node's non-VM reservations above the configured limit",
+			},
+			[]string{"node_group", "availability_zone", "rejected"},
+		)),
+		nodeFetchFails: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_plugin_node_fetch_fails_total",
+				Help: "Number of failures to fetch a node's state that were tolerated by the plugin",
+			},
+			[]string{"method"},
+		)),
+		pressureAccountingDrift: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_plugin_pressure_accounting_drift_total",
+				Help: "Number of times a node's pressureAccountedFor didn't match the pods currently migrating",
+			},
+			[]string{"node", "resource", "corrected"},
+		)),
+		underReportedUsage: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_plugin_underreported_usage_reconciled_total",
+				Help: "Number of times a VM's reserved memory was raised to match its measured usage",
+			},
+			[]string{"node"},
+		)),
+		metricsScrapes: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_plugin_vm_metrics_scrapes_total",
+				Help: "Number of attempts to fetch metrics directly from VMs, with their outcome",
+			},
+			[]string{"outcome"},
+		)),
 		migrationCreations: util.RegisterMetric(reg, prometheus.NewCounter(
 			prometheus.CounterOpts{
 				Name: "autoscaling_plugin_migrations_created_total",
 				Help: "Number of successful VirtualMachineMigration Create requests by the plugin",
 			},
 		)),
+		migrationsSuppressed: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_plugin_migrations_suppressed_total",
+				Help: "Number of migrations skipped because no other node would have enough more headroom than the source",
+			},
+			[]string{"node"},
+		)),
 		migrationDeletions: util.RegisterMetric(reg, prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "autoscaling_plugin_migrations_deleted_total",
@@ -107,11 +224,121 @@ func (p *AutoscaleEnforcer) makePrometheusRegistry() *prometheus.Registry {
 			},
 			[]string{"phase"},
 		)),
+		migrationsStarted: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_plugin_migrations_started_total",
+				Help: "Number of migrations started by the plugin, by source node",
+			},
+			[]string{"node"},
+		)),
+		migrationsSucceeded: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_plugin_migrations_succeeded_total",
+				Help: "Number of migrations started by the plugin that succeeded, by source node",
+			},
+			[]string{"node"},
+		)),
+		migrationsFailed: util.RegisterMetric(reg, prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "autoscaling_plugin_migrations_failed_total",
+				Help: "Number of migrations the plugin tried to start that failed, by source node and reason",
+			},
+			[]string{"node", "reason"},
+		)),
 	}
 
+	// Per-zone capacity is derived from all of the nodes, so rather than keeping a separate gauge
+	// up to date on every change, it's computed from the node map when scraped.
+	reg.MustRegister(makeZoneCapacityCollector(&p.state))
+	// ... and the same goes for the total buffer across the cluster.
+	reg.MustRegister(makeClusterBufferCollector(&p.state))
+
 	return reg
 }
 
+// zoneCapacityCollector is a prometheus.Collector reporting the aggregate reservable and reserved
+// resources in each availability zone, from (*pluginState).zoneCapacities()
+type zoneCapacityCollector struct {
+	state *pluginState
+
+	cpu *prometheus.Desc
+	mem *prometheus.Desc
+}
+
+func makeZoneCapacityCollector(state *pluginState) *zoneCapacityCollector {
+	labels := []string{"availability_zone", "field"}
+	return &zoneCapacityCollector{
+		state: state,
+		cpu: prometheus.NewDesc(
+			"autoscaling_plugin_zone_cpu_resources_current",
+			"Current aggregate amount of CPU across all nodes in each availability zone",
+			labels, nil,
+		),
+		mem: prometheus.NewDesc(
+			"autoscaling_plugin_zone_mem_resources_current",
+			"Current aggregate amount of memory (in bytes) across all nodes in each availability zone",
+			labels, nil,
+		),
+	}
+}
+
+func (c *zoneCapacityCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.cpu
+	ch <- c.mem
+}
+
+func (c *zoneCapacityCollector) Collect(ch chan<- prometheus.Metric) {
+	c.state.lock.Lock()
+	zones := c.state.zoneCapacities()
+	c.state.lock.Unlock()
+
+	for zone, z := range zones {
+		ch <- prometheus.MustNewConstMetric(c.cpu, prometheus.GaugeValue, z.ReservableCPU.AsFloat64(), zone, "Reservable")
+		ch <- prometheus.MustNewConstMetric(c.cpu, prometheus.GaugeValue, z.ReservedCPU.AsFloat64(), zone, "Reserved")
+		ch <- prometheus.MustNewConstMetric(c.mem, prometheus.GaugeValue, z.ReservableMem.AsFloat64(), zone, "Reservable")
+		ch <- prometheus.MustNewConstMetric(c.mem, prometheus.GaugeValue, z.ReservedMem.AsFloat64(), zone, "Reserved")
+	}
+}
+
+// clusterBufferCollector is a prometheus.Collector reporting the total buffer reserved across all
+// nodes, from (*pluginState).clusterBuffer()
+type clusterBufferCollector struct {
+	state *pluginState
+
+	cpu *prometheus.Desc
+	mem *prometheus.Desc
+}
+
+func makeClusterBufferCollector(state *pluginState) *clusterBufferCollector {
+	return &clusterBufferCollector{
+		state: state,
+		cpu: prometheus.NewDesc(
+			"autoscaling_plugin_cluster_cpu_buffer_current",
+			"Current total CPU reserved as buffer across all nodes",
+			nil, nil,
+		),
+		mem: prometheus.NewDesc(
+			"autoscaling_plugin_cluster_mem_buffer_current",
+			"Current total memory (in bytes) reserved as buffer across all nodes",
+			nil, nil,
+		),
+	}
+}
+
+func (c *clusterBufferCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.cpu
+	ch <- c.mem
+}
+
+func (c *clusterBufferCollector) Collect(ch chan<- prometheus.Metric) {
+	c.state.lock.Lock()
+	total := c.state.clusterBuffer()
+	c.state.lock.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(c.cpu, prometheus.GaugeValue, total.VCPU.AsFloat64())
+	ch <- prometheus.MustNewConstMetric(c.mem, prometheus.GaugeValue, total.Mem.AsFloat64())
+}
+
 func (m *PromMetrics) IncMethodCall(method string, ignored bool) {
 	m.pluginCalls.WithLabelValues(method, strconv.FormatBool(ignored)).Inc()
 }
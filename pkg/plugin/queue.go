@@ -4,6 +4,7 @@ package plugin
 
 import (
 	"container/heap"
+	"time"
 )
 
 type migrationQueue []*vmPodState
@@ -12,8 +13,11 @@ type migrationQueue []*vmPodState
 // package-local API //
 ///////////////////////
 
-func (mq *migrationQueue) addOrUpdate(vm *vmPodState) {
+// addOrUpdate adds the VM to the queue, or updates its position if it's already there. now is
+// recorded as the time the VM was enqueued, if it wasn't already.
+func (mq *migrationQueue) addOrUpdate(vm *vmPodState, now time.Time) {
 	if vm.mqIndex == -1 {
+		vm.mqEnqueuedAt = now
 		heap.Push(mq, vm)
 	} else {
 		heap.Fix(mq, vm.mqIndex)
@@ -30,9 +34,22 @@ func (mq migrationQueue) isNextInQueue(vm *vmPodState) bool {
 func (mq *migrationQueue) removeIfPresent(vm *vmPodState) {
 	if vm.mqIndex != -1 {
 		_ = heap.Remove(mq, vm.mqIndex)
+		vm.mqEnqueuedAt = time.Time{}
 	}
 }
 
+// oldestWait returns how long the longest-queued pod has been in the queue, or zero if the queue is
+// empty
+func (mq migrationQueue) oldestWait(now time.Time) time.Duration {
+	var oldest time.Duration
+	for _, vm := range mq {
+		if wait := now.Sub(vm.mqEnqueuedAt); wait > oldest {
+			oldest = wait
+		}
+	}
+	return oldest
+}
+
 //////////////////////////////////////
 // container/heap.Interface methods //
 //////////////////////////////////////
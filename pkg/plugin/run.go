@@ -10,10 +10,16 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/lithammer/shortuuid"
 	"github.com/tychoish/fun/srv"
 	"go.uber.org/zap"
+	"golang.org/x/exp/constraints"
 
+	corev1 "k8s.io/api/core/v1"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
 	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
 )
 
 const (
@@ -22,12 +28,12 @@ const (
 	ContentTypeError string = "text/plain"
 )
 
-// The scheduler plugin currently supports v1.0 to v4.0 of the agent<->scheduler plugin protocol.
+// The scheduler plugin currently supports v1.0 to v5.0 of the agent<->scheduler plugin protocol.
 //
 // If you update either of these values, make sure to also update VERSIONING.md.
 const (
 	MinPluginProtocolVersion api.PluginProtoVersion = api.PluginProtoV1_0
-	MaxPluginProtocolVersion api.PluginProtoVersion = api.PluginProtoV4_0
+	MaxPluginProtocolVersion api.PluginProtoVersion = api.PluginProtoV5_0
 )
 
 // startPermitHandler runs the server for handling each resourceRequest from a pod
@@ -120,6 +126,13 @@ func (e *AutoscaleEnforcer) handleAgentRequest(
 	logger *zap.Logger,
 	req api.AgentRequest,
 ) (_ *api.PluginResponse, status int, _ error) {
+	// Make sure every log line for this request can be matched up with the agent's logs, assigning
+	// an ID ourselves if the agent didn't send one.
+	if req.CorrelationID == "" {
+		req.CorrelationID = shortuuid.New()
+	}
+	logger = logger.With(zap.String("correlationID", req.CorrelationID))
+
 	nodeName := "<none>" // override this later if we have a node name
 	defer func() {
 		hasMetrics := req.Metrics != nil
@@ -156,12 +169,22 @@ func (e *AutoscaleEnforcer) handleAgentRequest(
 		return nil, 400, fmt.Errorf("computeUnit field not supported for protocol version %v", req.ProtoVersion)
 	}
 
+	// A zero compute unit would have us dividing by zero later on.
+	if req.ComputeUnit != nil {
+		if err := req.ComputeUnit.ValidateNonZero(); err != nil {
+			return nil, 400, fmt.Errorf("Invalid computeUnit: %w", err)
+		}
+	}
+
 	e.state.lock.Lock()
 	defer e.state.lock.Unlock()
 
 	pod, ok := e.state.pods[req.Pod]
 	if !ok {
 		logger.Warn("Received request for Pod we don't know") // pod already in the logger's context
+		if req.Metrics != nil {
+			e.state.bufferOrphanMetrics(logger, req.Pod, *req.Metrics)
+		}
 		return nil, 404, errors.New("pod not found")
 	}
 	if pod.vm == nil {
@@ -181,7 +204,7 @@ func (e *AutoscaleEnforcer) handleAgentRequest(
 	// If the request was actually sending a quantity of *memory slots*, rather than bytes, then
 	// multiply memory resources to make it match the
 	if !req.ProtoVersion.RepresentsMemoryAsBytes() {
-		req.Resources.Mem *= pod.vm.memSlotSize
+		req.Resources = resourcesFromMemSlots(req.Resources, pod.vm.memSlotSize)
 	}
 
 	computeUnit := e.state.conf.ComputeUnit
@@ -195,6 +218,13 @@ func (e *AutoscaleEnforcer) handleAgentRequest(
 	// Also, now that we know which VM this refers to (and which node it's on), add that to the logger for later.
 	logger = logger.With(zap.Object("virtualmachine", pod.vm.name), zap.String("node", nodeName))
 
+	// Refresh how over-provisioned the pod is (and how much it'd relieve a node with both CPU and
+	// memory pressure), before (possibly) updating its place in the migration queue alongside its
+	// metrics.
+	pod.vm.overprovisionedBonus = e.state.conf.overprovisionedBonus(pod)
+	pod.vm.dualReliefBonus = e.state.conf.dualReliefBonus(pod)
+	pod.vm.migrationSize = e.state.conf.migrationSize(pod)
+
 	mustMigrate := pod.vm.migrationState == nil &&
 		// Check whether the pod *will* migrate, then update its resources, and THEN start its
 		// migration, using the possibly-changed resources.
@@ -204,8 +234,9 @@ func (e *AutoscaleEnforcer) handleAgentRequest(
 
 	supportsFractionalCPU := req.ProtoVersion.SupportsFractionalCPU()
 
-	permit, status, err := e.handleResources(
+	permit, denialCause, status, err := e.handleResources(
 		logger,
+		req.CorrelationID,
 		pod,
 		node,
 		computeUnit,
@@ -218,6 +249,23 @@ func (e *AutoscaleEnforcer) handleAgentRequest(
 		return nil, status, err
 	}
 
+	// Only reserve burst headroom if the pod isn't about to migrate; it can't scale up during the
+	// migration anyways. Agents using older protocol versions don't know to report their use of
+	// the burst, so it's never reserved for them.
+	//
+	// This happens after the request has been handled, so that any cluster-wide reservation budget
+	// has already been applied to the request, and the burst only gets what's left of it.
+	var burst *api.Resources
+	if !mustMigrate && req.ProtoVersion.SupportsBurst() {
+		burst = e.reserveBurst(logger, pod, node, computeUnit, supportsFractionalCPU)
+	}
+
+	// Now that the request has been handled, make sure we haven't reserved less than the VM is
+	// actually using.
+	if !mustMigrate {
+		e.reconcileUnderReportedUsage(logger, pod)
+	}
+
 	var migrateDecision *api.MigrateResponse
 	if mustMigrate {
 		created, err := e.startMigration(context.Background(), logger, pod)
@@ -231,28 +279,86 @@ func (e *AutoscaleEnforcer) handleAgentRequest(
 		// should try to avoid
 		if created {
 			migrateDecision = &api.MigrateResponse{}
+			if e.state.conf.VerdictSummary != nil {
+				node.verdictSummary.MigrationsStarted += 1
+			}
+			// The migration will make room for any pod that was waiting to grow, so we don't need
+			// to start another for it.
+			node.accommodating = nil
 		}
 	}
 
 	resp := api.PluginResponse{
-		Permit:      permit,
-		Migrate:     migrateDecision,
-		ComputeUnit: getComputeUnitForResponse(e.state.conf.ComputeUnit, req.ProtoVersion),
+		Permit:             permit,
+		Migrate:            migrateDecision,
+		ComputeUnit:        getComputeUnitForResponse(e.state.conf.ComputeUnit, req.ProtoVersion),
+		RetryAfterSeconds:  getRetryAfterForResponse(e.state.conf.Backpressure, pod, node),
+		Burst:              burst,
+		SuggestedDownscale: getDownscaleForResponse(e.state.conf.DownscaleBeforeMigrate, pod, node, mustMigrate),
+		DenialCause:        denialCause,
 	}
 
 	// If the selected protocol version is using memory slots, rather than byte quantities, then we
 	// should convert the values before responding.
 	if !req.ProtoVersion.RepresentsMemoryAsBytes() {
-		resp.Permit.Mem /= pod.vm.memSlotSize
+		resp.Permit = resourcesToMemSlots(resp.Permit, pod.vm.memSlotSize)
 		if resp.ComputeUnit != nil {
-			resp.ComputeUnit.Mem /= pod.vm.memSlotSize
+			cu := resourcesToMemSlots(*resp.ComputeUnit, pod.vm.memSlotSize)
+			resp.ComputeUnit = &cu
+		}
+		if resp.SuggestedDownscale != nil {
+			downscale := resourcesToMemSlots(*resp.SuggestedDownscale, pod.vm.memSlotSize)
+			resp.SuggestedDownscale = &downscale
 		}
 	}
 
-	pod.vm.mostRecentComputeUnit = &e.state.conf.ComputeUnit
+	// Record the compute unit that was actually used for this request, so that the next one is
+	// checked against it. This is a copy, so it doesn't change with the config.
+	pod.vm.mostRecentComputeUnit = &computeUnit
 	return &resp, 200, nil
 }
 
+// getDownscaleForResponse returns the resources that the pod should downscale towards, if we're
+// currently waiting for pods on its node to downscale before migrating, and the pod's load is low
+// enough.
+//
+// Otherwise, returns nil.
+func getDownscaleForResponse(
+	conf *downscaleBeforeMigrateConfig,
+	pod *podState,
+	node *nodeState,
+	migrating bool,
+) *api.Resources {
+	if conf == nil || migrating || node.downscalePendingSince == nil || pod.vm.metrics == nil {
+		return nil
+	}
+
+	// Nothing to ask for if the pod is already at its minimum
+	if pod.cpu.Reserved <= pod.cpu.Min && pod.mem.Reserved <= pod.mem.Min {
+		return nil
+	}
+
+	loadFraction := float64(pod.vm.metrics.LoadAverage1Min) / pod.cpu.Reserved.AsFloat64()
+	if loadFraction > conf.MaxLoadFraction {
+		return nil
+	}
+
+	return &api.Resources{VCPU: pod.cpu.Min, Mem: pod.mem.Min}
+}
+
+// resourcesToMemSlots returns r with memory represented as a number of memory slots, rather than
+// bytes, as expected by versions of the protocol before v4.0
+func resourcesToMemSlots(r api.Resources, memSlotSize api.Bytes) api.Resources {
+	cpu, memSlots := api.ResourcesToSlots(r, memSlotSize)
+	return api.Resources{VCPU: cpu, Mem: api.Bytes(memSlots)}
+}
+
+// resourcesFromMemSlots is the inverse of resourcesToMemSlots, converting resources from a request
+// that represents memory as a number of memory slots into bytes
+func resourcesFromMemSlots(r api.Resources, memSlotSize api.Bytes) api.Resources {
+	return api.ResourcesFromSlots(r.VCPU, uint16(r.Mem), memSlotSize)
+}
+
 // getComputeUnitForResponse tries to return compute unit that the agent supports
 //
 // If the plugin is not supposed to send a compute unit in this version of the protocol, then we
@@ -274,8 +380,29 @@ func getComputeUnitForResponse(computeUnit api.Resources, protoVersion api.Plugi
 	return &computeUnit
 }
 
+// getRetryAfterForResponse returns the backpressure hint to send to the autoscaler-agent, if
+// backpressure is enabled and the pod's most recent request was capped because the node is full.
+//
+// Otherwise, returns nil.
+func getRetryAfterForResponse(conf *backpressureConfig, pod *podState, node *nodeState) *uint {
+	if conf == nil || (pod.cpu.CapacityPressure == 0 && pod.mem.CapacityPressure == 0) {
+		return nil
+	}
+
+	cpuFraction := node.cpu.CapacityPressure.AsFloat64() / node.cpu.Total.AsFloat64()
+	memFraction := node.mem.CapacityPressure.AsFloat64() / node.mem.Total.AsFloat64()
+
+	retryAfter := conf.retryAfterSeconds(util.Max(cpuFraction, memFraction))
+	return &retryAfter
+}
+
+// handleResources updates the pod's reserved resources for the request, returning what's permitted.
+//
+// The correlationID identifies the agent request in verdicts logged to the separate outputs from
+// Config.Logging, which don't include logger's fields.
 func (e *AutoscaleEnforcer) handleResources(
 	logger *zap.Logger,
+	correlationID string,
 	pod *podState,
 	node *nodeState,
 	cu api.Resources,
@@ -283,27 +410,54 @@ func (e *AutoscaleEnforcer) handleResources(
 	lastPermit *api.Resources,
 	startingMigration bool,
 	supportsFractionalCPU bool,
-) (api.Resources, int, error) {
+) (_ api.Resources, denialCause *api.PermitDenialCause, _ int, _ error) {
 	if !supportsFractionalCPU && req.VCPU%1000 != 0 {
 		err := errors.New("agent requested fractional CPU with protocol version that does not support it")
-		return api.Resources{}, 400, err
+		return api.Resources{}, nil, 400, err
 	}
 
 	// Check that we aren't being asked to do something during migration:
 	if pod.vm.currentlyMigrating() {
 		// The agent shouldn't have asked for a change after already receiving notice that it's
 		// migrating.
-		if req.VCPU != pod.cpu.Reserved || req.Mem != pod.mem.Reserved {
+		if req.VCPU != pod.cpu.Reserved || pod.vm.reservedMem(req.Mem) != pod.mem.Reserved {
 			err := errors.New("cannot change resources: agent has already been informed that pod is migrating")
-			return api.Resources{}, 400, err
+			return api.Resources{}, nil, 400, err
 		}
-		return api.Resources{VCPU: pod.cpu.Reserved, Mem: pod.mem.Reserved}, 200, nil
+		return api.Resources{VCPU: pod.cpu.Reserved, Mem: req.Mem}, nil, 200, nil
+	}
+
+	// Everything below may change the node's capacityPressure, so bring its average up to date
+	// first.
+	node.updateCapacityPressureAvg(e.state.conf, e.state.clock.Now())
+
+	// If the pod's compute unit has changed since its last request (e.g. because the VM or the
+	// autoscaler-agent was reconfigured), then any pressure we've recorded for it was relative to
+	// the old one. Clear it, so that it's recalculated from scratch with the new compute unit below.
+	computeUnitChanged := pod.vm.mostRecentComputeUnit != nil && *pod.vm.mostRecentComputeUnit != cu
+	if computeUnitChanged {
+		cpuVerdict := makeResourceTransitioner(&node.cpu, &pod.cpu).
+			handleComputeUnitChanged()
+		memVerdict := makeResourceTransitioner(&node.mem, &pod.mem).
+			handleComputeUnitChanged()
+		logger.Info(
+			"Handled change in compute unit for pod",
+			zap.Object("oldComputeUnit", *pod.vm.mostRecentComputeUnit),
+			zap.Object("newComputeUnit", cu),
+			zap.Object("verdict", verdictSet{
+				cpu: cpuVerdict,
+				mem: memVerdict,
+			}),
+		)
 	}
 
 	// Check that the resources correspond to an integer number of compute units, based on what the
 	// pod was most recently informed of. The resources may only be mismatched if one of them is at
 	// the minimum or maximum of what's allowed for this VM.
-	if pod.vm.mostRecentComputeUnit != nil {
+	//
+	// If the compute unit has just changed, the agent's request may still be based on the old one,
+	// so there's nothing useful to check.
+	if pod.vm.mostRecentComputeUnit != nil && !computeUnitChanged {
 		cu := *pod.vm.mostRecentComputeUnit
 		dividesCleanly := req.VCPU%cu.VCPU == 0 && req.Mem%cu.Mem == 0 && uint32(req.VCPU/cu.VCPU) == uint32(req.Mem/cu.Mem)
 		atMin := req.VCPU == pod.cpu.Min || req.Mem == pod.mem.Min
@@ -321,7 +475,7 @@ func (e *AutoscaleEnforcer) handleResources(
 		cpuVerdict := makeResourceTransitioner(&node.cpu, &pod.cpu).
 			handleLastPermit(lastPermit.VCPU)
 		memVerdict := makeResourceTransitioner(&node.mem, &pod.mem).
-			handleLastPermit(lastPermit.Mem)
+			handleLastPermit(pod.vm.reservedMem(lastPermit.Mem))
 		logger.Info(
 			"Handled last permit info from pod",
 			zap.Object("verdict", verdictSet{
@@ -331,18 +485,67 @@ func (e *AutoscaleEnforcer) handleResources(
 		)
 	}
 
+	// Any burst headroom that the pod is using becomes part of its normal reservation, and the rest
+	// is released, so that the request is handled relative to what the pod was permitted.
+	if pod.cpu.Burst != 0 || pod.mem.Burst != 0 {
+		cpuVerdict := makeResourceTransitioner(&node.cpu, &pod.cpu).
+			handleBurstConsumed(req.VCPU)
+		memVerdict := makeResourceTransitioner(&node.mem, &pod.mem).
+			handleBurstConsumed(pod.vm.reservedMem(req.Mem))
+		logger.Info(
+			"Handled burst usage from pod",
+			zap.Object("verdict", verdictSet{
+				cpu: cpuVerdict,
+				mem: memVerdict,
+			}),
+		)
+	}
+
 	cpuFactor := cu.VCPU
 	if !supportsFractionalCPU {
 		cpuFactor = 1000
 	}
-	memFactor := cu.Mem
+	// Memory is reserved in multiples of the VM's memGranularity (which may be coarser than the
+	// compute unit), so that partial increases stay aligned to it as well.
+	memFactor := pod.vm.reservedMem(cu.Mem)
+
+	before := api.Resources{VCPU: pod.cpu.Reserved, Mem: pod.mem.Reserved}
+
+	// Each of the steps below may deny some of the requested increase. We report the first one that
+	// did to the agent.
+	checkDenied := func(cause api.PermitDenialCause) {
+		if denialCause == nil && (pod.cpu.Reserved < req.VCPU || pod.mem.Reserved < req.Mem) {
+			denialCause = &cause
+		}
+	}
+
+	// Limit how much the pod can grow in a single request, if configured. The pod isn't given any
+	// pressure for the excess, because it's not the node's fault.
+	requested := api.Resources{VCPU: req.VCPU, Mem: pod.vm.reservedMem(req.Mem)}
+	if limit := e.state.conf.MaxGrowthPerRequest; limit != 0 && !startingMigration {
+		requested.VCPU = util.Min(requested.VCPU, pod.cpu.Reserved+cu.VCPU*vmapi.MilliCPU(limit))
+		requested.Mem = util.Min(requested.Mem, pod.mem.Reserved+memFactor*api.Bytes(limit))
+	}
+	growthLimited := requested.VCPU < req.VCPU || requested.Mem < pod.vm.reservedMem(req.Mem)
 
 	cpuVerdict := makeResourceTransitioner(&node.cpu, &pod.cpu).
-		handleRequested(req.VCPU, startingMigration, cpuFactor)
+		handleRequested(requested.VCPU, startingMigration, cpuFactor)
 	memVerdict := makeResourceTransitioner(&node.mem, &pod.mem).
-		handleRequested(req.Mem, startingMigration, memFactor)
+		handleRequested(requested.Mem, startingMigration, memFactor)
 
-	logger.Info(
+	// If we're summarizing verdicts per node, only log the individual ones at higher verbosity.
+	verdictLogger := e.debugLog(
+		logger,
+		zap.Object("pod", pod.name),
+		zap.String("node", node.name),
+		zap.String("correlationID", correlationID),
+	)
+	logVerdict := verdictLogger.Info
+	if e.state.conf.VerdictSummary != nil {
+		logVerdict = verdictLogger.Debug
+	}
+
+	logVerdict(
 		"Handled requested resources from pod",
 		zap.Object("verdict", verdictSet{
 			cpu: cpuVerdict,
@@ -350,7 +553,282 @@ func (e *AutoscaleEnforcer) handleResources(
 		}),
 	)
 
-	return api.Resources{VCPU: pod.cpu.Reserved, Mem: pod.mem.Reserved}, 200, nil
+	// If we couldn't grant everything that was requested (after the growth limit), it's because the
+	// node is full.
+	nodeFull := !startingMigration && (pod.cpu.Reserved < requested.VCPU || pod.mem.Reserved < requested.Mem)
+	if nodeFull && e.state.conf.NodeFullEvents != nil {
+		e.emitNodeFull(logger, correlationID, pod, node, req, e.state.clock.Now())
+	}
+
+	// With the "migrate-to-accommodate" policy, ask for another pod to be migrated to make room for
+	// the denied increase, or stop asking if we no longer need to.
+	if e.state.conf.migrateToAccommodate() && !startingMigration {
+		if nodeFull {
+			name := pod.vm.name
+			node.accommodating = &name
+		} else if node.accommodating != nil && *node.accommodating == pod.vm.name {
+			node.accommodating = nil
+		}
+	}
+
+	if startingMigration {
+		checkDenied(api.PermitDeniedMigrating)
+	} else if nodeFull {
+		checkDenied(api.PermitDeniedNodeFull)
+	} else if growthLimited {
+		checkDenied(api.PermitDeniedGrowthLimit)
+	}
+
+	if !startingMigration {
+		e.holdBackOverClusterBudget(logger, pod, node, before, cpuFactor, memFactor)
+		checkDenied(api.PermitDeniedClusterBudget)
+	}
+
+	// Without a separate audit output, the verdict above already records any denial.
+	granted := api.Resources{VCPU: pod.cpu.Reserved, Mem: pod.mem.Reserved}
+	if e.auditLogger != nil && !startingMigration && (granted.VCPU < req.VCPU || granted.Mem < req.Mem) {
+		e.auditLog(
+			logger,
+			zap.Object("pod", pod.name),
+			zap.String("node", node.name),
+			zap.String("correlationID", correlationID),
+		).Warn(
+			"Denied increase for pod",
+			zap.Object("requested", req),
+			zap.Object("granted", granted),
+		)
+	}
+
+	if e.state.conf.StrictComputeUnitAlignment && !startingMigration {
+		// Only a partially-granted increase is held back, so there's already a denial cause.
+		holdBackUnalignedIncrease(logger, pod, node, before, req, cu, cpuFactor)
+	}
+
+	if e.state.conf.VerdictSummary != nil {
+		after := api.Resources{VCPU: pod.cpu.Reserved, Mem: pod.mem.Reserved}
+		node.verdictSummary.recordRequest(before, req, after)
+	}
+
+	// Because memory is reserved in multiples of the VM's memGranularity, the pod's reservation may
+	// be more than what was requested. The permit never is.
+	reserved := api.Resources{VCPU: pod.cpu.Reserved, Mem: util.Min(pod.mem.Reserved, req.Mem)}
+
+	// As described in handleRequested, we may grant resources that don't correspond to the same
+	// number of compute units for CPU and memory. Track how often this actually happens.
+	//
+	// As with the check on the request above, this is expected if either resource is at the VM's
+	// minimum or maximum.
+	atMin := reserved.VCPU == pod.cpu.Min || reserved.Mem == pod.mem.Min
+	atMax := reserved.VCPU == pod.cpu.Max || reserved.Mem == pod.mem.Max
+	if !isEvenComputeUnits(reserved, cu) && !(atMin || atMax) {
+		e.metrics.unevenComputeUnits.Inc()
+		logger.Debug(
+			"Pod reserved resources do not correspond to an equal number of compute units",
+			zap.Object("requested", req), zap.Object("reserved", reserved), zap.Object("computeUnit", cu),
+		)
+	}
+
+	return reserved, denialCause, 200, nil
+}
+
+// reserveBurst reserves burst headroom for the pod above its current permit, if enabled by the
+// config, returning the amount reserved. The burst is limited by the node's watermark (see
+// handleBurstGranted) and by what's left of the cluster-wide reservation budget, if there is one.
+//
+// If burst headroom is not enabled, or none could be reserved, returns nil.
+func (e *AutoscaleEnforcer) reserveBurst(
+	logger *zap.Logger,
+	pod *podState,
+	node *nodeState,
+	cu api.Resources,
+	supportsFractionalCPU bool,
+) *api.Resources {
+	conf := e.state.conf.BurstBuffer
+	if conf == nil {
+		return nil
+	}
+
+	amount := conf.burstForComputeUnit(cu, pod.vm.memSlotSize, supportsFractionalCPU)
+
+	// The burst counts towards the cluster-wide reservation budget like anything else, so it's
+	// limited to what's left of it.
+	if maxCPU, maxMem := e.state.conf.MaxClusterReservableCPU, e.state.conf.MaxClusterReservableMem; maxCPU != 0 || maxMem != 0 {
+		total := e.state.clusterReserved()
+		if maxCPU != 0 {
+			amount.VCPU = util.Min(amount.VCPU, util.SaturatingSub(maxCPU, total.VCPU))
+		}
+		if maxMem != 0 {
+			amount.Mem = util.Min(amount.Mem, util.SaturatingSub(maxMem, total.Mem))
+		}
+	}
+
+	// As in burstForComputeUnit, CPU is kept to whole CPUs if fractional CPU isn't supported, and
+	// memory to a whole number of memory slots.
+	cpuFactor := vmapi.MilliCPU(1)
+	if !supportsFractionalCPU {
+		cpuFactor = 1000
+	}
+
+	cpuVerdict := makeResourceTransitioner(&node.cpu, &pod.cpu).
+		handleBurstGranted(amount.VCPU, cpuFactor)
+	memVerdict := makeResourceTransitioner(&node.mem, &pod.mem).
+		handleBurstGranted(amount.Mem, pod.vm.memSlotSize)
+
+	logger.Info(
+		"Reserved burst headroom for pod",
+		zap.Object("verdict", verdictSet{
+			cpu: cpuVerdict,
+			mem: memVerdict,
+		}),
+	)
+
+	if pod.cpu.Burst == 0 && pod.mem.Burst == 0 {
+		return nil
+	}
+	return &api.Resources{VCPU: pod.cpu.Burst, Mem: pod.mem.Burst}
+}
+
+// emitNodeFull logs that the pod's requested increase was denied because the node is full, and emits
+// a Kubernetes Event on the node, at most once per Config.NodeFullEvents.MinIntervalSeconds.
+func (e *AutoscaleEnforcer) emitNodeFull(
+	logger *zap.Logger,
+	correlationID string,
+	pod *podState,
+	node *nodeState,
+	req api.Resources,
+	now time.Time,
+) {
+	reserved := api.Resources{VCPU: pod.cpu.Reserved, Mem: pod.mem.Reserved}
+	logger.Warn(
+		"Node is full, denied increase for pod",
+		zap.Object("requested", req),
+		zap.Object("reserved", reserved),
+	)
+
+	minInterval := time.Second * time.Duration(e.state.conf.NodeFullEvents.MinIntervalSeconds)
+	if !node.lastNodeFullEvent.IsZero() && now.Sub(node.lastNodeFullEvent) < minInterval {
+		return
+	}
+	node.lastNodeFullEvent = now
+
+	e.handle.EventRecorder().Eventf(
+		&corev1.ObjectReference{Kind: "Node", APIVersion: "v1", Name: node.name}, // regarding
+		nil,                  // related
+		"Warning",            // eventtype
+		"NodeFull",           // reason
+		"HandleAgentRequest", // action
+		"Denied increase for VM %v: requested %v, reserved %v (node reserved cpu %v of %v, mem %v of %v, correlation ID %s)", // note
+		pod.vm.name, req, reserved, node.cpu.Reserved, node.cpu.Total, node.mem.Reserved, node.mem.Total, correlationID,
+	)
+}
+
+// holdBackUnalignedIncrease reduces the increase just granted to the pod for one resource if the
+// other resource couldn't be increased to the same number of compute units, so that the pod's
+// reserved resources stay aligned. Nothing is reduced below what was reserved before the request.
+//
+// This is only used with Config.StrictComputeUnitAlignment.
+func holdBackUnalignedIncrease(
+	logger *zap.Logger,
+	pod *podState,
+	node *nodeState,
+	before api.Resources,
+	req api.Resources,
+	cu api.Resources,
+	cpuFactor vmapi.MilliCPU,
+) {
+	// If we granted everything that was requested, any misalignment is from the request itself.
+	if pod.cpu.Reserved >= req.VCPU && pod.mem.Reserved >= req.Mem {
+		return
+	}
+
+	units := util.Min(uint64(pod.cpu.Reserved/cu.VCPU), uint64(pod.mem.Reserved/cu.Mem))
+	aligned := api.Resources{
+		// If fractional CPU isn't supported, the CPU must also stay a whole number.
+		VCPU: (vmapi.MilliCPU(units) * cu.VCPU / cpuFactor) * cpuFactor,
+		Mem:  api.Bytes(units) * cu.Mem,
+	}
+
+	target := api.Resources{
+		VCPU: util.Max(before.VCPU, aligned.VCPU),
+		Mem:  util.Max(before.Mem, aligned.Mem),
+	}
+	if target.VCPU >= pod.cpu.Reserved && target.Mem >= pod.mem.Reserved {
+		return // already aligned
+	}
+
+	cpuVerdict := makeResourceTransitioner(&node.cpu, &pod.cpu).
+		handleIncreaseHeldBack(target.VCPU)
+	memVerdict := makeResourceTransitioner(&node.mem, &pod.mem).
+		handleIncreaseHeldBack(target.Mem)
+
+	logger.Info(
+		"Held back increase to keep compute units aligned",
+		zap.Object("verdict", verdictSet{
+			cpu: cpuVerdict,
+			mem: memVerdict,
+		}),
+	)
+}
+
+// holdBackOverClusterBudget reduces the increase just granted to the pod if it put the total
+// reservations across the cluster above Config.MaxClusterReservableCPU or MaxClusterReservableMem.
+// Nothing is reduced below what was reserved before the request, and what's held back stays a
+// multiple of the factor for each resource.
+func (e *AutoscaleEnforcer) holdBackOverClusterBudget(
+	logger *zap.Logger,
+	pod *podState,
+	node *nodeState,
+	before api.Resources,
+	cpuFactor vmapi.MilliCPU,
+	memFactor api.Bytes,
+) {
+	maxCPU, maxMem := e.state.conf.MaxClusterReservableCPU, e.state.conf.MaxClusterReservableMem
+	if maxCPU == 0 && maxMem == 0 {
+		return
+	}
+
+	total := e.state.clusterReserved()
+
+	target := api.Resources{VCPU: pod.cpu.Reserved, Mem: pod.mem.Reserved}
+	if maxCPU != 0 && total.VCPU > maxCPU {
+		target.VCPU = overBudgetTarget(pod.cpu.Reserved, before.VCPU, total.VCPU-maxCPU, cpuFactor)
+	}
+	if maxMem != 0 && total.Mem > maxMem {
+		target.Mem = overBudgetTarget(pod.mem.Reserved, before.Mem, total.Mem-maxMem, memFactor)
+	}
+	if target.VCPU >= pod.cpu.Reserved && target.Mem >= pod.mem.Reserved {
+		return // within budget, or no increase to hold back
+	}
+
+	cpuVerdict := makeResourceTransitioner(&node.cpu, &pod.cpu).
+		handleIncreaseHeldBack(target.VCPU)
+	memVerdict := makeResourceTransitioner(&node.mem, &pod.mem).
+		handleIncreaseHeldBack(target.Mem)
+
+	logger.Warn(
+		"Held back increase because cluster-wide reservation budget is exhausted",
+		zap.Object("clusterReserved", total),
+		zap.Object("clusterMax", api.Resources{VCPU: maxCPU, Mem: maxMem}),
+		zap.Object("verdict", verdictSet{
+			cpu: cpuVerdict,
+			mem: memVerdict,
+		}),
+	)
+}
+
+// overBudgetTarget returns what the pod's reservation should be reduced to, given that the cluster
+// is over budget by the amount. Only the increase from before may be held back, and the amount held
+// back is rounded up to a multiple of the factor.
+func overBudgetTarget[T constraints.Unsigned](reserved, before, over, factor T) T {
+	increase := util.SaturatingSub(reserved, before)
+	heldBack := util.Min(increase, ((over+factor-1)/factor)*factor)
+	return reserved - heldBack
+}
+
+// isEvenComputeUnits returns whether the resources are an integer multiple of the compute unit,
+// with the same multiple for both CPU and memory
+func isEvenComputeUnits(r api.Resources, cu api.Resources) bool {
+	return r.VCPU%cu.VCPU == 0 && r.Mem%cu.Mem == 0 && uint64(r.VCPU/cu.VCPU) == uint64(r.Mem/cu.Mem)
 }
 
 func (e *AutoscaleEnforcer) updateMetricsAndCheckMustMigrate(
@@ -364,26 +842,93 @@ func (e *AutoscaleEnforcer) updateMetricsAndCheckMustMigrate(
 	//
 	// A third condition, "the pod is marked to always migrate" causes it to migrate even if neither
 	// of the above conditions are met, so long as it has *previously* provided metrics.
-	shouldMigrate := node.mq.isNextInQueue(vm) && node.tooMuchPressure(logger)
+	dwell := time.Second * time.Duration(e.state.conf.CapacityPressureDwellSeconds)
+	shouldMigrate := node.mq.isNextInQueue(vm) && node.tooMuchPressure(logger, e.state.clock.Now(), dwell)
+	// If another pod on the node is waiting for room to grow (see Config.IncreaseDenialPolicy), then
+	// migrate this one without waiting for the node to have too much pressure.
+	if !shouldMigrate && node.mq.isNextInQueue(vm) && node.accommodating != nil && *node.accommodating != vm.name {
+		logger.Info("Migrating pod to make room for denied increase", zap.Object("accommodating", *node.accommodating))
+		shouldMigrate = true
+	}
+	// If we're asking pods to downscale first, then only migrate if we've already waited long enough
+	// for that to relieve the pressure. As with scale-out below, we only update the pending state
+	// for the pod that's next in the queue.
+	if node.mq.isNextInQueue(vm) && e.state.conf.DownscaleBeforeMigrate != nil {
+		wait := time.Second * time.Duration(e.state.conf.DownscaleBeforeMigrate.WaitSeconds)
+		if node.updateDownscalePending(logger, shouldMigrate, e.state.clock.Now(), wait) {
+			shouldMigrate = false
+		}
+	}
+	// If we're trying to scale out first, then only migrate if we've already waited long enough for
+	// the node autoscaler to add capacity. We only update the pending state for the pod that's next
+	// in the queue, because otherwise we don't know whether the node has too much pressure.
+	if node.mq.isNextInQueue(vm) && e.state.conf.deferMigrationForScaleOut() {
+		gracePeriod := time.Second * time.Duration(e.state.conf.ScaleOutGracePeriodSeconds)
+		if node.updateScaleOutPending(logger, e.metrics, shouldMigrate, e.state.clock.Now(), gracePeriod) {
+			shouldMigrate = false
+		}
+	}
 	forcedMigrate := vm.testingOnlyAlwaysMigrate && vm.metrics != nil
 
 	logger.Info("Updating pod metrics", zap.Any("metrics", metrics))
 	oldMetrics := vm.metrics
-	vm.metrics = metrics
-	if vm.currentlyMigrating() {
+	retention := time.Second * time.Duration(e.state.conf.MetricsRetentionSeconds)
+	if vm.setMetrics(metrics, e.state.clock.Now(), retention) {
+		logger.Info(
+			"Request has no metrics, retaining previous metrics",
+			zap.Time("metricsUpdatedAt", vm.metricsUpdatedAt),
+			zap.Duration("retention", retention),
+		)
+	}
+	// The pod may be added to or removed from the migration queue below, so update its metrics once
+	// we're done.
+	defer func() { node.updateQueueMetrics(e.metrics, e.state.clock.Now()) }()
+
+	switch vm.migrationIneligibility(e.state.conf, e.state.clock.Now()) {
+	case skipReasonCurrentlyMigrating:
 		return false // don't do anything else; it's already migrating.
+	case skipReasonCooldown:
+		// If a previous migration failed, keep the pod out of the queue until its cooldown is
+		// over, so that it doesn't block other pods from being selected.
+		node.mq.removeIfPresent(vm)
+		return false
+	case skipReasonNoMetrics:
+		// Pods without metrics are normally migrated only as a last resort (see
+		// isBetterMigrationTarget), but they can also be exempted entirely.
+		node.mq.removeIfPresent(vm)
+		return false
 	}
 
-	node.mq.addOrUpdate(vm)
+	node.mq.addOrUpdate(vm, e.state.clock.Now())
 
 	if !shouldMigrate && !forcedMigrate {
 		return false
 	}
 
+	// Don't start more migrations from this node than allowed at once. The pod stays in the queue,
+	// so it'll be selected again once one of the ongoing migrations finishes.
+	if node.migrationLimitReached(e.state.conf) {
+		logger.Info(
+			"Not migrating pod, node is at its limit of concurrent migrations",
+			zap.Int("ongoingMigrations", node.migratingCount()),
+			zap.Uint("limit", e.state.conf.MaxConcurrentMigrationsPerNode),
+		)
+		return false
+	}
+	// ... and likewise across the whole cluster.
+	if e.state.migrationLimitReached() {
+		logger.Info(
+			"Deferring migration of pod, cluster is at its limit of concurrent migrations",
+			zap.Uint("ongoingMigrations", e.state.ongoingMigrations),
+			zap.Uint("limit", e.state.conf.MaxTotalConcurrentMigrations),
+		)
+		return false
+	}
+
 	// Give the pod a chance to veto migration if its metrics have significantly changed...
 	var veto error
 	if oldMetrics != nil && !forcedMigrate {
-		veto = vm.checkOkToMigrate(*oldMetrics)
+		veto = vm.checkOkToMigrate(*oldMetrics, e.state.conf.MigrationVetoLoadFraction)
 	}
 
 	// ... but override the veto if it's still the best candidate anyways.
@@ -0,0 +1,1824 @@
+package plugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/events"
+	"k8s.io/kubernetes/pkg/scheduler/framework"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestBurstBuffer(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) {
+		conf.BurstBuffer = &burstBufferConfig{ComputeUnitFraction: 0.5}
+	})
+	if path, err := conf.validate(); err != nil {
+		t.Fatalf("invalid config at %s: %s", path, err)
+	}
+
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+		conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+	)
+	pod := addTestPod(node, "vm", true, 2000, 8<<30)
+	pod.cpu.Min, pod.cpu.Max = 1000, 4000
+	pod.mem.Min, pod.mem.Max = 4<<30, 16<<30
+	e := makeTestEnforcer(conf, node)
+
+	cu := api.Resources{VCPU: 1000, Mem: 4 << 30}
+
+	requestWithVersion := func(version api.PluginProtoVersion, resources api.Resources, lastPermit *api.Resources) *api.PluginResponse {
+		resp, status, err := e.handleAgentRequest(zap.NewNop(), api.AgentRequest{
+			ProtoVersion:  version,
+			Pod:           pod.name,
+			ComputeUnit:   &cu,
+			Resources:     resources,
+			LastPermit:    lastPermit,
+			Metrics:       &api.Metrics{LoadAverage1Min: 0, LoadAverage5Min: 0, MemoryUsageBytes: 0},
+			CorrelationID: "",
+		})
+		if err != nil {
+			t.Fatalf("unexpected error handling request (status %d): %s", status, err)
+		}
+		return resp
+	}
+	request := func(resources api.Resources, lastPermit *api.Resources) *api.PluginResponse {
+		return requestWithVersion(api.PluginProtoV5_0, resources, lastPermit)
+	}
+
+	checkState := func(step string, reserved api.Resources, burst api.Resources) {
+		t.Helper()
+		if pod.cpu.Reserved != reserved.VCPU || pod.mem.Reserved != reserved.Mem {
+			t.Errorf("%s: expected pod reserved = %v, got {%d, %d}", step, reserved, pod.cpu.Reserved, pod.mem.Reserved)
+		}
+		if pod.cpu.Burst != burst.VCPU || pod.mem.Burst != burst.Mem {
+			t.Errorf("%s: expected pod burst = %v, got {%d, %d}", step, burst, pod.cpu.Burst, pod.mem.Burst)
+		}
+		// With only the one pod, the node's state should exactly match the pod's.
+		if node.cpu.Reserved != pod.cpu.Reserved || node.mem.Reserved != pod.mem.Reserved {
+			t.Errorf("%s: expected node reserved to match pod, got {%d, %d}", step, node.cpu.Reserved, node.mem.Reserved)
+		}
+		if node.cpu.Burst != pod.cpu.Burst || node.mem.Burst != pod.mem.Burst {
+			t.Errorf("%s: expected node burst to match pod, got {%d, %d}", step, node.cpu.Burst, node.mem.Burst)
+		}
+	}
+
+	checkResponse := func(step string, resp *api.PluginResponse, permit api.Resources, burst *api.Resources) {
+		t.Helper()
+		if resp.Permit != permit {
+			t.Errorf("%s: expected permit = %v, got %v", step, permit, resp.Permit)
+		}
+		if (resp.Burst == nil) != (burst == nil) || (burst != nil && *resp.Burst != *burst) {
+			t.Errorf("%s: expected burst = %v, got %v", step, burst, resp.Burst)
+		}
+	}
+
+	halfCU := api.Resources{VCPU: 500, Mem: 2 << 30}
+
+	// Initial request: no change, so we just get burst headroom on top.
+	resp := request(api.Resources{VCPU: 2000, Mem: 8 << 30}, nil)
+	checkResponse("initial", resp, api.Resources{VCPU: 2000, Mem: 8 << 30}, &halfCU)
+	checkState("initial", api.Resources{VCPU: 2500, Mem: 10 << 30}, halfCU)
+
+	// The agent used all of the burst, which should be converted into normal reserved resources,
+	// with more burst headroom given on top of that.
+	permit := resp.Permit
+	resp = request(api.Resources{VCPU: 2500, Mem: 10 << 30}, &permit)
+	checkResponse("consumed", resp, api.Resources{VCPU: 2500, Mem: 10 << 30}, &halfCU)
+	checkState("consumed", api.Resources{VCPU: 3000, Mem: 12 << 30}, halfCU)
+
+	// Scaling up to the maximum uses the burst and then some, leaving no room for more burst.
+	permit = resp.Permit
+	resp = request(api.Resources{VCPU: 4000, Mem: 16 << 30}, &permit)
+	checkResponse("max", resp, api.Resources{VCPU: 4000, Mem: 16 << 30}, nil)
+	checkState("max", api.Resources{VCPU: 4000, Mem: 16 << 30}, api.Resources{VCPU: 0, Mem: 0})
+
+	// Scaling down gives burst headroom again.
+	permit = resp.Permit
+	resp = request(api.Resources{VCPU: 2000, Mem: 8 << 30}, &permit)
+	checkResponse("downscale", resp, api.Resources{VCPU: 2000, Mem: 8 << 30}, &halfCU)
+	checkState("downscale", api.Resources{VCPU: 2500, Mem: 10 << 30}, halfCU)
+
+	// If the agent didn't use the burst, the unused part is released before it's granted again,
+	// rather than accumulating.
+	permit = resp.Permit
+	resp = request(api.Resources{VCPU: 2000, Mem: 8 << 30}, &permit)
+	checkResponse("unused", resp, api.Resources{VCPU: 2000, Mem: 8 << 30}, &halfCU)
+	checkState("unused", api.Resources{VCPU: 2500, Mem: 10 << 30}, halfCU)
+
+	// Agents using older protocol versions don't know about the burst, so it's released and not
+	// granted again.
+	permit = resp.Permit
+	resp = requestWithVersion(api.PluginProtoV4_0, api.Resources{VCPU: 2000, Mem: 8 << 30}, &permit)
+	checkResponse("old protocol", resp, api.Resources{VCPU: 2000, Mem: 8 << 30}, nil)
+	checkState("old protocol", api.Resources{VCPU: 2000, Mem: 8 << 30}, api.Resources{VCPU: 0, Mem: 0})
+
+	// Removing the pod should release its burst from the node as well.
+	_, _, _, _ = e.unreserveResources(zap.NewNop(), pod.name, false)
+	if node.cpu.Reserved != 0 || node.cpu.Burst != 0 || node.mem.Reserved != 0 || node.mem.Burst != 0 {
+		t.Errorf(
+			"expected node to have nothing reserved after pod removal, got cpu %+v, mem %+v",
+			node.cpu, node.mem,
+		)
+	}
+}
+
+func TestBurstBufferLimits(t *testing.T) {
+	cu := api.Resources{VCPU: 1000, Mem: 4 << 30}
+
+	cases := []struct {
+		name   string
+		modify func(*Config)
+		// nodePressure is the node's CPU capacity pressure from other pods
+		nodePressure vmapi.MilliCPU
+		// expected is the expected burst, or nil if there shouldn't be any
+		expected *api.Resources
+	}{
+		{
+			// With 7000m / 27Gi reserved, there's only 200m / 1.8Gi left below the watermarks.
+			// Memory is rounded down to whole slots.
+			name:         "Watermark",
+			modify:       func(*Config) {},
+			nodePressure: 0,
+			expected:     &api.Resources{VCPU: 200, Mem: 1 << 30},
+		},
+		{
+			// Room below the watermark that other pods are waiting for isn't used for burst.
+			name:         "Pressure",
+			modify:       func(*Config) {},
+			nodePressure: 200,
+			expected:     &api.Resources{VCPU: 0, Mem: 1 << 30},
+		},
+		{
+			// Burst is also limited to what's left of the cluster-wide reservation budget.
+			name: "ClusterBudget",
+			modify: func(conf *Config) {
+				conf.MaxClusterReservableCPU = 7100
+				conf.MaxClusterReservableMem = 27<<30 + 512<<20
+			},
+			nodePressure: 0,
+			expected:     &api.Resources{VCPU: 100, Mem: 0},
+		},
+		{
+			name: "NoRoom",
+			modify: func(conf *Config) {
+				conf.MaxClusterReservableCPU = 7000
+				conf.MaxClusterReservableMem = 27 << 30
+			},
+			nodePressure: 0,
+			expected:     nil,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := makeTestConfig(t, func(conf *Config) {
+				conf.BurstBuffer = &burstBufferConfig{ComputeUnitFraction: 0.5}
+				c.modify(conf)
+			})
+
+			// The node's watermarks are 7200m and 28.8Gi.
+			node := makeTestNodeState(
+				conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+				conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+			)
+			_ = addTestPod(node, "other", false, 4000, 16<<30)
+			pod := addTestPod(node, "vm", true, 3000, 11<<30)
+			pod.cpu.Max, pod.mem.Max = 8000, 32<<30
+			node.cpu.CapacityPressure = c.nodePressure
+			e := makeTestEnforcer(conf, node)
+
+			resp, status, err := e.handleAgentRequest(zap.NewNop(), api.AgentRequest{
+				ProtoVersion:  api.PluginProtoV5_0,
+				Pod:           pod.name,
+				ComputeUnit:   &cu,
+				Resources:     api.Resources{VCPU: 3000, Mem: 11 << 30},
+				LastPermit:    nil,
+				Metrics:       &api.Metrics{LoadAverage1Min: 0, LoadAverage5Min: 0, MemoryUsageBytes: 0},
+				CorrelationID: "",
+			})
+			if err != nil {
+				t.Fatalf("unexpected error handling request (status %d): %s", status, err)
+			}
+
+			if (resp.Burst == nil) != (c.expected == nil) || (c.expected != nil && *resp.Burst != *c.expected) {
+				t.Errorf("expected burst = %v, got %v", c.expected, resp.Burst)
+			}
+			if pod.cpu.Reserved-pod.cpu.Burst != 3000 || pod.mem.Reserved-pod.mem.Burst != 11<<30 {
+				t.Errorf("expected burst not to change what's permitted, got cpu %+v, mem %+v", pod.cpu, pod.mem)
+			}
+		})
+	}
+}
+
+func TestBurstForComputeUnit(t *testing.T) {
+	conf := burstBufferConfig{ComputeUnitFraction: 0.25}
+	cu := api.Resources{VCPU: 1000, Mem: 4 << 30}
+
+	// Memory should be rounded down to a whole number of memory slots
+	got := conf.burstForComputeUnit(cu, 3<<29, true) // 1.5 GiB slots
+	expected := api.Resources{VCPU: 250, Mem: 0}
+	if got != expected {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	got = conf.burstForComputeUnit(cu, 1<<30, true)
+	expected = api.Resources{VCPU: 250, Mem: 1 << 30}
+	if got != expected {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	// ... and CPU to whole CPUs, if fractional CPU isn't supported
+	got = conf.burstForComputeUnit(cu.Mul(4), 1<<30, false)
+	expected = api.Resources{VCPU: vmapi.MilliCPU(1000), Mem: 4 << 30}
+	if got != expected {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestDownscaleBeforeMigrate(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) {
+		doMigration := true
+		conf.DoMigration = &doMigration
+		conf.DownscaleBeforeMigrate = &downscaleBeforeMigrateConfig{
+			WaitSeconds:     60,
+			MaxLoadFraction: 0.5,
+		}
+	})
+	if path, err := conf.validate(); err != nil {
+		t.Fatalf("invalid config at %s: %s", path, err)
+	}
+
+	// With both pods at 4 vCPU, the node is above its watermark of 7.2 vCPU.
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+		conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+	)
+	idle := addTestPod(node, "idle", true, 4000, 8<<30)
+	busy := addTestPod(node, "busy", true, 4000, 8<<30)
+	for _, p := range []*podState{idle, busy} {
+		p.cpu.Min, p.mem.Min = 1000, 2<<30
+	}
+	e := makeTestEnforcer(conf, node)
+
+	cu := conf.ComputeUnit
+
+	// note: If any of these requests were to start a migration, it'd fail because there's no k8s
+	// client in the test enforcer.
+	request := func(pod *podState, resources api.Resources, load float32) *api.PluginResponse {
+		t.Helper()
+		resp, status, err := e.handleAgentRequest(zap.NewNop(), api.AgentRequest{
+			ProtoVersion:  api.PluginProtoV4_0,
+			Pod:           pod.name,
+			ComputeUnit:   &cu,
+			Resources:     resources,
+			LastPermit:    nil,
+			Metrics:       &api.Metrics{LoadAverage1Min: load, LoadAverage5Min: load, MemoryUsageBytes: 0},
+			CorrelationID: "",
+		})
+		if err != nil {
+			t.Fatalf("unexpected error handling request (status %d): %s", status, err)
+		}
+		if resp.Migrate != nil {
+			t.Fatalf("unexpected migration for pod %v", pod.name)
+		}
+		return resp
+	}
+
+	current := api.Resources{VCPU: 4000, Mem: 8 << 30}
+	minimum := api.Resources{VCPU: 1000, Mem: 2 << 30}
+
+	// First requests from each pod just add them to the migration queue. The idle pod is first,
+	// because it has the lower load.
+	_ = request(idle, current, 0.5)
+	_ = request(busy, current, 3.5)
+	if !node.mq.isNextInQueue(idle.vm) {
+		t.Fatal("expected idle pod to be next in the migration queue")
+	}
+
+	// Now that the idle pod is next in the queue, we should notice that the node has too much
+	// pressure, and ask it to downscale instead of migrating.
+	resp := request(idle, current, 0.5)
+	if node.downscalePendingSince == nil {
+		t.Fatal("expected node to be waiting for pods to downscale")
+	}
+	if resp.SuggestedDownscale == nil || *resp.SuggestedDownscale != minimum {
+		t.Errorf("expected idle pod to be asked to downscale to %v, got %v", minimum, resp.SuggestedDownscale)
+	}
+
+	// The busy pod's load is too high to be asked to downscale
+	resp = request(busy, current, 3.5)
+	if resp.SuggestedDownscale != nil {
+		t.Errorf("expected busy pod not to be asked to downscale, got %v", resp.SuggestedDownscale)
+	}
+
+	// The idle pod downscales. It's already at its minimum, so there's nothing more to ask of it.
+	resp = request(idle, minimum, 0.5)
+	if resp.SuggestedDownscale != nil {
+		t.Errorf("expected no downscale suggestion for pod at its minimum, got %v", resp.SuggestedDownscale)
+	}
+	if node.cpu.Reserved != 5000 {
+		t.Fatalf("expected node to have 5000m reserved after downscale, got %v", node.cpu.Reserved)
+	}
+
+	// On the next request, the pressure is resolved, without any migration.
+	_ = request(idle, minimum, 0.5)
+	if node.downscalePendingSince != nil {
+		t.Error("expected node to no longer be waiting for pods to downscale")
+	}
+	if node.tooMuchPressure(zap.NewNop(), time.Now(), 0) {
+		t.Error("expected node to no longer have too much pressure")
+	}
+}
+
+func TestMigrationWithoutMetrics(t *testing.T) {
+	for _, exempt := range []bool{false, true} {
+		conf := makeTestConfig(t, func(conf *Config) {
+			doMigration := true
+			conf.DoMigration = &doMigration
+			conf.ExemptPodsWithoutMetrics = exempt
+		})
+
+		// With both pods at 4 vCPU, the node is above its watermark of 7.2 vCPU. Neither has
+		// provided metrics.
+		node := makeTestNodeState(
+			conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+			conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+		)
+		b := addTestPod(node, "b", true, 4000, 8<<30)
+		a := addTestPod(node, "a", true, 4000, 8<<30)
+		e := makeTestEnforcer(conf, node)
+
+		// First check for each just adds them to the queue (if not exempt)
+		for _, p := range []*podState{b, a} {
+			if e.updateMetricsAndCheckMustMigrate(zap.NewNop(), p.vm, node, nil) {
+				t.Fatalf("exempt=%v: unexpected migration for pod %v on first check", exempt, p.name)
+			}
+		}
+
+		if exempt {
+			if len(node.mq) != 0 {
+				t.Errorf("expected pods without metrics to be kept out of the queue, got %d", len(node.mq))
+			}
+			if e.updateMetricsAndCheckMustMigrate(zap.NewNop(), a.vm, node, nil) {
+				t.Error("expected pod without metrics not to be migrated when exempt")
+			}
+			continue
+		}
+
+		// Even without any metrics, the node has too much pressure, so one of the pods must be
+		// chosen. The order is by name, so that it's deterministic.
+		if !node.mq.isNextInQueue(a.vm) {
+			t.Fatal("expected pod \"a\" to be next in the migration queue")
+		}
+		if !e.updateMetricsAndCheckMustMigrate(zap.NewNop(), a.vm, node, nil) {
+			t.Error("expected pod \"a\" to be migrated as a last resort")
+		}
+		if e.updateMetricsAndCheckMustMigrate(zap.NewNop(), b.vm, node, nil) {
+			t.Error("expected pod \"b\" not to be migrated")
+		}
+
+		// Once a pod has metrics, it's preferred over the pods without.
+		metrics := &api.Metrics{LoadAverage1Min: 4, LoadAverage5Min: 4, MemoryUsageBytes: 0}
+		_ = e.updateMetricsAndCheckMustMigrate(zap.NewNop(), b.vm, node, metrics)
+		if !node.mq.isNextInQueue(b.vm) {
+			t.Error("expected pod with metrics to be ahead of pods without")
+		}
+	}
+}
+
+func TestMaxConcurrentMigrationsPerNode(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) {
+		doMigration := true
+		conf.DoMigration = &doMigration
+		conf.MaxConcurrentMigrationsPerNode = 1
+	})
+
+	// With three pods at 4 vCPU each, the node is far enough above its watermark of 7.2 vCPU that
+	// migrating one pod away isn't enough.
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+		conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+	)
+	a := addTestPod(node, "a", true, 4000, 4<<30)
+	b := addTestPod(node, "b", true, 4000, 4<<30)
+	c := addTestPod(node, "c", true, 4000, 4<<30)
+	e := makeTestEnforcer(conf, node)
+
+	// First check for each just adds them to the queue
+	for _, p := range []*podState{a, b, c} {
+		if e.updateMetricsAndCheckMustMigrate(zap.NewNop(), p.vm, node, nil) {
+			t.Fatalf("unexpected migration for pod %v on first check", p.name)
+		}
+	}
+
+	if !e.updateMetricsAndCheckMustMigrate(zap.NewNop(), a.vm, node, nil) {
+		t.Fatal("expected pod \"a\" to be migrated")
+	}
+	migrationName := util.NamespacedName{Namespace: "default", Name: "migration-a"}
+	e.handlePodStartMigration(zap.NewNop(), a.name, migrationName, true)
+
+	// The node still has too much pressure, but it's already at its limit.
+	if !node.mq.isNextInQueue(b.vm) {
+		t.Fatal("expected pod \"b\" to be next in the migration queue")
+	}
+	for _, p := range []*podState{b, c} {
+		if e.updateMetricsAndCheckMustMigrate(zap.NewNop(), p.vm, node, nil) {
+			t.Errorf("expected pod %v not to be migrated while node is at its limit", p.name)
+		}
+	}
+	if reason := node.migrationDeferral(conf, e.state.clock.Now()); reason != skipReasonMigrationLimit {
+		t.Errorf("expected migration to be deferred with reason %q, got %q", skipReasonMigrationLimit, reason)
+	}
+
+	// Even if a pod were selected anyways, startMigration should refuse it.
+	e.state.lock.Lock()
+	created, err := e.startMigration(context.Background(), zap.NewNop(), b)
+	e.state.lock.Unlock()
+	if err == nil || created {
+		t.Errorf("expected startMigration to fail at the limit, got created = %v, err = %v", created, err)
+	}
+
+	// Once the ongoing migration ends, the next pod in the queue can be migrated.
+	e.handlePodEndMigration(zap.NewNop(), a.name, migrationName)
+	if !e.updateMetricsAndCheckMustMigrate(zap.NewNop(), b.vm, node, nil) {
+		t.Error("expected pod \"b\" to be migrated once the limit is no longer reached")
+	}
+}
+
+func TestMaxTotalConcurrentMigrations(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) {
+		doMigration := true
+		conf.DoMigration = &doMigration
+		conf.MaxTotalConcurrentMigrations = 1
+		conf.MigrationTimeoutSeconds = 60
+	})
+
+	// Both nodes are far enough above their watermark of 7.2 vCPU that each would migrate a pod.
+	makeNode := func(name string) (*nodeState, *podState) {
+		node := makeTestNodeState(
+			conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+			conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+		)
+		node.name = name
+		pod := addTestPod(node, name+"-a", true, 4000, 4<<30)
+		_ = addTestPod(node, name+"-b", true, 4000, 4<<30)
+		return node, pod
+	}
+	first, firstPod := makeNode("first")
+	second, secondPod := makeNode("second")
+	e := makeTestEnforcer(conf, first, second)
+
+	// First check for each just adds them to the queue
+	for _, p := range []*podState{firstPod, secondPod} {
+		if e.updateMetricsAndCheckMustMigrate(zap.NewNop(), p.vm, p.node, nil) {
+			t.Fatalf("unexpected migration for pod %v on first check", p.name)
+		}
+	}
+
+	if !e.updateMetricsAndCheckMustMigrate(zap.NewNop(), firstPod.vm, first, nil) {
+		t.Fatal("expected pod on first node to be migrated")
+	}
+	e.handlePodStartMigration(zap.NewNop(), firstPod.name, util.NamespacedName{Namespace: "default", Name: "migration"}, true)
+	if n := e.state.ongoingMigrations; n != 1 {
+		t.Fatalf("expected 1 ongoing migration, got %d", n)
+	}
+
+	// The second node has its own pressure, but the cluster is already at its limit.
+	if e.updateMetricsAndCheckMustMigrate(zap.NewNop(), secondPod.vm, second, nil) {
+		t.Error("expected pod on second node not to be migrated while the cluster is at its limit")
+	}
+	if !second.mq.isNextInQueue(secondPod.vm) {
+		t.Error("expected deferred pod to stay in its node's migration queue")
+	}
+
+	// Once the migration times out, we stop tracking it, but it may still be running, so it keeps
+	// its slot.
+	e.checkMigrationTimeouts(zap.NewNop(), time.Now().Add(61*time.Second))
+	if firstPod.vm.currentlyMigrating() {
+		t.Fatal("expected migration to have timed out")
+	}
+	if n := e.state.ongoingMigrations; n != 1 {
+		t.Fatalf("expected timed out migration to still be counted, got %d ongoing", n)
+	}
+	if e.updateMetricsAndCheckMustMigrate(zap.NewNop(), secondPod.vm, second, nil) {
+		t.Error("expected pod on second node not to be migrated while a timed out migration holds the slot")
+	}
+
+	// If the source pod is deleted, its migration no longer counts towards the limit.
+	e.handleDeletion(zap.NewNop(), firstPod.name)
+	if n := e.state.ongoingMigrations; n != 0 {
+		t.Fatalf("expected no ongoing migrations after pod deletion, got %d", n)
+	}
+	if !e.updateMetricsAndCheckMustMigrate(zap.NewNop(), secondPod.vm, second, nil) {
+		t.Error("expected pod on second node to be migrated once the limit is no longer reached")
+	}
+}
+
+func TestIncreaseDenialPolicy(t *testing.T) {
+	cases := []struct {
+		policy        increaseDenialPolicy
+		expectMigrate bool
+	}{
+		{policy: increaseDenialDenyFirst, expectMigrate: false},
+		{policy: increaseDenialMigrateToAccommodate, expectMigrate: true},
+	}
+
+	for _, c := range cases {
+		t.Run(string(c.policy), func(t *testing.T) {
+			conf := makeTestConfig(t, func(conf *Config) {
+				doMigration := true
+				conf.DoMigration = &doMigration
+				conf.IncreaseDenialPolicy = c.policy
+			})
+
+			// The node's CPU watermark is its total, so that it can be full without having too
+			// much pressure.
+			node := makeTestNodeState(
+				conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+				conf.NodeConfig.memoryLimits(resourcePtr("64Gi")),
+			)
+			node.cpu.Watermark = node.cpu.Total
+			growing := addTestPod(node, "growing", true, 4000, 16<<30)
+			other := addTestPod(node, "other", true, 3000, 12<<30)
+			e := makeTestEnforcer(conf, node)
+
+			idleMetrics := &api.Metrics{LoadAverage1Min: 0.5, LoadAverage5Min: 0.5, MemoryUsageBytes: 0}
+			busyMetrics := &api.Metrics{LoadAverage1Min: 3.5, LoadAverage5Min: 3.5, MemoryUsageBytes: 0}
+
+			// The other pod is idle, so it's first in the migration queue.
+			_ = e.updateMetricsAndCheckMustMigrate(zap.NewNop(), other.vm, node, idleMetrics)
+
+			request := func(resources api.Resources) *api.PluginResponse {
+				t.Helper()
+				cu := api.Resources{VCPU: 1000, Mem: 4 << 30}
+				resp, status, err := e.handleAgentRequest(zap.NewNop(), api.AgentRequest{
+					ProtoVersion:  api.PluginProtoV4_0,
+					Pod:           growing.name,
+					ComputeUnit:   &cu,
+					Resources:     resources,
+					LastPermit:    nil,
+					Metrics:       busyMetrics,
+					CorrelationID: "",
+				})
+				if err != nil {
+					t.Fatalf("unexpected error handling request (status %d): %s", status, err)
+				}
+				return resp
+			}
+
+			resp := request(api.Resources{VCPU: 6000, Mem: 24 << 30})
+			if resp.DenialCause == nil || *resp.DenialCause != api.PermitDeniedNodeFull {
+				t.Fatalf("expected increase to be denied because the node is full, got %v", resp.DenialCause)
+			}
+			if !node.mq.isNextInQueue(other.vm) {
+				t.Fatal("expected other pod to be next in the migration queue")
+			}
+
+			// The node doesn't have too much pressure, so the other pod should only be migrated if
+			// we're trying to make room for the denied increase.
+			if migrate := e.updateMetricsAndCheckMustMigrate(zap.NewNop(), other.vm, node, idleMetrics); migrate != c.expectMigrate {
+				t.Errorf("expected migrate = %v for other pod, got %v", c.expectMigrate, migrate)
+			}
+			if e.updateMetricsAndCheckMustMigrate(zap.NewNop(), growing.vm, node, busyMetrics) {
+				t.Error("expected growing pod not to be migrated")
+			}
+
+			// Once the other pod is gone, the increase can be granted, and we stop trying to make
+			// room for it.
+			_, _, _, _ = e.unreserveResources(zap.NewNop(), other.name, false)
+			resp = request(api.Resources{VCPU: 6000, Mem: 24 << 30})
+			if resp.DenialCause != nil {
+				t.Errorf("expected increase to be granted, got denial cause %v", *resp.DenialCause)
+			}
+			if node.accommodating != nil {
+				t.Errorf("expected node to no longer be accommodating %v", *node.accommodating)
+			}
+		})
+	}
+}
+
+func TestMetricsRetention(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) {
+		conf.ExemptPodsWithoutMetrics = true
+		conf.MetricsRetentionSeconds = 60
+	})
+
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+		conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+	)
+	pod := addTestPod(node, "pod", true, 1000, 4<<30)
+	e := makeTestEnforcer(conf, node)
+
+	metrics := &api.Metrics{LoadAverage1Min: 0.5, LoadAverage5Min: 0.5, MemoryUsageBytes: 0}
+	_ = e.updateMetricsAndCheckMustMigrate(zap.NewNop(), pod.vm, node, metrics)
+	if !node.mq.isNextInQueue(pod.vm) {
+		t.Fatal("expected pod with metrics to be in the migration queue")
+	}
+
+	// After the agent reconnects, its first request may not have any metrics. The previous metrics
+	// should be kept, so that the pod stays in the queue.
+	_ = e.updateMetricsAndCheckMustMigrate(zap.NewNop(), pod.vm, node, nil)
+	if pod.vm.metrics != metrics {
+		t.Errorf("expected metrics to be retained across reconnect, got %+v", pod.vm.metrics)
+	}
+	if !node.mq.isNextInQueue(pod.vm) {
+		t.Error("expected pod to stay in the migration queue across reconnect")
+	}
+
+	// Once the metrics are older than the retention period, they're stale and should be dropped.
+	now := time.Now()
+	pod.vm.metricsUpdatedAt = now.Add(-61 * time.Second)
+	if pod.vm.setMetrics(nil, now, 60*time.Second) {
+		t.Error("expected stale metrics not to be retained")
+	}
+	if pod.vm.metrics != nil {
+		t.Errorf("expected stale metrics to be cleared, got %+v", pod.vm.metrics)
+	}
+}
+
+func TestOrphanMetrics(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) {
+		conf.OrphanMetrics = &orphanMetricsConfig{MaxPods: 1, RetentionSeconds: 60}
+	})
+
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+		conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+	)
+	e := makeTestEnforcer(conf, node)
+	clock := newFakeClock()
+	e.state.clock = clock
+
+	request := func(name string, metrics *api.Metrics) int {
+		cu := api.Resources{VCPU: 1000, Mem: 4 << 30}
+		_, status, _ := e.handleAgentRequest(zap.NewNop(), api.AgentRequest{
+			ProtoVersion:  api.PluginProtoV4_0,
+			Pod:           util.NamespacedName{Namespace: "default", Name: name},
+			ComputeUnit:   &cu,
+			Resources:     api.Resources{VCPU: 1000, Mem: 4 << 30},
+			LastPermit:    nil,
+			Metrics:       metrics,
+			CorrelationID: "",
+		})
+		return status
+	}
+	register := func(name string) *podState {
+		pod := addTestPod(node, name, true, 1000, 4<<30)
+		e.state.pods[pod.name] = pod
+		e.state.applyOrphanMetrics(zap.NewNop(), pod.name, pod.vm)
+		return pod
+	}
+
+	// Metrics for a pod we don't know about yet should be buffered, and applied once it's
+	// registered.
+	metrics := &api.Metrics{LoadAverage1Min: 0.5, LoadAverage5Min: 0.5, MemoryUsageBytes: 0}
+	if status := request("early", metrics); status != 404 {
+		t.Fatalf("expected request for unknown pod to fail with status 404, got %d", status)
+	}
+	// The buffer only has room for one pod, so these should be dropped.
+	_ = request("dropped", metrics)
+
+	clock.advance(30 * time.Second)
+	early := register("early")
+	if early.vm.metrics == nil || *early.vm.metrics != *metrics {
+		t.Errorf("expected buffered metrics to be applied on registration, got %+v", early.vm.metrics)
+	}
+	if dropped := register("dropped"); dropped.vm.metrics != nil {
+		t.Errorf("expected metrics beyond the buffer size to be dropped, got %+v", dropped.vm.metrics)
+	}
+
+	// Metrics older than the retention period are stale, and should not be applied.
+	_ = request("late", metrics)
+	clock.advance(61 * time.Second)
+	if late := register("late"); late.vm.metrics != nil {
+		t.Errorf("expected stale buffered metrics not to be applied, got %+v", late.vm.metrics)
+	}
+	if len(e.state.orphanMetrics) != 0 {
+		t.Errorf("expected buffer to be empty, got %d entries", len(e.state.orphanMetrics))
+	}
+}
+
+func TestStrictComputeUnitAlignment(t *testing.T) {
+	cases := []struct {
+		name     string
+		strict   bool
+		expected api.Resources
+		pressure api.Resources
+	}{
+		{
+			name:     "Unaligned",
+			strict:   false,
+			expected: api.Resources{VCPU: 4000, Mem: 12 << 30},
+			pressure: api.Resources{VCPU: 0, Mem: 4 << 30},
+		},
+		{
+			name:     "Strict",
+			strict:   true,
+			expected: api.Resources{VCPU: 3000, Mem: 12 << 30},
+			pressure: api.Resources{VCPU: 1000, Mem: 4 << 30},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := makeTestConfig(t, func(conf *Config) {
+				conf.StrictComputeUnitAlignment = c.strict
+			})
+
+			// There's plenty of CPU on the node, but only 4Gi of memory left -- enough for the VM to
+			// go from 2 to 3 compute units, but not 4.
+			node := makeTestNodeState(
+				conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+				conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+			)
+			_ = addTestPod(node, "other", false, 0, 20<<30)
+			pod := addTestPod(node, "vm", true, 2000, 8<<30)
+			pod.cpu.Min, pod.cpu.Max = 1000, 8000
+			pod.mem.Min, pod.mem.Max = 4<<30, 32<<30
+			e := makeTestEnforcer(conf, node)
+
+			cu := api.Resources{VCPU: 1000, Mem: 4 << 30}
+			resp, status, err := e.handleAgentRequest(zap.NewNop(), api.AgentRequest{
+				ProtoVersion:  api.PluginProtoV4_0,
+				Pod:           pod.name,
+				ComputeUnit:   &cu,
+				Resources:     api.Resources{VCPU: 4000, Mem: 16 << 30},
+				LastPermit:    nil,
+				Metrics:       &api.Metrics{LoadAverage1Min: 0, LoadAverage5Min: 0, MemoryUsageBytes: 0},
+				CorrelationID: "",
+			})
+			if err != nil {
+				t.Fatalf("unexpected error handling request (status %d): %s", status, err)
+			}
+
+			if resp.Permit != c.expected {
+				t.Errorf("expected permit = %v, got %v", c.expected, resp.Permit)
+			}
+			pressure := api.Resources{VCPU: pod.cpu.CapacityPressure, Mem: pod.mem.CapacityPressure}
+			if pressure != c.pressure {
+				t.Errorf("expected pod capacity pressure = %v, got %v", c.pressure, pressure)
+			}
+			if node.cpu.Reserved != pod.cpu.Reserved || node.mem.Reserved != 20<<30+pod.mem.Reserved {
+				t.Errorf("node reserved doesn't match pods: cpu %v, mem %v", node.cpu.Reserved, node.mem.Reserved)
+			}
+			if node.cpu.CapacityPressure != pressure.VCPU || node.mem.CapacityPressure != pressure.Mem {
+				t.Errorf("node capacity pressure doesn't match pod: cpu %v, mem %v", node.cpu.CapacityPressure, node.mem.CapacityPressure)
+			}
+		})
+	}
+}
+
+func TestClusterReservationBudget(t *testing.T) {
+	cases := []struct {
+		name     string
+		max      api.Resources
+		expected api.Resources
+		pressure api.Resources
+	}{
+		{
+			name:     "Unlimited",
+			max:      api.Resources{VCPU: 0, Mem: 0},
+			expected: api.Resources{VCPU: 4000, Mem: 16 << 30},
+			pressure: api.Resources{VCPU: 0, Mem: 0},
+		},
+		{
+			name:     "Partial",
+			max:      api.Resources{VCPU: 7000, Mem: 28 << 30},
+			expected: api.Resources{VCPU: 3000, Mem: 12 << 30},
+			pressure: api.Resources{VCPU: 1000, Mem: 4 << 30},
+		},
+		{
+			name:     "Exhausted",
+			max:      api.Resources{VCPU: 6000, Mem: 24 << 30},
+			expected: api.Resources{VCPU: 2000, Mem: 8 << 30},
+			pressure: api.Resources{VCPU: 2000, Mem: 8 << 30},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := makeTestConfig(t, func(conf *Config) {
+				conf.MaxClusterReservableCPU = c.max.VCPU
+				conf.MaxClusterReservableMem = c.max.Mem
+			})
+
+			// The VM's node has plenty of room; it's the other node that uses up the budget.
+			node := makeTestNodeState(
+				conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+				conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+			)
+			pod := addTestPod(node, "vm", true, 2000, 8<<30)
+			pod.cpu.Min, pod.cpu.Max = 1000, 8000
+			pod.mem.Min, pod.mem.Max = 4<<30, 32<<30
+
+			other := makeTestNodeState(
+				conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+				conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+			)
+			other.name = "other-node"
+			_ = addTestPod(other, "other", false, 4000, 16<<30)
+
+			e := makeTestEnforcer(conf, node, other)
+
+			cu := api.Resources{VCPU: 1000, Mem: 4 << 30}
+			resp, status, err := e.handleAgentRequest(zap.NewNop(), api.AgentRequest{
+				ProtoVersion:  api.PluginProtoV4_0,
+				Pod:           pod.name,
+				ComputeUnit:   &cu,
+				Resources:     api.Resources{VCPU: 4000, Mem: 16 << 30},
+				LastPermit:    nil,
+				Metrics:       &api.Metrics{LoadAverage1Min: 0, LoadAverage5Min: 0, MemoryUsageBytes: 0},
+				CorrelationID: "",
+			})
+			if err != nil {
+				t.Fatalf("unexpected error handling request (status %d): %s", status, err)
+			}
+
+			if resp.Permit != c.expected {
+				t.Errorf("expected permit = %v, got %v", c.expected, resp.Permit)
+			}
+			pressure := api.Resources{VCPU: pod.cpu.CapacityPressure, Mem: pod.mem.CapacityPressure}
+			if pressure != c.pressure {
+				t.Errorf("expected pod capacity pressure = %v, got %v", c.pressure, pressure)
+			}
+			if node.cpu.Reserved != pod.cpu.Reserved || node.mem.Reserved != pod.mem.Reserved {
+				t.Errorf("node reserved doesn't match pod: cpu %v, mem %v", node.cpu.Reserved, node.mem.Reserved)
+			}
+			if node.cpu.CapacityPressure != pressure.VCPU || node.mem.CapacityPressure != pressure.Mem {
+				t.Errorf("node capacity pressure doesn't match pod: cpu %v, mem %v", node.cpu.CapacityPressure, node.mem.CapacityPressure)
+			}
+		})
+	}
+}
+
+func TestPermitDenialCause(t *testing.T) {
+	nodeFull := api.PermitDeniedNodeFull
+	migrating := api.PermitDeniedMigrating
+	clusterBudget := api.PermitDeniedClusterBudget
+
+	cases := []struct {
+		name string
+		// otherOnNode and otherOffNode give the memory reserved by non-VM pods on the VM's node and
+		// on another node
+		otherOnNode  api.Bytes
+		otherOffNode api.Bytes
+		maxMem       api.Bytes
+		// startingMigration, if true, handles the request as if the pod is about to be migrated.
+		// Actually starting the migration requires a NeonVM client, so the response isn't checked.
+		startingMigration bool
+		expected          *api.PermitDenialCause
+	}{
+		{
+			name:              "Granted",
+			otherOnNode:       0,
+			otherOffNode:      0,
+			maxMem:            0,
+			startingMigration: false,
+			expected:          nil,
+		},
+		{
+			name:              "NodeFull",
+			otherOnNode:       20 << 30,
+			otherOffNode:      0,
+			maxMem:            0,
+			startingMigration: false,
+			expected:          &nodeFull,
+		},
+		{
+			name:              "Migrating",
+			otherOnNode:       0,
+			otherOffNode:      0,
+			maxMem:            0,
+			startingMigration: true,
+			expected:          &migrating,
+		},
+		{
+			name:              "ClusterBudget",
+			otherOnNode:       0,
+			otherOffNode:      16 << 30,
+			maxMem:            28 << 30,
+			startingMigration: false,
+			expected:          &clusterBudget,
+		},
+		{
+			// If the node is full, that's what the agent should hear about, even if the cluster
+			// budget would also have held back the increase.
+			name:              "NodeFullAndClusterBudget",
+			otherOnNode:       20 << 30,
+			otherOffNode:      8 << 30,
+			maxMem:            36 << 30,
+			startingMigration: false,
+			expected:          &nodeFull,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := makeTestConfig(t, func(conf *Config) {
+				conf.MaxClusterReservableMem = c.maxMem
+			})
+
+			node := makeTestNodeState(
+				conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+				conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+			)
+			if c.otherOnNode != 0 {
+				_ = addTestPod(node, "other", false, 0, c.otherOnNode)
+			}
+			pod := addTestPod(node, "vm", true, 2000, 8<<30)
+			pod.cpu.Min, pod.cpu.Max = 1000, 8000
+			pod.mem.Min, pod.mem.Max = 4<<30, 32<<30
+
+			other := makeTestNodeState(
+				conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+				conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+			)
+			other.name = "other-node"
+			if c.otherOffNode != 0 {
+				_ = addTestPod(other, "other-off-node", false, 0, c.otherOffNode)
+			}
+
+			e := makeTestEnforcer(conf, node, other)
+
+			cu := api.Resources{VCPU: 1000, Mem: 4 << 30}
+			req := api.Resources{VCPU: 4000, Mem: 16 << 30}
+
+			var cause *api.PermitDenialCause
+			if c.startingMigration {
+				var status int
+				var err error
+				_, cause, status, err = e.handleResources(zap.NewNop(), "", pod, node, cu, req, nil, true, true)
+				if err != nil {
+					t.Fatalf("unexpected error handling resources (status %d): %s", status, err)
+				}
+			} else {
+				resp, status, err := e.handleAgentRequest(zap.NewNop(), api.AgentRequest{
+					ProtoVersion:  api.PluginProtoV4_0,
+					Pod:           pod.name,
+					ComputeUnit:   &cu,
+					Resources:     req,
+					LastPermit:    nil,
+					Metrics:       &api.Metrics{LoadAverage1Min: 0, LoadAverage5Min: 0, MemoryUsageBytes: 0},
+					CorrelationID: "",
+				})
+				if err != nil {
+					t.Fatalf("unexpected error handling request (status %d): %s", status, err)
+				}
+				cause = resp.DenialCause
+			}
+
+			if (cause == nil) != (c.expected == nil) || (cause != nil && *cause != *c.expected) {
+				format := func(c *api.PermitDenialCause) string {
+					if c == nil {
+						return "<nil>"
+					}
+					return string(*c)
+				}
+				t.Errorf("expected denial cause %s, got %s", format(c.expected), format(cause))
+			}
+		})
+	}
+}
+
+func TestSeparateLogOutputs(t *testing.T) {
+	conf := makeTestConfig(t, func(*Config) {})
+
+	// Only 4Gi of memory left on the node, so the VM's increase will be partially denied.
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+		conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+	)
+	_ = addTestPod(node, "other", false, 0, 20<<30)
+	pod := addTestPod(node, "vm", true, 2000, 8<<30)
+	pod.cpu.Min, pod.cpu.Max = 1000, 8000
+	pod.mem.Min, pod.mem.Max = 4<<30, 32<<30
+	e := makeTestEnforcer(conf, node)
+
+	auditCore, audit := observer.New(zap.DebugLevel)
+	debugCore, debug := observer.New(zap.DebugLevel)
+	e.auditLogger = zap.New(auditCore)
+	e.debugLogger = zap.New(debugCore)
+
+	cu := api.Resources{VCPU: 1000, Mem: 4 << 30}
+	_, status, err := e.handleAgentRequest(zap.NewNop(), api.AgentRequest{
+		ProtoVersion:  api.PluginProtoV4_0,
+		Pod:           pod.name,
+		ComputeUnit:   &cu,
+		Resources:     api.Resources{VCPU: 4000, Mem: 16 << 30},
+		LastPermit:    nil,
+		Metrics:       &api.Metrics{LoadAverage1Min: 0, LoadAverage5Min: 0, MemoryUsageBytes: 0},
+		CorrelationID: "",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error handling request (status %d): %s", status, err)
+	}
+
+	const auditMsg = "Denied increase for pod"
+	const debugMsg = "Handled requested resources from pod"
+
+	if n := audit.FilterMessage(auditMsg).Len(); n != 1 {
+		t.Errorf("expected 1 %q entry in audit logs, got %d", auditMsg, n)
+	}
+	if n := audit.FilterMessage(debugMsg).Len(); n != 0 {
+		t.Errorf("expected no %q entries in audit logs, got %d", debugMsg, n)
+	}
+	if n := debug.FilterMessage(debugMsg).Len(); n != 1 {
+		t.Errorf("expected 1 %q entry in debug logs, got %d", debugMsg, n)
+	}
+	if n := debug.FilterMessage(auditMsg).Len(); n != 0 {
+		t.Errorf("expected no %q entries in debug logs, got %d", auditMsg, n)
+	}
+}
+
+func TestCorrelationID(t *testing.T) {
+	cases := []struct {
+		name     string
+		provided string
+	}{
+		{name: "Provided", provided: "test-correlation-id"},
+		{name: "Assigned", provided: ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := makeTestConfig(t, func(*Config) {})
+
+			node := makeTestNodeState(
+				conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+				conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+			)
+			pod := addTestPod(node, "vm", true, 2000, 8<<30)
+			pod.cpu.Min, pod.cpu.Max = 1000, 8000
+			pod.mem.Min, pod.mem.Max = 4<<30, 32<<30
+			e := makeTestEnforcer(conf, node)
+
+			// Verdicts logged to a separate output don't have the request logger's fields, so the
+			// correlation ID must be included explicitly.
+			debugCore, debug := observer.New(zap.DebugLevel)
+			e.debugLogger = zap.New(debugCore)
+
+			cu := api.Resources{VCPU: 1000, Mem: 4 << 30}
+			_, status, err := e.handleAgentRequest(zap.NewNop(), api.AgentRequest{
+				ProtoVersion:  api.PluginProtoV4_0,
+				Pod:           pod.name,
+				ComputeUnit:   &cu,
+				Resources:     api.Resources{VCPU: 3000, Mem: 12 << 30},
+				LastPermit:    nil,
+				Metrics:       &api.Metrics{LoadAverage1Min: 0, LoadAverage5Min: 0, MemoryUsageBytes: 0},
+				CorrelationID: c.provided,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error handling request (status %d): %s", status, err)
+			}
+
+			verdicts := debug.FilterMessage("Handled requested resources from pod").All()
+			if len(verdicts) != 1 {
+				t.Fatalf("expected 1 verdict, got %d", len(verdicts))
+			}
+			id, ok := verdicts[0].ContextMap()["correlationID"].(string)
+			if !ok || id == "" {
+				t.Fatalf("expected verdict to have a correlation ID, got fields %v", verdicts[0].ContextMap())
+			}
+			if c.provided != "" && id != c.provided {
+				t.Errorf("expected correlation ID %q, got %q", c.provided, id)
+			}
+		})
+	}
+}
+
+func TestVerdictSummary(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) {
+		conf.VerdictSummary = &verdictSummaryConfig{IntervalSeconds: 60}
+	})
+	if path, err := conf.validate(); err != nil {
+		t.Fatalf("invalid config at %s: %s", path, err)
+	}
+
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+		conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+	)
+	_ = addTestPod(node, "other", false, 0, 16<<30)
+	pod := addTestPod(node, "vm", true, 2000, 8<<30)
+	pod.cpu.Min, pod.cpu.Max = 1000, 8000
+	pod.mem.Min, pod.mem.Max = 4<<30, 32<<30
+	e := makeTestEnforcer(conf, node)
+
+	cu := api.Resources{VCPU: 1000, Mem: 4 << 30}
+	request := func(resources api.Resources) {
+		t.Helper()
+		_, status, err := e.handleAgentRequest(zap.NewNop(), api.AgentRequest{
+			ProtoVersion:  api.PluginProtoV4_0,
+			Pod:           pod.name,
+			ComputeUnit:   &cu,
+			Resources:     resources,
+			LastPermit:    nil,
+			Metrics:       &api.Metrics{LoadAverage1Min: 0, LoadAverage5Min: 0, MemoryUsageBytes: 0},
+			CorrelationID: "",
+		})
+		if err != nil {
+			t.Fatalf("unexpected error handling request (status %d): %s", status, err)
+		}
+	}
+
+	// Fully granted increase
+	request(api.Resources{VCPU: 3000, Mem: 12 << 30})
+	// No change
+	request(api.Resources{VCPU: 3000, Mem: 12 << 30})
+	// Only 4Gi of memory left on the node, so half of the memory increase is denied
+	request(api.Resources{VCPU: 5000, Mem: 20 << 30})
+
+	expected := nodeVerdictSummary{
+		Requests:          3,
+		Granted:           api.Resources{VCPU: 3000, Mem: 8 << 30},
+		Denied:            api.Resources{VCPU: 0, Mem: 4 << 30},
+		MigrationsStarted: 0,
+	}
+	if node.verdictSummary != expected {
+		t.Errorf("expected summary %+v, got %+v", expected, node.verdictSummary)
+	}
+
+	// Flushing the summary should reset it
+	e.flushVerdictSummaries(zap.NewNop())
+	var empty nodeVerdictSummary
+	if node.verdictSummary != empty {
+		t.Errorf("expected summary to be reset after flush, got %+v", node.verdictSummary)
+	}
+
+	request(api.Resources{VCPU: 4000, Mem: 16 << 30})
+	expected = nodeVerdictSummary{
+		Requests:          1,
+		Granted:           api.Resources{VCPU: 0, Mem: 0},
+		Denied:            api.Resources{VCPU: 0, Mem: 0},
+		MigrationsStarted: 0,
+	}
+	if node.verdictSummary != expected {
+		t.Errorf("expected summary %+v after flush, got %+v", expected, node.verdictSummary)
+	}
+}
+
+func TestComputeUnitChange(t *testing.T) {
+	conf := makeTestConfig(t, func(*Config) {})
+
+	// There's only 2Gi of memory left on the node. With the old compute unit, that's not enough to
+	// grant any increase, so the pod has pressure. With the new compute unit, it is.
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+		conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+	)
+	_ = addTestPod(node, "other", false, 0, 22<<30)
+	pod := addTestPod(node, "vm", true, 2000, 8<<30)
+	pod.cpu.Min, pod.cpu.Max = 1000, 8000
+	pod.mem.Min, pod.mem.Max = 4<<30, 32<<30
+
+	oldCU := api.Resources{VCPU: 1000, Mem: 4 << 30}
+	newCU := api.Resources{VCPU: 500, Mem: 2 << 30}
+	pod.vm.mostRecentComputeUnit = &oldCU
+	pod.mem.CapacityPressure = 4 << 30
+	node.mem.CapacityPressure = 4 << 30
+
+	// Check the transition itself first, on a copy of the state
+	{
+		nodeMem, podMem := node.mem, pod.mem
+		_ = makeResourceTransitioner(&nodeMem, &podMem).handleComputeUnitChanged()
+		if podMem.CapacityPressure != 0 || nodeMem.CapacityPressure != 0 {
+			t.Fatalf(
+				"expected pressure to be cleared, got pod = %v, node = %v",
+				podMem.CapacityPressure, nodeMem.CapacityPressure,
+			)
+		}
+		if podMem.Reserved != pod.mem.Reserved || nodeMem.Reserved != node.mem.Reserved {
+			t.Fatal("expected reserved resources not to change")
+		}
+	}
+
+	e := makeTestEnforcer(conf, node)
+
+	resp, status, err := e.handleAgentRequest(zap.NewNop(), api.AgentRequest{
+		ProtoVersion:  api.PluginProtoV4_0,
+		Pod:           pod.name,
+		ComputeUnit:   &newCU,
+		Resources:     api.Resources{VCPU: 3000, Mem: 12 << 30},
+		LastPermit:    nil,
+		Metrics:       &api.Metrics{LoadAverage1Min: 0, LoadAverage5Min: 0, MemoryUsageBytes: 0},
+		CorrelationID: "",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error handling request (status %d): %s", status, err)
+	}
+
+	// Memory should be increased by a single new compute unit, with the rest as pressure measured in
+	// the new compute unit.
+	expectedPermit := api.Resources{VCPU: 3000, Mem: 10 << 30}
+	if resp.Permit != expectedPermit {
+		t.Errorf("expected permit = %v, got %v", expectedPermit, resp.Permit)
+	}
+	if pod.cpu.CapacityPressure != 0 || pod.mem.CapacityPressure != 2<<30 {
+		t.Errorf("expected pod pressure = {0, 2Gi}, got {%v, %v}", pod.cpu.CapacityPressure, pod.mem.CapacityPressure)
+	}
+	if node.cpu.CapacityPressure != pod.cpu.CapacityPressure || node.mem.CapacityPressure != pod.mem.CapacityPressure {
+		t.Errorf(
+			"expected node pressure to match pod, got {%v, %v}",
+			node.cpu.CapacityPressure, node.mem.CapacityPressure,
+		)
+	}
+
+	// The new compute unit should now be recorded as the most recent one, so that another request
+	// with it isn't treated as a change: the pressure is kept, and the request is checked for
+	// alignment with the compute unit.
+	if pod.vm.mostRecentComputeUnit == nil || *pod.vm.mostRecentComputeUnit != newCU {
+		t.Fatalf("expected most recent compute unit = %v, got %v", newCU, pod.vm.mostRecentComputeUnit)
+	}
+
+	request := func(resources api.Resources) *observer.ObservedLogs {
+		t.Helper()
+		core, logs := observer.New(zap.InfoLevel)
+		_, status, err := e.handleAgentRequest(zap.New(core), api.AgentRequest{
+			ProtoVersion:  api.PluginProtoV4_0,
+			Pod:           pod.name,
+			ComputeUnit:   &newCU,
+			Resources:     resources,
+			LastPermit:    &expectedPermit,
+			Metrics:       &api.Metrics{LoadAverage1Min: 0, LoadAverage5Min: 0, MemoryUsageBytes: 0},
+			CorrelationID: "",
+		})
+		if err != nil {
+			t.Fatalf("unexpected error handling request (status %d): %s", status, err)
+		}
+		return logs
+	}
+
+	logs := request(api.Resources{VCPU: 3000, Mem: 12 << 30})
+	if n := logs.FilterMessage("Handled change in compute unit for pod").Len(); n != 0 {
+		t.Error("expected request with the same compute unit not to be handled as a change")
+	}
+	if pod.cpu.CapacityPressure != 0 || pod.mem.CapacityPressure != 2<<30 {
+		t.Errorf(
+			"expected pod pressure = {0, 2Gi} to be kept, got {%v, %v}",
+			pod.cpu.CapacityPressure, pod.mem.CapacityPressure,
+		)
+	}
+
+	logs = request(api.Resources{VCPU: 3250, Mem: 12 << 30})
+	if n := logs.FilterMessage("Pod requested resources do not divide cleanly by previous compute unit").Len(); n != 1 {
+		t.Errorf("expected unaligned request to be logged once, got %d", n)
+	}
+}
+
+// fakeEventsHandle is a framework.Handle that only supports EventRecorder()
+type fakeEventsHandle struct {
+	framework.Handle
+	recorder *events.FakeRecorder
+}
+
+func (h fakeEventsHandle) EventRecorder() events.EventRecorder {
+	return h.recorder
+}
+
+func TestNodeFullEvents(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) {
+		conf.NodeFullEvents = &nodeFullEventsConfig{MinIntervalSeconds: 60}
+	})
+	if path, err := conf.validate(); err != nil {
+		t.Fatalf("invalid config at %s: %s", path, err)
+	}
+
+	// Only 4Gi of memory left on the node
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+		conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+	)
+	_ = addTestPod(node, "other", false, 0, 20<<30)
+	pod := addTestPod(node, "vm", true, 2000, 8<<30)
+	pod.cpu.Min, pod.cpu.Max = 1000, 8000
+	pod.mem.Min, pod.mem.Max = 4<<30, 32<<30
+	e := makeTestEnforcer(conf, node)
+	recorder := events.NewFakeRecorder(10)
+	e.handle = fakeEventsHandle{Handle: nil, recorder: recorder}
+
+	cu := api.Resources{VCPU: 1000, Mem: 4 << 30}
+	request := func(resources api.Resources) {
+		t.Helper()
+		_, status, err := e.handleAgentRequest(zap.NewNop(), api.AgentRequest{
+			ProtoVersion:  api.PluginProtoV4_0,
+			Pod:           pod.name,
+			ComputeUnit:   &cu,
+			Resources:     resources,
+			LastPermit:    nil,
+			Metrics:       &api.Metrics{LoadAverage1Min: 0, LoadAverage5Min: 0, MemoryUsageBytes: 0},
+			CorrelationID: "",
+		})
+		if err != nil {
+			t.Fatalf("unexpected error handling request (status %d): %s", status, err)
+		}
+	}
+	expectEvents := func(step string, count int) {
+		t.Helper()
+		if len(recorder.Events) != count {
+			t.Fatalf("%s: expected %d events, got %d", step, count, len(recorder.Events))
+		}
+		for i := 0; i < count; i++ {
+			event := <-recorder.Events
+			if !strings.HasPrefix(event, "Warning NodeFull") {
+				t.Errorf("%s: unexpected event %q", step, event)
+			}
+		}
+	}
+
+	// An increase that fits shouldn't emit anything
+	request(api.Resources{VCPU: 3000, Mem: 12 << 30})
+	expectEvents("fits", 0)
+
+	// ... but one that's capped should
+	request(api.Resources{VCPU: 4000, Mem: 16 << 30})
+	expectEvents("capped", 1)
+	if pod.mem.Reserved != 12<<30 {
+		t.Fatalf("expected memory to stay at 12Gi, got %v", pod.mem.Reserved)
+	}
+
+	// Further capped increases within the interval are rate limited
+	request(api.Resources{VCPU: 4000, Mem: 16 << 30})
+	expectEvents("rate limited", 0)
+
+	// ... until the interval has passed
+	node.lastNodeFullEvent = time.Now().Add(-time.Minute)
+	request(api.Resources{VCPU: 4000, Mem: 16 << 30})
+	expectEvents("after interval", 1)
+}
+
+func TestMemReservationGranularity(t *testing.T) {
+	const memSlotSize = 512 << 20 // 512Mi
+
+	labeled := func(value string) *corev1.Pod {
+		pod := &corev1.Pod{}
+		pod.Labels = map[string]string{api.LabelMemReservationGranularity: value}
+		return pod
+	}
+
+	granularity, err := memReservationGranularity(&corev1.Pod{}, memSlotSize)
+	if err != nil || granularity != memSlotSize {
+		t.Errorf("without label: expected granularity = %v, got %v (err = %v)", api.Bytes(memSlotSize), granularity, err)
+	}
+	if _, err := memReservationGranularity(labeled("768Mi"), memSlotSize); err == nil {
+		t.Errorf("expected error for granularity that isn't a multiple of the memory slot size")
+	}
+	granularity, err = memReservationGranularity(labeled("1Gi"), memSlotSize)
+	if err != nil || granularity != 1<<30 {
+		t.Fatalf("expected granularity = 1Gi, got %v (err = %v)", granularity, err)
+	}
+
+	conf := makeTestConfig(t, func(*Config) {})
+
+	// A VM backed by 1Gi hugepages, with a memory slot size of 512Mi
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+		conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+	)
+	pod := addTestPod(node, "vm", true, 500, 1<<30)
+	pod.vm.memSlotSize = memSlotSize
+	pod.vm.memGranularity = granularity
+	pod.cpu.Min, pod.cpu.Max = 250, 2000
+	pod.mem.Min, pod.mem.Max = 512<<20, 4<<30
+	e := makeTestEnforcer(conf, node)
+
+	cu := api.Resources{VCPU: 250, Mem: 512 << 20}
+	request := func(step string, resources api.Resources, lastPermit *api.Resources, reservedMem api.Bytes) {
+		t.Helper()
+		resp, status, err := e.handleAgentRequest(zap.NewNop(), api.AgentRequest{
+			ProtoVersion:  api.PluginProtoV4_0,
+			Pod:           pod.name,
+			ComputeUnit:   &cu,
+			Resources:     resources,
+			LastPermit:    lastPermit,
+			Metrics:       &api.Metrics{LoadAverage1Min: 0, LoadAverage5Min: 0, MemoryUsageBytes: 0},
+			CorrelationID: "",
+		})
+		if err != nil {
+			t.Fatalf("%s: unexpected error handling request (status %d): %s", step, status, err)
+		}
+		// The agent must never be permitted more than it asked for, even if we reserved more.
+		if resp.Permit != resources {
+			t.Errorf("%s: expected permit = %v, got %v", step, resources, resp.Permit)
+		}
+		if pod.mem.Reserved != reservedMem || node.mem.Reserved != reservedMem {
+			t.Errorf("%s: expected reserved mem = %v, got pod %v, node %v", step, reservedMem, pod.mem.Reserved, node.mem.Reserved)
+		}
+	}
+
+	// Increasing to 2.5Gi reserves 3Gi, because the VM can only use whole hugepages
+	request("increase", api.Resources{VCPU: 1250, Mem: 5 << 29}, nil, 3<<30)
+	// The last permit is rounded up in the same way, so the reservation doesn't shrink
+	request("unchanged", api.Resources{VCPU: 1250, Mem: 5 << 29}, &api.Resources{VCPU: 1250, Mem: 5 << 29}, 3<<30)
+	// Decreasing to 1.5Gi still reserves 2Gi
+	request("decrease", api.Resources{VCPU: 750, Mem: 3 << 29}, &api.Resources{VCPU: 1250, Mem: 5 << 29}, 2<<30)
+}
+
+func TestZeroResources(t *testing.T) {
+	cases := []struct {
+		name string
+		min  api.Resources
+	}{
+		{name: "ZeroRequest", min: api.Resources{VCPU: 1000, Mem: 4 << 30}},
+		{name: "ZeroMin", min: api.Resources{VCPU: 0, Mem: 0}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := makeTestConfig(t, func(*Config) {})
+
+			node := makeTestNodeState(
+				conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+				conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+			)
+			_ = addTestPod(node, "other", false, 1000, 4<<30)
+			// The VM hasn't contacted us yet, so half of what's reserved for it is buffer.
+			pod := addTestPod(node, "vm", true, 2000, 8<<30)
+			pod.cpu.Min, pod.cpu.Max = c.min.VCPU, 2000
+			pod.mem.Min, pod.mem.Max = c.min.Mem, 8<<30
+			pod.cpu.Buffer, pod.mem.Buffer = 1000, 4<<30
+			node.cpu.Buffer, node.mem.Buffer = 1000, 4<<30
+
+			e := makeTestEnforcer(conf, node)
+
+			cu := api.Resources{VCPU: 1000, Mem: 4 << 30}
+			resp, status, err := e.handleAgentRequest(zap.NewNop(), api.AgentRequest{
+				ProtoVersion:  api.PluginProtoV4_0,
+				Pod:           pod.name,
+				ComputeUnit:   &cu,
+				Resources:     api.Resources{VCPU: 0, Mem: 0},
+				LastPermit:    nil,
+				Metrics:       &api.Metrics{LoadAverage1Min: 0, LoadAverage5Min: 0, MemoryUsageBytes: 0},
+				CorrelationID: "",
+			})
+			if err != nil {
+				t.Fatalf("unexpected error handling request (status %d): %s", status, err)
+			}
+
+			// Everything reserved for the VM should be released, leaving only the other pod.
+			if resp.Permit != (api.Resources{VCPU: 0, Mem: 0}) {
+				t.Errorf("expected zero permit, got %v", resp.Permit)
+			}
+			if pod.cpu.Reserved != 0 || pod.mem.Reserved != 0 || pod.cpu.Buffer != 0 || pod.mem.Buffer != 0 {
+				t.Errorf(
+					"expected pod reserved and buffer to be zero, got reserved {%v, %v}, buffer {%v, %v}",
+					pod.cpu.Reserved, pod.mem.Reserved, pod.cpu.Buffer, pod.mem.Buffer,
+				)
+			}
+			if node.cpu.Reserved != 1000 || node.mem.Reserved != 4<<30 {
+				t.Errorf("expected node reserved = {1000, 4Gi}, got {%v, %v}", node.cpu.Reserved, node.mem.Reserved)
+			}
+			if node.cpu.Buffer != 0 || node.mem.Buffer != 0 {
+				t.Errorf("expected node buffer to be zero, got {%v, %v}", node.cpu.Buffer, node.mem.Buffer)
+			}
+		})
+	}
+
+	t.Run("ZeroComputeUnit", func(t *testing.T) {
+		conf := makeTestConfig(t, func(*Config) {})
+
+		node := makeTestNodeState(
+			conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+			conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+		)
+		pod := addTestPod(node, "vm", true, 2000, 8<<30)
+
+		e := makeTestEnforcer(conf, node)
+
+		cu := api.Resources{VCPU: 0, Mem: 4 << 30}
+		_, status, err := e.handleAgentRequest(zap.NewNop(), api.AgentRequest{
+			ProtoVersion:  api.PluginProtoV4_0,
+			Pod:           pod.name,
+			ComputeUnit:   &cu,
+			Resources:     api.Resources{VCPU: 0, Mem: 0},
+			LastPermit:    nil,
+			Metrics:       &api.Metrics{LoadAverage1Min: 0, LoadAverage5Min: 0, MemoryUsageBytes: 0},
+			CorrelationID: "",
+		})
+		if err == nil || status != 400 {
+			t.Errorf("expected 400 error for zero compute unit, got status %d, err %v", status, err)
+		}
+	})
+}
+
+func TestZeroMaxVM(t *testing.T) {
+	cases := []struct {
+		name       string
+		zeroMaxVMs *zeroMaxVMsConfig
+		// expected is the pod's max and reserved resources after the update, which are equal
+		// because the VM isn't using anything and hasn't contacted us yet.
+		expected api.Resources
+	}{
+		{
+			name:       "NotConfigured",
+			zeroMaxVMs: nil,
+			expected:   api.Resources{VCPU: 0, Mem: 0},
+		},
+		{
+			name:       "Clamp",
+			zeroMaxVMs: &zeroMaxVMsConfig{Reject: false},
+			// the compute unit from the base test config
+			expected: api.Resources{VCPU: 250, Mem: 1 << 30},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := makeTestConfig(t, func(conf *Config) { conf.ZeroMaxVMs = c.zeroMaxVMs })
+
+			node := makeTestNodeState(
+				conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+				conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+			)
+			pod := addTestPod(node, "vm", true, 0, 0)
+			pod.cpu.Max, pod.mem.Max = 2000, 8<<30
+
+			e := makeTestEnforcer(conf, node)
+
+			vm := &api.VmInfo{
+				Name:           "vm-vm",
+				Namespace:      "default",
+				Cpu:            api.VmCpuInfo{Min: 0, Max: 0, Use: 0},
+				Mem:            api.VmMemInfo{Min: 0, Max: 0, Use: 0, SlotSize: 1 << 30},
+				ScalingConfig:  nil,
+				AlwaysMigrate:  false,
+				ScalingEnabled: true,
+			}
+			e.handleUpdatedScalingBounds(zap.NewNop(), vm, pod.name.Name)
+
+			got := api.Resources{VCPU: pod.cpu.Max, Mem: pod.mem.Max}
+			if got != c.expected {
+				t.Errorf("expected pod max = %v, got %v", c.expected, got)
+			}
+			got = api.Resources{VCPU: pod.cpu.Reserved, Mem: pod.mem.Reserved}
+			if got != c.expected {
+				t.Errorf("expected pod reserved = %v, got %v", c.expected, got)
+			}
+			if node.cpu.Reserved != pod.cpu.Reserved || node.mem.Reserved != pod.mem.Reserved {
+				t.Errorf(
+					"expected node reserved to match pod, got {%v, %v}",
+					node.cpu.Reserved, node.mem.Reserved,
+				)
+			}
+			if node.cpu.Buffer != pod.cpu.Buffer || node.mem.Buffer != pod.mem.Buffer {
+				t.Errorf("expected node buffer to match pod, got {%v, %v}", node.cpu.Buffer, node.mem.Buffer)
+			}
+		})
+	}
+}
+
+func TestMaxGrowthPerRequest(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) { conf.MaxGrowthPerRequest = 2 })
+
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("64")),
+		conf.NodeConfig.memoryLimits(resourcePtr("256Gi")),
+	)
+	pod := addTestPod(node, "vm", true, 1000, 4<<30)
+	pod.cpu.Min, pod.cpu.Max = 1000, 64000
+	pod.mem.Min, pod.mem.Max = 4<<30, 256<<30
+
+	e := makeTestEnforcer(conf, node)
+
+	cu := api.Resources{VCPU: 1000, Mem: 4 << 30}
+	request := func(resources api.Resources) *api.PluginResponse {
+		t.Helper()
+		resp, status, err := e.handleAgentRequest(zap.NewNop(), api.AgentRequest{
+			ProtoVersion:  api.PluginProtoV4_0,
+			Pod:           pod.name,
+			ComputeUnit:   &cu,
+			Resources:     resources,
+			LastPermit:    nil,
+			Metrics:       &api.Metrics{LoadAverage1Min: 0, LoadAverage5Min: 0, MemoryUsageBytes: 0},
+			CorrelationID: "",
+		})
+		if err != nil {
+			t.Fatalf("unexpected error handling request (status %d): %s", status, err)
+		}
+		return resp
+	}
+
+	// Each request should only be granted 2 more compute units, even though the node has room for
+	// all of it.
+	for _, expected := range []api.Resources{
+		{VCPU: 3000, Mem: 12 << 30},
+		{VCPU: 5000, Mem: 20 << 30},
+	} {
+		// A pathological request, from 1 CU straight to 32 CU
+		resp := request(api.Resources{VCPU: 32000, Mem: 128 << 30})
+		if resp.Permit != expected {
+			t.Errorf("expected permit = %v, got %v", expected, resp.Permit)
+		}
+		if resp.DenialCause == nil || *resp.DenialCause != api.PermitDeniedGrowthLimit {
+			t.Errorf("expected denial cause %q, got %v", api.PermitDeniedGrowthLimit, resp.DenialCause)
+		}
+		// The rest shouldn't count as pressure, because the node had room for it.
+		if node.cpu.CapacityPressure != 0 || node.mem.CapacityPressure != 0 {
+			t.Errorf("expected no node pressure, got {%v, %v}", node.cpu.CapacityPressure, node.mem.CapacityPressure)
+		}
+	}
+
+	// A request within the limit that's denied for some other reason shouldn't be blamed on the
+	// growth limit.
+	e.state.conf.MaxClusterReservableCPU = 6000
+	resp := request(api.Resources{VCPU: 7000, Mem: 28 << 30})
+	if expected := (api.Resources{VCPU: 6000, Mem: 28 << 30}); resp.Permit != expected {
+		t.Errorf("expected permit = %v, got %v", expected, resp.Permit)
+	}
+	if resp.DenialCause == nil || *resp.DenialCause != api.PermitDeniedClusterBudget {
+		t.Errorf("expected denial cause %q, got %v", api.PermitDeniedClusterBudget, resp.DenialCause)
+	}
+}
+
+func TestMaxOverage(t *testing.T) {
+	halfOverage := float32(0.5)
+	cases := []struct {
+		name       string
+		maxOverage *float32
+		// expectedReserved and expectedPressure give the pod's state after it requests far more than
+		// the node has.
+		expectedReserved vmapi.MilliCPU
+		expectedPressure vmapi.MilliCPU
+	}{
+		// Without a hard limit, the pod can reserve up to the node's total, and the rest is added to
+		// the node's pressure.
+		{name: "NoLimit", maxOverage: nil, expectedReserved: 8000, expectedPressure: 2000},
+		// With a watermark of 4 vCPU, the hard limit is halfway to the total, at 6 vCPU. The rest is
+		// denied outright.
+		{name: "HalfOverage", maxOverage: &halfOverage, expectedReserved: 6000, expectedPressure: 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := makeTestConfig(t, func(conf *Config) {
+				conf.NodeConfig.Cpu.Watermark = 0.5
+				conf.NodeConfig.Cpu.MaxOverage = c.maxOverage
+			})
+			if path, err := conf.validate(); err != nil {
+				t.Fatalf("invalid config at %s: %s", path, err)
+			}
+
+			node := conf.NodeConfig.vCpuLimits(resourcePtr("8"))
+			node.Reserved = 4000
+			pod := podResourceState[vmapi.MilliCPU]{
+				Reserved:         4000,
+				Buffer:           0,
+				Burst:            0,
+				CapacityPressure: 0,
+				Min:              1000,
+				Max:              10000,
+			}
+
+			// Going above the watermark, but staying under any hard limit, is allowed as usual.
+			_ = makeResourceTransitioner(&node, &pod).handleRequested(5000, false, 1000)
+			if pod.Reserved != 5000 || node.Reserved != 5000 {
+				t.Fatalf("expected increase to 5000 to be granted, got pod %v, node %v", pod.Reserved, node.Reserved)
+			}
+
+			verdict := makeResourceTransitioner(&node, &pod).handleRequested(10000, false, 1000)
+			if pod.Reserved != c.expectedReserved || node.Reserved != c.expectedReserved {
+				t.Errorf("expected %v reserved, got pod %v, node %v", c.expectedReserved, pod.Reserved, node.Reserved)
+			}
+			if pod.CapacityPressure != c.expectedPressure || node.CapacityPressure != c.expectedPressure {
+				t.Errorf("expected pressure %v, got pod %v, node %v", c.expectedPressure, pod.CapacityPressure, node.CapacityPressure)
+			}
+			if hardLimited := strings.Contains(verdict, "hard limit"); hardLimited != (c.maxOverage != nil) {
+				t.Errorf("unexpected verdict %q", verdict)
+			}
+		})
+	}
+}
+
+func TestUnderReportedUsage(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) {
+		conf.UnderReportedUsage = &underReportedUsageConfig{GraceFraction: 0.25}
+	})
+
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("64")),
+		conf.NodeConfig.memoryLimits(resourcePtr("256Gi")),
+	)
+	pod := addTestPod(node, "vm", true, 1000, 4<<30)
+	pod.cpu.Min, pod.cpu.Max = 1000, 8000
+	pod.mem.Min, pod.mem.Max = 4<<30, 32<<30
+
+	e := makeTestEnforcer(conf, node)
+
+	cu := api.Resources{VCPU: 1000, Mem: 4 << 30}
+	request := func(memUsage api.Bytes) *api.PluginResponse {
+		t.Helper()
+		// The agent keeps asking for what it was already given, but its VM is using more memory.
+		resp, status, err := e.handleAgentRequest(zap.NewNop(), api.AgentRequest{
+			ProtoVersion:  api.PluginProtoV4_0,
+			Pod:           pod.name,
+			ComputeUnit:   &cu,
+			Resources:     api.Resources{VCPU: 1000, Mem: 4 << 30},
+			LastPermit:    &api.Resources{VCPU: 1000, Mem: 4 << 30},
+			Metrics:       &api.Metrics{LoadAverage1Min: 0, LoadAverage5Min: 0, MemoryUsageBytes: float32(memUsage)},
+			CorrelationID: "",
+		})
+		if err != nil {
+			t.Fatalf("unexpected error handling request (status %d): %s", status, err)
+		}
+		return resp
+	}
+	reconciled := func() float64 {
+		return testutil.ToFloat64(e.metrics.underReportedUsage.WithLabelValues(node.name))
+	}
+
+	// Within the grace fraction, nothing should change.
+	request(5 << 30)
+	if pod.mem.Reserved != 4<<30 || node.mem.Reserved != 4<<30 {
+		t.Errorf("expected pod and node reserved = 4Gi, got %v and %v", pod.mem.Reserved, node.mem.Reserved)
+	}
+	if n := reconciled(); n != 0 {
+		t.Errorf("expected no reconciliations, got %v", n)
+	}
+
+	// Beyond it, reserved should be raised to the measured usage, rounded up to the VM's
+	// granularity, and counted.
+	resp := request(6<<30 + 512<<20)
+	if expected := (api.Resources{VCPU: 1000, Mem: 4 << 30}); resp.Permit != expected {
+		t.Errorf("expected permit = %v, got %v", expected, resp.Permit)
+	}
+	if pod.mem.Reserved != 7<<30 || node.mem.Reserved != 7<<30 {
+		t.Errorf("expected pod and node reserved = 7Gi, got %v and %v", pod.mem.Reserved, node.mem.Reserved)
+	}
+	if n := reconciled(); n != 1 {
+		t.Errorf("expected one reconciliation, got %v", n)
+	}
+
+	// Reconciling should never go above the VM's maximum.
+	request(64 << 30)
+	if pod.mem.Reserved != pod.mem.Max {
+		t.Errorf("expected pod reserved = %v, got %v", pod.mem.Max, pod.mem.Reserved)
+	}
+}
+
+func TestMaxClusterBuffer(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) {
+		conf.MaxClusterBufferCPU = 3000
+		conf.MaxClusterBufferMem = 12 << 30
+	})
+
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("64")),
+		conf.NodeConfig.memoryLimits(resourcePtr("256Gi")),
+	)
+	// Two VMs that haven't contacted us yet, each using (and reserving) 1 CPU and 4Gi
+	first := addTestPod(node, "first", true, 1000, 4<<30)
+	second := addTestPod(node, "second", true, 1000, 4<<30)
+	for _, pod := range []*podState{first, second} {
+		pod.cpu.Max, pod.mem.Max = 1000, 4<<30
+	}
+
+	e := makeTestEnforcer(conf, node)
+
+	updateMax := func(pod *podState, cpu vmapi.MilliCPU, memSlots uint16) {
+		vm := &api.VmInfo{
+			Name:           pod.name.Name,
+			Namespace:      pod.name.Namespace,
+			Cpu:            api.VmCpuInfo{Min: 1000, Max: cpu, Use: 1000},
+			Mem:            api.VmMemInfo{Min: 4, Max: memSlots, Use: 4, SlotSize: 1 << 30},
+			ScalingConfig:  nil,
+			AlwaysMigrate:  false,
+			ScalingEnabled: true,
+		}
+		e.handleUpdatedScalingBounds(zap.NewNop(), vm, pod.name.Name)
+	}
+
+	// The first VM's new buffer fits under the cap, so it's reserved up to its new maximum.
+	updateMax(first, 3000, 8)
+	if first.cpu.Reserved != 3000 || first.mem.Reserved != 8<<30 {
+		t.Errorf("expected first VM reserved = {3000, 8Gi}, got {%v, %v}", first.cpu.Reserved, first.mem.Reserved)
+	}
+
+	// The second VM's doesn't, so it only gets what's left under the cap.
+	updateMax(second, 4000, 16)
+	if second.cpu.Buffer != 1000 || second.mem.Buffer != 8<<30 {
+		t.Errorf("expected second VM buffer = {1000, 8Gi}, got {%v, %v}", second.cpu.Buffer, second.mem.Buffer)
+	}
+	if second.cpu.Reserved != 2000 || second.mem.Reserved != 12<<30 {
+		t.Errorf("expected second VM reserved = {2000, 12Gi}, got {%v, %v}", second.cpu.Reserved, second.mem.Reserved)
+	}
+
+	expected := api.Resources{VCPU: 3000, Mem: 12 << 30}
+	if total := e.state.clusterBuffer(); total != expected {
+		t.Errorf("expected cluster buffer = %v, got %v", expected, total)
+	}
+	if node.cpu.Reserved != 5000 || node.mem.Reserved != 20<<30 {
+		t.Errorf("expected node reserved = {5000, 20Gi}, got {%v, %v}", node.cpu.Reserved, node.mem.Reserved)
+	}
+}
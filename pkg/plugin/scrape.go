@@ -0,0 +1,208 @@
+package plugin
+
+// Periodically fetching metrics directly from VMs, as an alternative to metrics pushed by the
+// autoscaler-agent.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/watch"
+)
+
+type metricsScrapingConfig struct {
+	// Port is the port that VMs are expected to provide metrics on
+	Port uint16 `json:"port"`
+	// LoadMetricPrefix is the prefix at the beginning of the load metrics that we use. For
+	// node_exporter, this is "node_", and for vector it's "host_"
+	LoadMetricPrefix string `json:"loadMetricPrefix"`
+	// IntervalSeconds gives the number of seconds to wait between scraping all VMs
+	IntervalSeconds uint `json:"intervalSeconds"`
+	// RequestTimeoutSeconds gives the timeout duration, in seconds, for each metrics request
+	RequestTimeoutSeconds uint `json:"requestTimeoutSeconds"`
+}
+
+func (c *metricsScrapingConfig) validate() (string, error) {
+	if c.Port == 0 {
+		return "port", errors.New("value must be > 0")
+	} else if c.LoadMetricPrefix == "" {
+		return "loadMetricPrefix", errors.New("string cannot be empty")
+	} else if c.IntervalSeconds == 0 {
+		return "intervalSeconds", errors.New("value must be > 0")
+	} else if c.RequestTimeoutSeconds == 0 {
+		return "requestTimeoutSeconds", errors.New("value must be > 0")
+	}
+
+	return "", nil
+}
+
+// metricsScrapeTarget is a single VM pod that we'd like to fetch metrics from
+type metricsScrapeTarget struct {
+	podName util.NamespacedName
+	vmName  util.NamespacedName
+	url     string
+}
+
+// runMetricsScraper periodically fetches metrics from all VMs, until the context is canceled.
+func (e *AutoscaleEnforcer) runMetricsScraper(ctx context.Context, logger *zap.Logger) {
+	conf := e.state.conf.MetricsScraping
+
+	ticker := time.NewTicker(time.Second * time.Duration(conf.IntervalSeconds))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			targets := e.getMetricsScrapeTargets(logger)
+			e.scrapeVMMetrics(ctx, logger, targets)
+		}
+	}
+}
+
+// getMetricsScrapeTargets returns the set of VM pods that we should fetch metrics from
+//
+// Pods' IP addresses are taken from the VM store, so VMs that don't (yet) have an IP, or whose
+// current pod is not the one we're tracking (e.g., during a migration), are skipped.
+func (e *AutoscaleEnforcer) getMetricsScrapeTargets(logger *zap.Logger) []metricsScrapeTarget {
+	var candidates []metricsScrapeTarget
+
+	func() {
+		e.state.lock.Lock()
+		defer e.state.lock.Unlock()
+
+		for name, pod := range e.state.pods {
+			if pod.vm == nil || pod.vm.currentlyMigrating() {
+				continue
+			}
+			candidates = append(candidates, metricsScrapeTarget{
+				podName: name,
+				vmName:  pod.vm.name,
+				url:     "", // filled below
+			})
+		}
+	}()
+
+	var targets []metricsScrapeTarget
+	for _, t := range candidates {
+		accessor := func(index *watch.NameIndex[vmapi.VirtualMachine]) (*vmapi.VirtualMachine, bool) {
+			return index.Get(t.vmName.Namespace, t.vmName.Name)
+		}
+
+		vm, ok := e.vmStore.GetIndexed(accessor)
+		if !ok || vm.Status.PodIP == "" || vm.Status.PodName != t.podName.Name {
+			logger.Debug(
+				"Skipping metrics scrape for VM without current pod IP",
+				zap.Object("pod", t.podName),
+				zap.Object("virtualmachine", t.vmName),
+			)
+			continue
+		}
+
+		t.url = fmt.Sprintf("http://%s:%d/metrics", vm.Status.PodIP, e.state.conf.MetricsScraping.Port)
+		targets = append(targets, t)
+	}
+
+	return targets
+}
+
+// scrapeVMMetrics fetches metrics from each of the targets and updates the pods' stored metrics
+//
+// Requests are made without holding the state lock. If a request fails, the pod's previous metrics
+// are left as-is.
+func (e *AutoscaleEnforcer) scrapeVMMetrics(ctx context.Context, logger *zap.Logger, targets []metricsScrapeTarget) {
+	conf := e.state.conf.MetricsScraping
+	timeout := time.Second * time.Duration(conf.RequestTimeoutSeconds)
+
+	for _, t := range targets {
+		if ctx.Err() != nil {
+			return
+		}
+
+		metrics, err := fetchVMMetrics(ctx, t.url, timeout, conf.LoadMetricPrefix)
+		if err != nil {
+			e.metrics.metricsScrapes.WithLabelValues("failed").Inc()
+			logger.Warn(
+				"Failed to fetch metrics from VM",
+				zap.Object("pod", t.podName),
+				zap.Object("virtualmachine", t.vmName),
+				zap.Error(err),
+			)
+			continue
+		}
+		e.metrics.metricsScrapes.WithLabelValues("ok").Inc()
+
+		e.handleScrapedMetrics(logger, t.podName, metrics)
+	}
+}
+
+// handleScrapedMetrics updates the pod's metrics and its position in the node's migration queue
+//
+// Unlike metrics received from the autoscaler-agent, this does not trigger any migration; that only
+// happens in response to a request from the agent.
+func (e *AutoscaleEnforcer) handleScrapedMetrics(logger *zap.Logger, podName util.NamespacedName, metrics *api.Metrics) {
+	e.state.lock.Lock()
+	defer e.state.lock.Unlock()
+
+	pod, ok := e.state.pods[podName]
+	if !ok || pod.vm == nil {
+		// The pod was removed while we were fetching its metrics. Nothing to do.
+		return
+	}
+
+	logger.Debug("Updating pod metrics from scrape", zap.Object("pod", podName), zap.Any("metrics", metrics))
+	_ = pod.vm.setMetrics(metrics, e.state.clock.Now(), 0)
+
+	if pod.vm.currentlyMigrating() || pod.vm.inMigrationCooldown(e.state.clock.Now()) {
+		return
+	}
+	e.reconcileUnderReportedUsage(logger, pod)
+	pod.vm.overprovisionedBonus = e.state.conf.overprovisionedBonus(pod)
+	pod.vm.dualReliefBonus = e.state.conf.dualReliefBonus(pod)
+	pod.vm.migrationSize = e.state.conf.migrationSize(pod)
+	pod.node.mq.addOrUpdate(pod.vm, e.state.clock.Now())
+	pod.node.updateQueueMetrics(e.metrics, e.state.clock.Now())
+}
+
+// fetchVMMetrics makes a single metrics request to the URL, parsing the response
+func fetchVMMetrics(ctx context.Context, url string, timeout time.Duration, loadPrefix string) (*api.Metrics, error) {
+	reqCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, url, http.NoBody)
+	if err != nil {
+		return nil, fmt.Errorf("Error constructing metrics request to %q: %w", url, err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error making request to %q: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error receiving response body: %w", err)
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Unsuccessful response status %d: %s", resp.StatusCode, string(body))
+	}
+
+	m, err := api.ReadMetrics(body, loadPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading metrics from prometheus output: %w", err)
+	}
+
+	return &m, nil
+}
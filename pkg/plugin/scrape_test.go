@@ -0,0 +1,69 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestScrapeVMMetrics(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) {
+		conf.MetricsScraping = &metricsScrapingConfig{
+			Port:                  9100,
+			LoadMetricPrefix:      "host_",
+			IntervalSeconds:       5,
+			RequestTimeoutSeconds: 1,
+		}
+	})
+
+	// fake metrics endpoint, returning the current load, or an error if fail is set
+	var load atomic.Int32
+	var fail atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(500)
+			return
+		}
+		l := load.Load()
+		fmt.Fprintf(w, "host_load1 %d\nhost_load15 0\nhost_load5 %d\n", l, l)
+		fmt.Fprint(w, "host_memory_available_bytes 1073741824\nhost_memory_total_bytes 4294967296\n")
+	}))
+	defer server.Close()
+
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+		conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+	)
+	pod := addTestPod(node, "vm", true, 1000, 1<<30)
+	e := makeTestEnforcer(conf, node)
+
+	targets := []metricsScrapeTarget{{podName: pod.name, vmName: pod.vm.name, url: server.URL + "/metrics"}}
+
+	load.Store(3)
+	e.scrapeVMMetrics(context.Background(), zap.NewNop(), targets)
+	if pod.vm.metrics == nil || pod.vm.metrics.LoadAverage1Min != 3 {
+		t.Fatalf("expected pod metrics to be set from scrape, got %+v", pod.vm.metrics)
+	}
+	if !node.mq.isNextInQueue(pod.vm) {
+		t.Error("expected pod to be added to the migration queue")
+	}
+
+	// Failed scrapes should leave the last-known metrics in place
+	fail.Store(true)
+	load.Store(7)
+	e.scrapeVMMetrics(context.Background(), zap.NewNop(), targets)
+	if pod.vm.metrics == nil || pod.vm.metrics.LoadAverage1Min != 3 {
+		t.Errorf("expected pod metrics to be unchanged after failed scrape, got %+v", pod.vm.metrics)
+	}
+
+	fail.Store(false)
+	e.scrapeVMMetrics(context.Background(), zap.NewNop(), targets)
+	if pod.vm.metrics == nil || pod.vm.metrics.LoadAverage1Min != 7 {
+		t.Errorf("expected pod metrics to be updated after successful scrape, got %+v", pod.vm.metrics)
+	}
+}
@@ -0,0 +1,119 @@
+package plugin
+
+// Logging a final summary of the plugin's state when it shuts down. See Config.ShutdownSummary.
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+// shutdownSummaryConfig configures the summary of the plugin's state that's logged on shutdown
+type shutdownSummaryConfig struct {
+	// TimeoutSeconds gives the maximum duration, in seconds, that we'll wait for the state lock
+	// before giving up on the summary, so that it can't hold up termination.
+	TimeoutSeconds uint `json:"timeoutSeconds"`
+}
+
+func (c *shutdownSummaryConfig) validate() (string, error) {
+	if c.TimeoutSeconds == 0 {
+		return "timeoutSeconds", errors.New("value must be > 0")
+	}
+
+	return "", nil
+}
+
+// nodeShutdownSummary is the part of the shutdown summary for a single node
+type nodeShutdownSummary struct {
+	Name          string                                      `json:"name"`
+	CPU           nodeResourceShutdownSummary[vmapi.MilliCPU] `json:"cpu"`
+	Mem           nodeResourceShutdownSummary[api.Bytes]      `json:"mem"`
+	OverWatermark bool                                        `json:"overWatermark"`
+}
+
+type nodeResourceShutdownSummary[T any] struct {
+	Total                T `json:"total"`
+	Watermark            T `json:"watermark"`
+	Reserved             T `json:"reserved"`
+	CapacityPressure     T `json:"capacityPressure"`
+	PressureAccountedFor T `json:"pressureAccountedFor"`
+}
+
+// logSummaryOnShutdown waits until ctx is canceled, i.e. the plugin is shutting down, and then logs
+// the shutdown summary.
+//
+// NB: expected to be run in its own thread.
+func (e *AutoscaleEnforcer) logSummaryOnShutdown(ctx context.Context, logger *zap.Logger) {
+	<-ctx.Done()
+	e.logShutdownSummary(logger)
+}
+
+// logShutdownSummary logs a summary of the current state of each node, and of the plugin overall,
+// for investigating why the scheduler was restarted.
+//
+// If the state lock can't be acquired within Config.ShutdownSummary.TimeoutSeconds, nothing is
+// logged.
+func (e *AutoscaleEnforcer) logShutdownSummary(logger *zap.Logger) {
+	timeout := time.Second * time.Duration(e.state.conf.ShutdownSummary.TimeoutSeconds)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := e.state.lock.TryLock(ctx); err != nil {
+		logger.Error("Timed out waiting for state lock, skipping shutdown summary", zap.Duration("timeout", timeout))
+		return
+	}
+	defer e.state.lock.Unlock()
+
+	nodes := make([]nodeShutdownSummary, 0, len(e.state.nodes))
+	overWatermark := []string{}
+	for _, node := range e.state.nodes {
+		over := node.cpu.Reserved > node.cpu.Watermark || node.mem.Reserved > node.mem.Watermark
+		if over {
+			overWatermark = append(overWatermark, node.name)
+		}
+
+		nodes = append(nodes, nodeShutdownSummary{
+			Name:          node.name,
+			CPU:           node.cpu.shutdownSummary(),
+			Mem:           node.mem.shutdownSummary(),
+			OverWatermark: over,
+		})
+	}
+	slices.SortFunc(nodes, func(a, b nodeShutdownSummary) bool {
+		return a.Name < b.Name
+	})
+	slices.Sort(overWatermark)
+
+	// Both the source and target pods of a migration refer to it, so count distinct names.
+	migrations := make(map[util.NamespacedName]struct{})
+	for _, pod := range e.state.pods {
+		if pod.vm != nil && pod.vm.currentlyMigrating() {
+			migrations[pod.vm.migrationState.name] = struct{}{}
+		}
+	}
+
+	logger.Info(
+		"Summary of plugin state at shutdown",
+		zap.Int("pods", len(e.state.pods)),
+		zap.Int("ongoingMigrations", len(migrations)),
+		zap.Strings("nodesOverWatermark", overWatermark),
+		zap.Any("nodes", nodes),
+	)
+}
+
+func (s *nodeResourceState[T]) shutdownSummary() nodeResourceShutdownSummary[T] {
+	return nodeResourceShutdownSummary[T]{
+		Total:                s.Total,
+		Watermark:            s.Watermark,
+		Reserved:             s.Reserved,
+		CapacityPressure:     s.CapacityPressure,
+		PressureAccountedFor: s.PressureAccountedFor,
+	}
+}
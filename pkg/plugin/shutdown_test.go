@@ -0,0 +1,72 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestShutdownSummary(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) {
+		conf.ShutdownSummary = &shutdownSummaryConfig{TimeoutSeconds: 1}
+	})
+	if path, err := conf.validate(); err != nil {
+		t.Fatalf("invalid config at %s: %s", path, err)
+	}
+
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+		conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+	)
+	// Over the memory watermark, with one of the VMs migrating
+	_ = addTestPod(node, "vm1", true, 2000, 16<<30)
+	migrating := addTestPod(node, "vm2", true, 2000, 14<<30)
+	migrating.vm.migrationState = &podMigrationState{
+		name:       util.NamespacedName{Namespace: "default", Name: "migration"},
+		startTime:  time.Now(),
+		targetNode: "",
+		phase:      "",
+	}
+	e := makeTestEnforcer(conf, node)
+
+	core, logs := observer.New(zap.InfoLevel)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.logSummaryOnShutdown(ctx, zap.New(core))
+	}()
+
+	if n := logs.Len(); n != 0 {
+		t.Fatalf("expected no logs before shutdown, got %d", n)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for shutdown summary")
+	}
+
+	entries := logs.FilterMessage("Summary of plugin state at shutdown").All()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 shutdown summary, got %d", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	if pods := fields["pods"]; pods != int64(2) {
+		t.Errorf("expected 2 pods, got %v", pods)
+	}
+	if migrations := fields["ongoingMigrations"]; migrations != int64(1) {
+		t.Errorf("expected 1 ongoing migration, got %v", migrations)
+	}
+	if over := fmt.Sprint(fields["nodesOverWatermark"]); over != "[node]" {
+		t.Errorf("expected node to be over watermark, got %s", over)
+	}
+}
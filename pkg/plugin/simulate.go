@@ -0,0 +1,288 @@
+package plugin
+
+// Simulating where hypothetical VMs would be placed, for capacity planning, served alongside the
+// dump-state endpoint
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/exp/slices"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/watch"
+)
+
+// simulatePlacementRequest is the body of requests to the "/simulate/placement" endpoint
+type simulatePlacementRequest struct {
+	// VMs lists the shapes of the hypothetical VMs, which are placed in order
+	VMs []simulatedVM `json:"vms"`
+}
+
+// simulatedVM is a hypothetical VM to place, with the resources that would be reserved for it
+type simulatedVM struct {
+	// Name identifies the VM in the response. It doesn't need to be unique.
+	Name string         `json:"name"`
+	CPU  vmapi.MilliCPU `json:"cpu"`
+	Mem  api.Bytes      `json:"mem"`
+	// Extended gives the amount of each of Config.ExtendedResources that the VM would request
+	Extended map[corev1.ResourceName]uint64 `json:"extended,omitempty"`
+	// Count is the number of VMs with this shape to place. If zero, one VM is placed.
+	Count uint `json:"count,omitempty"`
+}
+
+// maxSimulatedVMs is the maximum total number of VMs that may be placed in a single simulation, to
+// bound the time and memory used by each request.
+const maxSimulatedVMs = 10000
+
+// simulatePlacementResponse is the response to requests to the "/simulate/placement" endpoint
+type simulatePlacementResponse struct {
+	// Placements gives the outcome for each hypothetical VM, in the order they were placed. VMs
+	// with a Count are expanded into that many entries.
+	Placements []simulatedPlacement `json:"placements"`
+	// Unplaced is the number of VMs that didn't fit on any node
+	Unplaced int `json:"unplaced"`
+}
+
+type simulatedPlacement struct {
+	Name string `json:"name"`
+	// Node is the node the VM would be placed on, or empty if it didn't fit anywhere
+	Node string `json:"node,omitempty"`
+	// Score is the score Score would give the chosen node, or zero if there isn't one
+	Score int64 `json:"score"`
+}
+
+// simulatedNode is a snapshot of a node's state, used to place hypothetical VMs without holding
+// the state lock
+type simulatedNode struct {
+	// node is a copy of the node's state, which is updated as VMs are placed on it. The copy is
+	// shallow, so its pods and migration queue are cleared, and none of the methods that use them
+	// may be called on it. The extended resources are copied separately.
+	node nodeState
+
+	// usage is what's already in use on the node, for checkNodeFits, including the VMs placed by the
+	// simulation
+	usage nodeUsage
+}
+
+// snapshotForSimulation returns a snapshot of all nodes, sorted by name, and the maximum total
+// reservable CPU and memory across them
+func (s *pluginState) snapshotForSimulation(ctx context.Context) ([]*simulatedNode, api.Resources, error) {
+	if err := s.lock.TryLock(ctx); err != nil {
+		return nil, api.Resources{VCPU: 0, Mem: 0}, err
+	}
+	defer s.lock.Unlock()
+
+	nodes := make([]*simulatedNode, 0, len(s.nodes))
+	for _, n := range s.nodes {
+		var tenantUsage api.Resources
+		for _, pod := range n.pods {
+			if s.conf.tenantMatches(pod.labels) {
+				tenantUsage.VCPU += pod.cpu.Reserved
+				tenantUsage.Mem += pod.mem.Reserved
+			}
+		}
+
+		extended := make(map[corev1.ResourceName]*nodeResourceState[uint64], len(n.extended))
+		extendedUsage := make(map[corev1.ResourceName]uint64, len(n.extended))
+		for name, state := range n.extended {
+			stateCopy := *state
+			extended[name] = &stateCopy
+			extendedUsage[name] = state.Reserved
+		}
+
+		sn := &simulatedNode{
+			node: *n,
+			usage: nodeUsage{
+				reserved:      api.Resources{VCPU: n.cpu.Reserved, Mem: n.mem.Reserved},
+				tenant:        tenantUsage,
+				extended:      extendedUsage,
+				vmCount:       n.vmCount(),
+				noisyNeighbor: n.hasNoisyNeighbor(s.conf),
+			},
+		}
+		sn.node.extended = extended
+		sn.node.pods = nil
+		sn.node.mq = nil
+		nodes = append(nodes, sn)
+	}
+	slices.SortFunc(nodes, func(x, y *simulatedNode) (less bool) {
+		return x.node.name < y.node.name
+	})
+
+	maxTotal := api.Resources{VCPU: s.maxTotalReservableCPU, Mem: s.maxTotalReservableMem}
+	return nodes, maxTotal, nil
+}
+
+// place records that a VM with the given resources was placed on the node
+func (n *simulatedNode) place(resources api.Resources, extended map[corev1.ResourceName]uint64) {
+	n.node.cpu.Reserved += resources.VCPU
+	n.node.mem.Reserved += resources.Mem
+	n.usage.reserved.VCPU += resources.VCPU
+	n.usage.reserved.Mem += resources.Mem
+	for name, amount := range extended {
+		if state, ok := n.node.extended[name]; ok {
+			state.Reserved += amount
+		}
+		n.usage.extended[name] += amount
+	}
+	n.usage.vmCount += 1
+}
+
+// simulatedPod returns the pod and VM info that Filter would see for the hypothetical VM
+//
+// The VM is treated as having a fixed size, with all of its memory in a single slot. It's not a
+// migration target, and doesn't belong to the tenant with reserved resources, if there is one.
+func (e *AutoscaleEnforcer) simulatedPod(vm simulatedVM) filterPod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: vm.Name},
+		Spec:       corev1.PodSpec{SchedulerName: e.state.conf.SchedulerName},
+	}
+	vmInfo := &api.VmInfo{
+		Name:      vm.Name,
+		Namespace: "",
+		Cpu:       api.VmCpuInfo{Min: vm.CPU, Max: vm.CPU, Use: vm.CPU},
+		Mem:       api.VmMemInfo{Min: 1, Max: 1, Use: 1, SlotSize: vm.Mem},
+
+		ScalingConfig:  nil,
+		AlwaysMigrate:  false,
+		ScalingEnabled: false,
+	}
+
+	return filterPod{
+		PredicatePod: PredicatePod{
+			Pod:       pod,
+			VM:        vmInfo,
+			Resources: api.Resources{VCPU: vm.CPU, Mem: vm.Mem},
+		},
+		extended:    vm.Extended,
+		isTenantPod: false,
+	}
+}
+
+// simulatePlacement places each of the VMs in turn, on the node that passes Filter with the
+// highest score, as if they were all scheduled one after another with no other changes in the
+// cluster. Ties are broken by node name.
+//
+// The checks are the same ones that Filter and Score make, using the Node objects from our store.
+// Cordoned nodes and nodes missing from the store are skipped.
+//
+// The state lock is only held while taking the snapshot, so the simulation doesn't block
+// scheduling, and our state is never modified.
+func (e *AutoscaleEnforcer) simulatePlacement(ctx context.Context, vms []simulatedVM) (*simulatePlacementResponse, error) {
+	conf := e.state.conf
+
+	var total uint
+	for _, vm := range vms {
+		count := util.Max(vm.Count, 1)
+		if count > maxSimulatedVMs || total+count > maxSimulatedVMs {
+			return nil, fmt.Errorf("too many VMs to simulate: limit is %d", maxSimulatedVMs)
+		}
+		total += count
+
+		for name := range vm.Extended {
+			if !slices.Contains(conf.ExtendedResources, name) {
+				return nil, fmt.Errorf("VM %q requests extended resource %q, which isn't tracked", vm.Name, name)
+			}
+		}
+	}
+
+	snapshot, maxTotal, err := e.state.snapshotForSimulation(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only keep the nodes that the scheduler could place pods on, along with their Node objects,
+	// for the checks that need them.
+	var nodes []*simulatedNode
+	k8sNodes := make(map[string]*corev1.Node)
+	for _, n := range snapshot {
+		k8sNode, ok := e.nodeStore.GetIndexed(func(index *watch.FlatNameIndex[corev1.Node]) (*corev1.Node, bool) {
+			return index.Get(n.node.name)
+		})
+		if !ok || n.node.unschedulable {
+			continue
+		}
+		nodes = append(nodes, n)
+		k8sNodes[n.node.name] = k8sNode
+	}
+
+	now := e.state.clock.Now()
+	// The checks log as they would in Filter, which would be far too noisy here.
+	logger := zap.NewNop()
+
+	resp := &simulatePlacementResponse{
+		Placements: make([]simulatedPlacement, 0, total),
+		Unplaced:   0,
+	}
+	for _, vm := range vms {
+		pod := e.simulatedPod(vm)
+
+		for i := uint(0); i < util.Max(vm.Count, 1); i++ {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			var best *simulatedNode
+			var bestScore int64
+			for _, n := range nodes {
+				k8sNode := k8sNodes[n.node.name]
+				if status := e.checkNodeAcceptsVMs(logger, k8sNode, true, false); status != nil {
+					continue
+				}
+				if status := e.checkNodeFits(logger, k8sNode, &n.node, pod, n.usage); status != nil {
+					continue
+				}
+
+				score, _ := scoreNode(conf, &n.node, pod.Resources, n.usage.noisyNeighbor, maxTotal, now)
+				if best == nil || score > bestScore {
+					best, bestScore = n, score
+				}
+			}
+
+			if best == nil {
+				resp.Placements = append(resp.Placements, simulatedPlacement{Name: vm.Name, Node: "", Score: 0})
+				resp.Unplaced += 1
+				continue
+			}
+
+			best.place(pod.Resources, pod.extended)
+			resp.Placements = append(resp.Placements, simulatedPlacement{
+				Name:  vm.Name,
+				Node:  best.node.name,
+				Score: bestScore,
+			})
+		}
+	}
+
+	return resp, nil
+}
+
+// addSimulatePlacementHandler adds the "/simulate/placement" endpoint to the mux, which returns
+// where a list of hypothetical VMs would be placed, without changing anything
+func (e *AutoscaleEnforcer) addSimulatePlacementHandler(logger *zap.Logger, mux *http.ServeMux) {
+	util.AddHandler(logger, mux, "/simulate/placement", http.MethodPost, "simulatePlacementRequest", func(ctx context.Context, _ *zap.Logger, req *simulatePlacementRequest) (*simulatePlacementResponse, int, error) {
+		timeout := time.Duration(e.state.conf.DumpState.TimeoutSeconds) * time.Second
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		resp, err := e.simulatePlacement(ctx, req.VMs)
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				return nil, 500, fmt.Errorf("timed out while simulating placement: %w", err)
+			}
+			return nil, 400, fmt.Errorf("error while simulating placement: %w", err)
+		}
+
+		return resp, 200, nil
+	})
+}
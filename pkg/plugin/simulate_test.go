@@ -0,0 +1,100 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+)
+
+func TestSimulatePlacement(t *testing.T) {
+	conf := makeTestConfig(t, func(*Config) {})
+
+	makeNode := func(name string) *nodeState {
+		node := makeTestNodeState(
+			conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+			conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+		)
+		node.name = name
+		return node
+	}
+
+	full := makeNode("full")
+	addTestPod(full, "existing", true, 4000, 16<<30)
+	empty := makeNode("empty")
+	// The simulation must skip nodes that Filter would reject regardless of resources: ones that
+	// are excluded from VM scheduling, cordoned, or missing from the node store.
+	excluded := makeNode("excluded")
+	cordoned := makeNode("cordoned")
+	cordoned.unschedulable = true
+	missing := makeNode("missing")
+	e := makeTestEnforcer(conf, full, empty, excluded, cordoned, missing)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	makeK8sNode := func(name string) *corev1.Node {
+		node := &corev1.Node{}
+		node.Name = name
+		return node
+	}
+	excludedNode := makeK8sNode(excluded.name)
+	excludedNode.Annotations = map[string]string{AnnotationNoVMSchedule: "true"}
+	cordonedNode := makeK8sNode(cordoned.name)
+	cordonedNode.Spec.Unschedulable = true
+	e.nodeStore = makeTestNodeStore(ctx, t, makeK8sNode(full.name), makeK8sNode(empty.name), excludedNode, cordonedNode)
+
+	// Each node has room for as many 2 vCPU / 8Gi VMs as fit in its remaining CPU and memory
+	vmCPU, vmMem := vmapi.MilliCPU(2000), api.Bytes(8<<30)
+	capacity := func(n *nodeState) int {
+		return int(util.Min(uint64(n.remainingReservableCPU()/vmCPU), uint64(n.remainingReservableMem()/vmMem)))
+	}
+	expectedPlaced := map[string]int{full.name: capacity(full), empty.name: capacity(empty)}
+	fullReserved := full.cpu.Reserved
+
+	const count = 20
+	resp, err := e.simulatePlacement(ctx, []simulatedVM{
+		{Name: "vm", CPU: vmCPU, Mem: vmMem, Count: count},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(resp.Placements) != count {
+		t.Fatalf("expected %d placements, got %d", count, len(resp.Placements))
+	}
+
+	placed := make(map[string]int)
+	for _, p := range resp.Placements {
+		if p.Node != "" {
+			placed[p.Node] += 1
+		}
+	}
+	for _, name := range []string{excluded.name, cordoned.name, missing.name} {
+		if placed[name] != 0 {
+			t.Errorf("expected no VMs placed on node %q, got %d", name, placed[name])
+		}
+	}
+	for name, expected := range expectedPlaced {
+		if placed[name] != expected {
+			t.Errorf("expected %d VMs placed on node %q, got %d", expected, name, placed[name])
+		}
+	}
+	if expected := count - expectedPlaced[full.name] - expectedPlaced[empty.name]; resp.Unplaced != expected {
+		t.Errorf("expected %d unplaced VMs, got %d", expected, resp.Unplaced)
+	}
+
+	// The simulation must not change our actual state.
+	if full.cpu.Reserved != fullReserved || empty.cpu.Reserved != 0 || len(empty.pods) != 0 {
+		t.Error("expected simulation not to modify node state")
+	}
+
+	if _, err := e.simulatePlacement(ctx, []simulatedVM{
+		{Name: "vm", CPU: vmCPU, Mem: vmMem, Count: maxSimulatedVMs + 1},
+	}); err == nil {
+		t.Error("expected error when simulating too many VMs")
+	}
+}
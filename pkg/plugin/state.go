@@ -6,11 +6,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"golang.org/x/exp/constraints"
+	"golang.org/x/exp/slices"
 
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
@@ -32,21 +37,43 @@ type pluginState struct {
 
 	ongoingMigrationDeletions map[util.NamespacedName]int
 
+	// ongoingMigrations is the number of migrations that haven't yet ended, for
+	// Config.MaxTotalConcurrentMigrations. Each migration is counted once, by its source pod, which
+	// has vmPodState.migrationCounted set.
+	//
+	// It's incremented when we request a migration (or first observe one we didn't request), and
+	// decremented when creating it fails, when we see it end, or when its source pod is deleted.
+	// Migrations that time out are still counted, because they may still be running. See
+	// countMigration and uncountMigration.
+	ongoingMigrations uint
+
 	pods  map[util.NamespacedName]*podState
 	nodes map[string]*nodeState
 
 	// maxTotalReservableCPU stores the maximum value of any node's totalReservableCPU(), so that we
 	// can appropriately scale our scoring
+	//
+	// This value is recomputed by updateMaxTotalReservable() whenever nodes are added or removed.
 	maxTotalReservableCPU vmapi.MilliCPU
 	// maxTotalReservableMem is the same as maxTotalReservableCPU, but for bytes of memory instead
 	// of CPU
 	maxTotalReservableMem api.Bytes
+	// orphanMetrics stores metrics received from autoscaler-agents for pods that we didn't know
+	// about at the time, so that they can be applied once the pod is registered. It's only used if
+	// conf.OrphanMetrics is set.
+	orphanMetrics map[util.NamespacedName]orphanMetrics
 	// conf stores the current configuration, and is nil if the configuration has not yet been set
 	//
 	// Proper initialization of the plugin guarantees conf is not nil.
 	//
 	// conf MAY be accessed without holding the lock; it MUST not be modified.
 	conf *Config
+
+	// clock provides the current time for all of the plugin's time-dependent behavior. It's
+	// realClock outside of tests.
+	//
+	// clock MAY be accessed without holding the lock; it MUST not be modified.
+	clock clock
 }
 
 // nodeState is the information that we track for a particular
@@ -65,6 +92,18 @@ type nodeState struct {
 	// mem tracks the state of bytes of memory -- what's available and how
 	mem nodeResourceState[api.Bytes]
 
+	// tenantReserved gives the amount of this node's resources that are set aside for the tenant
+	// configured by Config.TenantReservation, or zero if there is none.
+	//
+	// Pods that don't belong to the tenant may not use the portion of it that isn't in use by the
+	// tenant's pods. This value does not change.
+	tenantReserved api.Resources
+
+	// extended tracks the state of each of the extended resources listed in
+	// Config.ExtendedResources. Unlike cpu and mem, these are never subject to pressure or
+	// migration; we only track them so that we don't place pods where they won't fit.
+	extended map[corev1.ResourceName]*nodeResourceState[uint64]
+
 	// pods tracks all the VM pods assigned to this node
 	//
 	// This includes both bound pods (i.e., pods fully committed to the node) and reserved pods
@@ -73,27 +112,207 @@ type nodeState struct {
 
 	// mq is the priority queue tracking which pods should be chosen first for migration
 	mq migrationQueue
+
+	// scaleOutPendingSince, if not nil, gives the time at which we first deferred migrating pods off
+	// this node in order to give the node autoscaler a chance to add capacity. It is only used with
+	// the "scale-out-then-migrate" migration strategy, and is reset to nil once the node no longer
+	// has too much pressure.
+	scaleOutPendingSince *time.Time
+
+	// scaleOutFallenBack is true if the node has had too much pressure for longer than the
+	// scale-out grace period, and we've fallen back to migrating pods off it. It's reset along with
+	// scaleOutPendingSince.
+	scaleOutFallenBack bool
+
+	// downscalePendingSince, if not nil, gives the time at which we first deferred migrating pods
+	// off this node in order to ask its pods to downscale. It is only used if
+	// Config.DownscaleBeforeMigrate is set, and is reset to nil once the node no longer has too much
+	// pressure.
+	downscalePendingSince *time.Time
+
+	// overWatermarkSince, if not nil, gives the time at which the node's reserved CPU or memory
+	// most recently went above its watermark. It's reset to nil once both are back under.
+	overWatermarkSince *time.Time
+
+	// pressureExceededSince, if not nil, gives the time at which the node's pressure (including
+	// capacityPressure) first went above the threshold used by tooMuchPressure(). It's reset to nil
+	// once the pressure is back under, and is used for Config.CapacityPressureDwellSeconds.
+	pressureExceededSince *time.Time
+
+	// inTooMuchPressure is true if the last call to tooMuchPressure() returned true. While it's
+	// set, pressure is measured relative to the resources' ReleaseThreshold instead of Watermark.
+	inTooMuchPressure bool
+
+	// accommodating, if not nil, gives the VM whose increase was most recently denied because this
+	// node was full, if Config.IncreaseDenialPolicy is "migrate-to-accommodate". While it's set, the
+	// next pod in the migration queue (if it isn't this VM) is migrated without waiting for the node
+	// to have too much pressure. It's reset once the VM's increase is granted, a migration is
+	// started to make room for it, or its pod is removed.
+	accommodating *util.NamespacedName
+
+	// lastNodeFullEvent gives the time at which we last emitted an event for this node because it
+	// was too full to grant a pod's increase, if Config.NodeFullEvents is set. It's used to rate
+	// limit the events.
+	lastNodeFullEvent time.Time
+
+	// verdictSummary accumulates the outcomes of requests for pods on this node, if
+	// Config.VerdictSummary is set. It's reset each time the summary is logged.
+	verdictSummary nodeVerdictSummary
+
+	// emptySince, if not nil, gives the time at which evictIdleNodes first saw this node without any
+	// pods. It's reset to nil once the node has pods again, and is used for
+	// Config.IdleNodeStateExpirySeconds.
+	emptySince *time.Time
+
+	// capacityPressureAvg is the recent average of the node's capacityPressure, if
+	// Config.ScorePressure is set. It's updated by updateCapacityPressureAvg.
+	capacityPressureAvg pressureAverage
+
+	// scoreMultiplier is the factor that Score multiplies this node's score by, from the node's
+	// AnnotationNodeScoreMultiplier annotation. It's 1 if the annotation isn't set.
+	scoreMultiplier float64
+
+	// capacityUpdatedAt gives the time at which the node's capacity was last calculated from its
+	// Node object. It's used for Config.MaxNodeStateAgeSeconds.
+	capacityUpdatedAt time.Time
+
+	// unschedulable is true if the node has been cordoned, from the Node's spec.unschedulable. We
+	// give cordoned nodes the minimum score and never choose them as migration targets, so that we
+	// don't move pods onto a node that an operator is trying to drain.
+	unschedulable bool
+}
+
+// pressureAverage is an exponentially weighted moving average of a node's CPU and memory
+// capacityPressure, weighted by how long each value was held
+type pressureAverage struct {
+	CPU        float64   `json:"cpu"`
+	Mem        float64   `json:"mem"`
+	LastUpdate time.Time `json:"lastUpdate"`
+}
+
+// update folds the pressure into the average, treating it as having been constant since the last
+// update
+func (a *pressureAverage) update(cpu vmapi.MilliCPU, mem api.Bytes, now time.Time, window time.Duration) {
+	if !now.After(a.LastUpdate) {
+		return
+	}
+
+	if !a.LastUpdate.IsZero() {
+		alpha := 1 - math.Exp(-now.Sub(a.LastUpdate).Seconds()/window.Seconds())
+		a.CPU += alpha * (cpu.AsFloat64() - a.CPU)
+		a.Mem += alpha * (mem.AsFloat64() - a.Mem)
+	}
+	a.LastUpdate = now
+}
+
+// nodeVerdictSummary is the aggregated outcome of the requests handled for a node's pods since the
+// summary was last logged
+type nodeVerdictSummary struct {
+	Requests uint `json:"requests"`
+	// Granted is the total increase in resources granted
+	Granted api.Resources `json:"granted"`
+	// Denied is the total amount of requested increases that weren't granted
+	Denied            api.Resources `json:"denied"`
+	MigrationsStarted uint          `json:"migrationsStarted"`
+}
+
+// MarshalLogObject implements zapcore.ObjectMarshaler
+func (s nodeVerdictSummary) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddUint("requests", s.Requests)
+	if err := enc.AddObject("granted", s.Granted); err != nil {
+		return err
+	}
+	if err := enc.AddObject("denied", s.Denied); err != nil {
+		return err
+	}
+	enc.AddUint("migrationsStarted", s.MigrationsStarted)
+	return nil
 }
 
-type nodeResourceStateField[T any] struct {
+// recordRequest adds the outcome of a single request to the summary
+func (s *nodeVerdictSummary) recordRequest(before, requested, after api.Resources) {
+	s.Requests += 1
+	s.Granted.VCPU += util.SaturatingSub(after.VCPU, before.VCPU)
+	s.Granted.Mem += util.SaturatingSub(after.Mem, before.Mem)
+	s.Denied.VCPU += util.SaturatingSub(requested.VCPU, util.Max(before.VCPU, after.VCPU))
+	s.Denied.Mem += util.SaturatingSub(requested.Mem, util.Max(before.Mem, after.Mem))
+}
+
+// flushVerdictSummaries logs the accumulated verdict summary for each node that's had any activity,
+// and resets them.
+func (e *AutoscaleEnforcer) flushVerdictSummaries(logger *zap.Logger) {
+	e.state.lock.Lock()
+	defer e.state.lock.Unlock()
+
+	var empty nodeVerdictSummary
+	for _, node := range e.state.nodes {
+		if node.verdictSummary == empty {
+			continue
+		}
+
+		logger.Info(
+			"Summary of requests handled for node",
+			zap.String("node", node.name),
+			zap.Object("summary", node.verdictSummary),
+		)
+		node.verdictSummary = empty
+	}
+}
+
+type resourceStateField[T any] struct {
 	valueName string
 	value     T
 }
 
-func (s *nodeResourceState[T]) fields() []nodeResourceStateField[T] {
-	return []nodeResourceStateField[T]{
+func (s *nodeResourceState[T]) fields() []resourceStateField[T] {
+	return []resourceStateField[T]{
 		{"Total", s.Total},
 		{"Watermark", s.Watermark},
 		{"Reserved", s.Reserved},
 		{"Buffer", s.Buffer},
+		{"Burst", s.Burst},
+		{"EffectiveUsage", s.effectiveUsage()},
 		{"CapacityPressure", s.CapacityPressure},
 		{"PressureAccountedFor", s.PressureAccountedFor},
 	}
 }
 
-func (s *nodeState) updateMetrics(metrics PromMetrics) {
+func (s *nodeState) updateMetrics(metrics PromMetrics, now time.Time) {
+	// updateMetrics is called after every change to the node's reservations, so it's where we check
+	// whether the node has crossed its watermark.
+	s.updateOverWatermark(metrics, now)
+
 	s.cpu.updateMetrics(metrics.nodeCPUResources, s.name, s.nodeGroup, s.availabilityZone, vmapi.MilliCPU.AsFloat64)
 	s.mem.updateMetrics(metrics.nodeMemResources, s.name, s.nodeGroup, s.availabilityZone, api.Bytes.AsFloat64)
+
+	var scaleOutPending float64
+	if s.scaleOutPendingSince != nil && !s.scaleOutFallenBack {
+		scaleOutPending = 1
+	}
+	metrics.nodeScaleOutPending.WithLabelValues(s.name, s.nodeGroup, s.availabilityZone).Set(scaleOutPending)
+
+	s.updateQueueMetrics(metrics, now)
+
+	// Any time the node's state changes, it's typically because one of its pods has changed, so we
+	// update the pods' metrics here as well.
+	for _, pod := range s.pods {
+		pod.updateMetrics(metrics)
+	}
+}
+
+// updateOverWatermark records when the node's reserved resources first go above the watermark, and
+// once they drop back below it (whether by migration or by pods scaling down), observes how long
+// the node was over the watermark.
+func (s *nodeState) updateOverWatermark(metrics PromMetrics, now time.Time) {
+	over := s.cpu.Reserved > s.cpu.Watermark || s.mem.Reserved > s.mem.Watermark
+
+	if over && s.overWatermarkSince == nil {
+		s.overWatermarkSince = &now
+	} else if !over && s.overWatermarkSince != nil {
+		duration := now.Sub(*s.overWatermarkSince)
+		metrics.nodeOverWatermarkDuration.WithLabelValues(s.nodeGroup, s.availabilityZone).Observe(duration.Seconds())
+		s.overWatermarkSince = nil
+	}
 }
 
 func (s *nodeResourceState[T]) updateMetrics(
@@ -117,15 +336,81 @@ func (s *nodeState) removeMetrics(metrics PromMetrics) {
 			g.DeleteLabelValues(s.name, s.nodeGroup, s.availabilityZone, f.valueName)
 		}
 	}
+
+	metrics.nodeScaleOutPending.DeleteLabelValues(s.name, s.nodeGroup, s.availabilityZone)
+	metrics.migrationQueueDepth.DeleteLabelValues(s.name, s.nodeGroup, s.availabilityZone)
+	metrics.migrationQueueOldestWait.DeleteLabelValues(s.name, s.nodeGroup, s.availabilityZone)
+}
+
+// updateQueueMetrics sets the metrics for the node's migration queue. It must be called whenever
+// the queue changes, in addition to updateMetrics.
+func (s *nodeState) updateQueueMetrics(metrics PromMetrics, now time.Time) {
+	metrics.migrationQueueDepth.WithLabelValues(s.name, s.nodeGroup, s.availabilityZone).Set(float64(len(s.mq)))
+	metrics.migrationQueueOldestWait.WithLabelValues(s.name, s.nodeGroup, s.availabilityZone).Set(s.mq.oldestWait(now).Seconds())
+}
+
+func (s *podResourceState[T]) fields() []resourceStateField[T] {
+	return []resourceStateField[T]{
+		{"Reserved", s.Reserved},
+		{"Buffer", s.Buffer},
+		{"Burst", s.Burst},
+		{"EffectiveUsage", s.effectiveUsage()},
+		{"Min", s.Min},
+		{"Max", s.Max},
+	}
+}
+
+func (s *podState) updateMetrics(metrics PromMetrics) {
+	s.cpu.updateMetrics(metrics.podCPUResources, s.name, s.node.name, vmapi.MilliCPU.AsFloat64)
+	s.mem.updateMetrics(metrics.podMemResources, s.name, s.node.name, api.Bytes.AsFloat64)
+}
+
+func (s *podResourceState[T]) updateMetrics(
+	metric *prometheus.GaugeVec,
+	podName util.NamespacedName,
+	nodeName string,
+	convert func(T) float64,
+) {
+	for _, f := range s.fields() {
+		metric.WithLabelValues(podName.Namespace, podName.Name, nodeName, f.valueName).Set(convert(f.value))
+	}
+}
+
+func (s *podState) removeMetrics(metrics PromMetrics) {
+	gauges := []*prometheus.GaugeVec{metrics.podCPUResources, metrics.podMemResources}
+	fields := s.cpu.fields() // same as with nodeState.removeMetrics, we just want the valueNames
+
+	for _, g := range gauges {
+		for _, f := range fields {
+			g.DeleteLabelValues(s.name.Namespace, s.name.Name, s.node.name, f.valueName)
+		}
+	}
 }
 
 // nodeResourceState describes the state of a resource allocated to a node
-type nodeResourceState[T any] struct {
-	// Total is the Total amount of T available on the node. This value does not change.
+type nodeResourceState[T constraints.Unsigned] struct {
+	// Total is the Total amount of T available on the node. This value only changes if the node's
+	// extra reservation annotations change (see AnnotationNodeExtraReservedCPU).
 	Total T `json:"total"`
 	// Watermark is the amount of T reserved to pods above which we attempt to reduce usage via
 	// migration.
 	Watermark T `json:"watermark"`
+	// ReleaseThreshold is the amount of T reserved to pods that a node with too much pressure must
+	// get back down to before it's no longer considered to have too much pressure. It is always
+	// less than or equal to Watermark, and does not change.
+	ReleaseThreshold T `json:"releaseThreshold"`
+	// PressureMargin is the amount by which pressure must exceed PressureAccountedFor (plus any
+	// slack) before tooMuchPressure() reports that we should migrate more pods away. This value does
+	// not change.
+	PressureMargin T `json:"pressureMargin"`
+	// NoMigrationTrigger is true if this resource alone shouldn't make tooMuchPressure() report
+	// that pods should be migrated away, from the resource's DisableMigrationTrigger config. This
+	// value does not change.
+	NoMigrationTrigger bool `json:"noMigrationTrigger"`
+	// HardLimit, if not zero, is the amount of T reserved to pods above which increases are denied
+	// outright, without adding to CapacityPressure, from the resource's MaxOverage config. It's
+	// between Watermark and Total, and does not change.
+	HardLimit T `json:"hardLimit"`
 	// Reserved is the current amount of T reserved to pods. It SHOULD be less than or equal to
 	// Total), and we take active measures reduce it once it is above Watermark.
 	//
@@ -142,7 +427,15 @@ type nodeResourceState[T any] struct {
 	// autoscaler-agents from making use of it.
 	//
 	// Buffer is always exactly equal to the sum of all this node's pods' Buffer for T.
+	//
+	// Because Buffer is included in Reserved, the amount of T we expect is actually in use is
+	// (Reserved - Buffer). This is exposed in the metrics as "EffectiveUsage", alongside Reserved.
 	Buffer T `json:"buffer"`
+	// Burst is the amount of T that's been reserved for pods as burst headroom, above what they've
+	// been permitted. Like Buffer, Burst is included in Reserved.
+	//
+	// Burst is always exactly equal to the sum of all this node's pods' Burst for T.
+	Burst T `json:"burst"`
 	// CapacityPressure is -- roughly speaking -- the amount of T that we're currently denying to
 	// pods in this node when they request it, due to not having space in remainingReservableCPU().
 	// This value is exactly equal to the sum of each pod's CapacityPressure.
@@ -158,6 +451,12 @@ type nodeResourceState[T any] struct {
 	PressureAccountedFor T `json:"pressureAccountedFor"`
 }
 
+// effectiveUsage returns the amount of T that we expect is actually in use by the node's pods,
+// i.e. Reserved - Buffer.
+func (s *nodeResourceState[T]) effectiveUsage() T {
+	return util.SaturatingSub(s.Reserved, s.Buffer)
+}
+
 // podState is the information we track for an individual pod, which may or may not be associated
 // with a VM
 type podState struct {
@@ -174,10 +473,34 @@ type podState struct {
 	// memBytes is the current state of this pod's memory utilization and pressure
 	mem podResourceState[api.Bytes]
 
+	// extended is the amount of each of the node's tracked extended resources that this pod has
+	// requested. These amounts do not change.
+	extended map[corev1.ResourceName]*podResourceState[uint64]
+
+	// labels are the pod's labels, used to match non-VM pods against Config.NoisyNeighbors, and all
+	// pods against Config.TenantReservation. They do not change.
+	labels map[string]string
+
 	// vm stores the extra information associated with VMs
 	vm *vmPodState
+
+	// phase is where the pod is in its lifecycle on the node, which determines whether Unreserve is
+	// allowed to remove it.
+	phase podPhase
 }
 
+// podPhase is where a pod is in its lifecycle on a node, from our perspective
+type podPhase string
+
+const (
+	// podPhaseReserved means the pod's resources were reserved by the scheduler's Reserve call, but
+	// we haven't yet seen it running on the node. The scheduler may still Unreserve it.
+	podPhaseReserved podPhase = "reserved"
+	// podPhaseBound means we've seen the pod running on the node (or it was already there when we
+	// started). Only its deletion removes it; calls to Unreserve are ignored.
+	podPhaseBound podPhase = "bound"
+)
+
 type vmPodState struct {
 	// name is the name of the VM, as given by the owner reference for the VM or VM migration that
 	// owns this pod
@@ -187,6 +510,12 @@ type vmPodState struct {
 	// earlier versions of the agent<->plugin protocol.
 	memSlotSize api.Bytes
 
+	// memGranularity is the unit in which memory is reserved for this VM, so that its reservations
+	// reflect how it actually consumes memory on the node (e.g. in 1Gi chunks for VMs backed by
+	// hugepages). It is a multiple of memSlotSize, and equal to it unless overridden by the
+	// api.LabelMemReservationGranularity label.
+	memGranularity api.Bytes
+
 	// testingOnlyAlwaysMigrate is a test-only debugging flag that, if present in the pod's labels,
 	// will always prompt it to mgirate, regardless of whether the VM actually *needs* to.
 	testingOnlyAlwaysMigrate bool
@@ -199,22 +528,146 @@ type vmPodState struct {
 	// we have not yet received metrics.
 	metrics *api.Metrics
 
+	// metricsUpdatedAt gives the time at which metrics was last set to a non-nil value. It's used to
+	// decide whether to keep metrics when a request doesn't include any, according to
+	// Config.MetricsRetentionSeconds.
+	metricsUpdatedAt time.Time
+
 	// mqIndex stores this pod's index in the migrationQueue. This value is -1 iff metrics is nil or
 	// it is currently migrating.
 	mqIndex int
 
+	// overprovisionedBonus is the amount subtracted from this pod's load average when ordering the
+	// migration queue, from Config.overprovisionedBonus. Like metrics, it's only updated right
+	// before the pod's position in the queue is.
+	overprovisionedBonus float64
+
+	// dualReliefBonus is the amount subtracted from this pod's load average when ordering the
+	// migration queue, from Config.dualReliefBonus. It's updated alongside overprovisionedBonus.
+	dualReliefBonus float64
+
+	// migrationSize is the size of this pod's reservation when ordering the migration queue, from
+	// Config.migrationSize. It's updated alongside overprovisionedBonus.
+	migrationSize float64
+
+	// mqEnqueuedAt gives the time at which this pod was most recently added to the migrationQueue.
+	// It is zero iff mqIndex is -1.
+	mqEnqueuedAt time.Time
+
 	// migrationState gives current information about an ongoing migration, if this pod is currently
 	// migrating.
 	migrationState *podMigrationState
+
+	// migrationCooldownUntil, if not zero, gives the time before which this pod must not be selected
+	// for migration, because a previous migration failed.
+	migrationCooldownUntil time.Time
+
+	// pendingMigrationTarget, if not empty, gives the name of the node chosen as the destination for
+	// the migration we most recently created for this pod, before we've observed it starting. It's
+	// moved into migrationState once the migration starts.
+	pendingMigrationTarget string
+
+	// migrationRequested is true from when startMigration decides to create a migration for this
+	// pod until we observe the migration starting (or creating it fails), so that it counts towards
+	// Config.MaxConcurrentMigrationsPerNode before its migrationState is set.
+	migrationRequested bool
+
+	// migrationCounted is true if this pod is the source of a migration that's included in
+	// pluginState.ongoingMigrations, so that the migration is only removed from the count once.
+	migrationCounted bool
+}
+
+// setMetrics updates the VM's metrics, returning true if the update was skipped in order to retain
+// the previous metrics
+//
+// Requests from the autoscaler-agent may not include metrics (e.g. right after it reconnects). In
+// that case, the previous metrics are kept if they were set within the retention period, so that
+// the pod doesn't briefly drop out of the migration queue.
+func (s *vmPodState) setMetrics(metrics *api.Metrics, now time.Time, retention time.Duration) (retained bool) {
+	if metrics == nil && s.metrics != nil && now.Sub(s.metricsUpdatedAt) < retention {
+		return true
+	}
+
+	s.metrics = metrics
+	if metrics != nil {
+		s.metricsUpdatedAt = now
+	}
+	return false
+}
+
+// reservedMem returns the amount of memory that must be reserved for the VM to use mem, i.e. mem
+// rounded up to a multiple of the VM's memGranularity.
+func (s *vmPodState) reservedMem(mem api.Bytes) api.Bytes {
+	return roundUpMem(mem, s.memGranularity)
+}
+
+func roundUpMem(mem api.Bytes, granularity api.Bytes) api.Bytes {
+	if granularity == 0 {
+		return mem
+	}
+	return (mem + granularity - 1) / granularity * granularity
+}
+
+// memReservationGranularity returns the granularity with which memory should be reserved for the
+// VM, based on the api.LabelMemReservationGranularity label on obj, if present.
+//
+// The label must be a quantity that's a positive multiple of the VM's memory slot size. If it's
+// missing, the VM's memory slot size is returned.
+func memReservationGranularity(obj metav1.ObjectMetaAccessor, memSlotSize api.Bytes) (api.Bytes, error) {
+	value, ok := obj.GetObjectMeta().GetLabels()[api.LabelMemReservationGranularity]
+	if !ok {
+		return memSlotSize, nil
+	}
+
+	q, err := resource.ParseQuantity(value)
+	if err != nil {
+		return memSlotSize, fmt.Errorf("could not parse label %q: %w", api.LabelMemReservationGranularity, err)
+	}
+	if q.Sign() <= 0 || api.Bytes(q.Value())%memSlotSize != 0 {
+		return memSlotSize, fmt.Errorf(
+			"label %q must be a positive multiple of the VM memory slot size %v, got %v",
+			api.LabelMemReservationGranularity, memSlotSize, q.String(),
+		)
+	}
+	return api.Bytes(q.Value()), nil
 }
 
 // podMigrationState tracks the information about an ongoing VM pod's migration
 type podMigrationState struct {
 	// name gives the name of the VirtualMachineMigration that this pod is involved in
 	name util.NamespacedName
+
+	// startTime gives the time at which we first observed the migration, used to check whether it's
+	// exceeded the configured timeout.
+	startTime time.Time
+
+	// targetNode gives the name of the node that the VM is being migrated to, if known. For the
+	// source pod, this is only set if we chose the node according to the MigrationTargetStrategy.
+	targetNode string
+
+	// phase gives the most recently observed phase of the VirtualMachineMigration, or empty if we
+	// haven't seen it yet. Migrations are usually first observed through their pods, so the phase
+	// is only known once the migration watch reports a change to it (or if we adopted the migration
+	// in startMigration).
+	phase vmapi.VmmPhase
 }
 
-type podResourceState[T any] struct {
+// MarshalLogObject implements zapcore.ObjectMarshaler
+func (s *podMigrationState) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	if err := enc.AddObject("name", s.name); err != nil {
+		return err
+	}
+	enc.AddTime("startTime", s.startTime)
+	if s.targetNode != "" {
+		enc.AddString("targetNode", s.targetNode)
+	}
+	if s.phase != "" {
+		enc.AddString("phase", string(s.phase))
+	}
+	return nil
+}
+
+type podResourceState[T constraints.Unsigned] struct {
 	// Reserved is the amount of T that this pod has reserved. It is guaranteed that the pod is
 	// using AT MOST Reserved T.
 	Reserved T `json:"reserved"`
@@ -226,7 +679,17 @@ type podResourceState[T any] struct {
 	//
 	// After the first communication from the autoscaler-agent, we update Reserved to match its
 	// value, and set Buffer to zero.
+	//
+	// As with nodeResourceState, (Reserved - Buffer) is exposed in the metrics as "EffectiveUsage".
 	Buffer T `json:"buffer"`
+	// Burst is the amount of T that we've included in Reserved as headroom that the
+	// autoscaler-agent may use immediately, without first making a request. The autoscaler-agent is
+	// only permitted (Reserved - Burst).
+	//
+	// When the autoscaler-agent next makes a request, any of Burst that it's using is converted into
+	// normal reserved resources, and the rest is released before being granted again. This value is
+	// only nonzero if Config.BurstBuffer is set, and MUST be less than or equal to Reserved.
+	Burst T `json:"burst"`
 	// CapacityPressure is this pod's contribution to this pod's node's CapacityPressure for this
 	// resource
 	CapacityPressure T `json:"capacityPressure"`
@@ -236,6 +699,12 @@ type podResourceState[T any] struct {
 	Max T `json:"max"`
 }
 
+// effectiveUsage returns the amount of T that we expect the pod is actually using, i.e. Reserved -
+// Buffer.
+func (s *podResourceState[T]) effectiveUsage() T {
+	return util.SaturatingSub(s.Reserved, s.Buffer)
+}
+
 func (p *podState) kind() string {
 	if p.vm != nil {
 		return "VM"
@@ -265,10 +734,219 @@ func (s *nodeState) remainingReservableMem() api.Bytes {
 	return util.SaturatingSub(s.mem.Total, s.mem.Reserved)
 }
 
+// extendedResourcesFit returns whether adding the given amounts of extended resources to the
+// node's current reservations would keep all of them within the node's totals, and if not, the
+// name of the first one that wouldn't.
+func (s *nodeState) extendedResourcesFit(add map[corev1.ResourceName]uint64) (_ corev1.ResourceName, ok bool) {
+	names := make([]corev1.ResourceName, 0, len(add))
+	for name := range add {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		var remaining uint64
+		if state, ok := s.extended[name]; ok {
+			remaining = util.SaturatingSub(state.Total, state.Reserved)
+		}
+		if add[name] > remaining {
+			return name, false
+		}
+	}
+	return "", true
+}
+
+// extendedTotal returns the node's total amount of the extended resource, or zero if we aren't
+// tracking it on the node (e.g., because it was added to Config.ExtendedResources after our state
+// for the node was built).
+func (s *nodeState) extendedTotal(name corev1.ResourceName) uint64 {
+	if state, ok := s.extended[name]; ok {
+		return state.Total
+	}
+	return 0
+}
+
+// reserveExtended adds the pod's extended resources to the node's reservations
+func (s *nodeState) reserveExtended(pod *podState) {
+	for name, state := range pod.extended {
+		s.extended[name].Reserved += state.Reserved
+	}
+}
+
+// maxReservableFor returns the maximum total resources that may be reserved on the node when adding
+// a pod, given whether the pod belongs to the tenant with reserved resources and how much of the
+// node the tenant's pods are currently using.
+//
+// The tenant's pods may use the entire node; other pods are excluded from the portion of the
+// tenant's reservation that the tenant isn't already using.
+func (s *nodeState) maxReservableFor(isTenantPod bool, tenantUsage api.Resources) api.Resources {
+	if isTenantPod {
+		return api.Resources{VCPU: s.cpu.Total, Mem: s.mem.Total}
+	}
+
+	return api.Resources{
+		VCPU: util.SaturatingSub(s.cpu.Total, util.SaturatingSub(s.tenantReserved.VCPU, tenantUsage.VCPU)),
+		Mem:  util.SaturatingSub(s.mem.Total, util.SaturatingSub(s.tenantReserved.Mem, tenantUsage.Mem)),
+	}
+}
+
+// vmCount returns the number of VM pods on the node, including pods that are only reserved
+func (s *nodeState) vmCount() int {
+	count := 0
+	for _, pod := range s.pods {
+		if pod.vm != nil {
+			count += 1
+		}
+	}
+	return count
+}
+
+// countMigration adds the migration that the VM pod is the source of to s.ongoingMigrations, if it
+// isn't already counted.
+//
+// This method must only be called while holding s.lock.
+func (s *pluginState) countMigration(vm *vmPodState) {
+	if !vm.migrationCounted {
+		vm.migrationCounted = true
+		s.ongoingMigrations += 1
+	}
+}
+
+// uncountMigration removes the migration that the VM pod is the source of from
+// s.ongoingMigrations, if it was counted.
+//
+// This method must only be called while holding s.lock.
+func (s *pluginState) uncountMigration(vm *vmPodState) {
+	if vm.migrationCounted {
+		vm.migrationCounted = false
+		s.ongoingMigrations -= 1
+	}
+}
+
+// migrationLimitReached returns whether there are already as many ongoing migrations as allowed by
+// Config.MaxTotalConcurrentMigrations, in which case no more should be started.
+//
+// This method must only be called while holding s.lock.
+func (s *pluginState) migrationLimitReached() bool {
+	return s.conf.MaxTotalConcurrentMigrations != 0 && s.ongoingMigrations >= s.conf.MaxTotalConcurrentMigrations
+}
+
+// migratingCount returns the number of pods on the node that are currently migrating, either to or
+// from it, including the ones we've requested migrations for that haven't started yet
+func (s *nodeState) migratingCount() int {
+	count := 0
+	for _, pod := range s.pods {
+		if pod.vm != nil && (pod.vm.currentlyMigrating() || pod.vm.migrationRequested) {
+			count += 1
+		}
+	}
+	return count
+}
+
+// migrationLimitReached returns whether the node already has the maximum number of ongoing
+// migrations allowed by Config.MaxConcurrentMigrationsPerNode, in which case no more pods should be
+// migrated away from it.
+func (s *nodeState) migrationLimitReached(conf *Config) bool {
+	return conf.MaxConcurrentMigrationsPerNode != 0 && uint(s.migratingCount()) >= conf.MaxConcurrentMigrationsPerNode
+}
+
+// vmCountLimitReached returns whether the node already has the maximum number of VM pods allowed by
+// the config, in which case no more VMs should be placed onto it.
+func (s *nodeState) vmCountLimitReached(conf *Config) bool {
+	return conf.vmCountLimitReached(s.vmCount())
+}
+
+// hasNoisyNeighbor returns whether any of the non-VM pods on the node match conf.NoisyNeighbors
+func (s *nodeState) hasNoisyNeighbor(conf *Config) bool {
+	for _, pod := range s.pods {
+		if conf.NoisyNeighbors.matches(pod) {
+			return true
+		}
+	}
+	return false
+}
+
+// nonVMReserved returns the total resources reserved by non-VM pods on the node
+func (s *nodeState) nonVMReserved() api.Resources {
+	var total api.Resources
+	for _, pod := range s.pods {
+		if pod.vm == nil {
+			total.VCPU += pod.cpu.Reserved
+			total.Mem += pod.mem.Reserved
+		}
+	}
+	return total
+}
+
+// nonVMLimit returns the maximum resources that non-VM pods may reserve on the node, according to
+// the config, or nil if there is no limit.
+func (s *nodeState) nonVMLimit(conf *Config) *api.Resources {
+	if conf.NonVMLimit == nil {
+		return nil
+	}
+
+	return &api.Resources{
+		VCPU: vmapi.MilliCPU(conf.NonVMLimit.MaxFraction * float64(s.cpu.Total)),
+		Mem:  api.Bytes(conf.NonVMLimit.MaxFraction * float64(s.mem.Total)),
+	}
+}
+
+// updateCapacityPressureAvg updates the node's capacityPressureAvg, if Config.ScorePressure is set
+//
+// Because the average is weighted by how long each value was held, this must be called immediately
+// before anything that changes the node's capacityPressure.
+func (s *nodeState) updateCapacityPressureAvg(conf *Config, now time.Time) {
+	if conf.ScorePressure == nil {
+		return
+	}
+
+	window := time.Second * time.Duration(conf.ScorePressure.WindowSeconds)
+	s.capacityPressureAvg.update(s.cpu.CapacityPressure, s.mem.CapacityPressure, now, window)
+}
+
+// blendedCapacityPressure returns the node's CPU and memory capacityPressure, as a blend of the
+// current values and their recent averages, according to the config
+func (s *nodeState) blendedCapacityPressure(conf *scorePressureConfig) (cpu float64, mem float64) {
+	w := conf.InstantaneousWeight
+	cpu = w*s.cpu.CapacityPressure.AsFloat64() + (1-w)*s.capacityPressureAvg.CPU
+	mem = w*s.mem.CapacityPressure.AsFloat64() + (1-w)*s.capacityPressureAvg.Mem
+	return
+}
+
+// dualPressure returns whether the node's reserved CPU and memory are both above their watermarks
+//
+// As with tooMuchPressure, the ReleaseThreshold is used instead while the node is already migrating
+// pods out.
+func (s *nodeState) dualPressure() bool {
+	cpuWatermark, memWatermark := s.cpu.Watermark, s.mem.Watermark
+	if s.inTooMuchPressure {
+		cpuWatermark, memWatermark = s.cpu.ReleaseThreshold, s.mem.ReleaseThreshold
+	}
+
+	return !s.cpu.NoMigrationTrigger && s.cpu.Reserved > cpuWatermark &&
+		!s.mem.NoMigrationTrigger && s.mem.Reserved > memWatermark
+}
+
 // tooMuchPressure is used to signal whether the node should start migrating pods out in order to
 // relieve some of the pressure
-func (s *nodeState) tooMuchPressure(logger *zap.Logger) bool {
-	if s.cpu.Reserved <= s.cpu.Watermark && s.mem.Reserved < s.mem.Watermark {
+//
+// Once this returns true, pressure is measured relative to the resources' ReleaseThreshold until it
+// returns false again, so that nodes hovering around the watermark don't flap in and out of
+// migrating pods.
+//
+// If the pressure is only too much because of capacityPressure, it must have persisted for at least
+// dwell before this returns true.
+//
+// Resources with NoMigrationTrigger set are never too much on their own.
+func (s *nodeState) tooMuchPressure(logger *zap.Logger, now time.Time, dwell time.Duration) bool {
+	cpuWatermark, memWatermark := s.cpu.Watermark, s.mem.Watermark
+	if s.inTooMuchPressure {
+		cpuWatermark, memWatermark = s.cpu.ReleaseThreshold, s.mem.ReleaseThreshold
+	}
+
+	cpuOK := s.cpu.NoMigrationTrigger || s.cpu.Reserved <= cpuWatermark
+	memOK := s.mem.NoMigrationTrigger || s.mem.Reserved < memWatermark
+	if cpuOK && memOK {
 		type okPair[T any] struct {
 			Reserved  T
 			Watermark T
@@ -276,9 +954,12 @@ func (s *nodeState) tooMuchPressure(logger *zap.Logger) bool {
 
 		logger.Debug(
 			"tooMuchPressure = false (clearly)",
-			zap.Any("cpu", okPair[vmapi.MilliCPU]{Reserved: s.cpu.Reserved, Watermark: s.cpu.Watermark}),
-			zap.Any("mem", okPair[api.Bytes]{Reserved: s.mem.Reserved, Watermark: s.mem.Watermark}),
+			zap.Any("cpu", okPair[vmapi.MilliCPU]{Reserved: s.cpu.Reserved, Watermark: cpuWatermark}),
+			zap.Any("mem", okPair[api.Bytes]{Reserved: s.mem.Reserved, Watermark: memWatermark}),
+			zap.Bool("wasTooMuchPressure", s.inTooMuchPressure),
 		)
+		s.inTooMuchPressure = false
+		s.pressureExceededSince = nil
 		return false
 	}
 
@@ -287,41 +968,185 @@ func (s *nodeState) tooMuchPressure(logger *zap.Logger) bool {
 		LogicalSlack    T
 		Capacity        T
 		AccountedFor    T
+		Margin          T
 		TooMuch         bool
 	}
 
 	var cpu info[vmapi.MilliCPU]
 	var mem info[api.Bytes]
 
-	cpu.LogicalPressure = util.SaturatingSub(s.cpu.Reserved, s.cpu.Watermark)
-	mem.LogicalPressure = util.SaturatingSub(s.mem.Reserved, s.mem.Watermark)
+	cpu.LogicalPressure = util.SaturatingSub(s.cpu.Reserved, cpuWatermark)
+	mem.LogicalPressure = util.SaturatingSub(s.mem.Reserved, memWatermark)
 
 	// Account for existing slack in the system, to counteract capacityPressure that hasn't been
 	// updated yet
-	cpu.LogicalSlack = s.cpu.Buffer + util.SaturatingSub(s.cpu.Watermark, s.cpu.Reserved)
-	mem.LogicalSlack = s.mem.Buffer + util.SaturatingSub(s.mem.Watermark, s.mem.Reserved)
+	cpu.LogicalSlack = s.cpu.Buffer + util.SaturatingSub(cpuWatermark, s.cpu.Reserved)
+	mem.LogicalSlack = s.mem.Buffer + util.SaturatingSub(memWatermark, s.mem.Reserved)
+
+	cpu.Capacity = s.cpu.CapacityPressure
+	mem.Capacity = s.mem.CapacityPressure
+	cpu.AccountedFor = s.cpu.PressureAccountedFor
+	mem.AccountedFor = s.mem.PressureAccountedFor
+
+	// Only consider the pressure "too much" if it exceeds what's accounted for by more than the
+	// configured margin.
+	cpu.Margin = s.cpu.PressureMargin
+	mem.Margin = s.mem.PressureMargin
 
-	cpu.TooMuch = cpu.LogicalPressure+s.cpu.CapacityPressure > s.cpu.PressureAccountedFor+cpu.LogicalSlack
-	mem.TooMuch = mem.LogicalPressure+s.mem.CapacityPressure > s.mem.PressureAccountedFor+mem.LogicalSlack
+	cpu.TooMuch = !s.cpu.NoMigrationTrigger &&
+		cpu.LogicalPressure+cpu.Capacity > cpu.AccountedFor+cpu.LogicalSlack+cpu.Margin
+	mem.TooMuch = !s.mem.NoMigrationTrigger &&
+		mem.LogicalPressure+mem.Capacity > mem.AccountedFor+mem.LogicalSlack+mem.Margin
 
 	result := cpu.TooMuch || mem.TooMuch
 
+	if !result {
+		s.pressureExceededSince = nil
+	} else if s.pressureExceededSince == nil {
+		s.pressureExceededSince = &now
+	}
+
+	// capacityPressure can spike from a single bursty request, so if it's the only reason there's
+	// too much pressure, wait until it's persisted for long enough.
+	reservedTooMuch := cpu.TooMuch && cpu.LogicalPressure > cpu.AccountedFor+cpu.LogicalSlack+cpu.Margin ||
+		mem.TooMuch && mem.LogicalPressure > mem.AccountedFor+mem.LogicalSlack+mem.Margin
+	waitingForDwell := result && !reservedTooMuch && now.Sub(*s.pressureExceededSince) < dwell
+	if waitingForDwell {
+		result = false
+	}
+
 	logger.Debug(
 		fmt.Sprintf("tooMuchPressure = %v", result),
 		zap.Any("cpu", cpu),
 		zap.Any("mem", mem),
+		zap.Bool("wasTooMuchPressure", s.inTooMuchPressure),
+		zap.Timep("overWatermarkSince", s.overWatermarkSince),
+		zap.Timep("pressureExceededSince", s.pressureExceededSince),
+		zap.Bool("waitingForDwell", waitingForDwell),
 	)
 
+	s.inTooMuchPressure = result
 	return result
 }
 
+// updateDownscalePending records whether the node currently has too much pressure, for use with
+// Config.DownscaleBeforeMigrate, and returns whether migration should be deferred in order to give
+// the node's pods a chance to downscale.
+//
+// While migration is deferred, low-load pods on the node are asked to downscale in responses to
+// their requests (see getDownscaleForResponse).
+func (s *nodeState) updateDownscalePending(
+	logger *zap.Logger,
+	tooMuchPressure bool,
+	now time.Time,
+	wait time.Duration,
+) (deferMigration bool) {
+	if !tooMuchPressure {
+		if s.downscalePendingSince != nil {
+			logger.Info(
+				"Node no longer has too much pressure, clearing pending downscale",
+				zap.Duration("pendingFor", now.Sub(*s.downscalePendingSince)),
+			)
+			s.downscalePendingSince = nil
+		}
+		return false
+	}
+
+	if s.downscalePendingSince == nil {
+		logger.Info(
+			"Node has too much pressure, deferring migration to ask pods to downscale",
+			zap.Duration("wait", wait),
+		)
+		s.downscalePendingSince = &now
+	}
+
+	pendingFor := now.Sub(*s.downscalePendingSince)
+	if pendingFor < wait {
+		return true
+	}
+
+	logger.Warn(
+		"Node still has too much pressure after waiting for pods to downscale, falling back to migration",
+		zap.Duration("pendingFor", pendingFor),
+		zap.Duration("wait", wait),
+	)
+	return false
+}
+
+// updateScaleOutPending records whether the node currently has too much pressure, for use with the
+// "scale-out-then-migrate" migration strategy, and returns whether migration should be deferred in
+// order to give the node autoscaler a chance to add capacity.
+//
+// While migration is deferred, the node is reported as pending scale-out in the metrics. Once the
+// grace period has passed, it's no longer reported as pending.
+func (s *nodeState) updateScaleOutPending(
+	logger *zap.Logger,
+	metrics PromMetrics,
+	tooMuchPressure bool,
+	now time.Time,
+	gracePeriod time.Duration,
+) (deferMigration bool) {
+	if !tooMuchPressure {
+		if s.scaleOutPendingSince != nil {
+			logger.Info(
+				"Node no longer has too much pressure, clearing pending scale-out",
+				zap.Duration("pendingFor", now.Sub(*s.scaleOutPendingSince)),
+			)
+			s.scaleOutPendingSince = nil
+			s.scaleOutFallenBack = false
+			s.updateMetrics(metrics, now)
+		}
+		return false
+	}
+
+	if s.scaleOutPendingSince == nil {
+		logger.Info(
+			"Node has too much pressure, deferring migration to allow scale-out",
+			zap.Duration("gracePeriod", gracePeriod),
+		)
+		s.scaleOutPendingSince = &now
+		s.updateMetrics(metrics, now)
+	}
+
+	pendingFor := now.Sub(*s.scaleOutPendingSince)
+	if pendingFor < gracePeriod {
+		return true
+	}
+
+	if !s.scaleOutFallenBack {
+		logger.Warn(
+			"Node still has too much pressure after scale-out grace period, falling back to migration",
+			zap.Duration("pendingFor", pendingFor),
+			zap.Duration("gracePeriod", gracePeriod),
+		)
+		s.scaleOutFallenBack = true
+		s.updateMetrics(metrics, now)
+	}
+	return false
+}
+
 // checkOkToMigrate allows us to check that it's still ok to start migrating a pod, after it was
 // previously selected for migration
 //
 // A returned error indicates that the pod's resource usage has changed enough that we should try to
 // migrate something else first. The error provides justification for this.
-func (s *vmPodState) checkOkToMigrate(oldMetrics api.Metrics) error {
-	// TODO. Note: s.metrics may be nil.
+//
+// Currently, the only reason for vetoing is that the pod's 1-minute load average has dropped below
+// minLoadFraction of its value in oldMetrics. A minLoadFraction of zero never vetoes.
+func (s *vmPodState) checkOkToMigrate(oldMetrics api.Metrics, minLoadFraction float64) error {
+	if s.metrics == nil || minLoadFraction == 0 {
+		return nil
+	}
+
+	oldLoad := float64(oldMetrics.LoadAverage1Min)
+	newLoad := float64(s.metrics.LoadAverage1Min)
+	if newLoad < oldLoad*minLoadFraction {
+		return fmt.Errorf(
+			"load average dropped from %.2f to %.2f since selection, below %v of previous",
+			oldLoad, newLoad, minLoadFraction,
+		)
+	}
+
 	return nil
 }
 
@@ -329,6 +1154,12 @@ func (s *vmPodState) currentlyMigrating() bool {
 	return s.migrationState != nil
 }
 
+// inMigrationCooldown returns whether the pod is not allowed to be selected for migration, because a
+// previous migration recently failed.
+func (s *vmPodState) inMigrationCooldown(now time.Time) bool {
+	return now.Before(s.migrationCooldownUntil)
+}
+
 // this method can only be called while holding a lock. If we don't have the necessary information
 // locally, then the lock is released temporarily while we query the API server
 //
@@ -410,64 +1241,130 @@ func (s *pluginState) getOrFetchNodeState(
 		}
 	}
 
-	n, err := buildInitialNodeState(logger, node, s.conf)
+	return s.addNode(logger, metrics, node)
+}
+
+// addNode builds the initial state for the Node and adds it to s.nodes, updating the maximum
+// reservable resources to match
+//
+// This method must only be called while holding s.lock.
+func (s *pluginState) addNode(logger *zap.Logger, metrics PromMetrics, node *corev1.Node) (*nodeState, error) {
+	n, err := buildInitialNodeState(logger, node, s.conf, s.clock.Now())
 	if err != nil {
 		return nil, err
 	}
 
-	// update maxTotalReservableCPU and maxTotalReservableMemSlots if there's new maxima
-	if n.cpu.Total > s.maxTotalReservableCPU {
-		s.maxTotalReservableCPU = n.cpu.Total
-	}
-	if n.mem.Total > s.maxTotalReservableMem {
-		s.maxTotalReservableMem = n.mem.Total
-	}
+	n.updateMetrics(metrics, s.clock.Now())
 
-	n.updateMetrics(metrics)
-
-	s.nodes[nodeName] = n
+	s.nodes[node.Name] = n
+	s.updateMaxTotalReservable()
 	return n, nil
 }
 
-// this method must only be called while holding s.lock. It will not be released during this
-// function.
+// updateMaxTotalReservable recomputes maxTotalReservableCPU and maxTotalReservableMem from the
+// current set of nodes
 //
-// Note: buildInitialNodeState does not take any of the pods or VMs on the node into account; it
-// only examines the total resources available to the node.
-func buildInitialNodeState(logger *zap.Logger, node *corev1.Node, conf *Config) (*nodeState, error) {
-	// cpuQ = "cpu, as a K8s resource.Quantity"
-	// -A for allocatable, -C for capacity
-	var cpuQ *resource.Quantity
-	cpuQA := node.Status.Allocatable.Cpu()
-	cpuQC := node.Status.Capacity.Cpu()
+// This must be called whenever a node is added or removed, or its total resources change, so that
+// the maxima don't remain stale once the node that set them is gone.
+//
+// This method must only be called while holding s.lock.
+func (s *pluginState) updateMaxTotalReservable() {
+	s.maxTotalReservableCPU = 0
+	s.maxTotalReservableMem = 0
+	for _, n := range s.nodes {
+		s.maxTotalReservableCPU = util.Max(s.maxTotalReservableCPU, n.cpu.Total)
+		s.maxTotalReservableMem = util.Max(s.maxTotalReservableMem, n.mem.Total)
+	}
+}
 
-	if cpuQA != nil {
-		// Use Allocatable by default ...
-		cpuQ = cpuQA
-	} else if cpuQC != nil {
-		// ... but use Capacity if Allocatable is not available
-		cpuQ = cpuQC
-	} else {
-		return nil, errors.New("Node has no Allocatable or Capacity CPU limits")
+// zoneCapacity is the aggregate capacity of all the nodes in a single availability zone
+type zoneCapacity struct {
+	Nodes         int            `json:"nodes"`
+	ReservableCPU vmapi.MilliCPU `json:"reservableCPU"`
+	ReservedCPU   vmapi.MilliCPU `json:"reservedCPU"`
+	ReservableMem api.Bytes      `json:"reservableMem"`
+	ReservedMem   api.Bytes      `json:"reservedMem"`
+}
+
+// clusterReserved returns the total resources reserved across all nodes
+//
+// This is derived from the nodes each time, rather than kept as a separate running total, so that
+// it can't drift from the nodes' own accounting.
+//
+// This method must only be called while holding s.lock.
+func (s *pluginState) clusterReserved() api.Resources {
+	var total api.Resources
+	for _, n := range s.nodes {
+		total.VCPU += n.cpu.Reserved
+		total.Mem += n.mem.Reserved
 	}
+	return total
+}
 
-	cpu := conf.NodeConfig.vCpuLimits(cpuQ)
+// clusterBuffer returns the total buffer reserved across all nodes
+//
+// Like clusterReserved, this is derived from the nodes each time.
+//
+// This method must only be called while holding s.lock.
+func (s *pluginState) clusterBuffer() api.Resources {
+	var total api.Resources
+	for _, n := range s.nodes {
+		total.VCPU += n.cpu.Buffer
+		total.Mem += n.mem.Buffer
+	}
+	return total
+}
 
-	// memQ = "mem, as a K8s resource.Quantity"
-	// -A for allocatable, -C for capacity
-	var memQ *resource.Quantity
-	memQA := node.Status.Allocatable.Memory()
-	memQC := node.Status.Capacity.Memory()
+// bufferAllowance returns the most buffer that the pod may have, according to
+// Config.MaxClusterBufferCPU and MaxClusterBufferMem: what it already has, plus whatever's left
+// under the cap. Resources without a cap are limited to vmMax, which the pod's buffer can never
+// exceed anyways.
+//
+// This method must only be called while holding s.lock.
+func (s *pluginState) bufferAllowance(pod *podState, vmMax api.Resources) api.Resources {
+	allowance := vmMax
+	if s.conf.MaxClusterBufferCPU == 0 && s.conf.MaxClusterBufferMem == 0 {
+		return allowance
+	}
 
-	if memQA != nil {
-		memQ = memQA
-	} else if memQC != nil {
-		memQ = memQC
-	} else {
-		return nil, errors.New("Node has no Allocatable or Capacity Memory limits")
+	total := s.clusterBuffer()
+	if s.conf.MaxClusterBufferCPU != 0 {
+		allowance.VCPU = pod.cpu.Buffer + util.SaturatingSub(s.conf.MaxClusterBufferCPU, total.VCPU)
+	}
+	if s.conf.MaxClusterBufferMem != 0 {
+		allowance.Mem = pod.mem.Buffer + util.SaturatingSub(s.conf.MaxClusterBufferMem, total.Mem)
 	}
+	return allowance
+}
+
+// zoneCapacities returns the aggregate capacity of the nodes in each availability zone, keyed by
+// zone. Nodes without a known zone are grouped under the empty string.
+//
+// This method must only be called while holding s.lock.
+func (s *pluginState) zoneCapacities() map[string]zoneCapacity {
+	zones := make(map[string]zoneCapacity)
+	for _, n := range s.nodes {
+		z := zones[n.availabilityZone]
+		z.Nodes += 1
+		z.ReservableCPU += n.cpu.Total
+		z.ReservedCPU += n.cpu.Reserved
+		z.ReservableMem += n.mem.Total
+		z.ReservedMem += n.mem.Reserved
+		zones[n.availabilityZone] = z
+	}
+	return zones
+}
 
-	mem := conf.NodeConfig.memoryLimits(memQ)
+// this method must only be called while holding s.lock. It will not be released during this
+// function.
+//
+// Note: buildInitialNodeState does not take any of the pods or VMs on the node into account; it
+// only examines the total resources available to the node.
+func buildInitialNodeState(logger *zap.Logger, node *corev1.Node, conf *Config, now time.Time) (*nodeState, error) {
+	cpu, mem, err := nodeResourceLimits(logger, node, conf)
+	if err != nil {
+		return nil, err
+	}
 
 	var nodeGroup string
 	if conf.K8sNodeGroupLabel != "" {
@@ -478,13 +1375,10 @@ func buildInitialNodeState(logger *zap.Logger, node *corev1.Node, conf *Config)
 		}
 	}
 
-	var availabilityZone string
-	if conf.K8sAvailabilityZoneLabel != "" {
-		var ok bool
-		availabilityZone, ok = node.Labels[conf.K8sAvailabilityZoneLabel]
-		if !ok {
-			logger.Warn("Node does not have availability zone label", zap.String("label", conf.K8sAvailabilityZoneLabel))
-		}
+	availabilityZone, ok := node.Labels[conf.availabilityZoneLabel()]
+	// Only warn if the label was explicitly configured; plenty of clusters don't set the default.
+	if !ok && conf.K8sAvailabilityZoneLabel != "" {
+		logger.Warn("Node does not have availability zone label", zap.String("label", conf.K8sAvailabilityZoneLabel))
 	}
 
 	n := &nodeState{
@@ -493,8 +1387,30 @@ func buildInitialNodeState(logger *zap.Logger, node *corev1.Node, conf *Config)
 		availabilityZone: availabilityZone,
 		cpu:              cpu,
 		mem:              mem,
+		tenantReserved:   conf.tenantReserved(cpu.Total, mem.Total),
+		extended:         extendedResourceLimits(node, conf.ExtendedResources),
 		pods:             make(map[util.NamespacedName]*podState),
 		mq:               migrationQueue{},
+
+		scaleOutPendingSince:  nil,
+		scaleOutFallenBack:    false,
+		downscalePendingSince: nil,
+		overWatermarkSince:    nil,
+		pressureExceededSince: nil,
+		inTooMuchPressure:     false,
+		accommodating:         nil,
+		lastNodeFullEvent:     time.Time{},
+		verdictSummary: nodeVerdictSummary{
+			Requests:          0,
+			Granted:           api.Resources{VCPU: 0, Mem: 0},
+			Denied:            api.Resources{VCPU: 0, Mem: 0},
+			MigrationsStarted: 0,
+		},
+		emptySince:          nil,
+		capacityPressureAvg: pressureAverage{CPU: 0, Mem: 0, LastUpdate: time.Time{}},
+		scoreMultiplier:     nodeScoreMultiplier(logger, node),
+		capacityUpdatedAt:   now,
+		unschedulable:       node.Spec.Unschedulable,
 	}
 
 	type resourceInfo[T any] struct {
@@ -517,6 +1433,150 @@ func buildInitialNodeState(logger *zap.Logger, node *corev1.Node, conf *Config)
 	return n, nil
 }
 
+// nodeResourceLimits returns the reservable CPU and memory for the node, before taking any of its
+// pods into account
+func nodeResourceLimits(
+	logger *zap.Logger,
+	node *corev1.Node,
+	conf *Config,
+) (cpu nodeResourceState[vmapi.MilliCPU], mem nodeResourceState[api.Bytes], _ error) {
+	// cpuQ = "cpu, as a K8s resource.Quantity"
+	// -A for allocatable, -C for capacity
+	//
+	// We check whether the values are present directly, because ResourceList.Cpu() and Memory()
+	// return zero, rather than nil, if they're missing.
+	var cpuQ *resource.Quantity
+	if cpuQA, ok := node.Status.Allocatable[corev1.ResourceCPU]; ok {
+		// Use Allocatable by default ...
+		cpuQ = &cpuQA
+	} else if cpuQC, ok := node.Status.Capacity[corev1.ResourceCPU]; ok {
+		// ... but use Capacity if Allocatable is not available
+		cpuQ = &cpuQC
+	} else {
+		return cpu, mem, errors.New("Node has no Allocatable or Capacity CPU limits")
+	}
+
+	// memQ = "mem, as a K8s resource.Quantity"
+	//
+	// Same as with CPU, but we also need to know whether we fell back to Capacity.
+	var memQ *resource.Quantity
+	usingMemCapacity := false
+	if memQA, ok := node.Status.Allocatable[corev1.ResourceMemory]; ok {
+		memQ = &memQA
+	} else if memQC, ok := node.Status.Capacity[corev1.ResourceMemory]; ok {
+		memQ = &memQC
+		usingMemCapacity = true
+	} else {
+		return cpu, mem, errors.New("Node has no Allocatable or Capacity Memory limits")
+	}
+
+	if bounds := conf.NodeCapacityBounds; bounds != nil {
+		if err := checkNodeCapacityBounds(bounds, cpuQ, memQ); err != nil {
+			return cpu, mem, err
+		}
+	}
+
+	// Never reserve memory past the eviction threshold, where the kubelet would start evicting
+	// pods. Allocatable already has the threshold subtracted by the kubelet, so this only applies
+	// when we've fallen back to Capacity.
+	if conf.EvictionThreshold != nil && usingMemCapacity {
+		threshold, err := conf.EvictionThreshold.memoryThreshold(node)
+		if err != nil {
+			logger.Warn("Invalid eviction threshold for node, using default", zap.Any("threshold", threshold), zap.Error(err))
+		}
+		memQ = util.SaturatingSub(api.BytesFromResourceQuantity(*memQ), threshold).ToResourceQuantity()
+	}
+
+	// Hold back anything extra that the node's annotations ask for, e.g. for heavier node-local
+	// agents.
+	extra := nodeExtraReserved(logger, node)
+	cpuQ = util.SaturatingSub(vmapi.MilliCPUFromResourceQuantity(*cpuQ), extra.VCPU).ToResourceQuantity()
+	memQ = util.SaturatingSub(api.BytesFromResourceQuantity(*memQ), extra.Mem).ToResourceQuantity()
+
+	cpu = conf.NodeConfig.vCpuLimits(cpuQ)
+	mem = conf.NodeConfig.memoryLimits(memQ)
+	return cpu, mem, nil
+}
+
+// minNodeCPU is the least CPU that any node may have, if Config.NodeCapacityBounds is provided
+const minNodeCPU vmapi.MilliCPU = 1000
+
+// checkNodeCapacityBounds returns an error if the node's CPU or memory is outside of the bounds
+//
+// The quantities are compared directly, rather than after conversion, so that absurd values can't
+// overflow into something that looks reasonable.
+func checkNodeCapacityBounds(bounds *nodeCapacityBoundsConfig, cpuQ, memQ *resource.Quantity) error {
+	if cpuQ.Cmp(*minNodeCPU.ToResourceQuantity()) < 0 || cpuQ.Cmp(*bounds.MaxCPU.ToResourceQuantity()) > 0 {
+		return fmt.Errorf(
+			"Node CPU %s is outside the expected range of %v to %v (maybe it's reported in unexpected units?)",
+			cpuQ, minNodeCPU, bounds.MaxCPU,
+		)
+	}
+	if memQ.Cmp(*bounds.MinMemory.ToResourceQuantity()) < 0 {
+		return fmt.Errorf(
+			"Node memory %s is below the expected minimum of %v (maybe it's reported in unexpected units?)",
+			memQ, bounds.MinMemory,
+		)
+	}
+	return nil
+}
+
+// nodeExtraReserved returns the additional resources that the node's AnnotationNodeExtraReservedCPU
+// and AnnotationNodeExtraReservedMem annotations ask us to hold back from VMs. Invalid annotations
+// are logged and treated as zero.
+func nodeExtraReserved(logger *zap.Logger, node *corev1.Node) api.Resources {
+	parse := func(annotation string) resource.Quantity {
+		value, ok := node.Annotations[annotation]
+		if !ok {
+			return resource.Quantity{}
+		}
+
+		q, err := resource.ParseQuantity(value)
+		if err == nil && q.Sign() < 0 {
+			err = errors.New("value must not be negative")
+		}
+		if err != nil {
+			logger.Warn(
+				"Ignoring invalid extra reservation annotation on node",
+				zap.String("annotation", annotation),
+				zap.String("value", value),
+				zap.Error(err),
+			)
+			return resource.Quantity{}
+		}
+		return q
+	}
+
+	return api.Resources{
+		VCPU: vmapi.MilliCPUFromResourceQuantity(parse(AnnotationNodeExtraReservedCPU)),
+		Mem:  api.BytesFromResourceQuantity(parse(AnnotationNodeExtraReservedMem)),
+	}
+}
+
+// nodeScoreMultiplier returns the value of the node's AnnotationNodeScoreMultiplier annotation, or 1
+// if it's not set. Invalid values are logged and treated as 1.
+func nodeScoreMultiplier(logger *zap.Logger, node *corev1.Node) float64 {
+	value, ok := node.Annotations[AnnotationNodeScoreMultiplier]
+	if !ok {
+		return 1
+	}
+
+	multiplier, err := strconv.ParseFloat(value, 64)
+	if err == nil && !(multiplier > 0 && !math.IsInf(multiplier, 1)) {
+		err = errors.New("value must be positive and finite")
+	}
+	if err != nil {
+		logger.Warn(
+			"Ignoring invalid score multiplier annotation on node",
+			zap.String("annotation", AnnotationNodeScoreMultiplier),
+			zap.String("value", value),
+			zap.Error(err),
+		)
+		return 1
+	}
+	return multiplier
+}
+
 func extractPodResources(pod *corev1.Pod) api.Resources {
 	var cpu vmapi.MilliCPU
 	var mem api.Bytes
@@ -534,6 +1594,110 @@ func extractPodResources(pod *corev1.Pod) api.Resources {
 	return api.Resources{VCPU: cpu, Mem: mem}
 }
 
+// runnerContainerName is the name of the container in VM pods that runs the VM itself
+const runnerContainerName = "neonvm-runner"
+
+// checkRunnerGuaranteedQoS returns whether the VM pod's runner container has requests equal to
+// limits for both CPU and memory, with a verdictSet describing the result for each.
+func checkRunnerGuaranteedQoS(pod *corev1.Pod) (_ verdictSet, ok bool) {
+	var runner *corev1.Container
+	for i := range pod.Spec.Containers {
+		if pod.Spec.Containers[i].Name == runnerContainerName {
+			runner = &pod.Spec.Containers[i]
+			break
+		}
+	}
+	if runner == nil {
+		msg := fmt.Sprintf("no %q container", runnerContainerName)
+		return verdictSet{cpu: msg, mem: msg}, false
+	}
+
+	check := func(name corev1.ResourceName) (string, bool) {
+		limit, ok := runner.Resources.Limits[name]
+		if !ok {
+			return "no limit set (NOT GUARANTEED)", false
+		}
+		// Kubernetes defaults requests to limits if they aren't set, so that's fine too.
+		request, ok := runner.Resources.Requests[name]
+		if !ok {
+			request = limit
+		}
+
+		if request.Cmp(limit) != 0 {
+			return fmt.Sprintf("requests %s != limits %s (NOT GUARANTEED)", &request, &limit), false
+		}
+		return fmt.Sprintf("requests %s == limits %s (OK)", &request, &limit), true
+	}
+
+	cpuVerdict, cpuOK := check(corev1.ResourceCPU)
+	memVerdict, memOK := check(corev1.ResourceMemory)
+	return verdictSet{cpu: cpuVerdict, mem: memVerdict}, cpuOK && memOK
+}
+
+// extendedResourceLimits returns the initial state of each of the named extended resources on the
+// node. Resources that the node doesn't have are given a total of zero.
+func extendedResourceLimits(node *corev1.Node, names []corev1.ResourceName) map[corev1.ResourceName]*nodeResourceState[uint64] {
+	limits := make(map[corev1.ResourceName]*nodeResourceState[uint64])
+	for _, name := range names {
+		// Same as with CPU and memory, use Allocatable by default, but fall back to Capacity.
+		q, ok := node.Status.Allocatable[name]
+		if !ok {
+			q = node.Status.Capacity[name]
+		}
+		total := uint64(q.Value())
+
+		limits[name] = &nodeResourceState[uint64]{
+			Total:                total,
+			Watermark:            total,
+			ReleaseThreshold:     total,
+			PressureMargin:       0,
+			NoMigrationTrigger:   false,
+			HardLimit:            0,
+			Reserved:             0,
+			Buffer:               0,
+			Burst:                0,
+			CapacityPressure:     0,
+			PressureAccountedFor: 0,
+		}
+	}
+	return limits
+}
+
+// extractPodExtendedResources returns the amount of each of the named extended resources that the
+// pod requests. Resources that the pod doesn't request are omitted.
+func extractPodExtendedResources(pod *corev1.Pod, names []corev1.ResourceName) map[corev1.ResourceName]uint64 {
+	amounts := make(map[corev1.ResourceName]uint64)
+	for _, name := range names {
+		var total uint64
+		for _, container := range pod.Spec.Containers {
+			if q, ok := container.Resources.Requests[name]; ok {
+				total += uint64(q.Value())
+			}
+		}
+		if total != 0 {
+			amounts[name] = total
+		}
+	}
+	return amounts
+}
+
+// makeExtendedPodState returns the podState.extended for a pod requesting the given amounts of
+// extended resources
+func makeExtendedPodState(amounts map[corev1.ResourceName]uint64) map[corev1.ResourceName]*podResourceState[uint64] {
+	state := make(map[corev1.ResourceName]*podResourceState[uint64])
+	for name, amount := range amounts {
+		state[name] = &podResourceState[uint64]{
+			Reserved:         amount,
+			Buffer:           0,
+			Burst:            0,
+			CapacityPressure: 0,
+			Min:              amount,
+			Max:              amount,
+		}
+	}
+	return state
+}
+
 func (e *AutoscaleEnforcer) handleNodeDeletion(logger *zap.Logger, nodeName string) {
 	logger = logger.With(
 		zap.String("action", "Node deletion"),
@@ -547,7 +1711,10 @@ func (e *AutoscaleEnforcer) handleNodeDeletion(logger *zap.Logger, nodeName stri
 
 	node, ok := e.state.nodes[nodeName]
 	if !ok {
+		// Nodes are added to our state lazily, so this can happen for nodes that never had any of
+		// our pods. There's nothing to clean up.
 		logger.Warn("Cannot find node in nodeMap")
+		return
 	}
 
 	if logger.Core().Enabled(zapcore.DebugLevel) {
@@ -561,12 +1728,190 @@ func (e *AutoscaleEnforcer) handleNodeDeletion(logger *zap.Logger, nodeName stri
 			pod.logFields()...,
 		)
 		delete(e.state.pods, name)
+		pod.removeMetrics(e.metrics)
 	}
 
 	node.removeMetrics(e.metrics)
 
 	delete(e.state.nodes, nodeName)
-	logger.Info("Deleted node")
+	e.state.updateMaxTotalReservable()
+	logger.Info(
+		"Deleted node",
+		zap.Any("maxTotalReservableCPU", e.state.maxTotalReservableCPU),
+		zap.Any("maxTotalReservableMem", e.state.maxTotalReservableMem),
+	)
+}
+
+// handleNodeUpdate recalculates the node's reservable resources, to pick up any change in its
+// extra reservation annotations. Existing reservations are left as-is, even if they're now above
+// the node's Total; we'll migrate pods away as usual.
+func (e *AutoscaleEnforcer) handleNodeUpdate(logger *zap.Logger, node *corev1.Node) {
+	logger = logger.With(
+		zap.String("action", "Node update"),
+		zap.String("node", node.Name),
+	)
+
+	e.state.lock.Lock()
+	defer e.state.lock.Unlock()
+
+	n, ok := e.state.nodes[node.Name]
+	if !ok {
+		// We'll pick up the new annotations when we first build the node's state.
+		logger.Info("Ignoring update for node without state")
+		return
+	}
+
+	if err := e.state.updateNodeCapacity(logger, e.metrics, n, node); err != nil {
+		logger.Error("Failed to recalculate node resources", zap.Error(err))
+	}
+}
+
+// updateNodeCapacity recalculates n's reservable resources from the Node object, including any
+// extended resources, and whether it's cordoned. Existing reservations are left as-is.
+//
+// This method must only be called while holding s.lock.
+func (s *pluginState) updateNodeCapacity(logger *zap.Logger, metrics PromMetrics, n *nodeState, node *corev1.Node) error {
+	cpu, mem, err := nodeResourceLimits(logger, node, s.conf)
+	if err != nil {
+		return err
+	}
+
+	oldCPU, oldMem := n.cpu.Total, n.mem.Total
+
+	n.cpu.Total = cpu.Total
+	n.cpu.Watermark = cpu.Watermark
+	n.cpu.ReleaseThreshold = cpu.ReleaseThreshold
+	n.cpu.PressureMargin = cpu.PressureMargin
+	n.cpu.NoMigrationTrigger = cpu.NoMigrationTrigger
+	n.cpu.HardLimit = cpu.HardLimit
+	n.mem.Total = mem.Total
+	n.mem.Watermark = mem.Watermark
+	n.mem.ReleaseThreshold = mem.ReleaseThreshold
+	n.mem.PressureMargin = mem.PressureMargin
+	n.mem.NoMigrationTrigger = mem.NoMigrationTrigger
+	n.mem.HardLimit = mem.HardLimit
+	if n.extended == nil {
+		n.extended = make(map[corev1.ResourceName]*nodeResourceState[uint64])
+	}
+	for name, limits := range extendedResourceLimits(node, s.conf.ExtendedResources) {
+		if state, ok := n.extended[name]; ok {
+			state.Total = limits.Total
+			state.Watermark = limits.Watermark
+			state.ReleaseThreshold = limits.ReleaseThreshold
+		} else {
+			n.extended[name] = limits
+		}
+	}
+	n.tenantReserved = s.conf.tenantReserved(n.cpu.Total, n.mem.Total)
+	n.scoreMultiplier = nodeScoreMultiplier(logger, node)
+	n.capacityUpdatedAt = s.clock.Now()
+	if n.unschedulable != node.Spec.Unschedulable {
+		logger.Info("Node schedulability changed", zap.Bool("unschedulable", node.Spec.Unschedulable))
+		n.unschedulable = node.Spec.Unschedulable
+	}
+
+	s.updateMaxTotalReservable()
+	n.updateMetrics(metrics, s.clock.Now())
+
+	logger.Info(
+		"Updated node resources",
+		zap.Object("old", api.Resources{VCPU: oldCPU, Mem: oldMem}),
+		zap.Object("new", api.Resources{VCPU: n.cpu.Total, Mem: n.mem.Total}),
+		zap.Float64("scoreMultiplier", n.scoreMultiplier),
+	)
+	return nil
+}
+
+// refreshStaleNodeCapacity fetches the Node directly from the API server and recalculates its
+// capacity, if our view of it is older than Config.MaxNodeStateAgeSeconds. Nodes we don't have any
+// state for yet are left alone, because their state will be built fresh anyways.
+//
+// This method must not be called while holding e.state.lock; it's acquired as needed, and released
+// while waiting on the API server.
+func (e *AutoscaleEnforcer) refreshStaleNodeCapacity(ctx context.Context, logger *zap.Logger, nodeName string) error {
+	if e.state.conf.MaxNodeStateAgeSeconds == 0 {
+		return nil
+	}
+
+	maxAge := time.Second * time.Duration(e.state.conf.MaxNodeStateAgeSeconds)
+
+	e.state.lock.Lock()
+	var age time.Duration
+	n, ok := e.state.nodes[nodeName]
+	if ok {
+		age = e.state.clock.Now().Sub(n.capacityUpdatedAt)
+	}
+	e.state.lock.Unlock()
+
+	if !ok || age <= maxAge {
+		return nil
+	}
+
+	logger.Info(
+		"Node state is stale, fetching Node from API server",
+		zap.Duration("age", age),
+		zap.Duration("maxAge", maxAge),
+	)
+
+	node, err := e.handle.ClientSet().CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("Error fetching Node: %w", err)
+	}
+
+	e.state.lock.Lock()
+	defer e.state.lock.Unlock()
+
+	// The node may have been removed while we weren't holding the lock. If so, its state will be
+	// rebuilt from the store when it's next needed.
+	n, ok = e.state.nodes[nodeName]
+	if !ok {
+		return nil
+	}
+	return e.state.updateNodeCapacity(logger, e.metrics, n, node)
+}
+
+// evictIdleNodes removes our state for any nodes that have had no pods for at least the configured
+// Config.IdleNodeStateExpirySeconds. Evicted nodes are rebuilt by getOrFetchNodeState the next time
+// they're needed.
+func (e *AutoscaleEnforcer) evictIdleNodes(logger *zap.Logger, now time.Time) {
+	if e.state.conf.IdleNodeStateExpirySeconds == 0 {
+		return
+	}
+
+	expiry := time.Second * time.Duration(e.state.conf.IdleNodeStateExpirySeconds)
+
+	e.state.lock.Lock()
+	defer e.state.lock.Unlock()
+
+	var evicted []string
+	for name, node := range e.state.nodes {
+		if len(node.pods) != 0 {
+			node.emptySince = nil
+			continue
+		} else if node.emptySince == nil {
+			node.emptySince = &now
+			continue
+		} else if now.Sub(*node.emptySince) < expiry {
+			continue
+		}
+
+		node.removeMetrics(e.metrics)
+		delete(e.state.nodes, name)
+		evicted = append(evicted, name)
+	}
+
+	if len(evicted) == 0 {
+		return
+	}
+
+	e.state.updateMaxTotalReservable()
+	logger.Info(
+		"Evicted state for idle nodes",
+		zap.Strings("nodes", evicted),
+		zap.Duration("expiry", expiry),
+		zap.Any("maxTotalReservableCPU", e.state.maxTotalReservableCPU),
+		zap.Any("maxTotalReservableMem", e.state.maxTotalReservableMem),
+	)
 }
 
 // handleStarted updates the state according to a pod that's already started, but may or may not
@@ -621,12 +1966,31 @@ func (e *AutoscaleEnforcer) reserveResources(
 		return false, nil, fmt.Errorf("%s: %w", msg, err)
 	}
 
+	// Before committing to a new placement, make sure our view of the node isn't too stale.
+	if allowDeny {
+		if err := e.refreshStaleNodeCapacity(ctx, logger, nodeName); err != nil {
+			msg := "Failed to refresh stale node state"
+			logger.Error(msg, zap.Error(err))
+			return false, nil, fmt.Errorf("%s: %w", msg, err)
+		}
+	}
+
 	e.state.lock.Lock()
 	defer e.state.lock.Unlock()
 
-	// If the pod already exists, nothing to do
-	if _, ok := e.state.pods[util.GetNamespacedName(pod)]; ok {
-		logger.Info("Pod already exists in global state")
+	// Only Reserve is allowed to deny pods. Everything else is reserving resources for pods that
+	// are already running on the node.
+	phase := podPhaseBound
+	if allowDeny {
+		phase = podPhaseReserved
+	}
+
+	// If the pod already exists, nothing to do, except to record that it's now running.
+	if ps, ok := e.state.pods[util.GetNamespacedName(pod)]; ok {
+		logger.Info("Pod already exists in global state", zap.String("phase", string(ps.phase)))
+		if phase == podPhaseBound {
+			ps.phase = podPhaseBound
+		}
 		return true, &verdictSet{cpu: "", mem: ""}, nil
 	}
 
@@ -639,13 +2003,75 @@ func (e *AutoscaleEnforcer) reserveResources(
 	}
 
 	var add api.Resources
+	var memGranularity api.Bytes
 	if vmInfo != nil {
+		memGranularity, err = memReservationGranularity(pod, vmInfo.Mem.SlotSize)
+		if err != nil {
+			logger.Warn("Ignoring invalid memory reservation granularity for VM", zap.Error(err))
+		}
 		add = vmInfo.Using()
+		add.Mem = roundUpMem(add.Mem, memGranularity)
 	} else {
 		add = extractPodResources(pod)
 	}
 
-	shouldDeny := add.VCPU > node.remainingReservableCPU() || add.Mem > node.remainingReservableMem()
+	// Non-VM pods directly reduce what's available to VMs, so check that they aren't taking up too
+	// much of the node.
+	if limit := node.nonVMLimit(e.state.conf); vmInfo == nil && limit != nil {
+		current := node.nonVMReserved()
+		newTotal := current.Add(add)
+		if newTotal.VCPU > limit.VCPU || newTotal.Mem > limit.Mem {
+			verdict := verdictSet{
+				cpu: fmt.Sprintf("non-VM reserved %v + %v -> %v of limit %v", current.VCPU, add.VCPU, newTotal.VCPU, limit.VCPU),
+				mem: fmt.Sprintf("non-VM reserved %v + %v -> %v of limit %v", current.Mem, add.Mem, newTotal.Mem, limit.Mem),
+			}
+
+			reject := allowDeny && e.state.conf.NonVMLimit.Reject
+			e.metrics.nonVMLimitExceeded.WithLabelValues(node.nodeGroup, node.availabilityZone, strconv.FormatBool(reject)).Inc()
+
+			if reject {
+				logger.Error("Can't reserve resources for non-VM Pod (above non-VM limit)", zap.Object("verdict", verdict))
+				return false, &verdict, nil
+			}
+			logger.Warn("Non-VM pods on node are above non-VM limit", zap.Object("verdict", verdict))
+		}
+	}
+
+	// VM pods that aren't Guaranteed QoS are at risk of eviction under node pressure. We can't fix
+	// that here, but we can make it visible (or refuse to schedule them).
+	if qosConf := e.state.conf.GuaranteedQoS; vmInfo != nil && qosConf != nil {
+		if verdict, ok := checkRunnerGuaranteedQoS(pod); !ok {
+			if allowDeny && qosConf.Reject {
+				logger.Error("Can't reserve resources for VM Pod (runner container is not Guaranteed QoS)", zap.Object("verdict", verdict))
+				return false, &verdict, nil
+			}
+			logger.Warn("VM Pod runner container is not Guaranteed QoS", zap.Object("verdict", verdict))
+		}
+	}
+
+	// A VM with a maximum of zero can't ever be given any resources, so it's probably a mistake.
+	// Depending on the config, either refuse to schedule it or treat the maximum as one compute unit.
+	var vmMax api.Resources
+	if vmInfo != nil {
+		vmMax = vmInfo.Max()
+		if zeroConf := e.state.conf.ZeroMaxVMs; zeroConf != nil && (vmMax.VCPU == 0 || vmMax.Mem == 0) {
+			verdict := verdictSet{
+				cpu: fmt.Sprintf("max %v", vmMax.VCPU),
+				mem: fmt.Sprintf("max %v", vmMax.Mem),
+			}
+			if allowDeny && zeroConf.Reject {
+				logger.Error("Can't reserve resources for VM Pod (maximum is zero)", zap.Object("verdict", verdict))
+				return false, &verdict, nil
+			}
+			vmMax = e.state.conf.clampZeroMax(vmMax)
+			logger.Warn("VM Pod has zero maximum, clamping to compute unit", zap.Object("verdict", verdict), zap.Object("clamped", vmMax))
+		}
+	}
+
+	addExtended := extractPodExtendedResources(pod, e.state.conf.ExtendedResources)
+	missingExtended, extendedFits := node.extendedResourcesFit(addExtended)
+
+	shouldDeny := add.VCPU > node.remainingReservableCPU() || add.Mem > node.remainingReservableMem() || !extendedFits
 	if shouldDeny && allowDeny {
 		cpuShortVerdict := "NOT ENOUGH"
 		if add.VCPU <= node.remainingReservableCPU() {
@@ -667,7 +2093,15 @@ func (e *AutoscaleEnforcer) reserveResources(
 			),
 		}
 
-		logger.Error("Can't reserve resources for Pod (not enough available)", zap.Object("verdict", verdict))
+		var extendedFields []zap.Field
+		if !extendedFits {
+			extendedFields = append(extendedFields, zap.String("notEnoughExtendedResource", string(missingExtended)))
+		}
+
+		logger.Error(
+			"Can't reserve resources for Pod (not enough available)",
+			append([]zap.Field{zap.Object("verdict", verdict)}, extendedFields...)...,
+		)
 		return false, &verdict, nil
 	}
 
@@ -681,30 +2115,43 @@ func (e *AutoscaleEnforcer) reserveResources(
 		vmState = &vmPodState{
 			name:                     vmInfo.NamespacedName(),
 			memSlotSize:              vmInfo.Mem.SlotSize,
+			memGranularity:           memGranularity,
 			testingOnlyAlwaysMigrate: vmInfo.AlwaysMigrate,
 			mostRecentComputeUnit:    nil,
 			metrics:                  nil,
+			metricsUpdatedAt:         time.Time{},
+			overprovisionedBonus:     0,
+			dualReliefBonus:          0,
+			migrationSize:            0,
 			mqIndex:                  -1,
+			mqEnqueuedAt:             time.Time{},
 			migrationState:           nil,
+			migrationCooldownUntil:   time.Time{},
+			pendingMigrationTarget:   "",
+			migrationRequested:       false,
+			migrationCounted:         false,
 		}
 		cpuState = podResourceState[vmapi.MilliCPU]{
 			Reserved:         vmInfo.Using().VCPU,
 			Buffer:           0,
+			Burst:            0,
 			CapacityPressure: 0,
 			Min:              vmInfo.Min().VCPU,
-			Max:              vmInfo.Max().VCPU,
+			Max:              vmMax.VCPU,
 		}
 		memState = podResourceState[api.Bytes]{
-			Reserved:         vmInfo.Using().Mem,
+			Reserved:         add.Mem,
 			Buffer:           0,
+			Burst:            0,
 			CapacityPressure: 0,
 			Min:              vmInfo.Min().Mem,
-			Max:              vmInfo.Max().Mem,
+			Max:              vmMax.Mem,
 		}
 	} else {
 		cpuState = podResourceState[vmapi.MilliCPU]{
 			Reserved:         add.VCPU,
 			Buffer:           0,
+			Burst:            0,
 			CapacityPressure: 0,
 			Min:              add.VCPU,
 			Max:              add.VCPU,
@@ -712,6 +2159,7 @@ func (e *AutoscaleEnforcer) reserveResources(
 		memState = podResourceState[api.Bytes]{
 			Reserved:         add.Mem,
 			Buffer:           0,
+			Burst:            0,
 			CapacityPressure: 0,
 			Min:              add.Mem,
 			Max:              add.Mem,
@@ -721,11 +2169,14 @@ func (e *AutoscaleEnforcer) reserveResources(
 	podName := util.GetNamespacedName(pod)
 
 	ps := &podState{
-		name: podName,
-		node: node,
-		cpu:  cpuState,
-		mem:  memState,
-		vm:   vmState,
+		name:     podName,
+		node:     node,
+		cpu:      cpuState,
+		mem:      memState,
+		extended: makeExtendedPodState(addExtended),
+		labels:   pod.Labels,
+		vm:       vmState,
+		phase:    phase,
 	}
 	newNodeReservedCPU := node.cpu.Reserved + ps.cpu.Reserved
 	newNodeReservedMem := node.mem.Reserved + ps.mem.Reserved
@@ -751,11 +2202,14 @@ func (e *AutoscaleEnforcer) reserveResources(
 
 	node.cpu.Reserved = newNodeReservedCPU
 	node.mem.Reserved = newNodeReservedMem
+	node.reserveExtended(ps)
 
 	node.pods[podName] = ps
 	e.state.pods[podName] = ps
 
-	node.updateMetrics(e.metrics)
+	e.state.applyOrphanMetrics(logger, podName, vmState)
+
+	node.updateMetrics(e.metrics, e.state.clock.Now())
 
 	return true, &verdict, nil
 }
@@ -770,7 +2224,7 @@ func (e *AutoscaleEnforcer) handleDeletion(logger *zap.Logger, podName util.Name
 
 	logger.Info("Handling deletion of VM pod")
 
-	logFields, kind, migrating, verdict := e.unreserveResources(logger, podName)
+	logFields, kind, migrating, verdict := e.unreserveResources(logger, podName, false)
 
 	logger.With(logFields...).Info(
 		fmt.Sprintf("Deleted %s Pod", kind),
@@ -787,10 +2241,13 @@ func (e *AutoscaleEnforcer) handleDeletion(logger *zap.Logger, podName util.Name
 //  2. unreserveResources returns additional information for logging.
 //
 // Also note that because unreserveResources is expected to be called by the plugin's Unreserve()
-// method, it may be called for pods that no longer exist.
+// method, it may be called for pods that no longer exist, or more than once for the same pod. If
+// onlyIfReserved is true, pods that aren't in podPhaseReserved are left alone, so that an extra
+// Unreserve can't remove a pod that's running on the node.
 func (e *AutoscaleEnforcer) unreserveResources(
 	logger *zap.Logger,
 	podName util.NamespacedName,
+	onlyIfReserved bool,
 ) (_ []zap.Field, kind string, migrating bool, _ verdictSet) {
 	e.state.lock.Lock()
 	defer e.state.lock.Unlock()
@@ -799,6 +2256,9 @@ func (e *AutoscaleEnforcer) unreserveResources(
 	if !ok {
 		logger.Warn("Cannot find Pod in global pods map")
 		return
+	} else if onlyIfReserved && ps.phase != podPhaseReserved {
+		logger.Warn("Pod is not in reserved phase, ignoring", zap.String("phase", string(ps.phase)))
+		return
 	}
 	logFields := []zap.Field{zap.String("node", ps.node.name)}
 	if ps.vm != nil {
@@ -807,20 +2267,31 @@ func (e *AutoscaleEnforcer) unreserveResources(
 
 	// Mark the resources as no longer reserved
 	currentlyMigrating := ps.vm != nil && ps.vm.currentlyMigrating()
+	ps.node.updateCapacityPressureAvg(e.state.conf, e.state.clock.Now())
 
 	cpuVerdict := makeResourceTransitioner(&ps.node.cpu, &ps.cpu).
 		handleDeleted(currentlyMigrating)
 	memVerdict := makeResourceTransitioner(&ps.node.mem, &ps.mem).
 		handleDeleted(currentlyMigrating)
+	for name, state := range ps.extended {
+		// Extended resources are never included in PressureAccountedFor, so there's nothing extra
+		// to undo if the pod was migrating.
+		_ = makeResourceTransitioner(ps.node.extended[name], state).handleDeleted(false)
+	}
 
 	// Delete our record of the pod
 	delete(e.state.pods, podName)
 	delete(ps.node.pods, podName)
+	ps.removeMetrics(e.metrics)
 	if ps.vm != nil {
 		ps.node.mq.removeIfPresent(ps.vm)
+		e.state.uncountMigration(ps.vm)
+		if ps.node.accommodating != nil && *ps.node.accommodating == ps.vm.name {
+			ps.node.accommodating = nil
+		}
 	}
 
-	ps.node.updateMetrics(e.metrics)
+	ps.node.updateMetrics(e.metrics, e.state.clock.Now())
 
 	return logFields, ps.kind(), currentlyMigrating, verdictSet{cpu: cpuVerdict, mem: memVerdict}
 }
@@ -853,7 +2324,7 @@ func (e *AutoscaleEnforcer) handleVMDisabledScaling(logger *zap.Logger, podName
 	memVerdict := makeResourceTransitioner(&ps.node.mem, &ps.mem).
 		handleAutoscalingDisabled()
 
-	ps.node.updateMetrics(e.metrics)
+	ps.node.updateMetrics(e.metrics, e.state.clock.Now())
 
 	logger.Info(
 		"Disabled autoscaling for VM pod",
@@ -888,19 +2359,52 @@ func (e *AutoscaleEnforcer) handlePodStartMigration(logger *zap.Logger, podName,
 	}
 	logger = logger.With(zap.Object("virtualmachine", ps.vm.name))
 
+	e.startPodMigration(logger, ps, migrationName, source)
+}
+
+// startPodMigration records that the VM pod has started migrating, as either the source or the
+// target of the migration.
+//
+// This method must only be called while holding e.state.lock.
+func (e *AutoscaleEnforcer) startPodMigration(
+	logger *zap.Logger,
+	ps *podState,
+	migrationName util.NamespacedName,
+	source bool,
+) {
 	// Reset buffer to zero, remove from migration queue (if in it), and set pod's migrationState
 	cpuVerdict := makeResourceTransitioner(&ps.node.cpu, &ps.cpu).
 		handleStartMigration(source)
 	memVerdict := makeResourceTransitioner(&ps.node.mem, &ps.mem).
 		handleStartMigration(source)
 
+	// If this is the target pod, then it's already on the migration's target node. Otherwise, use
+	// the node we chose when creating the migration, if any.
+	targetNode := ps.node.name
+	if source {
+		targetNode = ps.vm.pendingMigrationTarget
+	}
+	ps.vm.pendingMigrationTarget = ""
+	ps.vm.migrationRequested = false
+	// Migrations that we requested are already counted, but we may not have requested this one.
+	if source {
+		e.state.countMigration(ps.vm)
+	}
+
 	ps.node.mq.removeIfPresent(ps.vm)
-	ps.vm.migrationState = &podMigrationState{name: migrationName}
+	ps.vm.migrationState = &podMigrationState{
+		name:       migrationName,
+		startTime:  e.state.clock.Now(),
+		targetNode: targetNode,
+		phase:      "",
+	}
+	e.migrationAudit.add(makeMigrationRecord(ps, migrationRecordStart, ps.vm.migrationState.startTime))
 
-	ps.node.updateMetrics(e.metrics)
+	ps.node.updateMetrics(e.metrics, e.state.clock.Now())
 
 	logger.Info(
 		"Handled start of migration involving pod",
+		zap.Object("migrationState", ps.vm.migrationState),
 		zap.Object("verdict", verdictSet{
 			cpu: cpuVerdict,
 			mem: memVerdict,
@@ -932,12 +2436,252 @@ func (e *AutoscaleEnforcer) handlePodEndMigration(logger *zap.Logger, podName, m
 	}
 	logger = logger.With(zap.Object("virtualmachine", ps.vm.name))
 
+	e.state.uncountMigration(ps.vm)
+
+	// If we already stopped tracking the migration (e.g. because it timed out), then its pressure
+	// has already been released.
+	if ps.vm.migrationState == nil {
+		logger.Info("Recorded end of migration for VM pod, which was no longer being tracked")
+		return
+	}
+
+	record := makeMigrationRecord(ps, migrationRecordEnd, e.state.clock.Now())
+	e.migrationAudit.add(record.withOutcome(ps.vm.migrationState.endOutcome(), ps.vm.migrationState.startTime))
+
+	// The pod is still here, so the migration is no longer going to relieve the node of its
+	// resources. If the migration failed, the pod stays put; if it succeeded, the pod will be
+	// deleted separately, and handleDeleted no longer needs to release the pressure either.
+	//
+	// Failed migrations that we created are usually handled first by handleMigrationFinished, so
+	// this is only reached for the ones that weren't. The pod is re-added to the migration queue
+	// the next time its autoscaler-agent sends us its metrics, as usual.
+	cpuVerdict := makeResourceTransitioner(&ps.node.cpu, &ps.cpu).
+		handleMigrationAborted()
+	memVerdict := makeResourceTransitioner(&ps.node.mem, &ps.mem).
+		handleMigrationAborted()
 	ps.vm.migrationState = nil
 
-	//nolint:gocritic // NOTE: not *currently* needed, but this should be kept here as a reminder, in case that changes.
-	// ps.node.updateMetrics(e.metrics)
+	ps.node.updateMetrics(e.metrics, e.state.clock.Now())
+
+	logger.Info(
+		"Recorded end of migration for VM pod",
+		zap.Object("verdict", verdictSet{
+			cpu: cpuVerdict,
+			mem: memVerdict,
+		}),
+	)
+}
+
+// handleMigrationFinished updates the pods involved in a VirtualMachineMigration once it reaches a
+// terminal phase, as reported by the migration watch
+//
+// If the migration failed, the pods stay where they are, so we release the pressure that we expected
+// the migration to relieve and make the source pod eligible for migration again (after
+// Config.MigrationFailureCooldownSeconds). If it succeeded, the source pod will be deleted
+// separately, which releases its pressure, so there's nothing to release here.
+func (e *AutoscaleEnforcer) handleMigrationFinished(logger *zap.Logger, vmm *vmapi.VirtualMachineMigration) {
+	migrationName := util.GetNamespacedName(vmm)
+	logger = logger.With(
+		zap.String("action", "VM migration finished"),
+		zap.Object("virtualmachinemigration", migrationName),
+		zap.String("phase", string(vmm.Status.Phase)),
+	)
+
+	e.state.lock.Lock()
+	defer e.state.lock.Unlock()
+
+	// The migration no longer counts towards the limits on concurrent migrations. This includes
+	// the case where it finished before we saw it start, so the source pod is still only marked as
+	// having requested it.
+	vmName := util.NamespacedName{Namespace: vmm.Namespace, Name: vmm.Spec.VmName}
+	for _, ps := range e.state.pods {
+		if ps.vm == nil {
+			continue
+		}
+		tracked := ps.vm.currentlyMigrating() && ps.vm.migrationState.name == migrationName
+		requested := !ps.vm.currentlyMigrating() && ps.vm.name == vmName
+		if !tracked && !requested {
+			continue
+		}
+		ps.vm.migrationRequested = false
+		e.state.uncountMigration(ps.vm)
+	}
+
+	if vmm.Status.Phase != vmapi.VmmFailed {
+		logger.Info("Migration finished, nothing to release until the source pod is deleted")
+		return
+	}
+
+	now := e.state.clock.Now()
+	cooldown := time.Second * time.Duration(e.state.conf.MigrationFailureCooldownSeconds)
+
+	for _, ps := range e.state.pods {
+		if ps.vm == nil || !ps.vm.currentlyMigrating() || ps.vm.migrationState.name != migrationName {
+			continue
+		}
+
+		logger := logger.With(
+			zap.Object("pod", ps.name),
+			zap.String("node", ps.node.name),
+			zap.Object("virtualmachine", ps.vm.name),
+			zap.Object("migrationState", ps.vm.migrationState),
+		)
+
+		// Migrations never target the node the VM is already on, so this is the source pod exactly
+		// when it isn't on the target node.
+		source := ps.vm.migrationState.targetNode != ps.node.name
+
+		ps.vm.migrationState.phase = vmm.Status.Phase
+		record := makeMigrationRecord(ps, migrationRecordEnd, now)
+		e.migrationAudit.add(record.withOutcome(ps.vm.migrationState.endOutcome(), ps.vm.migrationState.startTime))
+
+		cpuVerdict := makeResourceTransitioner(&ps.node.cpu, &ps.cpu).
+			handleMigrationAborted()
+		memVerdict := makeResourceTransitioner(&ps.node.mem, &ps.mem).
+			handleMigrationAborted()
+		ps.vm.migrationState = nil
+		ps.vm.migrationCooldownUntil = now.Add(cooldown)
+
+		// Put the source pod back in the migration queue, so that it can be selected again without
+		// waiting for its next request. If it's in cooldown, a later request will add it instead.
+		if source && ps.vm.migrationIneligibility(e.state.conf, now) == "" {
+			ps.node.mq.addOrUpdate(ps.vm, now)
+		}
+
+		ps.node.updateMetrics(e.metrics, now)
+
+		logger.Warn(
+			"Migration failed, released its pressure",
+			zap.Duration("cooldown", cooldown),
+			zap.Bool("requeued", ps.vm.mqIndex != -1),
+			zap.Object("verdict", verdictSet{
+				cpu: cpuVerdict,
+				mem: memVerdict,
+			}),
+		)
+	}
+}
+
+// checkMigrationTimeouts aborts our tracking of any migrations that have been ongoing for longer than
+// the configured timeout, so that they no longer hold the node's PressureAccountedFor.
+//
+// The pod is then given a cooldown before it can be selected for migration again. The migration
+// still counts towards Config.MaxTotalConcurrentMigrations until we see it end.
+func (e *AutoscaleEnforcer) checkMigrationTimeouts(logger *zap.Logger, now time.Time) {
+	if e.state.conf.MigrationTimeoutSeconds == 0 {
+		return
+	}
+
+	timeout := time.Second * time.Duration(e.state.conf.MigrationTimeoutSeconds)
+	cooldown := time.Second * time.Duration(e.state.conf.MigrationFailureCooldownSeconds)
+
+	e.state.lock.Lock()
+	defer e.state.lock.Unlock()
+
+	for _, ps := range e.state.pods {
+		if ps.vm == nil || !ps.vm.currentlyMigrating() {
+			continue
+		}
+
+		duration := now.Sub(ps.vm.migrationState.startTime)
+		if duration < timeout {
+			continue
+		}
+
+		logger := logger.With(
+			zap.String("action", "VM pod migration timeout"),
+			zap.Object("pod", ps.name),
+			zap.String("node", ps.node.name),
+			zap.Object("virtualmachine", ps.vm.name),
+			zap.Object("migrationState", ps.vm.migrationState),
+		)
+
+		cpuVerdict := makeResourceTransitioner(&ps.node.cpu, &ps.cpu).
+			handleMigrationAborted()
+		memVerdict := makeResourceTransitioner(&ps.node.mem, &ps.mem).
+			handleMigrationAborted()
+
+		record := makeMigrationRecord(ps, migrationRecordEnd, now)
+		e.migrationAudit.add(record.withOutcome(migrationOutcomeTimedOut, ps.vm.migrationState.startTime))
+
+		// The VirtualMachineMigration may still be running, so it keeps counting towards
+		// Config.MaxTotalConcurrentMigrations until we see it end.
+		ps.vm.migrationState = nil
+		ps.vm.migrationCooldownUntil = now.Add(cooldown)
+
+		ps.node.updateMetrics(e.metrics, now)
+
+		logger.Error(
+			"Migration exceeded timeout, considering it failed",
+			zap.Duration("duration", duration),
+			zap.Duration("timeout", timeout),
+			zap.Duration("cooldown", cooldown),
+			zap.Object("verdict", verdictSet{
+				cpu: cpuVerdict,
+				mem: memVerdict,
+			}),
+		)
+	}
+}
+
+// checkPressureAccounting recomputes each node's PressureAccountedFor from the pods that are
+// currently migrating, reporting (and, if configured, correcting) any drift from the tracked value.
+func (e *AutoscaleEnforcer) checkPressureAccounting(logger *zap.Logger) {
+	correct := e.state.conf.PressureAccountingCheck != nil && e.state.conf.PressureAccountingCheck.Correct
+
+	e.state.lock.Lock()
+	defer e.state.lock.Unlock()
 
-	logger.Info("Recorded end of migration for VM pod")
+	for _, node := range e.state.nodes {
+		var cpu vmapi.MilliCPU
+		var mem api.Bytes
+		for _, pod := range node.pods {
+			if pod.vm != nil && pod.vm.currentlyMigrating() {
+				cpu += pod.cpu.Reserved + pod.cpu.CapacityPressure
+				mem += pod.mem.Reserved + pod.mem.CapacityPressure
+			}
+		}
+
+		logger := logger.With(zap.String("node", node.name))
+		cpuDrift := checkPressureAccountedFor(logger, e.metrics, node.name, "cpu", &node.cpu, cpu, correct)
+		memDrift := checkPressureAccountedFor(logger, e.metrics, node.name, "mem", &node.mem, mem, correct)
+
+		if (cpuDrift || memDrift) && correct {
+			node.updateMetrics(e.metrics, e.state.clock.Now())
+		}
+	}
+}
+
+// checkPressureAccountedFor compares the node's PressureAccountedFor to the expected value,
+// returning whether they differ
+//
+// If they differ, the drift is logged and counted and, if correct is true, fixed.
+func checkPressureAccountedFor[T constraints.Unsigned](
+	logger *zap.Logger,
+	metrics PromMetrics,
+	nodeName string,
+	resourceName string,
+	node *nodeResourceState[T],
+	expected T,
+	correct bool,
+) (drifted bool) {
+	if node.PressureAccountedFor == expected {
+		return false
+	}
+
+	logger.Error(
+		"Node's pressureAccountedFor doesn't match currently migrating pods",
+		zap.String("resource", resourceName),
+		zap.Any("pressureAccountedFor", node.PressureAccountedFor),
+		zap.Any("expected", expected),
+		zap.Bool("corrected", correct),
+	)
+	metrics.pressureAccountingDrift.WithLabelValues(nodeName, resourceName, strconv.FormatBool(correct)).Inc()
+
+	if correct {
+		node.PressureAccountedFor = expected
+	}
+	return true
 }
 
 func (e *AutoscaleEnforcer) handleUpdatedScalingBounds(logger *zap.Logger, vm *api.VmInfo, unqualifiedPodName string) {
@@ -968,10 +2712,13 @@ func (e *AutoscaleEnforcer) handleUpdatedScalingBounds(logger *zap.Logger, vm *a
 	// FIXME: this definition of receivedContact may be inaccurate if there was an error with the
 	// autoscaler-agent's request.
 	receivedContact := ps.vm.mostRecentComputeUnit != nil
-	cpuVerdict := handleUpdatedLimits(&ps.node.cpu, &ps.cpu, receivedContact, vm.Cpu.Min, vm.Cpu.Max)
-	memVerdict := handleUpdatedLimits(&ps.node.mem, &ps.mem, receivedContact, vm.Min().Mem, vm.Max().Mem)
+	// If the VM was allowed in with a zero maximum, keep it clamped the same way.
+	vmMax := e.state.conf.clampZeroMax(vm.Max())
+	maxBuffer := e.state.bufferAllowance(ps, vmMax)
+	cpuVerdict := handleUpdatedLimits(&ps.node.cpu, &ps.cpu, receivedContact, vm.Cpu.Min, vmMax.VCPU, maxBuffer.VCPU)
+	memVerdict := handleUpdatedLimits(&ps.node.mem, &ps.mem, receivedContact, vm.Min().Mem, vmMax.Mem, maxBuffer.Mem)
 
-	ps.node.updateMetrics(e.metrics)
+	ps.node.updateMetrics(e.metrics, e.state.clock.Now())
 
 	logger.Info(
 		"Updated scaling bounds for VM pod",
@@ -1005,7 +2752,7 @@ func (e *AutoscaleEnforcer) handleNonAutoscalingUsageChange(logger *zap.Logger,
 	memVerdict := makeResourceTransitioner(&ps.node.mem, &ps.mem).
 		handleNonAutoscalingUsageChange(vm.Using().Mem)
 
-	ps.node.updateMetrics(e.metrics)
+	ps.node.updateMetrics(e.metrics, e.state.clock.Now())
 
 	logger.Info(
 		"Updated non-autoscaling VM usage",
@@ -1016,6 +2763,47 @@ func (e *AutoscaleEnforcer) handleNonAutoscalingUsageChange(logger *zap.Logger,
 	)
 }
 
+// reconcileUnderReportedUsage raises the pod's reserved memory to match its measured usage, if its
+// most recent metrics show that it's using more than we've reserved for it. See
+// underReportedUsageConfig.
+//
+// This can happen if the VM was granted more by a previous scheduler than its autoscaler-agent has
+// told us about. We can't prevent that overcommit, but we can at least account for it.
+//
+// This method expects e.state.lock to be held.
+func (e *AutoscaleEnforcer) reconcileUnderReportedUsage(logger *zap.Logger, pod *podState) {
+	conf := e.state.conf.UnderReportedUsage
+	if conf == nil || pod.vm == nil || pod.vm.metrics == nil || pod.vm.currentlyMigrating() {
+		return
+	}
+
+	measured := api.Bytes(pod.vm.metrics.MemoryUsageBytes)
+	grace := api.Bytes(conf.GraceFraction * float64(pod.mem.Reserved))
+	if measured <= pod.mem.Reserved+grace {
+		return
+	}
+
+	// Reserve in the same units as any other change, but never more than the VM could possibly be
+	// using.
+	newReserved := util.Min(pod.vm.reservedMem(measured), pod.mem.Max)
+	if newReserved <= pod.mem.Reserved {
+		return
+	}
+
+	verdict := makeResourceTransitioner(&pod.node.mem, &pod.mem).
+		handleNonAutoscalingUsageChange(newReserved)
+
+	e.metrics.underReportedUsage.WithLabelValues(pod.node.name).Inc()
+	pod.node.updateMetrics(e.metrics, e.state.clock.Now())
+
+	logger.Warn(
+		"Raised reserved memory for VM pod to match under-reported usage",
+		zap.Object("pod", pod.name),
+		zap.Any("measured", measured),
+		zap.String("verdict", verdict),
+	)
+}
+
 // NB: expected to be run in its own thread.
 func (e *AutoscaleEnforcer) cleanupMigration(logger *zap.Logger, vmm *vmapi.VirtualMachineMigration) {
 	vmmName := util.GetNamespacedName(vmm)
@@ -1112,13 +2900,166 @@ func (e *AutoscaleEnforcer) cleanupMigration(logger *zap.Logger, vmm *vmapi.Virt
 }
 
 func (s *vmPodState) isBetterMigrationTarget(other *vmPodState) bool {
-	// TODO: this deprioritizes VMs whose metrics we can't collect. Maybe we don't want that?
-	if s.metrics == nil || other.metrics == nil {
+	// VMs whose metrics we don't have are only migrated as a last resort, after all the VMs that
+	// we do have metrics for. Between themselves, they're ordered by name so that the choice is
+	// at least deterministic.
+	//
+	// If Config.ExemptPodsWithoutMetrics is set, these VMs aren't in the queue at all.
+	if s.metrics == nil && other.metrics == nil {
+		if s.name.Namespace != other.name.Namespace {
+			return s.name.Namespace < other.name.Namespace
+		}
+		return s.name.Name < other.name.Name
+	} else if s.metrics == nil || other.metrics == nil {
 		return s.metrics != nil && other.metrics == nil
 	}
 
-	// TODO - this is just a first-pass approximation. Maybe it's ok for now? Maybe it's not. Idk.
-	return s.metrics.LoadAverage1Min < other.metrics.LoadAverage1Min
+	// Larger VMs relieve more pressure, so prefer them, unless disabled by
+	// Config.PreferLargerMigrations (in which case migrationSize is always zero).
+	if s.migrationSize != other.migrationSize {
+		return s.migrationSize > other.migrationSize
+	}
+
+	// Then, prefer the VM with the lowest load, because it'll be the least disrupted by migration.
+	sLoad := float64(s.metrics.LoadAverage1Min) - s.overprovisionedBonus - s.dualReliefBonus
+	otherLoad := float64(other.metrics.LoadAverage1Min) - other.overprovisionedBonus - other.dualReliefBonus
+	if sLoad != otherLoad {
+		return sLoad < otherLoad
+	}
+
+	// Then, prefer the VM using less memory, because there's less to copy, so it'll be quicker to
+	// migrate.
+	if s.metrics.MemoryUsageBytes != other.metrics.MemoryUsageBytes {
+		return s.metrics.MemoryUsageBytes < other.metrics.MemoryUsageBytes
+	}
+
+	// Finally, break ties by name, so that the order of the queue is stable.
+	if s.name.Namespace != other.name.Namespace {
+		return s.name.Namespace < other.name.Namespace
+	}
+	return s.name.Name < other.name.Name
+}
+
+// chooseMigrationTarget returns the node that the pod should be migrated to, according to the
+// configured MigrationTargetStrategy, or nil if there's no strategy or no other node has room for
+// the pod.
+//
+// This method must only be called while holding s.lock.
+func (s *pluginState) chooseMigrationTarget(pod *podState) *nodeState {
+	strategy := s.conf.MigrationTargetStrategy
+	if strategy == "" {
+		return nil
+	}
+
+	isPreferred := func(n *nodeState) bool {
+		switch strategy {
+		case migrationTargetSameZone:
+			return n.availabilityZone == pod.node.availabilityZone
+		case migrationTargetDifferentZone:
+			return n.availabilityZone != pod.node.availabilityZone
+		default:
+			return true
+		}
+	}
+
+	// best is the emptiest node overall, used as a fallback if none of the nodes are preferred.
+	var best, bestPreferred *nodeState
+	for _, n := range s.nodes {
+		if !s.canMigrateTo(pod, n) {
+			continue
+		}
+
+		if n.isEmptierThan(best) {
+			best = n
+		}
+		if isPreferred(n) && n.isEmptierThan(bestPreferred) {
+			bestPreferred = n
+		}
+	}
+
+	if bestPreferred != nil {
+		return bestPreferred
+	}
+	return best
+}
+
+// canMigrateTo returns whether the pod could be migrated to the node, according to our current
+// state for the node. It's a dry run of the checks we'd make when the migration target pod is
+// scheduled.
+//
+// This method must only be called while holding s.lock.
+func (s *pluginState) canMigrateTo(pod *podState, n *nodeState) bool {
+	if n == pod.node || n.unschedulable {
+		return false
+	}
+	if pod.cpu.Reserved > n.remainingReservableCPU() || pod.mem.Reserved > n.remainingReservableMem() {
+		return false
+	}
+	if pod.vm != nil && n.vmCountLimitReached(s.conf) {
+		return false
+	}
+	return true
+}
+
+// hasMigrationTarget returns whether there's any node the pod could be migrated to
+//
+// This method must only be called while holding s.lock.
+func (s *pluginState) hasMigrationTarget(pod *podState) bool {
+	for _, n := range s.nodes {
+		if s.canMigrateTo(pod, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasUsefulMigrationTarget returns whether there's any node the pod could be migrated to that would
+// have at least Config.MigrationHeadroomMargin more headroom than the pod's current node (see
+// remainingFraction), after adding the pod to it
+//
+// This method must only be called while holding s.lock.
+func (s *pluginState) hasUsefulMigrationTarget(pod *podState) bool {
+	sourceHeadroom := pod.node.remainingFraction()
+	add := api.Resources{VCPU: pod.cpu.Reserved, Mem: pod.mem.Reserved}
+	for _, n := range s.nodes {
+		if s.canMigrateTo(pod, n) && n.remainingFractionAfter(add)-sourceHeadroom >= s.conf.MigrationHeadroomMargin {
+			return true
+		}
+	}
+	return false
+}
+
+// remainingFraction returns the fraction of the node's CPU or memory that's still available to be
+// reserved, whichever is smaller
+func (s *nodeState) remainingFraction() float64 {
+	return s.remainingFractionAfter(api.Resources{VCPU: 0, Mem: 0})
+}
+
+// remainingFractionAfter returns what remainingFraction would be after reserving add on the node
+func (s *nodeState) remainingFractionAfter(add api.Resources) float64 {
+	cpu := util.SaturatingSub(s.remainingReservableCPU(), add.VCPU).AsFloat64() / s.cpu.Total.AsFloat64()
+	mem := util.SaturatingSub(s.remainingReservableMem(), add.Mem).AsFloat64() / s.mem.Total.AsFloat64()
+	return util.Min(cpu, mem)
+}
+
+// isEmptierThan returns whether s has a larger fraction of its resources remaining than other, or
+// true if other is nil. Ties are broken by node name, so that the choice is deterministic.
+func (s *nodeState) isEmptierThan(other *nodeState) bool {
+	if other == nil {
+		return true
+	}
+
+	sFrac, otherFrac := s.remainingFraction(), other.remainingFraction()
+	return sFrac > otherFrac || (sFrac == otherFrac && s.name < other.name)
+}
+
+// pluginMigrationNamePrefix is the prefix of the names of VirtualMachineMigrations created by
+// startMigration
+const pluginMigrationNamePrefix = "schedplugin-"
+
+// isPluginMigrationName returns whether the VirtualMachineMigration was created by startMigration
+func isPluginMigrationName(name util.NamespacedName) bool {
+	return strings.HasPrefix(name.Name, pluginMigrationNamePrefix)
 }
 
 // this method can only be called while holding a lock. It will be released temporarily while we
@@ -1126,16 +3067,87 @@ func (s *vmPodState) isBetterMigrationTarget(other *vmPodState) bool {
 //
 // A lock will ALWAYS be held on return from this function.
 func (e *AutoscaleEnforcer) startMigration(ctx context.Context, logger *zap.Logger, pod *podState) (created bool, _ error) {
-	if pod.vm.currentlyMigrating() {
+	if pod.vm.currentlyMigrating() || pod.vm.migrationRequested {
 		return false, fmt.Errorf("Pod is already migrating")
 	}
 
+	// Pods shouldn't be selected for migration while their node or the cluster is at the limit (see
+	// updateMetricsAndCheckMustMigrate), so this is just a safeguard.
+	if pod.node.migrationLimitReached(e.state.conf) {
+		return false, fmt.Errorf(
+			"Node %q already has %d ongoing migrations, at limit of %d",
+			pod.node.name, pod.node.migratingCount(), e.state.conf.MaxConcurrentMigrationsPerNode,
+		)
+	} else if e.state.migrationLimitReached() {
+		return false, fmt.Errorf(
+			"Cluster already has %d ongoing migrations, at limit of %d",
+			e.state.ongoingMigrations, e.state.conf.MaxTotalConcurrentMigrations,
+		)
+	}
+
+	if e.isPaused() {
+		logger.Warn("Skipping migration for VM, plugin is paused")
+		return false, nil
+	}
+
+	// Migrating a pod that can only fit on its current node is futile, so optionally don't bother.
+	if e.state.conf.RequireMigrationTarget && !e.state.hasMigrationTarget(pod) {
+		logger.Warn("Skipping migration for VM, no other node has room for it")
+		return false, nil
+	}
+
+	// Likewise, migrating a pod to a node that'd end up about as full as its current node would just
+	// move the pressure around.
+	if e.state.conf.MigrationHeadroomMargin != 0 && !e.state.hasUsefulMigrationTarget(pod) {
+		logger.Warn(
+			"Skipping migration for VM, no other node would have enough more headroom than the current one",
+			zap.Float64("sourceHeadroom", pod.node.remainingFraction()),
+			zap.Float64("margin", e.state.conf.MigrationHeadroomMargin),
+		)
+		e.metrics.migrationsSuppressed.WithLabelValues(pod.node.name).Inc()
+		return false, nil
+	}
+
+	// Choose the destination node (if configured) while we still hold the lock.
+	var nodeSelector map[string]string
+	pod.vm.pendingMigrationTarget = ""
+	if target := e.state.chooseMigrationTarget(pod); target != nil {
+		logger.Info(
+			"Chose target node for migration",
+			zap.String("targetNode", target.name),
+			zap.String("strategy", string(e.state.conf.MigrationTargetStrategy)),
+		)
+		pod.vm.pendingMigrationTarget = target.name
+		nodeSelector = map[string]string{corev1.LabelHostname: target.name}
+	}
+
+	// If the migration already exists and is still going, we'll start tracking it once we've
+	// re-acquired the lock.
+	var adopt *vmapi.VirtualMachineMigration
+
+	// Count the migration towards the node's and cluster's limits while we don't hold the lock, so
+	// that requests from other pods can't start more migrations than allowed in the meantime. If we
+	// don't end up creating (or adopting) the migration, it's uncounted once we re-acquire the lock.
+	pod.vm.migrationRequested = true
+	e.state.countMigration(pod.vm)
+
 	// Unlock to make the API request(s), then make sure we're locked on return.
 	e.state.lock.Unlock()
-	defer e.state.lock.Lock()
+	defer func() {
+		e.state.lock.Lock()
+		if !created {
+			pod.vm.migrationRequested = false
+			if adopt == nil {
+				e.state.uncountMigration(pod.vm)
+			}
+		}
+		if adopt != nil {
+			e.adoptMigration(logger, pod, adopt)
+		}
+	}()
 
 	vmmName := util.NamespacedName{
-		Name:      fmt.Sprintf("schedplugin-%s", pod.vm.name.Name),
+		Name:      pluginMigrationNamePrefix + pod.vm.name.Name,
 		Namespace: pod.name.Namespace,
 	}
 
@@ -1143,18 +3155,38 @@ func (e *AutoscaleEnforcer) startMigration(ctx context.Context, logger *zap.Logg
 
 	logger.Info("Starting VirtualMachineMigration for VM")
 
-	// Check that the migration doesn't already exist. If it does, then there's no need to recreate
-	// it.
+	// Check that the migration doesn't already exist. If it does (e.g. left over from an earlier
+	// attempt that we lost track of), then there's no need to recreate it: we adopt it instead,
+	// unless it's already failed.
 	//
 	// We technically don't *need* this additional request here (because we can check the return
 	// from the Create request with apierrors.IsAlreadyExists). However: the benefit we get from
 	// this is that the logs are significantly clearer.
-	_, err := e.vmClient.NeonvmV1().
+	existing, err := e.vmClient.NeonvmV1().
 		VirtualMachineMigrations(pod.name.Namespace).
 		Get(ctx, vmmName.Name, metav1.GetOptions{})
 	if err == nil {
-		logger.Warn("VirtualMachineMigration already exists, nothing to do")
-		return false, nil
+		switch existing.Status.Phase {
+		case vmapi.VmmFailed:
+			logger.Warn("VirtualMachineMigration already exists but has failed, deleting it to try again")
+			err := e.vmClient.NeonvmV1().
+				VirtualMachineMigrations(pod.name.Namespace).
+				Delete(ctx, vmmName.Name, metav1.DeleteOptions{})
+			if err != nil && !apierrors.IsNotFound(err) {
+				logger.Error("Failed to delete failed VirtualMachineMigration", zap.Error(err))
+				return false, fmt.Errorf("Error deleting failed migration: %w", err)
+			}
+		case vmapi.VmmSucceeded:
+			logger.Warn("VirtualMachineMigration already exists and has succeeded, nothing to do")
+			return false, nil
+		default:
+			logger.Warn(
+				"VirtualMachineMigration already exists, adopting it",
+				zap.String("phase", string(existing.Status.Phase)),
+			)
+			adopt = existing
+			return false, nil
+		}
 	} else if !apierrors.IsNotFound(err) {
 		// We're *expecting* to get IsNotFound = true; if err != nil and isn't NotFound, then
 		// there's some unexpected error.
@@ -1184,7 +3216,8 @@ func (e *AutoscaleEnforcer) startMigration(ctx context.Context, logger *zap.Logg
 			},
 		},
 		Spec: vmapi.VirtualMachineMigrationSpec{
-			VmName: pod.vm.name.Name,
+			VmName:       pod.vm.name.Name,
+			NodeSelector: nodeSelector,
 
 			// FIXME: NeonVM's VirtualMachineMigrationSpec has a bunch of boolean fields that aren't
 			// pointers, which means we need to explicitly set them when using the Go API.
@@ -1199,18 +3232,93 @@ func (e *AutoscaleEnforcer) startMigration(ctx context.Context, logger *zap.Logg
 
 	logger.Info("Migration doesn't already exist, creating one for VM", zap.Any("spec", vmm.Spec))
 	_, err = e.vmClient.NeonvmV1().VirtualMachineMigrations(pod.name.Namespace).Create(ctx, vmm, metav1.CreateOptions{})
-	if err != nil {
+	if apierrors.IsAlreadyExists(err) {
+		// The failed migration we deleted above may not be fully gone yet. We'll try again on a
+		// later request.
+		logger.Warn("VirtualMachineMigration still exists, will try again later", zap.Error(err))
+		return false, nil
+	} else if err != nil {
 		e.metrics.migrationCreateFails.Inc()
+		e.metrics.migrationsFailed.WithLabelValues(pod.node.name, migrationFailReasonCreate).Inc()
 		// log here, while the logger's fields are in scope
 		logger.Error("Unexpected error doing Create request for new migration", zap.Error(err))
 		return false, fmt.Errorf("Error creating migration: %w", err)
 	}
 	e.metrics.migrationCreations.Inc()
-	logger.Info("VM migration request successful")
+	e.metrics.migrationsStarted.WithLabelValues(pod.node.name).Inc()
+	e.auditLog(
+		logger,
+		zap.Object("pod", pod.name),
+		zap.String("node", pod.node.name),
+		zap.Object("virtualmachine", pod.vm.name),
+		zap.Object("virtualmachinemigration", vmmName),
+	).Info("VM migration request successful", zap.Any("spec", vmm.Spec))
 
 	return true, nil
 }
 
+// adoptMigration starts tracking an existing VirtualMachineMigration for the pod, as the source of
+// the migration, if we aren't already.
+//
+// This method must only be called while holding e.state.lock.
+func (e *AutoscaleEnforcer) adoptMigration(
+	logger *zap.Logger,
+	pod *podState,
+	vmm *vmapi.VirtualMachineMigration,
+) {
+	// The pod may have been removed, or its migration may have been picked up by the pod watch,
+	// while we weren't holding the lock.
+	if ps, ok := e.state.pods[pod.name]; !ok || ps != pod {
+		logger.Warn("Pod was removed before its existing VirtualMachineMigration could be adopted")
+		return
+	} else if pod.vm.currentlyMigrating() {
+		logger.Info("Already tracking existing VirtualMachineMigration")
+		return
+	}
+
+	// Use the existing migration's target node, if it has one, rather than what we just chose.
+	pod.vm.pendingMigrationTarget = vmm.Spec.NodeSelector[corev1.LabelHostname]
+	e.startPodMigration(logger, pod, util.GetNamespacedName(vmm), true)
+	pod.vm.migrationState.phase = vmm.Status.Phase
+}
+
+// handleMigrationPhaseChanged records the new phase of a VirtualMachineMigration in the
+// migrationState of each of the pods involved in it that we're tracking, and counts the migration's
+// outcome once it reaches a terminal phase.
+func (e *AutoscaleEnforcer) handleMigrationPhaseChanged(logger *zap.Logger, vmm *vmapi.VirtualMachineMigration) {
+	migrationName := util.GetNamespacedName(vmm)
+	logger = logger.With(
+		zap.String("action", "VM migration phase changed"),
+		zap.Object("virtualmachinemigration", migrationName),
+		zap.String("phase", string(vmm.Status.Phase)),
+	)
+
+	// note: SourceNode may be empty if the migration failed before NeonVM recorded it.
+	switch vmm.Status.Phase {
+	case vmapi.VmmSucceeded:
+		e.metrics.migrationsSucceeded.WithLabelValues(vmm.Status.SourceNode).Inc()
+	case vmapi.VmmFailed:
+		e.metrics.migrationsFailed.WithLabelValues(vmm.Status.SourceNode, migrationFailReasonPhase).Inc()
+	}
+
+	e.state.lock.Lock()
+	defer e.state.lock.Unlock()
+
+	for _, ps := range e.state.pods {
+		if ps.vm == nil || !ps.vm.currentlyMigrating() || ps.vm.migrationState.name != migrationName {
+			continue
+		}
+
+		ps.vm.migrationState.phase = vmm.Status.Phase
+		logger.Info(
+			"Updated phase of migration involving pod",
+			zap.Object("pod", ps.name),
+			zap.String("node", ps.node.name),
+			zap.Object("migrationState", ps.vm.migrationState),
+		)
+	}
+}
+
 // readClusterState sets the initial node and pod maps for the plugin's state, getting its
 // information from the K8s cluster
 //
@@ -1224,7 +3332,8 @@ func (p *AutoscaleEnforcer) readClusterState(ctx context.Context, logger *zap.Lo
 
 	// Check that all fields are equal to their zero value, per the function documentation.
 	hasNonNilField := p.state.nodes != nil || p.state.pods != nil ||
-		p.state.maxTotalReservableCPU != 0 || p.state.maxTotalReservableMem != 0
+		p.state.maxTotalReservableCPU != 0 || p.state.maxTotalReservableMem != 0 ||
+		p.state.ongoingMigrations != 0
 
 	if hasNonNilField {
 		panic(errors.New("readClusterState called with non-nil pluginState field"))
@@ -1275,9 +3384,9 @@ func (p *AutoscaleEnforcer) readClusterState(ctx context.Context, logger *zap.Lo
 		pod := &pods.Items[i]
 		podName := util.GetNamespacedName(pod)
 
-		vmName := util.TryPodOwnerVirtualMachine(pod)
+		vmName := p.tryPodOwnerVirtualMachine(pod)
 		if vmName == nil {
-			continue
+			continue // non-VM pods, or VM pods belonging to other schedulers, are handled below
 		}
 
 		// new logger just for this loop iteration, with info about the Pod
@@ -1325,35 +3434,60 @@ func (p *AutoscaleEnforcer) readClusterState(ctx context.Context, logger *zap.Lo
 			continue
 		}
 
+		memGranularity, err := memReservationGranularity(vm, vmInfo.Mem.SlotSize)
+		if err != nil {
+			logger.Warn("Ignoring invalid memory reservation granularity for VM", zap.Error(err))
+		}
+
+		// VMs with a zero maximum were clamped (or rejected) when they were first scheduled, so
+		// clamp them the same way here.
+		vmMax := p.state.conf.clampZeroMax(vmInfo.Max())
+
 		// Build the pod state, update the node
 		ps := &podState{
 			name: podName,
 			node: ns,
 			cpu: podResourceState[vmapi.MilliCPU]{
-				Reserved:         vmInfo.Cpu.Max,
-				Buffer:           vmInfo.Cpu.Max - vmInfo.Cpu.Use,
+				Reserved:         vmMax.VCPU,
+				Buffer:           util.SaturatingSub(vmMax.VCPU, vmInfo.Cpu.Use),
+				Burst:            0,
 				CapacityPressure: 0,
 				Min:              vmInfo.Cpu.Min,
-				Max:              vmInfo.Cpu.Max,
+				Max:              vmMax.VCPU,
 			},
 			mem: podResourceState[api.Bytes]{
-				Reserved:         vmInfo.Max().Mem,
-				Buffer:           vmInfo.Max().Mem - vmInfo.Using().Mem,
+				Reserved:         roundUpMem(vmMax.Mem, memGranularity),
+				Buffer:           util.SaturatingSub(roundUpMem(vmMax.Mem, memGranularity), roundUpMem(vmInfo.Using().Mem, memGranularity)),
+				Burst:            0,
 				CapacityPressure: 0,
 				Min:              vmInfo.Min().Mem,
-				Max:              vmInfo.Max().Mem,
+				Max:              vmMax.Mem,
 			},
+			extended: makeExtendedPodState(extractPodExtendedResources(pod, p.state.conf.ExtendedResources)),
+			labels:   pod.Labels,
 			vm: &vmPodState{
 				name: util.GetNamespacedName(vm),
 
+				overprovisionedBonus:  0,
+				dualReliefBonus:       0,
+				migrationSize:         0,
 				mqIndex:               -1,
+				mqEnqueuedAt:          time.Time{},
 				metrics:               nil,
+				metricsUpdatedAt:      time.Time{},
 				mostRecentComputeUnit: nil,
 				migrationState:        nil,
 
+				migrationCooldownUntil: time.Time{},
+				pendingMigrationTarget: "",
+				migrationRequested:     false,
+				migrationCounted:       false,
+
 				memSlotSize:              vmInfo.Mem.SlotSize,
+				memGranularity:           memGranularity,
 				testingOnlyAlwaysMigrate: vmInfo.AlwaysMigrate,
 			},
+			phase: podPhaseBound,
 		}
 
 		// If scaling isn't enabled *or* the pod is involved in an ongoing migration, then we can be
@@ -1363,7 +3497,7 @@ func (p *AutoscaleEnforcer) readClusterState(ctx context.Context, logger *zap.Lo
 			ps.cpu.Reserved = vmInfo.Cpu.Use
 
 			ps.mem.Buffer = 0
-			ps.mem.Reserved = vmInfo.Using().Mem
+			ps.mem.Reserved = roundUpMem(vmInfo.Using().Mem, memGranularity)
 		}
 
 		oldNodeCPUReserved := ns.cpu.Reserved
@@ -1375,14 +3509,15 @@ func (p *AutoscaleEnforcer) readClusterState(ctx context.Context, logger *zap.Lo
 		ns.cpu.Buffer += ps.cpu.Buffer
 		ns.mem.Reserved += ps.mem.Reserved
 		ns.mem.Buffer += ps.mem.Buffer
+		ns.reserveExtended(ps)
 
 		cpuVerdict := fmt.Sprintf(
 			"pod = %v/%v (node %v -> %v / %v, %v -> %v buffer)",
-			ps.cpu.Reserved, vmInfo.Cpu.Max, oldNodeCPUReserved, ns.cpu.Reserved, ns.cpu.Total, oldNodeCPUBuffer, ns.cpu.Buffer,
+			ps.cpu.Reserved, vmMax.VCPU, oldNodeCPUReserved, ns.cpu.Reserved, ns.cpu.Total, oldNodeCPUBuffer, ns.cpu.Buffer,
 		)
 		memVerdict := fmt.Sprintf(
 			"pod = %v/%v (node %v -> %v / %v, %v -> %v buffer",
-			ps.mem.Reserved, vmInfo.Max().Mem, oldNodeMemReserved, ns.mem.Reserved, ns.mem.Total, oldNodeMemBuffer, ns.mem.Buffer,
+			ps.mem.Reserved, vmMax.Mem, oldNodeMemReserved, ns.mem.Reserved, ns.mem.Total, oldNodeMemBuffer, ns.mem.Buffer,
 		)
 
 		logger.Info(
@@ -1393,7 +3528,7 @@ func (p *AutoscaleEnforcer) readClusterState(ctx context.Context, logger *zap.Lo
 			}),
 		)
 
-		ns.updateMetrics(p.metrics)
+		ns.updateMetrics(p.metrics, p.state.clock.Now())
 
 		ns.pods[podName] = ps
 		p.state.pods[podName] = ps
@@ -1405,7 +3540,7 @@ func (p *AutoscaleEnforcer) readClusterState(ctx context.Context, logger *zap.Lo
 		pod := &pods.Items[i]
 		podName := util.GetNamespacedName(pod)
 
-		if util.TryPodOwnerVirtualMachine(pod) != nil {
+		if p.tryPodOwnerVirtualMachine(pod) != nil {
 			continue // skip VMs
 		}
 
@@ -1452,12 +3587,14 @@ func (p *AutoscaleEnforcer) readClusterState(ctx context.Context, logger *zap.Lo
 		ns.mem.Reserved += podRes.Mem
 
 		ps := &podState{
-			name: podName,
-			node: ns,
-			vm:   nil,
+			name:  podName,
+			node:  ns,
+			vm:    nil,
+			phase: podPhaseBound,
 			cpu: podResourceState[vmapi.MilliCPU]{
 				Reserved:         podRes.VCPU,
 				Buffer:           0,
+				Burst:            0,
 				CapacityPressure: 0,
 				Min:              podRes.VCPU,
 				Max:              podRes.VCPU,
@@ -1465,11 +3602,15 @@ func (p *AutoscaleEnforcer) readClusterState(ctx context.Context, logger *zap.Lo
 			mem: podResourceState[api.Bytes]{
 				Reserved:         podRes.Mem,
 				Buffer:           0,
+				Burst:            0,
 				CapacityPressure: 0,
 				Min:              podRes.Mem,
 				Max:              podRes.Mem,
 			},
+			extended: makeExtendedPodState(extractPodExtendedResources(pod, p.state.conf.ExtendedResources)),
+			labels:   pod.Labels,
 		}
+		ns.reserveExtended(ps)
 
 		cpuVerdict := fmt.Sprintf(
 			"pod %v (node %v -> %v)",
@@ -1488,7 +3629,7 @@ func (p *AutoscaleEnforcer) readClusterState(ctx context.Context, logger *zap.Lo
 			}),
 		)
 
-		ns.updateMetrics(p.metrics)
+		ns.updateMetrics(p.metrics, p.state.clock.Now())
 
 		ns.pods[podName] = ps
 		p.state.pods[podName] = ps
@@ -1519,6 +3660,14 @@ func (p *AutoscaleEnforcer) readClusterState(ctx context.Context, logger *zap.Lo
 				ns.mem.Reserved, ns.mem.Buffer, ns.mem.Total,
 			))
 		}
+		for name, state := range ns.extended {
+			if state.Reserved > state.Total {
+				overBudget = append(overBudget, fmt.Sprintf(
+					"expected %s usage %d > total %d",
+					name, state.Reserved, state.Total,
+				))
+			}
+		}
 
 		if len(overBudget) == 0 {
 			continue
@@ -0,0 +1,2467 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/kubernetes/pkg/scheduler/framework"
+
+	vmapi "github.com/neondatabase/autoscaling/neonvm/apis/neonvm/v1"
+	vmfake "github.com/neondatabase/autoscaling/neonvm/client/clientset/versioned/fake"
+	"github.com/neondatabase/autoscaling/pkg/api"
+	"github.com/neondatabase/autoscaling/pkg/util"
+	"github.com/neondatabase/autoscaling/pkg/util/watch"
+)
+
+func resourcePtr(s string) *resource.Quantity {
+	q := resource.MustParse(s)
+	return &q
+}
+
+// makeTestNodeState returns a nodeState with the given CPU and memory resource states, and no pods
+func makeTestNodeState(cpu nodeResourceState[vmapi.MilliCPU], mem nodeResourceState[api.Bytes]) *nodeState {
+	return &nodeState{
+		name:             "node",
+		nodeGroup:        "",
+		availabilityZone: "",
+		cpu:              cpu,
+		mem:              mem,
+		tenantReserved:   api.Resources{VCPU: 0, Mem: 0},
+		extended:         make(map[corev1.ResourceName]*nodeResourceState[uint64]),
+		pods:             make(map[util.NamespacedName]*podState),
+		mq:               migrationQueue{},
+
+		scaleOutPendingSince:  nil,
+		scaleOutFallenBack:    false,
+		downscalePendingSince: nil,
+		overWatermarkSince:    nil,
+		pressureExceededSince: nil,
+		inTooMuchPressure:     false,
+		accommodating:         nil,
+		lastNodeFullEvent:     time.Time{},
+		verdictSummary: nodeVerdictSummary{
+			Requests:          0,
+			Granted:           api.Resources{VCPU: 0, Mem: 0},
+			Denied:            api.Resources{VCPU: 0, Mem: 0},
+			MigrationsStarted: 0,
+		},
+		emptySince:          nil,
+		capacityPressureAvg: pressureAverage{CPU: 0, Mem: 0, LastUpdate: time.Time{}},
+		scoreMultiplier:     1,
+		capacityUpdatedAt:   time.Time{},
+		unschedulable:       false,
+	}
+}
+
+func TestTooMuchPressureMargin(t *testing.T) {
+	cases := []struct {
+		name     string
+		margin   float32
+		expected bool
+	}{
+		{name: "NoMargin", margin: 0, expected: true},
+		{name: "MarginAbovePressure", margin: 0.05, expected: false},
+		{name: "MarginBelowPressure", margin: 0.005, expected: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := nodeConfig{
+				Cpu:                   resourceConfig{Watermark: 0.9, PressureMargin: c.margin, HysteresisGap: 0, DisableMigrationTrigger: false},
+				Memory:                resourceConfig{Watermark: 0.9, PressureMargin: c.margin, HysteresisGap: 0, DisableMigrationTrigger: false},
+				GlobalReserveFraction: 0,
+				MinUsageScore:         0.5,
+				MaxUsageScore:         0,
+				ScorePeak:             0.8,
+			}
+
+			cpu := conf.vCpuLimits(resourcePtr("10"))
+			mem := conf.memoryLimits(resourcePtr("10Gi"))
+
+			// Reserved CPU is 1% over the watermark (100m of 10 CPU), with nothing accounted for.
+			cpu.Reserved = cpu.Watermark + 100
+			mem.Reserved = mem.Watermark / 2
+
+			node := makeTestNodeState(cpu, mem)
+
+			if got := node.tooMuchPressure(zap.NewNop(), time.Now(), 0); got != c.expected {
+				t.Errorf("expected tooMuchPressure() = %v, got %v", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestTooMuchPressureTriggers(t *testing.T) {
+	cases := []struct {
+		name       string
+		disableCPU bool
+		overCPU    bool
+		overMem    bool
+		expected   bool
+	}{
+		{name: "CPUEnabled", disableCPU: false, overCPU: true, overMem: false, expected: true},
+		{name: "CPUDisabled", disableCPU: true, overCPU: true, overMem: false, expected: false},
+		{name: "CPUDisabledMemoryOver", disableCPU: true, overCPU: true, overMem: true, expected: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := nodeConfig{
+				Cpu: resourceConfig{
+					Watermark:               0.9,
+					PressureMargin:          0,
+					HysteresisGap:           0,
+					DisableMigrationTrigger: c.disableCPU,
+				},
+				Memory:                resourceConfig{Watermark: 0.9, PressureMargin: 0, HysteresisGap: 0, DisableMigrationTrigger: false},
+				GlobalReserveFraction: 0,
+				MinUsageScore:         0.5,
+				MaxUsageScore:         0,
+				ScorePeak:             0.8,
+			}
+
+			cpu := conf.vCpuLimits(resourcePtr("10"))
+			mem := conf.memoryLimits(resourcePtr("10Gi"))
+
+			cpu.Reserved = cpu.Watermark / 2
+			if c.overCPU {
+				cpu.Reserved = cpu.Watermark + 500
+			}
+			mem.Reserved = mem.Watermark / 2
+			if c.overMem {
+				mem.Reserved = mem.Watermark + (512 << 20)
+			}
+
+			node := makeTestNodeState(cpu, mem)
+
+			if got := node.tooMuchPressure(zap.NewNop(), time.Now(), 0); got != c.expected {
+				t.Errorf("expected tooMuchPressure() = %v, got %v", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestTooMuchPressureHysteresis(t *testing.T) {
+	conf := nodeConfig{
+		Cpu:                   resourceConfig{Watermark: 0.9, PressureMargin: 0, HysteresisGap: 0.1, DisableMigrationTrigger: false},
+		Memory:                resourceConfig{Watermark: 0.9, PressureMargin: 0, HysteresisGap: 0.1, DisableMigrationTrigger: false},
+		GlobalReserveFraction: 0,
+		MinUsageScore:         0.5,
+		MaxUsageScore:         0,
+		ScorePeak:             0.8,
+	}
+
+	cpu := conf.vCpuLimits(resourcePtr("10"))
+	mem := conf.memoryLimits(resourcePtr("10Gi"))
+	if cpu.Watermark != 9000 || cpu.ReleaseThreshold != 8000 {
+		t.Fatalf("expected CPU watermark = 9000, release threshold = 8000; got %d and %d", cpu.Watermark, cpu.ReleaseThreshold)
+	}
+
+	node := makeTestNodeState(cpu, mem)
+	node.mem.Reserved = node.mem.ReleaseThreshold / 2
+
+	// Drive the reserved CPU up and down across the hysteresis band (8000m - 9000m). Within the
+	// band, the result should stay the same as it was before.
+	steps := []struct {
+		reserved vmapi.MilliCPU
+		expected bool
+	}{
+		{reserved: 8500, expected: false}, // within band, not yet over the watermark
+		{reserved: 9100, expected: true},  // over the watermark
+		{reserved: 8500, expected: true},  // back within band, but still over release threshold
+		{reserved: 8900, expected: true},
+		{reserved: 8100, expected: true},
+		{reserved: 7900, expected: false}, // below release threshold
+		{reserved: 8500, expected: false}, // within band again, but not over the watermark
+		{reserved: 9000, expected: false}, // exactly at the watermark is still ok
+		{reserved: 9100, expected: true},
+	}
+
+	for i, step := range steps {
+		node.cpu.Reserved = step.reserved
+		if got := node.tooMuchPressure(zap.NewNop(), time.Now(), 0); got != step.expected {
+			t.Errorf("step %d: expected tooMuchPressure() = %v with %d reserved, got %v", i, step.expected, step.reserved, got)
+		}
+	}
+}
+
+func TestTooMuchPressureDwell(t *testing.T) {
+	conf := nodeConfig{
+		Cpu:                   resourceConfig{Watermark: 0.9, PressureMargin: 0, HysteresisGap: 0, DisableMigrationTrigger: false},
+		Memory:                resourceConfig{Watermark: 0.9, PressureMargin: 0, HysteresisGap: 0, DisableMigrationTrigger: false},
+		GlobalReserveFraction: 0,
+		MinUsageScore:         0.5,
+		MaxUsageScore:         0,
+		ScorePeak:             0.8,
+	}
+
+	node := makeTestNodeState(conf.vCpuLimits(resourcePtr("10")), conf.memoryLimits(resourcePtr("10Gi")))
+	node.cpu.Reserved = 8000 // 1000m under the watermark
+	node.mem.Reserved = node.mem.Watermark / 2
+
+	dwell := 30 * time.Second
+	start := time.Now()
+
+	// Each step sets the node's CPU capacityPressure at some time after the start. 2000m of pressure
+	// is enough to go over the watermark.
+	steps := []struct {
+		after    time.Duration
+		pressure vmapi.MilliCPU
+		expected bool
+	}{
+		{after: 0, pressure: 2000, expected: false},                // spike starts, but hasn't persisted
+		{after: time.Second, pressure: 0, expected: false},         // ... and it's gone on the next tick
+		{after: 40 * time.Second, pressure: 2000, expected: false}, // dwell starts again from here
+		{after: 60 * time.Second, pressure: 2000, expected: false},
+		{after: 70 * time.Second, pressure: 2000, expected: true}, // sustained for the full dwell time
+		{after: 80 * time.Second, pressure: 2000, expected: true},
+	}
+
+	for i, step := range steps {
+		node.cpu.CapacityPressure = step.pressure
+		if got := node.tooMuchPressure(zap.NewNop(), start.Add(step.after), dwell); got != step.expected {
+			t.Errorf("step %d: expected tooMuchPressure() = %v with %d pressure, got %v", i, step.expected, step.pressure, got)
+		}
+	}
+
+	// Pressure from reserved resources alone isn't delayed.
+	node = makeTestNodeState(conf.vCpuLimits(resourcePtr("10")), conf.memoryLimits(resourcePtr("10Gi")))
+	node.cpu.Reserved = 9100
+	if !node.tooMuchPressure(zap.NewNop(), start, dwell) {
+		t.Errorf("expected tooMuchPressure() = true with reserved over the watermark")
+	}
+}
+
+func TestScaleOutPendingFallback(t *testing.T) {
+	conf := makeTestConfig(t, func(*Config) {})
+
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+		conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+	)
+	e := makeTestEnforcer(conf, node)
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	logger := zap.New(core)
+
+	gracePeriod := time.Minute
+	start := time.Now()
+
+	pending := func() float64 {
+		return testutil.ToFloat64(e.metrics.nodeScaleOutPending.WithLabelValues(node.name, node.nodeGroup, node.availabilityZone))
+	}
+	fallbackLogs := func() int {
+		return logs.FilterMessageSnippet("falling back to migration").Len()
+	}
+
+	if !node.updateScaleOutPending(logger, e.metrics, true, start, gracePeriod) {
+		t.Fatal("expected migration to be deferred within the grace period")
+	}
+	if pending() != 1 {
+		t.Errorf("expected node to be reported as pending scale-out, got %v", pending())
+	}
+
+	// After the grace period, we fall back to migration, logging only once no matter how many
+	// requests there are.
+	for i := 0; i < 3; i++ {
+		if node.updateScaleOutPending(logger, e.metrics, true, start.Add(gracePeriod+time.Duration(i)*time.Second), gracePeriod) {
+			t.Fatal("expected migration not to be deferred after the grace period")
+		}
+	}
+	if n := fallbackLogs(); n != 1 {
+		t.Errorf("expected fallback to be logged once, got %d", n)
+	}
+	if pending() != 0 {
+		t.Errorf("expected node not to be reported as pending scale-out after falling back, got %v", pending())
+	}
+
+	// Once the pressure clears and comes back, the grace period starts again.
+	later := start.Add(10 * time.Minute)
+	node.updateScaleOutPending(logger, e.metrics, false, later, gracePeriod)
+	if !node.updateScaleOutPending(logger, e.metrics, true, later, gracePeriod) {
+		t.Fatal("expected migration to be deferred again after pressure returned")
+	}
+	if pending() != 1 {
+		t.Errorf("expected node to be reported as pending scale-out again, got %v", pending())
+	}
+	node.updateScaleOutPending(logger, e.metrics, true, later.Add(gracePeriod), gracePeriod)
+	if n := fallbackLogs(); n != 2 {
+		t.Errorf("expected second fallback to be logged, got %d total", n)
+	}
+}
+
+// addTestPod adds a pod with the given reserved resources to the node, updating the node's reserved
+// resources to match. If isVM is true, the pod is given a VM.
+func addTestPod(node *nodeState, name string, isVM bool, cpu vmapi.MilliCPU, mem api.Bytes) *podState {
+	podName := util.NamespacedName{Namespace: "default", Name: name}
+
+	var vm *vmPodState
+	if isVM {
+		vm = &vmPodState{
+			name:                     util.NamespacedName{Namespace: "default", Name: name + "-vm"},
+			memSlotSize:              1 << 30, // 1 Gi
+			memGranularity:           1 << 30,
+			testingOnlyAlwaysMigrate: false,
+			mostRecentComputeUnit:    nil,
+			metrics:                  nil,
+			metricsUpdatedAt:         time.Time{},
+			overprovisionedBonus:     0,
+			dualReliefBonus:          0,
+			migrationSize:            0,
+			mqIndex:                  -1,
+			mqEnqueuedAt:             time.Time{},
+			migrationState:           nil,
+			migrationCooldownUntil:   time.Time{},
+			pendingMigrationTarget:   "",
+			migrationRequested:       false,
+			migrationCounted:         false,
+		}
+	}
+
+	pod := &podState{
+		name: podName,
+		node: node,
+		cpu: podResourceState[vmapi.MilliCPU]{
+			Reserved:         cpu,
+			Buffer:           0,
+			Burst:            0,
+			CapacityPressure: 0,
+			Min:              cpu,
+			Max:              cpu,
+		},
+		mem: podResourceState[api.Bytes]{
+			Reserved:         mem,
+			Buffer:           0,
+			Burst:            0,
+			CapacityPressure: 0,
+			Min:              mem,
+			Max:              mem,
+		},
+		extended: make(map[corev1.ResourceName]*podResourceState[uint64]),
+		labels:   nil,
+		vm:       vm,
+		phase:    podPhaseBound,
+	}
+
+	node.cpu.Reserved += cpu
+	node.mem.Reserved += mem
+	node.pods[podName] = pod
+	return pod
+}
+
+// makeTestVMStore returns an IndexedVMStore containing the given VMs, which is stopped when ctx
+// is cancelled
+func makeTestVMStore(ctx context.Context, t *testing.T, vms ...*vmapi.VirtualMachine) IndexedVMStore {
+	objects := make([]runtime.Object, 0, len(vms))
+	for _, vm := range vms {
+		objects = append(objects, vm)
+	}
+	client := vmfake.NewSimpleClientset(objects...)
+
+	store, err := watch.Watch(
+		ctx,
+		zap.NewNop(),
+		client.NeonvmV1().VirtualMachines(corev1.NamespaceAll),
+		watch.Config{
+			ObjectNameLogField: "virtualmachine",
+			Metrics: watch.MetricsConfig{
+				Metrics:  watch.NewMetrics("test"),
+				Instance: "VirtualMachines",
+			},
+			RetryRelistAfter: nil,
+			RetryWatchAfter:  nil,
+		},
+		watch.Accessors[*vmapi.VirtualMachineList, vmapi.VirtualMachine]{
+			Items: func(list *vmapi.VirtualMachineList) []vmapi.VirtualMachine { return list.Items },
+		},
+		watch.InitModeSync,
+		metav1.ListOptions{},
+		watch.HandlerFuncs[*vmapi.VirtualMachine]{},
+	)
+	if err != nil {
+		t.Fatalf("failed to start VM watch: %s", err)
+	}
+	go func() {
+		<-ctx.Done()
+		store.Stop()
+	}()
+	return watch.NewIndexedStore(store, watch.NewNameIndex[vmapi.VirtualMachine]())
+}
+
+// makeTestNodeStore returns a node store containing the given Nodes, which is stopped when ctx is
+// canceled
+func makeTestNodeStore(ctx context.Context, t *testing.T, nodes ...*corev1.Node) IndexedNodeStore {
+	objects := make([]runtime.Object, 0, len(nodes))
+	for _, node := range nodes {
+		objects = append(objects, node)
+	}
+	client := fake.NewSimpleClientset(objects...)
+
+	store, err := watch.Watch(
+		ctx,
+		zap.NewNop(),
+		client.CoreV1().Nodes(),
+		watch.Config{
+			ObjectNameLogField: "node",
+			Metrics: watch.MetricsConfig{
+				Metrics:  watch.NewMetrics("test"),
+				Instance: "Nodes",
+			},
+			RetryRelistAfter: nil,
+			RetryWatchAfter:  nil,
+		},
+		watch.Accessors[*corev1.NodeList, corev1.Node]{
+			Items: func(list *corev1.NodeList) []corev1.Node { return list.Items },
+		},
+		watch.InitModeSync,
+		metav1.ListOptions{},
+		watch.HandlerFuncs[*corev1.Node]{},
+	)
+	if err != nil {
+		t.Fatalf("failed to start node watch: %s", err)
+	}
+	go func() {
+		<-ctx.Done()
+		store.Stop()
+	}()
+	return watch.NewIndexedStore(store, watch.NewFlatNameIndex[corev1.Node]())
+}
+
+// makeTestVM returns a VirtualMachine with a fixed amount of CPU and memory, and a pod that belongs
+// to it
+func makeTestVM(conf *Config, name string, cpu vmapi.MilliCPU, memSlots int32) (*vmapi.VirtualMachine, *corev1.Pod) {
+	vm := &vmapi.VirtualMachine{}
+	vm.Namespace = "default"
+	vm.Name = name
+	vm.Spec.Guest.CPUs = vmapi.CPUs{Min: &cpu, Max: &cpu, Use: &cpu}
+	vm.Spec.Guest.MemorySlots = vmapi.MemorySlots{Min: &memSlots, Max: &memSlots, Use: &memSlots}
+	vm.Spec.Guest.MemorySlotSize = resource.MustParse("1Gi")
+
+	pod := &corev1.Pod{}
+	pod.Namespace = "default"
+	pod.Name = name + "-pod"
+	pod.Spec.SchedulerName = conf.SchedulerName
+	pod.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: "vm.neon.tech/v1",
+		Kind:       "VirtualMachine",
+		Name:       name,
+	}}
+	return vm, pod
+}
+
+// makeTestEnforcer returns an AutoscaleEnforcer with the given config and nodes, suitable for
+// testing methods that only need to access the plugin's state and metrics.
+func makeTestEnforcer(conf *Config, nodes ...*nodeState) *AutoscaleEnforcer {
+	e := &AutoscaleEnforcer{ //nolint:exhaustruct // only state and metrics are used in tests
+		logger: zap.NewNop(),
+		state: pluginState{
+			lock:                      util.NewChanMutex(),
+			ongoingMigrationDeletions: make(map[util.NamespacedName]int),
+			ongoingMigrations:         0,
+			pods:                      make(map[util.NamespacedName]*podState),
+			nodes:                     make(map[string]*nodeState),
+			maxTotalReservableCPU:     0,
+			maxTotalReservableMem:     0,
+			orphanMetrics:             make(map[util.NamespacedName]orphanMetrics),
+			conf:                      conf,
+			clock:                     realClock{},
+		},
+	}
+	_ = e.makePrometheusRegistry()
+
+	for _, n := range nodes {
+		e.state.nodes[n.name] = n
+		for name, pod := range n.pods {
+			e.state.pods[name] = pod
+		}
+	}
+	e.state.updateMaxTotalReservable()
+
+	return e
+}
+
+func TestMigrationTimeout(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) {
+		conf.MigrationTimeoutSeconds = 60
+		conf.MigrationFailureCooldownSeconds = 30
+	})
+
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+		conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+	)
+	migrating := addTestPod(node, "migrating", true, 2000, 4<<30)
+	other := addTestPod(node, "other", true, 1000, 1<<30)
+
+	e := makeTestEnforcer(conf, node)
+
+	// Start the migration, as if from handlePodStartMigration
+	startTime := time.Now()
+	_ = makeResourceTransitioner(&node.cpu, &migrating.cpu).handleStartMigration(true)
+	_ = makeResourceTransitioner(&node.mem, &migrating.mem).handleStartMigration(true)
+	migrating.vm.migrationState = &podMigrationState{
+		name:       util.NamespacedName{Namespace: "default", Name: "migration"},
+		startTime:  startTime,
+		targetNode: "",
+		phase:      "",
+	}
+	e.state.countMigration(migrating.vm)
+
+	if node.cpu.PressureAccountedFor != 2000 || node.mem.PressureAccountedFor != 4<<30 {
+		t.Fatalf("unexpected pressureAccountedFor after starting migration: cpu = %v, mem = %v", node.cpu.PressureAccountedFor, node.mem.PressureAccountedFor)
+	}
+
+	// Before the timeout, nothing should change.
+	e.checkMigrationTimeouts(zap.NewNop(), startTime.Add(59*time.Second))
+	if !migrating.vm.currentlyMigrating() {
+		t.Fatal("migration aborted before timeout")
+	}
+
+	// After the timeout, the migration should be considered failed.
+	abortTime := startTime.Add(61 * time.Second)
+	e.checkMigrationTimeouts(zap.NewNop(), abortTime)
+	if migrating.vm.currentlyMigrating() {
+		t.Fatal("migration not aborted after timeout")
+	}
+	if node.cpu.PressureAccountedFor != 0 || node.mem.PressureAccountedFor != 0 {
+		t.Errorf("expected pressureAccountedFor to be reset, got cpu = %v, mem = %v", node.cpu.PressureAccountedFor, node.mem.PressureAccountedFor)
+	}
+	if e.state.ongoingMigrations != 1 {
+		t.Errorf("expected timed out migration to still be counted, got %d ongoing", e.state.ongoingMigrations)
+	}
+	if !migrating.vm.inMigrationCooldown(abortTime.Add(29 * time.Second)) {
+		t.Error("expected pod to be in migration cooldown after abort")
+	}
+	if migrating.vm.inMigrationCooldown(abortTime.Add(31 * time.Second)) {
+		t.Error("expected pod migration cooldown to have ended")
+	}
+	if other.vm.inMigrationCooldown(abortTime) {
+		t.Error("expected non-migrating pod to be unaffected")
+	}
+}
+
+// fakeClock is a clock that only moves forward when advanced, so that tests of time-dependent
+// behavior don't need to sleep
+type fakeClock struct {
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	// a nice round number, to make any logs easier to read
+	return &fakeClock{now: time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestMigrationEnd(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) {
+		conf.MigrationTimeoutSeconds = 60
+	})
+
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+		conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+	)
+	migrating := addTestPod(node, "migrating", true, 2000, 4<<30)
+	e := makeTestEnforcer(conf, node)
+	migrationName := util.NamespacedName{Namespace: "default", Name: "migration"}
+
+	e.handlePodStartMigration(zap.NewNop(), migrating.name, migrationName, true)
+	if node.cpu.PressureAccountedFor != 2000 || node.mem.PressureAccountedFor != 4<<30 {
+		t.Fatalf("unexpected pressureAccountedFor after starting migration: cpu = %v, mem = %v", node.cpu.PressureAccountedFor, node.mem.PressureAccountedFor)
+	}
+
+	// If the migration fails, the pod is left where it was, and the node should no longer expect
+	// the migration to relieve any pressure.
+	e.handlePodEndMigration(zap.NewNop(), migrating.name, migrationName)
+	if migrating.vm.currentlyMigrating() {
+		t.Fatal("expected pod to no longer be migrating")
+	}
+	if node.cpu.PressureAccountedFor != 0 || node.mem.PressureAccountedFor != 0 {
+		t.Errorf("expected pressureAccountedFor to be released, got cpu = %v, mem = %v", node.cpu.PressureAccountedFor, node.mem.PressureAccountedFor)
+	}
+
+	// Its next request should put it back in the migration queue.
+	metrics := &api.Metrics{LoadAverage1Min: 0.5, LoadAverage5Min: 0.5, MemoryUsageBytes: 0}
+	_ = e.updateMetricsAndCheckMustMigrate(zap.NewNop(), migrating.vm, node, metrics)
+	if !node.mq.isNextInQueue(migrating.vm) {
+		t.Error("expected pod to be back in the migration queue")
+	}
+
+	// If we'd already given up on the migration, its pressure shouldn't be released twice.
+	e.handlePodStartMigration(zap.NewNop(), migrating.name, migrationName, true)
+	e.checkMigrationTimeouts(zap.NewNop(), time.Now().Add(61*time.Second))
+	e.handlePodEndMigration(zap.NewNop(), migrating.name, migrationName)
+	if node.cpu.PressureAccountedFor != 0 || node.mem.PressureAccountedFor != 0 {
+		t.Errorf("expected pressureAccountedFor to stay at zero, got cpu = %v, mem = %v", node.cpu.PressureAccountedFor, node.mem.PressureAccountedFor)
+	}
+}
+
+func TestMigrationFinished(t *testing.T) {
+	conf := makeTestConfig(t, func(*Config) {})
+
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+		conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+	)
+	migrating := addTestPod(node, "migrating", true, 2000, 4<<30)
+	migrating.vm.metrics = &api.Metrics{LoadAverage1Min: 0.5, LoadAverage5Min: 0.5, MemoryUsageBytes: 0}
+	e := makeTestEnforcer(conf, node)
+	migrationName := util.NamespacedName{Namespace: "default", Name: "migration"}
+
+	vmm := &vmapi.VirtualMachineMigration{}
+	vmm.Namespace = migrationName.Namespace
+	vmm.Name = migrationName.Name
+	vmm.Spec.VmName = migrating.vm.name.Name
+
+	e.handlePodStartMigration(zap.NewNop(), migrating.name, migrationName, true)
+	if e.state.ongoingMigrations != 1 {
+		t.Fatalf("expected 1 ongoing migration, got %d", e.state.ongoingMigrations)
+	}
+
+	// If the migration succeeded, the source pod's pressure is released when it's deleted, so it
+	// should still be accounted for.
+	vmm.Status.Phase = vmapi.VmmSucceeded
+	e.handleMigrationFinished(zap.NewNop(), vmm)
+	if !migrating.vm.currentlyMigrating() {
+		t.Fatal("expected pod to still be migrating after the migration succeeded")
+	}
+	if node.cpu.PressureAccountedFor != 2000 || node.mem.PressureAccountedFor != 4<<30 {
+		t.Errorf("expected pressureAccountedFor to be unchanged, got cpu = %v, mem = %v", node.cpu.PressureAccountedFor, node.mem.PressureAccountedFor)
+	}
+	if migrating.vm.mqIndex != -1 {
+		t.Error("expected pod to not be in the migration queue")
+	}
+	// ... but the migration itself is over.
+	if e.state.ongoingMigrations != 0 {
+		t.Errorf("expected no ongoing migrations after the migration succeeded, got %d", e.state.ongoingMigrations)
+	}
+
+	// If the migration failed, the pod stays where it is, so the node should no longer expect the
+	// migration to relieve any pressure, and the pod should be eligible for migration again.
+	vmm.Status.Phase = vmapi.VmmFailed
+	e.handleMigrationFinished(zap.NewNop(), vmm)
+	if migrating.vm.currentlyMigrating() {
+		t.Fatal("expected pod to no longer be migrating after the migration failed")
+	}
+	if node.cpu.PressureAccountedFor != 0 || node.mem.PressureAccountedFor != 0 {
+		t.Errorf("expected pressureAccountedFor to be released, got cpu = %v, mem = %v", node.cpu.PressureAccountedFor, node.mem.PressureAccountedFor)
+	}
+	if !node.mq.isNextInQueue(migrating.vm) {
+		t.Error("expected pod to be back in the migration queue")
+	}
+
+	// The pod watch seeing the end of the migration afterwards shouldn't release anything again.
+	e.handlePodEndMigration(zap.NewNop(), migrating.name, migrationName)
+	if node.cpu.PressureAccountedFor != 0 || node.mem.PressureAccountedFor != 0 {
+		t.Errorf("expected pressureAccountedFor to stay at zero, got cpu = %v, mem = %v", node.cpu.PressureAccountedFor, node.mem.PressureAccountedFor)
+	}
+
+	// With a cooldown, the pod should be kept out of the queue until it's over.
+	e.state.conf.MigrationFailureCooldownSeconds = 60
+	node.mq.removeIfPresent(migrating.vm)
+	e.handlePodStartMigration(zap.NewNop(), migrating.name, migrationName, true)
+	e.handleMigrationFinished(zap.NewNop(), vmm)
+	if node.cpu.PressureAccountedFor != 0 || node.mem.PressureAccountedFor != 0 {
+		t.Errorf("expected pressureAccountedFor to be released, got cpu = %v, mem = %v", node.cpu.PressureAccountedFor, node.mem.PressureAccountedFor)
+	}
+	if migrating.vm.mqIndex != -1 {
+		t.Error("expected pod to stay out of the migration queue during its cooldown")
+	}
+	if e.state.ongoingMigrations != 0 {
+		t.Errorf("expected no ongoing migrations after the migration failed, got %d", e.state.ongoingMigrations)
+	}
+}
+
+func TestMigrationPhaseChanged(t *testing.T) {
+	conf := makeTestConfig(t, func(*Config) {})
+
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+		conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+	)
+	migrating := addTestPod(node, "migrating", true, 2000, 4<<30)
+	other := addTestPod(node, "other", true, 1000, 2<<30)
+	e := makeTestEnforcer(conf, node)
+	migrationName := util.NamespacedName{Namespace: "default", Name: "migration"}
+
+	e.handlePodStartMigration(zap.NewNop(), migrating.name, migrationName, true)
+	e.handlePodStartMigration(zap.NewNop(), other.name, util.NamespacedName{Namespace: "default", Name: "other-migration"}, true)
+	if migrating.vm.migrationState.phase != "" {
+		t.Fatalf("expected phase to be unknown before any update, got %q", migrating.vm.migrationState.phase)
+	}
+
+	vmm := &vmapi.VirtualMachineMigration{}
+	vmm.Namespace = migrationName.Namespace
+	vmm.Name = migrationName.Name
+	vmm.Status.Phase = vmapi.VmmRunning
+	e.handleMigrationPhaseChanged(zap.NewNop(), vmm)
+
+	if migrating.vm.migrationState.phase != vmapi.VmmRunning {
+		t.Errorf("expected phase %q, got %q", vmapi.VmmRunning, migrating.vm.migrationState.phase)
+	}
+	if other.vm.migrationState.phase != "" {
+		t.Errorf("expected phase of unrelated migration to be unchanged, got %q", other.vm.migrationState.phase)
+	}
+
+	enc := zapcore.NewMapObjectEncoder()
+	if err := migrating.vm.migrationState.MarshalLogObject(enc); err != nil {
+		t.Fatal(err)
+	}
+	if enc.Fields["phase"] != string(vmapi.VmmRunning) {
+		t.Errorf("expected logged phase %q, got %v", vmapi.VmmRunning, enc.Fields["phase"])
+	}
+
+	// Only terminal phases should count towards the migration's outcome.
+	if n := testutil.CollectAndCount(e.metrics.migrationsSucceeded) + testutil.CollectAndCount(e.metrics.migrationsFailed); n != 0 {
+		t.Errorf("expected no migration outcomes to be counted yet, got %d series", n)
+	}
+
+	vmm.Status.Phase = vmapi.VmmFailed
+	vmm.Status.SourceNode = node.name
+	e.handleMigrationPhaseChanged(zap.NewNop(), vmm)
+	if n := testutil.ToFloat64(e.metrics.migrationsFailed.WithLabelValues(node.name, migrationFailReasonPhase)); n != 1 {
+		t.Errorf("expected 1 failed migration, got %v", n)
+	}
+	if n := testutil.CollectAndCount(e.metrics.migrationsSucceeded); n != 0 {
+		t.Errorf("expected no succeeded migrations, got %d series", n)
+	}
+}
+
+func TestMigrationCooldownExpiry(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) {
+		conf.MigrationTimeoutSeconds = 60
+		conf.MigrationFailureCooldownSeconds = 300
+	})
+
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+		conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+	)
+	pod := addTestPod(node, "vm", true, 2000, 4<<30)
+
+	clock := newFakeClock()
+	e := makeTestEnforcer(conf, node)
+	e.state.clock = clock
+
+	// Start a migration that never finishes, and let it time out.
+	_ = makeResourceTransitioner(&node.cpu, &pod.cpu).handleStartMigration(true)
+	_ = makeResourceTransitioner(&node.mem, &pod.mem).handleStartMigration(true)
+	pod.vm.migrationState = &podMigrationState{
+		name:       util.NamespacedName{Namespace: "default", Name: "migration"},
+		startTime:  clock.Now(),
+		targetNode: "",
+		phase:      "",
+	}
+
+	clock.advance(61 * time.Second)
+	e.checkMigrationTimeouts(zap.NewNop(), clock.Now())
+	if pod.vm.currentlyMigrating() {
+		t.Fatal("migration not aborted after timeout")
+	}
+
+	metrics := &api.Metrics{LoadAverage1Min: 1, LoadAverage5Min: 1, MemoryUsageBytes: 0}
+
+	// During the cooldown, the pod shouldn't be put back into the migration queue.
+	clock.advance(299 * time.Second)
+	e.handleScrapedMetrics(zap.NewNop(), pod.name, metrics)
+	if pod.vm.mqIndex != -1 {
+		t.Errorf("expected pod not to be queued during cooldown, got index %d", pod.vm.mqIndex)
+	}
+
+	// ... but once the clock passes the end of the cooldown, it should be.
+	clock.advance(2 * time.Second)
+	e.handleScrapedMetrics(zap.NewNop(), pod.name, metrics)
+	if pod.vm.mqIndex != 0 {
+		t.Errorf("expected pod to be queued after cooldown, got index %d", pod.vm.mqIndex)
+	}
+	if pod.vm.mqEnqueuedAt != clock.Now() {
+		t.Errorf("expected pod to be enqueued at %v, got %v", clock.Now(), pod.vm.mqEnqueuedAt)
+	}
+}
+
+func TestPressureAccountingDrift(t *testing.T) {
+	for _, correct := range []bool{false, true} {
+		conf := makeTestConfig(t, func(conf *Config) {
+			conf.PressureAccountingCheck = &pressureAccountingCheckConfig{IntervalSeconds: 60, Correct: correct}
+		})
+
+		node := makeTestNodeState(
+			conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+			conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+		)
+		migrating := addTestPod(node, "migrating", true, 2000, 4<<30)
+		_ = addTestPod(node, "other", true, 1000, 1<<30)
+
+		e := makeTestEnforcer(conf, node)
+
+		// Start the migration, as if from handlePodStartMigration
+		_ = makeResourceTransitioner(&node.cpu, &migrating.cpu).handleStartMigration(true)
+		_ = makeResourceTransitioner(&node.mem, &migrating.mem).handleStartMigration(true)
+		migrating.vm.migrationState = &podMigrationState{
+			name:       util.NamespacedName{Namespace: "default", Name: "migration"},
+			startTime:  time.Now(),
+			targetNode: "",
+			phase:      "",
+		}
+
+		drift := func(resourceName string) float64 {
+			return testutil.ToFloat64(e.metrics.pressureAccountingDrift.WithLabelValues(node.name, resourceName, strconv.FormatBool(correct)))
+		}
+
+		// With accurate accounting, there's nothing to report.
+		e.checkPressureAccounting(zap.NewNop())
+		if drift("cpu") != 0 || drift("mem") != 0 {
+			t.Fatalf("expected no drift to be reported, got cpu = %v, mem = %v", drift("cpu"), drift("mem"))
+		}
+
+		// Simulate a migration that ended without releasing its pressureAccountedFor
+		node.cpu.PressureAccountedFor += 1000
+
+		e.checkPressureAccounting(zap.NewNop())
+		if drift("cpu") != 1 || drift("mem") != 0 {
+			t.Errorf("expected only cpu drift to be reported, got cpu = %v, mem = %v", drift("cpu"), drift("mem"))
+		}
+
+		expectedCPU := vmapi.MilliCPU(3000)
+		if correct {
+			expectedCPU = 2000
+		}
+		if node.cpu.PressureAccountedFor != expectedCPU || node.mem.PressureAccountedFor != 4<<30 {
+			t.Errorf(
+				"expected pressureAccountedFor cpu = %v, mem = %v, got cpu = %v, mem = %v",
+				expectedCPU, api.Bytes(4<<30), node.cpu.PressureAccountedFor, node.mem.PressureAccountedFor,
+			)
+		}
+	}
+}
+
+func TestTenantReservation(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) {
+		conf.TenantReservation = &tenantReservationConfig{
+			LabelKey:   "tenant",
+			LabelValue: "dedicated",
+			Cpu:        0.2,
+			Memory:     0.25,
+		}
+	})
+
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("10")),
+		conf.NodeConfig.memoryLimits(resourcePtr("16Gi")),
+	)
+	node.tenantReserved = conf.tenantReserved(node.cpu.Total, node.mem.Total)
+
+	if node.tenantReserved.VCPU != 2000 || node.tenantReserved.Mem != 4<<30 {
+		t.Fatalf("unexpected tenant reservation %v", node.tenantReserved)
+	}
+
+	tenantPod := &corev1.Pod{}
+	tenantPod.Labels = map[string]string{"tenant": "dedicated"}
+	otherPod := &corev1.Pod{}
+	otherPod.Labels = map[string]string{"tenant": "other"}
+
+	if !conf.tenantMatches(tenantPod.Labels) {
+		t.Error("expected tenant pod to match")
+	}
+	if conf.tenantMatches(otherPod.Labels) {
+		t.Error("expected other pod not to match")
+	}
+
+	// Other tenants are already using 7 CPU / 10Gi, and the tenant with the reservation is using
+	// 1 CPU / 1Gi of its 2 CPU / 4Gi.
+	_ = addTestPod(node, "other", false, 7000, 10<<30)
+	tenant := addTestPod(node, "tenant", false, 1000, 1<<30)
+	e := makeTestEnforcer(conf, node)
+
+	makePod := func(name string, labels map[string]string, cpu, mem string) *corev1.Pod {
+		pod := &corev1.Pod{}
+		pod.Namespace = "default"
+		pod.Name = name
+		pod.Labels = labels
+		pod.Spec.SchedulerName = conf.SchedulerName
+		pod.Spec.Containers = []corev1.Container{{}}
+		pod.Spec.Containers[0].Resources.Requests = corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse(cpu),
+			corev1.ResourceMemory: resource.MustParse(mem),
+		}
+		return pod
+	}
+
+	k8sNode := &corev1.Node{}
+	k8sNode.Name = node.name
+	nodeInfo := framework.NewNodeInfo(
+		makePod("other", otherPod.Labels, "7", "10Gi"),
+		makePod("tenant", tenantPod.Labels, "1", "1Gi"),
+	)
+	nodeInfo.SetNode(k8sNode)
+
+	// A pod from another tenant would have to dip into the unused part of the reservation...
+	status := e.Filter(context.Background(), nil, makePod("new", otherPod.Labels, "1500m", "3Gi"), nodeInfo)
+	if status.Code() != framework.Unschedulable {
+		t.Errorf("expected non-tenant pod to be denied the reserved resources, got %v", status)
+	}
+	// ... but the tenant itself can use it.
+	status = e.Filter(context.Background(), nil, makePod("new", tenantPod.Labels, "1500m", "3Gi"), nodeInfo)
+	if !status.IsSuccess() {
+		t.Errorf("expected tenant pod to be allowed to use the reserved resources, got %v", status)
+	}
+
+	// Once the tenant is using all of its reservation, other pods can use the rest of the node.
+	tenant.cpu.Reserved, tenant.mem.Reserved = 2000, 4<<30
+	status = e.Filter(context.Background(), nil, makePod("new", otherPod.Labels, "1", "2Gi"), nodeInfo)
+	if !status.IsSuccess() {
+		t.Errorf("expected non-tenant pod to fit once the reservation is fully used, got %v", status)
+	}
+}
+
+func TestGrowthReserve(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) { conf.GrowthReserveFraction = 0.25 })
+	if path, err := conf.validate(); err != nil {
+		t.Fatalf("invalid config at %s: %s", path, err)
+	}
+
+	// 2 CPU / 8Gi of the node is held back for growth, and the existing VM is using 4 CPU / 16Gi.
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+		conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+	)
+	existing := addTestPod(node, "existing", true, 4000, 16<<30)
+	existing.cpu.Min, existing.cpu.Max = 1000, 8000
+	existing.mem.Min, existing.mem.Max = 4<<30, 32<<30
+	e := makeTestEnforcer(conf, node)
+
+	makePod := func(name string, cpu, mem string) *corev1.Pod {
+		pod := &corev1.Pod{}
+		pod.Namespace = "default"
+		pod.Name = name
+		pod.Spec.SchedulerName = conf.SchedulerName
+		pod.Spec.Containers = []corev1.Container{{}}
+		pod.Spec.Containers[0].Resources.Requests = corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse(cpu),
+			corev1.ResourceMemory: resource.MustParse(mem),
+		}
+		return pod
+	}
+
+	k8sNode := &corev1.Node{}
+	k8sNode.Name = node.name
+	nodeInfo := framework.NewNodeInfo(makePod("existing", "4", "16Gi"))
+	nodeInfo.SetNode(k8sNode)
+
+	// A new pod that would need the growth reserve is rejected...
+	status := e.Filter(context.Background(), nil, makePod("new", "3", "12Gi"), nodeInfo)
+	if status.Code() != framework.Unschedulable {
+		t.Errorf("expected new pod to be rejected as unschedulable, got %v", status)
+	}
+	// ... but one that fits outside it is allowed.
+	status = e.Filter(context.Background(), nil, makePod("new", "2", "8Gi"), nodeInfo)
+	if !status.IsSuccess() {
+		t.Errorf("expected new pod to be allowed, got %v", status)
+	}
+
+	// The existing VM can grow into the reserve.
+	cu := api.Resources{VCPU: 1000, Mem: 4 << 30}
+	requested := api.Resources{VCPU: 7000, Mem: 28 << 30}
+	resp, status2, err := e.handleAgentRequest(zap.NewNop(), api.AgentRequest{
+		ProtoVersion:  api.PluginProtoV4_0,
+		Pod:           existing.name,
+		ComputeUnit:   &cu,
+		Resources:     requested,
+		LastPermit:    nil,
+		Metrics:       &api.Metrics{LoadAverage1Min: 0, LoadAverage5Min: 0, MemoryUsageBytes: 0},
+		CorrelationID: "",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error handling request (status %d): %s", status2, err)
+	}
+	if resp.Permit != requested {
+		t.Errorf("expected existing pod to be permitted %v, got %v", requested, resp.Permit)
+	}
+}
+
+func TestExtendedResources(t *testing.T) {
+	const fpga corev1.ResourceName = "example.com/fpga"
+
+	conf := makeTestConfig(t, func(conf *Config) {
+		conf.ExtendedResources = []corev1.ResourceName{fpga}
+	})
+
+	k8sNode := &corev1.Node{}
+	k8sNode.Name = "node"
+	k8sNode.Status.Allocatable = corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("16"),
+		corev1.ResourceMemory: resource.MustParse("64Gi"),
+		fpga:                  resource.MustParse("2"),
+		// not tracked, so should be ignored:
+		"example.com/gpu": resource.MustParse("0"),
+	}
+
+	node, err := buildInitialNodeState(zap.NewNop(), k8sNode, conf, time.Now())
+	if err != nil {
+		t.Fatalf("failed to build node state: %s", err)
+	}
+	if node.extended[fpga].Total != 2 {
+		t.Fatalf("expected node to have 2 %s, got %d", fpga, node.extended[fpga].Total)
+	}
+
+	e := makeTestEnforcer(conf, node)
+
+	makePod := func(name string, requests corev1.ResourceList) *corev1.Pod {
+		pod := &corev1.Pod{}
+		pod.Namespace = "default"
+		pod.Name = name
+		pod.Spec.NodeName = node.name
+		pod.Spec.Containers = []corev1.Container{{}}
+		pod.Spec.Containers[0].Resources.Requests = requests
+		return pod
+	}
+	reserve := func(pod *corev1.Pod) bool {
+		ok, _, err := e.reserveResources(context.Background(), zap.NewNop(), pod, "test", true)
+		if err != nil {
+			t.Fatalf("unexpected error reserving resources: %s", err)
+		}
+		return ok
+	}
+
+	fpgaRequest := func() corev1.ResourceList {
+		return corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("1"),
+			corev1.ResourceMemory: resource.MustParse("1Gi"),
+			fpga:                  resource.MustParse("1"),
+		}
+	}
+
+	if !reserve(makePod("fpga-1", fpgaRequest())) || !reserve(makePod("fpga-2", fpgaRequest())) {
+		t.Fatal("expected first two pods requesting an FPGA to fit")
+	}
+	if reserve(makePod("fpga-3", fpgaRequest())) {
+		t.Error("expected third pod requesting an FPGA to be denied")
+	}
+
+	// Pods requesting untracked extended resources should be unaffected.
+	if !reserve(makePod("gpu", corev1.ResourceList{"example.com/gpu": resource.MustParse("1")})) {
+		t.Error("expected pod requesting untracked extended resource to fit")
+	}
+
+	// Once one of the FPGA pods is removed, there should be room again.
+	_, _, _, _ = e.unreserveResources(zap.NewNop(), util.NamespacedName{Namespace: "default", Name: "fpga-1"}, false)
+	if node.extended[fpga].Reserved != 1 {
+		t.Fatalf("expected 1 %s reserved after deletion, got %d", fpga, node.extended[fpga].Reserved)
+	}
+	if !reserve(makePod("fpga-3", fpgaRequest())) {
+		t.Error("expected pod requesting an FPGA to fit after deletion")
+	}
+
+	// Updates to the node's capacity should also update the extended resources, without changing
+	// what's reserved.
+	k8sNode.Status.Allocatable[fpga] = resource.MustParse("4")
+	if err := e.state.updateNodeCapacity(zap.NewNop(), e.metrics, node, k8sNode); err != nil {
+		t.Fatalf("failed to update node capacity: %s", err)
+	}
+	if node.extended[fpga].Total != 4 || node.extended[fpga].Reserved != 2 {
+		t.Errorf(
+			"expected 4 %s total with 2 reserved after update, got %d total and %d reserved",
+			fpga, node.extended[fpga].Total, node.extended[fpga].Reserved,
+		)
+	}
+
+	// If we aren't tracking a resource on the node, Filter should reject pods requesting it, rather
+	// than failing.
+	delete(node.extended, fpga)
+	nodeInfo := framework.NewNodeInfo()
+	nodeInfo.SetNode(k8sNode)
+	pod := makePod("fpga-4", fpgaRequest())
+	pod.Spec.SchedulerName = conf.SchedulerName
+	if status := e.Filter(context.Background(), nil, pod, nodeInfo); status.Code() != framework.Unschedulable {
+		t.Errorf("expected Filter to reject pod requesting untracked resource, got %v", status)
+	}
+}
+
+func TestEvictionThreshold(t *testing.T) {
+	const annotation = "example.com/memory-eviction-threshold"
+
+	// makeNode returns a node with 64Gi of memory, reported as either its allocatable memory or
+	// (if allocatable isn't available) its capacity.
+	makeNode := func(annotations map[string]string, allocatable bool) *corev1.Node {
+		node := &corev1.Node{}
+		node.Name = "node"
+		node.Annotations = annotations
+		resources := corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("16"),
+			corev1.ResourceMemory: resource.MustParse("64Gi"),
+		}
+		if allocatable {
+			node.Status.Allocatable = resources
+		} else {
+			node.Status.Capacity = resources
+		}
+		return node
+	}
+
+	cases := []struct {
+		name        string
+		threshold   *evictionThresholdConfig
+		annotations map[string]string
+		// allocatable is whether the node reports allocatable memory. If not, only capacity is
+		// reported.
+		allocatable bool
+		expected    api.Bytes
+	}{
+		{
+			name:        "Disabled",
+			threshold:   nil,
+			annotations: nil,
+			allocatable: false,
+			expected:    64 << 30,
+		},
+		{
+			// Allocatable already excludes the eviction threshold, so it's used as-is.
+			name:        "Allocatable",
+			threshold:   &evictionThresholdConfig{Memory: 2 << 30, NodeAnnotation: annotation},
+			annotations: map[string]string{annotation: "4Gi"},
+			allocatable: true,
+			expected:    64 << 30,
+		},
+		{
+			name:        "FromConfig",
+			threshold:   &evictionThresholdConfig{Memory: 2 << 30, NodeAnnotation: annotation},
+			annotations: nil,
+			allocatable: false,
+			expected:    62 << 30,
+		},
+		{
+			name:        "FromAnnotation",
+			threshold:   &evictionThresholdConfig{Memory: 2 << 30, NodeAnnotation: annotation},
+			annotations: map[string]string{annotation: "4Gi"},
+			allocatable: false,
+			expected:    60 << 30,
+		},
+		{
+			name:        "InvalidAnnotation",
+			threshold:   &evictionThresholdConfig{Memory: 2 << 30, NodeAnnotation: annotation},
+			annotations: map[string]string{annotation: "not a quantity"},
+			allocatable: false,
+			expected:    62 << 30,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := makeTestConfig(t, func(conf *Config) {
+				conf.EvictionThreshold = c.threshold
+			})
+
+			node, err := buildInitialNodeState(zap.NewNop(), makeNode(c.annotations, c.allocatable), conf, time.Now())
+			if err != nil {
+				t.Fatalf("failed to build node state: %s", err)
+			}
+			if node.mem.Total != c.expected {
+				t.Errorf("expected reservable memory %v, got %v", c.expected, node.mem.Total)
+			}
+			if node.mem.Watermark != watermarkForTotal(conf.NodeConfig.Memory, c.expected, nil) {
+				t.Errorf("expected watermark to be calculated from reduced total, got %v", node.mem.Watermark)
+			}
+		})
+	}
+}
+
+func TestNodeCapacityBounds(t *testing.T) {
+	makeNode := func(cpu, mem string) *corev1.Node {
+		node := &corev1.Node{}
+		node.Name = "node"
+		node.Status.Allocatable = corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse(cpu),
+			corev1.ResourceMemory: resource.MustParse(mem),
+		}
+		return node
+	}
+
+	bounds := &nodeCapacityBoundsConfig{MaxCPU: 512000, MinMemory: 1 << 30}
+
+	cases := []struct {
+		name      string
+		bounds    *nodeCapacityBoundsConfig
+		cpu       string
+		mem       string
+		expectErr bool
+	}{
+		{name: "Normal", bounds: bounds, cpu: "16", mem: "64Gi", expectErr: false},
+		{name: "Disabled", bounds: nil, cpu: "1M", mem: "1", expectErr: false},
+		{name: "CPUInMillicoresAsCores", bounds: bounds, cpu: "16000", mem: "64Gi", expectErr: true},
+		{name: "TinyCPU", bounds: bounds, cpu: "16m", mem: "64Gi", expectErr: true},
+		{name: "HugeCPU", bounds: bounds, cpu: "1E", mem: "64Gi", expectErr: true},
+		{name: "MemoryInGiAsBytes", bounds: bounds, cpu: "16", mem: "64", expectErr: true},
+		{name: "ZeroMemory", bounds: bounds, cpu: "16", mem: "0", expectErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := makeTestConfig(t, func(conf *Config) {
+				conf.NodeCapacityBounds = c.bounds
+			})
+
+			_, err := buildInitialNodeState(zap.NewNop(), makeNode(c.cpu, c.mem), conf, time.Now())
+			if c.expectErr && err == nil {
+				t.Errorf("expected error for node with cpu = %s, mem = %s", c.cpu, c.mem)
+			} else if !c.expectErr && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+func TestNodeExtraReserved(t *testing.T) {
+	conf := makeTestConfig(t, func(*Config) {})
+
+	makeNode := func(name string, annotations map[string]string) *corev1.Node {
+		node := &corev1.Node{}
+		node.Name = name
+		node.Annotations = annotations
+		node.Status.Allocatable = corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("16"),
+			corev1.ResourceMemory: resource.MustParse("64Gi"),
+		}
+		return node
+	}
+
+	annotated := makeNode("annotated", map[string]string{
+		AnnotationNodeExtraReservedCPU: "2",
+		AnnotationNodeExtraReservedMem: "8Gi",
+	})
+	plain := makeNode("plain", nil)
+
+	annotatedState, err := buildInitialNodeState(zap.NewNop(), annotated, conf, time.Now())
+	if err != nil {
+		t.Fatalf("failed to build node state: %s", err)
+	}
+	plainState, err := buildInitialNodeState(zap.NewNop(), plain, conf, time.Now())
+	if err != nil {
+		t.Fatalf("failed to build node state: %s", err)
+	}
+
+	if annotatedState.cpu.Total != 14000 || annotatedState.mem.Total != 56<<30 {
+		t.Errorf("expected annotated node to have 14 CPU and 56Gi, got %v and %v", annotatedState.cpu.Total, annotatedState.mem.Total)
+	}
+	if plainState.cpu.Total != 16000 || plainState.mem.Total != 64<<30 {
+		t.Errorf("expected plain node to have 16 CPU and 64Gi, got %v and %v", plainState.cpu.Total, plainState.mem.Total)
+	}
+
+	// Changing the annotation should update the existing node state, without touching reservations
+	addTestPod(annotatedState, "pod", false, 1000, 4<<30)
+	e := makeTestEnforcer(conf, annotatedState, plainState)
+
+	annotated.Annotations[AnnotationNodeExtraReservedMem] = "not a quantity"
+	e.handleNodeUpdate(zap.NewNop(), annotated)
+
+	if annotatedState.cpu.Total != 14000 || annotatedState.mem.Total != 64<<30 {
+		t.Errorf("expected updated node to have 14 CPU and 64Gi, got %v and %v", annotatedState.cpu.Total, annotatedState.mem.Total)
+	}
+	if annotatedState.mem.Watermark != watermarkForTotal(conf.NodeConfig.Memory, api.Bytes(64<<30), nil) {
+		t.Errorf("expected watermark to be recalculated, got %v", annotatedState.mem.Watermark)
+	}
+	if annotatedState.cpu.Reserved != 1000 || annotatedState.mem.Reserved != 4<<30 {
+		t.Errorf("expected reservations to be unchanged, got %v and %v", annotatedState.cpu.Reserved, annotatedState.mem.Reserved)
+	}
+}
+
+func TestNodeScoreMultiplier(t *testing.T) {
+	conf := makeTestConfig(t, func(*Config) {})
+
+	makeNode := func(name string, multiplier string) (*corev1.Node, *nodeState) {
+		node := &corev1.Node{}
+		node.Name = name
+		if multiplier != "" {
+			node.Annotations = map[string]string{AnnotationNodeScoreMultiplier: multiplier}
+		}
+		node.Status.Allocatable = corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("8"),
+			corev1.ResourceMemory: resource.MustParse("32Gi"),
+		}
+
+		state, err := buildInitialNodeState(zap.NewNop(), node, conf, time.Now())
+		if err != nil {
+			t.Fatalf("failed to build node state: %s", err)
+		}
+		_ = addTestPod(state, name+"-vm", true, 2000, 8<<30)
+		return node, state
+	}
+
+	_, fast := makeNode("fast", "1.2")
+	_, plain := makeNode("plain", "")
+	slowNode, slow := makeNode("slow", "0.8")
+	_, invalid := makeNode("invalid", "-1")
+
+	if invalid.scoreMultiplier != 1 {
+		t.Errorf("expected invalid multiplier to be treated as 1, got %g", invalid.scoreMultiplier)
+	}
+
+	e := makeTestEnforcer(conf, fast, plain, slow, invalid)
+
+	pod := &corev1.Pod{}
+	pod.Namespace = "default"
+	pod.Name = "pod"
+	pod.Spec.SchedulerName = conf.SchedulerName
+
+	score := func(node *nodeState) int64 {
+		s, status := e.Score(context.Background(), nil, pod, node.name)
+		if !status.IsSuccess() {
+			t.Fatalf("unexpected Score failure: %v", status)
+		}
+		return s
+	}
+
+	fastScore, plainScore, slowScore := score(fast), score(plain), score(slow)
+	if !(fastScore > plainScore && plainScore > slowScore) {
+		t.Errorf(
+			"expected nodes to rank in multiplier order, got fast = %d, plain = %d, slow = %d",
+			fastScore, plainScore, slowScore,
+		)
+	}
+	if invalidScore := score(invalid); invalidScore != plainScore {
+		t.Errorf("expected node with invalid multiplier to score like plain node, got %d and %d", invalidScore, plainScore)
+	}
+
+	// Changing the annotation should be picked up by the existing node state
+	slowNode.Annotations[AnnotationNodeScoreMultiplier] = "1.5"
+	e.handleNodeUpdate(zap.NewNop(), slowNode)
+	if slow.scoreMultiplier != 1.5 {
+		t.Errorf("expected updated multiplier to be 1.5, got %g", slow.scoreMultiplier)
+	}
+	if slowScore = score(slow); slowScore <= fastScore {
+		t.Errorf("expected updated node to score higher than fast node, got %d and %d", slowScore, fastScore)
+	}
+}
+
+func TestUnschedulableNode(t *testing.T) {
+	conf := makeTestConfig(t, func(*Config) {})
+
+	makeNode := func(name string, unschedulable bool) (*corev1.Node, *nodeState) {
+		node := &corev1.Node{}
+		node.Name = name
+		node.Spec.Unschedulable = unschedulable
+		node.Status.Allocatable = corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("8"),
+			corev1.ResourceMemory: resource.MustParse("32Gi"),
+		}
+
+		state, err := buildInitialNodeState(zap.NewNop(), node, conf, time.Now())
+		if err != nil {
+			t.Fatalf("failed to build node state: %s", err)
+		}
+		return node, state
+	}
+
+	_, source := makeNode("source", false)
+	migrating := addTestPod(source, "migrating", true, 2000, 4<<30)
+	cordonedNode, cordoned := makeNode("cordoned", true)
+	e := makeTestEnforcer(conf, source, cordoned)
+
+	pod := &corev1.Pod{}
+	pod.Namespace = "default"
+	pod.Name = "pod"
+	pod.Spec.SchedulerName = conf.SchedulerName
+
+	score, status := e.Score(context.Background(), nil, pod, cordoned.name)
+	if !status.IsSuccess() {
+		t.Fatalf("unexpected Score failure: %v", status)
+	}
+	if score != framework.MinNodeScore {
+		t.Errorf("expected cordoned node to get minimum score, got %d", score)
+	}
+	if e.state.hasMigrationTarget(migrating) {
+		t.Error("expected cordoned node not to be a migration target")
+	}
+
+	// Once the node is uncordoned, it should be usable again.
+	cordonedNode.Spec.Unschedulable = false
+	e.handleNodeUpdate(zap.NewNop(), cordonedNode)
+	if cordoned.unschedulable {
+		t.Fatal("expected node to be schedulable after update")
+	}
+	score, status = e.Score(context.Background(), nil, pod, cordoned.name)
+	if !status.IsSuccess() {
+		t.Fatalf("unexpected Score failure: %v", status)
+	}
+	if score == framework.MinNodeScore {
+		t.Error("expected uncordoned node to get more than the minimum score")
+	}
+	if !e.state.hasMigrationTarget(migrating) {
+		t.Error("expected uncordoned node to be a migration target")
+	}
+}
+
+func TestMaxNodeStateAge(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) { conf.MaxNodeStateAgeSeconds = 60 })
+
+	makeK8sNode := func(cpu, mem string) *corev1.Node {
+		node := &corev1.Node{}
+		node.Name = "node"
+		node.Status.Allocatable = corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse(cpu),
+			corev1.ResourceMemory: resource.MustParse(mem),
+		}
+		return node
+	}
+
+	// Our view of the node says it's large, but it's since been shrunk, and the informer hasn't
+	// caught up yet.
+	node, err := buildInitialNodeState(zap.NewNop(), makeK8sNode("8", "32Gi"), conf, time.Now())
+	if err != nil {
+		t.Fatalf("failed to build node state: %s", err)
+	}
+	shrunk := makeK8sNode("2", "8Gi")
+	shrunkCPU, shrunkMem, err := nodeResourceLimits(zap.NewNop(), shrunk, conf)
+	if err != nil {
+		t.Fatalf("failed to get shrunk node limits: %s", err)
+	}
+
+	e := makeTestEnforcer(conf, node)
+	e.handle = fakeClientHandle{Handle: nil, client: fake.NewSimpleClientset(shrunk)}
+
+	pod := &corev1.Pod{}
+	pod.Namespace = "default"
+	pod.Name = "pod"
+	pod.Spec.NodeName = node.name
+	pod.Spec.SchedulerName = conf.SchedulerName
+	pod.Spec.Containers = []corev1.Container{{}}
+	pod.Spec.Containers[0].Resources.Requests = corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("4"),
+		corev1.ResourceMemory: resource.MustParse("16Gi"),
+	}
+
+	// While our view is fresh enough, it's used as-is, so the pod fits.
+	if status := e.Reserve(context.Background(), nil, pod, node.name); !status.IsSuccess() {
+		t.Fatalf("expected Reserve to succeed with fresh node state, got %v", status)
+	}
+	if node.cpu.Total == shrunkCPU.Total {
+		t.Fatal("expected node state not to be refreshed while it's fresh")
+	}
+	e.Unreserve(context.Background(), nil, pod, node.name)
+
+	// Once it's stale, Reserve should fetch the node and find that the pod doesn't fit anymore.
+	node.capacityUpdatedAt = time.Now().Add(-2 * time.Minute)
+	if status := e.Reserve(context.Background(), nil, pod, node.name); status.IsSuccess() {
+		t.Error("expected Reserve to fail after refreshing stale node state")
+	}
+	if node.cpu.Total != shrunkCPU.Total || node.mem.Total != shrunkMem.Total {
+		t.Errorf(
+			"expected node totals to be refreshed to {%v, %v}, got {%v, %v}",
+			shrunkCPU.Total, shrunkMem.Total, node.cpu.Total, node.mem.Total,
+		)
+	}
+	if time.Since(node.capacityUpdatedAt) > time.Minute {
+		t.Errorf("expected capacityUpdatedAt to be updated, got %v", node.capacityUpdatedAt)
+	}
+}
+
+func TestUnreserveIdempotent(t *testing.T) {
+	conf := makeTestConfig(t, func(*Config) {})
+
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+		conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+	)
+	running := addTestPod(node, "running", false, 1000, 4<<30)
+	e := makeTestEnforcer(conf, node)
+
+	pod := &corev1.Pod{}
+	pod.Namespace = "default"
+	pod.Name = "pod"
+	pod.Spec.NodeName = node.name
+	pod.Spec.SchedulerName = conf.SchedulerName
+	pod.Spec.Containers = []corev1.Container{{}}
+	pod.Spec.Containers[0].Resources.Requests = corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("2"),
+		corev1.ResourceMemory: resource.MustParse("8Gi"),
+	}
+
+	if status := e.Reserve(context.Background(), nil, pod, node.name); !status.IsSuccess() {
+		t.Fatalf("unexpected Reserve failure: %v", status)
+	}
+	if node.cpu.Reserved != 3000 || node.mem.Reserved != 12<<30 {
+		t.Fatalf("unexpected node reservation after Reserve: cpu = %v, mem = %v", node.cpu.Reserved, node.mem.Reserved)
+	}
+
+	// Calling Unreserve twice should only release the pod's resources once.
+	for i := 0; i < 2; i++ {
+		e.Unreserve(context.Background(), nil, pod, node.name)
+		if node.cpu.Reserved != 1000 || node.mem.Reserved != 4<<30 {
+			t.Fatalf(
+				"unexpected node reservation after Unreserve #%d: cpu = %v, mem = %v",
+				i+1, node.cpu.Reserved, node.mem.Reserved,
+			)
+		}
+	}
+
+	// Pods that are already running on the node shouldn't be removed by Unreserve at all.
+	runningPod := &corev1.Pod{}
+	runningPod.Namespace = running.name.Namespace
+	runningPod.Name = running.name.Name
+	e.Unreserve(context.Background(), nil, runningPod, node.name)
+	if _, ok := e.state.pods[running.name]; !ok {
+		t.Error("expected running pod to be kept after Unreserve")
+	}
+	if node.cpu.Reserved != 1000 || node.mem.Reserved != 4<<30 {
+		t.Errorf("unexpected node reservation after Unreserve of running pod: cpu = %v, mem = %v", node.cpu.Reserved, node.mem.Reserved)
+	}
+}
+
+func TestMaxTotalReservableOnNodeDeletion(t *testing.T) {
+	conf := makeTestConfig(t, func(*Config) {})
+
+	makeNode := func(name, cpu, mem string) *nodeState {
+		n := makeTestNodeState(conf.NodeConfig.vCpuLimits(resourcePtr(cpu)), conf.NodeConfig.memoryLimits(resourcePtr(mem)))
+		n.name = name
+		return n
+	}
+
+	small := makeNode("small", "8", "32Gi")
+	large := makeNode("large", "32", "128Gi")
+	e := makeTestEnforcer(conf, small, large)
+
+	if e.state.maxTotalReservableCPU != large.cpu.Total || e.state.maxTotalReservableMem != large.mem.Total {
+		t.Fatalf(
+			"expected maxima to be set from largest node, got cpu = %v, mem = %v",
+			e.state.maxTotalReservableCPU, e.state.maxTotalReservableMem,
+		)
+	}
+
+	pod := &corev1.Pod{}
+	pod.Namespace = "default"
+	pod.Name = "pod"
+	pod.Spec.SchedulerName = conf.SchedulerName
+
+	scoreBefore, status := e.Score(context.Background(), nil, pod, small.name)
+	if !status.IsSuccess() {
+		t.Fatalf("unexpected Score failure: %v", status)
+	}
+
+	e.handleNodeDeletion(zap.NewNop(), large.name)
+
+	if e.state.maxTotalReservableCPU != small.cpu.Total || e.state.maxTotalReservableMem != small.mem.Total {
+		t.Fatalf(
+			"expected maxima to be reduced after removing largest node, got cpu = %v, mem = %v",
+			e.state.maxTotalReservableCPU, e.state.maxTotalReservableMem,
+		)
+	}
+
+	scoreAfter, status := e.Score(context.Background(), nil, pod, small.name)
+	if !status.IsSuccess() {
+		t.Fatalf("unexpected Score failure: %v", status)
+	}
+	if scoreAfter <= scoreBefore {
+		t.Errorf("expected score for remaining node to increase after removing largest node, got %d -> %d", scoreBefore, scoreAfter)
+	}
+
+	// Pods still tracked on a deleted node should be removed along with it.
+	leftover := addTestPod(small, "leftover", true, 1000, 1<<30)
+	e.state.pods[leftover.name] = leftover
+	e.handleNodeDeletion(zap.NewNop(), small.name)
+	if _, ok := e.state.pods[leftover.name]; ok {
+		t.Error("expected pod on deleted node to be removed")
+	}
+	if len(e.state.nodes) != 0 || e.state.maxTotalReservableCPU != 0 || e.state.maxTotalReservableMem != 0 {
+		t.Errorf(
+			"expected no nodes left, got %d nodes, maxima cpu = %v, mem = %v",
+			len(e.state.nodes), e.state.maxTotalReservableCPU, e.state.maxTotalReservableMem,
+		)
+	}
+
+	// Deleting a node we never tracked is a no-op.
+	e.handleNodeDeletion(zap.NewNop(), "unknown")
+}
+
+func TestIdleNodeStateExpiry(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) {
+		conf.IdleNodeStateExpirySeconds = 60
+	})
+
+	k8sNode := &corev1.Node{}
+	k8sNode.Name = "idle"
+	k8sNode.Status.Allocatable = corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("16"),
+		corev1.ResourceMemory: resource.MustParse("64Gi"),
+	}
+
+	idle, err := buildInitialNodeState(zap.NewNop(), k8sNode, conf, time.Now())
+	if err != nil {
+		t.Fatalf("failed to build node state: %s", err)
+	}
+	busy := makeTestNodeState(conf.NodeConfig.vCpuLimits(resourcePtr("8")), conf.NodeConfig.memoryLimits(resourcePtr("32Gi")))
+	busy.name = "busy"
+	addTestPod(busy, "pod", true, 1000, 4<<30)
+
+	e := makeTestEnforcer(conf, idle, busy)
+	if e.state.maxTotalReservableCPU != idle.cpu.Total {
+		t.Fatalf("expected max CPU to be set from idle node, got %v", e.state.maxTotalReservableCPU)
+	}
+
+	// The first pass only notices that the node is empty; it shouldn't be evicted until it's been
+	// empty for the full expiry.
+	start := time.Now()
+	e.evictIdleNodes(zap.NewNop(), start)
+	e.evictIdleNodes(zap.NewNop(), start.Add(59*time.Second))
+	if _, ok := e.state.nodes[idle.name]; !ok {
+		t.Fatal("expected idle node to be kept before expiry")
+	}
+
+	e.evictIdleNodes(zap.NewNop(), start.Add(60*time.Second))
+	if _, ok := e.state.nodes[idle.name]; ok {
+		t.Fatal("expected idle node to be evicted after expiry")
+	}
+	if _, ok := e.state.nodes[busy.name]; !ok {
+		t.Fatal("expected node with pods to be kept")
+	}
+	if e.state.maxTotalReservableCPU != busy.cpu.Total || e.state.maxTotalReservableMem != busy.mem.Total {
+		t.Fatalf(
+			"expected maxima to be reduced after eviction, got cpu = %v, mem = %v",
+			e.state.maxTotalReservableCPU, e.state.maxTotalReservableMem,
+		)
+	}
+
+	// Rebuilding the node's state, as getOrFetchNodeState does on next use, should restore it.
+	rebuilt, err := e.state.addNode(zap.NewNop(), e.metrics, k8sNode)
+	if err != nil {
+		t.Fatalf("failed to rebuild node state: %s", err)
+	}
+	if rebuilt.cpu != idle.cpu || rebuilt.mem != idle.mem || rebuilt.emptySince != nil {
+		t.Errorf("expected rebuilt node state to match original, got cpu = %+v, mem = %+v", rebuilt.cpu, rebuilt.mem)
+	}
+	if e.state.maxTotalReservableCPU != idle.cpu.Total || e.state.maxTotalReservableMem != idle.mem.Total {
+		t.Fatalf(
+			"expected maxima to be restored after rebuilding, got cpu = %v, mem = %v",
+			e.state.maxTotalReservableCPU, e.state.maxTotalReservableMem,
+		)
+	}
+}
+
+func TestChooseMigrationTarget(t *testing.T) {
+	// makeNodes returns a set of nodes, with the source node in zone-a and candidates spread across
+	// zones with varying usage.
+	makeNodes := func(conf *Config) (source *nodeState, nodes []*nodeState) {
+		makeNode := func(name, zone string, usedCPU vmapi.MilliCPU, usedMem api.Bytes) *nodeState {
+			n := makeTestNodeState(conf.NodeConfig.vCpuLimits(resourcePtr("8")), conf.NodeConfig.memoryLimits(resourcePtr("32Gi")))
+			n.name = name
+			n.availabilityZone = zone
+			if usedCPU != 0 || usedMem != 0 {
+				addTestPod(n, name+"-existing", false, usedCPU, usedMem)
+			}
+			return n
+		}
+
+		source = makeNode("source", "zone-a", 0, 0)
+		nodes = []*nodeState{
+			source,
+			makeNode("a-busy", "zone-a", 4000, 16<<30),
+			makeNode("b-empty", "zone-b", 0, 0),
+			makeNode("b-full", "zone-b", 7500, 31<<30),
+		}
+		return source, nodes
+	}
+
+	cases := []struct {
+		name     string
+		strategy migrationTargetStrategy
+		// remove gives the names of nodes to remove before choosing a target
+		remove   []string
+		expected string
+	}{
+		{name: "None", strategy: "", remove: nil, expected: ""},
+		{name: "Emptiest", strategy: migrationTargetEmptiest, remove: nil, expected: "b-empty"},
+		{name: "SameZone", strategy: migrationTargetSameZone, remove: nil, expected: "a-busy"},
+		{name: "SameZoneFallback", strategy: migrationTargetSameZone, remove: []string{"a-busy"}, expected: "b-empty"},
+		{name: "DifferentZone", strategy: migrationTargetDifferentZone, remove: nil, expected: "b-empty"},
+		{name: "DifferentZoneFallback", strategy: migrationTargetDifferentZone, remove: []string{"b-empty", "b-full"}, expected: "a-busy"},
+		{name: "NoRoom", strategy: migrationTargetEmptiest, remove: []string{"a-busy", "b-empty"}, expected: ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := makeTestConfig(t, func(conf *Config) {
+				conf.K8sAvailabilityZoneLabel = "topology.kubernetes.io/zone"
+				conf.MigrationTargetStrategy = c.strategy
+			})
+			if path, err := conf.validate(); err != nil {
+				t.Fatalf("invalid config at %s: %s", path, err)
+			}
+
+			source, nodes := makeNodes(conf)
+			pod := addTestPod(source, "migrating", true, 2000, 4<<30)
+			e := makeTestEnforcer(conf, nodes...)
+			for _, name := range c.remove {
+				delete(e.state.nodes, name)
+			}
+
+			var got string
+			if target := e.state.chooseMigrationTarget(pod); target != nil {
+				got = target.name
+			}
+			if got != c.expected {
+				t.Errorf("expected target node %q, got %q", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestRequireMigrationTarget(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) {
+		conf.RequireMigrationTarget = true
+	})
+
+	source := makeTestNodeState(conf.NodeConfig.vCpuLimits(resourcePtr("8")), conf.NodeConfig.memoryLimits(resourcePtr("32Gi")))
+	source.name = "source"
+	pod := addTestPod(source, "migrating", true, 2000, 4<<30)
+
+	// The only other node doesn't have room for the pod, so it can only fit where it already is.
+	full := makeTestNodeState(conf.NodeConfig.vCpuLimits(resourcePtr("8")), conf.NodeConfig.memoryLimits(resourcePtr("32Gi")))
+	full.name = "full"
+	_ = addTestPod(full, "existing", false, 7000, 30<<30)
+
+	e := makeTestEnforcer(conf, source, full)
+
+	if e.state.hasMigrationTarget(pod) {
+		t.Fatal("expected no migration target for pod")
+	}
+
+	// NB: e.vmClient is nil, so this would panic if it tried to create the migration.
+	e.state.lock.Lock()
+	created, err := e.startMigration(context.Background(), zap.NewNop(), pod)
+	e.state.lock.Unlock()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if created {
+		t.Error("expected migration to be skipped")
+	}
+	if pod.vm.currentlyMigrating() || pod.vm.pendingMigrationTarget != "" {
+		t.Error("expected pod's migration state to be unchanged")
+	}
+
+	// Once the other node has room, there's somewhere to migrate to.
+	_, _, _, _ = e.unreserveResources(zap.NewNop(), util.NamespacedName{Namespace: "default", Name: "existing"}, false)
+	if !e.state.hasMigrationTarget(pod) {
+		t.Error("expected migration target after freeing up the other node")
+	}
+}
+
+func TestCheckOkToMigrate(t *testing.T) {
+	cases := []struct {
+		name            string
+		oldLoad         float32
+		newLoad         float32
+		minLoadFraction float64
+		expectVeto      bool
+	}{
+		{name: "disabled", oldLoad: 4, newLoad: 0, minLoadFraction: 0, expectVeto: false},
+		{name: "unchanged", oldLoad: 4, newLoad: 4, minLoadFraction: 0.5, expectVeto: false},
+		{name: "at-threshold", oldLoad: 4, newLoad: 2, minLoadFraction: 0.5, expectVeto: false},
+		{name: "below-threshold", oldLoad: 4, newLoad: 1.5, minLoadFraction: 0.5, expectVeto: true},
+	}
+
+	conf := makeTestConfig(t, func(*Config) {})
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			node := makeTestNodeState(
+				conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+				conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+			)
+			pod := addTestPod(node, "vm", true, 1000, 1<<30)
+			pod.vm.metrics = &api.Metrics{LoadAverage1Min: c.newLoad, LoadAverage5Min: c.newLoad, MemoryUsageBytes: 0}
+			oldMetrics := api.Metrics{LoadAverage1Min: c.oldLoad, LoadAverage5Min: c.oldLoad, MemoryUsageBytes: 0}
+
+			err := pod.vm.checkOkToMigrate(oldMetrics, c.minLoadFraction)
+			if c.expectVeto && err == nil {
+				t.Error("expected pod to veto migration")
+			} else if !c.expectVeto && err != nil {
+				t.Errorf("unexpected veto: %s", err)
+			}
+		})
+	}
+}
+
+func TestNodeResourceMetrics(t *testing.T) {
+	conf := makeTestConfig(t, func(*Config) {})
+
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+		conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+	)
+	addTestPod(node, "vm", true, 2000, 4<<30)
+	node.cpu.CapacityPressure = 500
+	node.cpu.PressureAccountedFor = 250
+	e := makeTestEnforcer(conf, node)
+
+	node.updateMetrics(e.metrics, time.Now())
+
+	cpuFields := map[string]vmapi.MilliCPU{
+		"Total":                node.cpu.Total,
+		"Reserved":             2000,
+		"CapacityPressure":     500,
+		"PressureAccountedFor": 250,
+	}
+	for field, expected := range cpuFields {
+		got := testutil.ToFloat64(e.metrics.nodeCPUResources.WithLabelValues(node.name, node.nodeGroup, node.availabilityZone, field))
+		if got != expected.AsFloat64() {
+			t.Errorf("expected CPU %s = %v, got %v", field, expected.AsFloat64(), got)
+		}
+	}
+	memFields := map[string]api.Bytes{
+		"Total":    node.mem.Total,
+		"Reserved": 4 << 30,
+	}
+	for field, expected := range memFields {
+		got := testutil.ToFloat64(e.metrics.nodeMemResources.WithLabelValues(node.name, node.nodeGroup, node.availabilityZone, field))
+		if got != expected.AsFloat64() {
+			t.Errorf("expected memory %s = %v, got %v", field, expected.AsFloat64(), got)
+		}
+	}
+
+	// Once the node is removed, its series should be gone as well.
+	node.removeMetrics(e.metrics)
+	if n := testutil.CollectAndCount(e.metrics.nodeCPUResources); n != 0 {
+		t.Errorf("expected no CPU series after node removal, got %d", n)
+	}
+	if n := testutil.CollectAndCount(e.metrics.nodeMemResources); n != 0 {
+		t.Errorf("expected no memory series after node removal, got %d", n)
+	}
+}
+
+func TestMigrationHeadroomMargin(t *testing.T) {
+	conf := makeTestConfig(t, func(conf *Config) {
+		conf.MigrationHeadroomMargin = 0.1
+	})
+
+	source := makeTestNodeState(conf.NodeConfig.vCpuLimits(resourcePtr("8")), conf.NodeConfig.memoryLimits(resourcePtr("32Gi")))
+	source.name = "source"
+	pod := addTestPod(source, "migrating", true, 2000, 4<<30)
+	_ = addTestPod(source, "source-existing", true, 5500, 4<<30)
+
+	// The other node has room for the pod, but would end up just as full as the source node is now,
+	// so the pod would just end up migrating back.
+	other := makeTestNodeState(conf.NodeConfig.vCpuLimits(resourcePtr("8")), conf.NodeConfig.memoryLimits(resourcePtr("32Gi")))
+	other.name = "other"
+	_ = addTestPod(other, "other-existing", true, 5500, 4<<30)
+
+	e := makeTestEnforcer(conf, source, other)
+
+	if !e.state.hasMigrationTarget(pod) {
+		t.Fatal("expected other node to have room for the pod")
+	}
+	if e.state.hasUsefulMigrationTarget(pod) {
+		t.Fatal("expected no useful migration target for pod")
+	}
+
+	// NB: e.vmClient is nil, so this would panic if it tried to create the migration.
+	e.state.lock.Lock()
+	created, err := e.startMigration(context.Background(), zap.NewNop(), pod)
+	e.state.lock.Unlock()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if created {
+		t.Error("expected migration to be suppressed")
+	}
+	if pod.vm.currentlyMigrating() || pod.vm.pendingMigrationTarget != "" {
+		t.Error("expected pod's migration state to be unchanged")
+	}
+	if n := testutil.ToFloat64(e.metrics.migrationsSuppressed.WithLabelValues("source")); n != 1 {
+		t.Errorf("expected 1 suppressed migration, got %v", n)
+	}
+
+	// Once the other node has more room, migrating would actually help.
+	_, _, _, _ = e.unreserveResources(zap.NewNop(), util.NamespacedName{Namespace: "default", Name: "other-existing"}, false)
+	if !e.state.hasUsefulMigrationTarget(pod) {
+		t.Error("expected useful migration target after freeing up the other node")
+	}
+}
+
+func TestStartMigrationExisting(t *testing.T) {
+	cases := []struct {
+		name          string
+		phase         vmapi.VmmPhase
+		expectCreated bool
+		expectTracked bool
+	}{
+		{name: "Running", phase: vmapi.VmmRunning, expectCreated: false, expectTracked: true},
+		{name: "Pending", phase: vmapi.VmmPending, expectCreated: false, expectTracked: true},
+		{name: "Succeeded", phase: vmapi.VmmSucceeded, expectCreated: false, expectTracked: false},
+		// Failed migrations are replaced by a new one. Tracking it starts when the pod watch sees
+		// it, as usual.
+		{name: "Failed", phase: vmapi.VmmFailed, expectCreated: true, expectTracked: false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := makeTestConfig(t, func(*Config) {})
+
+			node := makeTestNodeState(conf.NodeConfig.vCpuLimits(resourcePtr("8")), conf.NodeConfig.memoryLimits(resourcePtr("32Gi")))
+			pod := addTestPod(node, "migrating", true, 2000, 4<<30)
+			e := makeTestEnforcer(conf, node)
+
+			existing := &vmapi.VirtualMachineMigration{}
+			existing.Namespace = pod.name.Namespace
+			existing.Name = pluginMigrationNamePrefix + pod.vm.name.Name
+			existing.Spec.VmName = pod.vm.name.Name
+			existing.Spec.NodeSelector = map[string]string{corev1.LabelHostname: "target"}
+			existing.Status.Phase = c.phase
+			e.vmClient = vmfake.NewSimpleClientset(existing)
+
+			e.state.lock.Lock()
+			created, err := e.startMigration(context.Background(), zap.NewNop(), pod)
+			e.state.lock.Unlock()
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if created != c.expectCreated {
+				t.Errorf("expected created = %v, got %v", c.expectCreated, created)
+			}
+			var expectStarted float64
+			if c.expectCreated {
+				expectStarted = 1
+			}
+			if n := testutil.ToFloat64(e.metrics.migrationsStarted.WithLabelValues(node.name)); n != expectStarted {
+				t.Errorf("expected %v started migrations, got %v", expectStarted, n)
+			}
+
+			if pod.vm.currentlyMigrating() != c.expectTracked {
+				t.Fatalf("expected currentlyMigrating() = %v, got %v", c.expectTracked, pod.vm.currentlyMigrating())
+			}
+			if c.expectTracked {
+				name := util.GetNamespacedName(existing)
+				if pod.vm.migrationState.name != name {
+					t.Errorf("expected migration %v to be adopted, got %v", name, pod.vm.migrationState.name)
+				}
+				if pod.vm.migrationState.targetNode != "target" {
+					t.Errorf("expected target node from existing migration, got %q", pod.vm.migrationState.targetNode)
+				}
+			}
+
+			vmm, err := e.vmClient.NeonvmV1().VirtualMachineMigrations(existing.Namespace).
+				Get(context.Background(), existing.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("expected migration to exist: %s", err)
+			}
+			if c.phase == vmapi.VmmFailed && vmm.Status.Phase == vmapi.VmmFailed {
+				t.Error("expected failed migration to be replaced")
+			}
+		})
+	}
+}
+
+func TestStartMigrationCreateFailure(t *testing.T) {
+	conf := makeTestConfig(t, func(*Config) {})
+
+	node := makeTestNodeState(conf.NodeConfig.vCpuLimits(resourcePtr("8")), conf.NodeConfig.memoryLimits(resourcePtr("32Gi")))
+	pod := addTestPod(node, "migrating", true, 2000, 4<<30)
+	e := makeTestEnforcer(conf, node)
+
+	client := vmfake.NewSimpleClientset()
+	client.PrependReactor("create", "virtualmachinemigrations", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("injected failure")
+	})
+	e.vmClient = client
+
+	before := node.cpu
+
+	e.state.lock.Lock()
+	created, err := e.startMigration(context.Background(), zap.NewNop(), pod)
+	e.state.lock.Unlock()
+	if err == nil {
+		t.Fatal("expected error from failed Create request")
+	}
+	if created {
+		t.Error("expected migration not to be created")
+	}
+
+	// Pressure is only accounted for once the migration is observed, so nothing should have
+	// changed.
+	if node.cpu.PressureAccountedFor != before.PressureAccountedFor || node.cpu.Reserved != before.Reserved {
+		t.Errorf("expected node CPU state to be unchanged, was %+v, now %+v", before, node.cpu)
+	}
+	if pod.vm.currentlyMigrating() || pod.vm.migrationRequested {
+		t.Error("expected pod not to be migrating")
+	}
+	if n := node.migratingCount(); n != 0 {
+		t.Errorf("expected failed migration not to count towards the node's limit, got %d", n)
+	}
+	if e.state.ongoingMigrations != 0 {
+		t.Errorf("expected failed migration not to count towards the cluster's limit, got %d", e.state.ongoingMigrations)
+	}
+	if n := testutil.ToFloat64(e.metrics.migrationCreateFails); n != 1 {
+		t.Errorf("expected 1 failed migration creation, got %v", n)
+	}
+	if n := testutil.ToFloat64(e.metrics.migrationsFailed.WithLabelValues(pod.node.name, migrationFailReasonCreate)); n != 1 {
+		t.Errorf("expected 1 failed migration with reason %q, got %v", migrationFailReasonCreate, n)
+	}
+	if n := testutil.CollectAndCount(e.metrics.migrationsStarted); n != 0 {
+		t.Errorf("expected no started migrations, got %d series", n)
+	}
+}
+
+func TestStartMigrationCountsRequested(t *testing.T) {
+	conf := makeTestConfig(t, func(c *Config) {
+		c.MaxConcurrentMigrationsPerNode = 1
+	})
+
+	node := makeTestNodeState(conf.NodeConfig.vCpuLimits(resourcePtr("8")), conf.NodeConfig.memoryLimits(resourcePtr("32Gi")))
+	first := addTestPod(node, "first", true, 2000, 4<<30)
+	second := addTestPod(node, "second", true, 2000, 4<<30)
+	e := makeTestEnforcer(conf, node)
+
+	// While the first Create request is in flight, we don't hold the lock, so the second pod could
+	// be selected at the same time. It must see the first migration as counting towards the limit.
+	client := vmfake.NewSimpleClientset()
+	var secondErr error
+	client.PrependReactor("create", "virtualmachinemigrations", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		vmm := action.(k8stesting.CreateAction).GetObject().(*vmapi.VirtualMachineMigration)
+		if vmm.Spec.VmName == first.vm.name.Name {
+			e.state.lock.Lock()
+			_, secondErr = e.startMigration(context.Background(), zap.NewNop(), second)
+			e.state.lock.Unlock()
+		}
+		return false, nil, nil
+	})
+	e.vmClient = client
+
+	e.state.lock.Lock()
+	created, err := e.startMigration(context.Background(), zap.NewNop(), first)
+	e.state.lock.Unlock()
+	if err != nil || !created {
+		t.Fatalf("expected migration to be created, got created = %v, err = %v", created, err)
+	}
+	if secondErr == nil {
+		t.Error("expected second migration to be refused while the first was being created")
+	}
+	if second.vm.migrationRequested {
+		t.Error("expected second pod not to be marked as having requested a migration")
+	}
+
+	// The first migration keeps counting until we observe it starting.
+	if !first.vm.migrationRequested {
+		t.Error("expected first pod to be marked as having requested a migration")
+	}
+	if !node.migrationLimitReached(conf) {
+		t.Errorf("expected node to be at its migration limit, has %d migrating", node.migratingCount())
+	}
+
+	migrationName := util.NamespacedName{Namespace: first.name.Namespace, Name: pluginMigrationNamePrefix + first.vm.name.Name}
+	e.startPodMigration(zap.NewNop(), first, migrationName, true)
+	if first.vm.migrationRequested {
+		t.Error("expected mark to be cleared once the migration started")
+	}
+	if n := node.migratingCount(); n != 1 {
+		t.Errorf("expected 1 migration counting towards the node's limit, got %d", n)
+	}
+}
+
+func TestOtherSchedulerVMPod(t *testing.T) {
+	conf := makeTestConfig(t, func(*Config) {})
+
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+		conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+	)
+	e := makeTestEnforcer(conf, node)
+
+	pod := &corev1.Pod{}
+	pod.Namespace = "default"
+	pod.Name = "other-vm-pod"
+	pod.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: "vm.neon.tech/v1",
+		Kind:       "VirtualMachine",
+		Name:       "other-vm",
+	}}
+	pod.Spec.NodeName = node.name
+	pod.Spec.SchedulerName = "other-scheduler"
+	pod.Spec.Containers = []corev1.Container{{}}
+	pod.Spec.Containers[0].Resources.Requests = corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("1"),
+		corev1.ResourceMemory: resource.MustParse("2Gi"),
+	}
+
+	if e.tryPodOwnerVirtualMachine(pod) != nil {
+		t.Fatal("expected VM pod belonging to another scheduler not to be treated as a VM")
+	}
+
+	// Handling the pod starting should count its resources, but not track it as a VM. This doesn't
+	// access the VM store, which isn't set up here.
+	e.handleStarted(zap.NewNop(), pod)
+
+	ps, ok := e.state.pods[util.GetNamespacedName(pod)]
+	if !ok {
+		t.Fatal("expected pod's resources to be tracked")
+	}
+	if ps.vm != nil {
+		t.Error("expected pod not to have VM state")
+	}
+	if node.cpu.Reserved != 1000 || node.mem.Reserved != 2<<30 {
+		t.Errorf("unexpected node reserved resources: cpu = %v, mem = %v", node.cpu.Reserved, node.mem.Reserved)
+	}
+
+	// ... and if the same pod were for our scheduler, it would be a VM.
+	pod.Spec.SchedulerName = conf.SchedulerName
+	if e.tryPodOwnerVirtualMachine(pod) == nil {
+		t.Error("expected VM pod belonging to our scheduler to be treated as a VM")
+	}
+}
+
+func TestOverWatermarkTracking(t *testing.T) {
+	conf := makeTestConfig(t, func(*Config) {})
+
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("10")),
+		conf.NodeConfig.memoryLimits(resourcePtr("10Gi")),
+	)
+	e := makeTestEnforcer(conf, node)
+
+	start := time.Now()
+
+	node.updateOverWatermark(e.metrics, start)
+	if node.overWatermarkSince != nil {
+		t.Fatal("expected empty node not to be over watermark")
+	}
+
+	// Go over the watermark on CPU
+	pod := addTestPod(node, "pod", false, node.cpu.Watermark+100, 1<<30)
+	node.updateOverWatermark(e.metrics, start)
+	if node.overWatermarkSince == nil || !node.overWatermarkSince.Equal(start) {
+		t.Fatalf("expected node to be over watermark since %v, got %v", start, node.overWatermarkSince)
+	}
+
+	// Staying over the watermark shouldn't reset the start time
+	node.updateOverWatermark(e.metrics, start.Add(10*time.Second))
+	if node.overWatermarkSince == nil || !node.overWatermarkSince.Equal(start) {
+		t.Fatalf("expected node to still be over watermark since %v, got %v", start, node.overWatermarkSince)
+	}
+
+	// Once the pod's usage goes down, the node is no longer over the watermark
+	node.cpu.Reserved -= pod.cpu.Reserved
+	node.updateOverWatermark(e.metrics, start.Add(30*time.Second))
+	if node.overWatermarkSince != nil {
+		t.Errorf("expected node to no longer be over watermark, got %v", node.overWatermarkSince)
+	}
+}
+
+func TestZoneCapacities(t *testing.T) {
+	conf := makeTestConfig(t, func(*Config) {})
+
+	makeNode := func(name, zone, cpu, mem string) *nodeState {
+		n := makeTestNodeState(conf.NodeConfig.vCpuLimits(resourcePtr(cpu)), conf.NodeConfig.memoryLimits(resourcePtr(mem)))
+		n.name = name
+		n.availabilityZone = zone
+		return n
+	}
+
+	a1 := makeNode("a1", "zone-a", "8", "32Gi")
+	a2 := makeNode("a2", "zone-a", "16", "64Gi")
+	b1 := makeNode("b1", "zone-b", "8", "32Gi")
+	_ = addTestPod(a1, "a1-vm", true, 2000, 8<<30)
+	_ = addTestPod(a2, "a2-vm", true, 1000, 4<<30)
+	_ = addTestPod(a2, "a2-other", false, 500, 1<<30)
+	_ = addTestPod(b1, "b1-vm", true, 4000, 16<<30)
+	e := makeTestEnforcer(conf, a1, a2, b1)
+
+	dump, err := e.state.dump(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error dumping state: %s", err)
+	}
+
+	expected := []keyed[string, zoneCapacity]{
+		{
+			Key: "zone-a",
+			Value: zoneCapacity{
+				Nodes:         2,
+				ReservableCPU: a1.cpu.Total + a2.cpu.Total,
+				ReservedCPU:   3500,
+				ReservableMem: a1.mem.Total + a2.mem.Total,
+				ReservedMem:   13 << 30,
+			},
+		},
+		{
+			Key: "zone-b",
+			Value: zoneCapacity{
+				Nodes:         1,
+				ReservableCPU: b1.cpu.Total,
+				ReservedCPU:   4000,
+				ReservableMem: b1.mem.Total,
+				ReservedMem:   16 << 30,
+			},
+		},
+	}
+
+	if len(dump.Zones) != len(expected) {
+		t.Fatalf("expected %d zones, got %+v", len(expected), dump.Zones)
+	}
+	for i := range expected {
+		if dump.Zones[i] != expected[i] {
+			t.Errorf("expected zone %d = %+v, got %+v", i, expected[i], dump.Zones[i])
+		}
+	}
+
+	// The zone should come from the well-known topology label by default
+	k8sNode := &corev1.Node{}
+	k8sNode.Name = "c1"
+	k8sNode.Labels = map[string]string{corev1.LabelTopologyZone: "zone-c"}
+	k8sNode.Status.Allocatable = corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("8"),
+		corev1.ResourceMemory: resource.MustParse("32Gi"),
+	}
+	n, err := buildInitialNodeState(zap.NewNop(), k8sNode, conf, time.Now())
+	if err != nil {
+		t.Fatalf("unexpected error building node state: %s", err)
+	}
+	if n.availabilityZone != "zone-c" {
+		t.Errorf("expected availability zone from default label, got %q", n.availabilityZone)
+	}
+}
+
+func TestNonVMLimit(t *testing.T) {
+	makePod := func(name string, nodeName string) *corev1.Pod {
+		pod := &corev1.Pod{}
+		pod.Namespace = "default"
+		pod.Name = name
+		pod.Spec.NodeName = nodeName
+		pod.Spec.Containers = []corev1.Container{{}}
+		pod.Spec.Containers[0].Resources.Requests = corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("1"),
+			corev1.ResourceMemory: resource.MustParse("1Gi"),
+		}
+		return pod
+	}
+
+	cases := []struct {
+		name      string
+		reject    bool
+		allowDeny bool
+		expected  bool
+	}{
+		{name: "Reject", reject: true, allowDeny: true, expected: false},
+		{name: "WarnOnly", reject: false, allowDeny: true, expected: true},
+		// Pods that have already started can't be rejected, even if the config says to.
+		{name: "RejectAlreadyStarted", reject: true, allowDeny: false, expected: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := makeTestConfig(t, func(conf *Config) {
+				conf.NonVMLimit = &nonVMLimitConfig{MaxFraction: 0.25, Reject: c.reject}
+			})
+			if path, err := conf.validate(); err != nil {
+				t.Fatalf("invalid config at %s: %s", path, err)
+			}
+
+			// With a limit of 2 vCPU / 8Gi for non-VM pods, another pod needing 1 vCPU would exceed
+			// it, even though there's plenty of room on the node overall.
+			node := makeTestNodeState(
+				conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+				conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+			)
+			_ = addTestPod(node, "vm", true, 4000, 16<<30)
+			_ = addTestPod(node, "system", false, 1500, 2<<30)
+			e := makeTestEnforcer(conf, node)
+
+			if limit := node.nonVMLimit(conf); limit == nil || *limit != (api.Resources{VCPU: 2000, Mem: 8 << 30}) {
+				t.Fatalf("unexpected non-VM limit %v", limit)
+			}
+
+			pod := makePod("new-system", node.name)
+			ok, _, err := e.reserveResources(context.Background(), zap.NewNop(), pod, "test", c.allowDeny)
+			if err != nil {
+				t.Fatalf("unexpected error reserving resources: %s", err)
+			}
+			if ok != c.expected {
+				t.Fatalf("expected reserveResources to return %v, got %v", c.expected, ok)
+			}
+
+			expectedNonVM := api.Resources{VCPU: 1500, Mem: 2 << 30}
+			if c.expected {
+				expectedNonVM = api.Resources{VCPU: 2500, Mem: 3 << 30}
+			}
+			if got := node.nonVMReserved(); got != expectedNonVM {
+				t.Errorf("expected non-VM reserved = %v, got %v", expectedNonVM, got)
+			}
+		})
+	}
+}
+
+func TestMigrationQueueMetrics(t *testing.T) {
+	conf := makeTestConfig(t, func(*Config) {})
+
+	node := makeTestNodeState(
+		conf.NodeConfig.vCpuLimits(resourcePtr("8")),
+		conf.NodeConfig.memoryLimits(resourcePtr("32Gi")),
+	)
+	a := addTestPod(node, "a", true, 1000, 4<<30)
+	b := addTestPod(node, "b", true, 1000, 4<<30)
+	a.vm.metrics = &api.Metrics{LoadAverage1Min: 0.5, LoadAverage5Min: 0.5, MemoryUsageBytes: 0}
+	b.vm.metrics = &api.Metrics{LoadAverage1Min: 2.0, LoadAverage5Min: 2.0, MemoryUsageBytes: 0}
+
+	e := makeTestEnforcer(conf, node)
+
+	check := func(now time.Time, expectedDepth int, expectedWait time.Duration) {
+		t.Helper()
+		node.updateQueueMetrics(e.metrics, now)
+		depth := testutil.ToFloat64(e.metrics.migrationQueueDepth.WithLabelValues(node.name, node.nodeGroup, node.availabilityZone))
+		if depth != float64(expectedDepth) {
+			t.Errorf("expected queue depth %d, got %v", expectedDepth, depth)
+		}
+		wait := testutil.ToFloat64(e.metrics.migrationQueueOldestWait.WithLabelValues(node.name, node.nodeGroup, node.availabilityZone))
+		if wait != expectedWait.Seconds() {
+			t.Errorf("expected oldest wait %v, got %vs", expectedWait, wait)
+		}
+	}
+
+	start := time.Now()
+	check(start, 0, 0)
+
+	node.mq.addOrUpdate(a.vm, time.Now())
+	a.vm.mqEnqueuedAt = start
+	node.mq.addOrUpdate(b.vm, time.Now())
+	b.vm.mqEnqueuedAt = start.Add(10 * time.Second)
+	check(start.Add(30*time.Second), 2, 30*time.Second)
+
+	// Updating a pod that's already in the queue shouldn't reset how long it's been waiting
+	node.mq.addOrUpdate(a.vm, time.Now())
+	if !a.vm.mqEnqueuedAt.Equal(start) {
+		t.Errorf("expected enqueue time to be unchanged, got %v", a.vm.mqEnqueuedAt)
+	}
+
+	node.mq.removeIfPresent(a.vm)
+	check(start.Add(30*time.Second), 1, 20*time.Second)
+
+	node.mq.removeIfPresent(b.vm)
+	check(start.Add(30*time.Second), 0, 0)
+
+	// Removing pods from their node should also remove them from the queue metrics
+	node.mq.addOrUpdate(a.vm, time.Now())
+	node.mq.addOrUpdate(b.vm, time.Now())
+	node.updateQueueMetrics(e.metrics, time.Now())
+	_, _, _, _ = e.unreserveResources(zap.NewNop(), a.name, false)
+	_, _, _, _ = e.unreserveResources(zap.NewNop(), b.name, false)
+	depth := testutil.ToFloat64(e.metrics.migrationQueueDepth.WithLabelValues(node.name, node.nodeGroup, node.availabilityZone))
+	if depth != 0 {
+		t.Errorf("expected queue depth 0 after removing pods, got %v", depth)
+	}
+}
+
+func TestRunnerGuaranteedQoS(t *testing.T) {
+	makePod := func(containerName string, requests, limits corev1.ResourceList) *corev1.Pod {
+		pod := &corev1.Pod{}
+		pod.Spec.Containers = []corev1.Container{{
+			Name: containerName,
+			Resources: corev1.ResourceRequirements{
+				Requests: requests,
+				Limits:   limits,
+			},
+		}}
+		return pod
+	}
+
+	resources := func(cpu, mem string) corev1.ResourceList {
+		return corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse(cpu),
+			corev1.ResourceMemory: resource.MustParse(mem),
+		}
+	}
+
+	cases := []struct {
+		name     string
+		pod      *corev1.Pod
+		expected bool
+	}{
+		{
+			name:     "Guaranteed",
+			pod:      makePod(runnerContainerName, resources("1", "4Gi"), resources("1", "4Gi")),
+			expected: true,
+		},
+		{
+			name:     "LimitsOnly",
+			pod:      makePod(runnerContainerName, nil, resources("1", "4Gi")),
+			expected: true,
+		},
+		{
+			name:     "Burstable",
+			pod:      makePod(runnerContainerName, resources("250m", "4Gi"), resources("1", "4Gi")),
+			expected: false,
+		},
+		{
+			name:     "NoLimits",
+			pod:      makePod(runnerContainerName, resources("1", "4Gi"), nil),
+			expected: false,
+		},
+		{
+			name:     "NoRunner",
+			pod:      makePod("something-else", resources("1", "4Gi"), resources("1", "4Gi")),
+			expected: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			verdict, ok := checkRunnerGuaranteedQoS(c.pod)
+			if ok != c.expected {
+				t.Errorf("expected %v, got %v with verdict cpu=%q, mem=%q", c.expected, ok, verdict.cpu, verdict.mem)
+			}
+		})
+	}
+}
+
+func TestPodLimitsExposed(t *testing.T) {
+	conf := makeTestConfig(t, func(*Config) {})
+
+	node := makeTestNodeState(conf.NodeConfig.vCpuLimits(resourcePtr("8")), conf.NodeConfig.memoryLimits(resourcePtr("32Gi")))
+	pod := addTestPod(node, "vm", true, 1000, 4<<30)
+	e := makeTestEnforcer(conf, node)
+
+	_ = handleUpdatedLimits(&node.cpu, &pod.cpu, true, 250, 4000, 4000)
+	_ = handleUpdatedLimits(&node.mem, &pod.mem, true, 1<<30, 16<<30, 16<<30)
+	node.updateMetrics(e.metrics, time.Now())
+
+	gauge := func(metric *prometheus.GaugeVec, field string) float64 {
+		return testutil.ToFloat64(metric.WithLabelValues(pod.name.Namespace, pod.name.Name, node.name, field))
+	}
+
+	cases := []struct {
+		name     string
+		got      float64
+		expected float64
+	}{
+		{name: "cpu Min", got: gauge(e.metrics.podCPUResources, "Min"), expected: 250},
+		{name: "cpu Max", got: gauge(e.metrics.podCPUResources, "Max"), expected: 4000},
+		{name: "mem Min", got: gauge(e.metrics.podMemResources, "Min"), expected: 1 << 30},
+		{name: "mem Max", got: gauge(e.metrics.podMemResources, "Max"), expected: 16 << 30},
+	}
+	for _, c := range cases {
+		if c.got != c.expected {
+			t.Errorf("expected %s gauge to be %g, got %g", c.name, c.expected, c.got)
+		}
+	}
+
+	dump := pod.dump()
+	if dump.CPU.Min != 250 || dump.CPU.Max != 4000 || dump.Mem.Min != 1<<30 || dump.Mem.Max != 16<<30 {
+		t.Errorf("unexpected bounds in state dump: cpu = %+v, mem = %+v", dump.CPU, dump.Mem)
+	}
+}
@@ -7,7 +7,11 @@ package plugin
 // resourceTransitions are created with the collectResourceTransition function.
 //
 // Handling requested resources from the autoscaler-agent is done with the handleRequested method,
-// and changes from VM deletion are handled by handleDeleted.
+// and changes from VM deletion are handled by handleDeleted. Burst headroom is converted or released
+// by handleBurstConsumed before each request, and granted again afterwards by handleBurstGranted.
+// With Config.StrictComputeUnitAlignment, part of an increase from handleRequested may be taken back
+// by handleIncreaseHeldBack. If a pod's compute unit changes between requests, handleComputeUnitChanged
+// is called before any of the above.
 
 import (
 	"errors"
@@ -73,12 +77,17 @@ func (s verdictSet) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 // any disconnect, which could lead to unintentional over-committing of resources
 // from the Buffer values if too many agents request upscaling on the first
 // request to the scheduler.
+//
+// The pod's Burst isn't included in the permit, but is still reserved for the pod, so it's left
+// as-is.
 func (r resourceTransitioner[T]) handleLastPermit(lastPermit T) (verdict string) {
 	oldState := r.snapshotState()
 
-	if lastPermit <= r.pod.Reserved {
-		r.node.Reserved -= r.pod.Reserved - lastPermit
-		r.pod.Reserved = lastPermit
+	lastReserved := lastPermit + r.pod.Burst
+
+	if lastReserved <= r.pod.Reserved {
+		r.node.Reserved -= r.pod.Reserved - lastReserved
+		r.pod.Reserved = lastReserved
 
 		var podBuffer string
 		var oldNodeBuffer string
@@ -131,6 +140,10 @@ func (r resourceTransitioner[T]) handleRequested(requested T, startingMigration
 	// config change; we have to use SaturatingSub here to account for that.
 	remainingReservable := util.SaturatingSub(totalReservable, oldState.node.Reserved)
 
+	// hardLimited is set below if the increase is bounded by the node's HardLimit, rather than by
+	// what's left of its total.
+	hardLimited := false
+
 	// Note: The correctness of this function depends on the autoscaler-agents and previous
 	// scheduler being well-behaved. This function will fail to prevent overcommitting when:
 	//
@@ -203,16 +216,27 @@ func (r resourceTransitioner[T]) handleRequested(requested T, startingMigration
 		// Increases are bounded by what's left in the node, rounded down to the nearest multiple of
 		// the factor.
 		maxIncrease := (remainingReservable / factor) * factor
-		if increase > maxIncrease /* increases are bound by what's left in the node */ {
+		// If the node has a hard limit, increases past it are denied outright.
+		if r.node.HardLimit != 0 {
+			remainingUnderLimit := util.SaturatingSub(r.node.HardLimit, oldState.node.Reserved)
+			if limited := (remainingUnderLimit / factor) * factor; limited < maxIncrease {
+				maxIncrease = limited
+				hardLimited = true
+			}
+		}
+
+		if increase > maxIncrease && !hardLimited /* increases are bound by what's left in the node */ {
 			r.pod.CapacityPressure = increase - maxIncrease
 			// adjust node pressure accordingly. We can have old < new or new > old, so we shouldn't
 			// directly += or -= (implicitly relying on overflow).
 			r.node.CapacityPressure = r.node.CapacityPressure - oldState.pod.CapacityPressure + r.pod.CapacityPressure
 			increase = maxIncrease // cap at maxIncrease.
 		} else {
-			// If we're not capped by maxIncrease, relieve pressure coming from this pod
+			// If we're not capped by maxIncrease (or we're capped by the hard limit, which doesn't
+			// count as pressure), relieve pressure coming from this pod
 			r.node.CapacityPressure -= r.pod.CapacityPressure
 			r.pod.CapacityPressure = 0
+			increase = util.Min(increase, maxIncrease)
 		}
 		r.pod.Reserved += increase
 		r.node.Reserved += increase
@@ -238,7 +262,9 @@ func (r resourceTransitioner[T]) handleRequested(requested T, startingMigration
 	}
 
 	var wanted string
-	if r.pod.Reserved != requested {
+	if r.pod.Reserved != requested && hardLimited {
+		wanted = fmt.Sprintf(" (wanted %d, over hard limit %d)", requested, r.node.HardLimit)
+	} else if r.pod.Reserved != requested {
 		wanted = fmt.Sprintf(" (wanted %d)", requested)
 	}
 
@@ -254,6 +280,119 @@ func (r resourceTransitioner[T]) handleRequested(requested T, startingMigration
 	return verdict
 }
 
+// handleIncreaseHeldBack reduces the pod's reservation to target, after an increase was granted by
+// handleRequested, so that it stays aligned with the other resource. The withheld amount is added
+// to the pod's CapacityPressure, because the pod still wants it.
+//
+// If target is not less than the pod's current reservation, no changes are made.
+//
+// A pretty-formatted summary of the outcome is returned as the verdict, for logging.
+func (r resourceTransitioner[T]) handleIncreaseHeldBack(target T) (verdict string) {
+	oldState := r.snapshotState()
+
+	if target >= r.pod.Reserved {
+		return fmt.Sprintf("no change: target %d is not less than pod reserved %d", target, r.pod.Reserved)
+	}
+
+	heldBack := r.pod.Reserved - target
+	r.pod.Reserved = target
+	r.node.Reserved -= heldBack
+	r.pod.CapacityPressure += heldBack
+	r.node.CapacityPressure += heldBack
+
+	verdict = fmt.Sprintf(
+		"held back %d to keep compute units aligned: pod reserved %d -> %d (pressure %d -> %d), "+
+			"node reserved %d -> %d, node capacityPressure %d -> %d",
+		heldBack, oldState.pod.Reserved, r.pod.Reserved, oldState.pod.CapacityPressure, r.pod.CapacityPressure,
+		oldState.node.Reserved, r.node.Reserved, oldState.node.CapacityPressure, r.node.CapacityPressure,
+	)
+	return verdict
+}
+
+// handleComputeUnitChanged clears r.pod's CapacityPressure, because it was measured in multiples of
+// the pod's previous compute unit.
+//
+// This must be called before handling anything else in the request, so that handleRequested
+// calculates the pod's pressure from scratch with the new compute unit. Buffer is unaffected
+// because it's already zero by the time we know the pod's compute unit, and Burst is converted or
+// released by handleBurstConsumed as usual.
+//
+// A pretty-formatted summary of the outcome is returned as the verdict, for logging.
+func (r resourceTransitioner[T]) handleComputeUnitChanged() (verdict string) {
+	oldState := r.snapshotState()
+
+	r.node.CapacityPressure -= r.pod.CapacityPressure
+	r.pod.CapacityPressure = 0
+
+	verdict = fmt.Sprintf(
+		"cleared pod capacityPressure %d; node capacityPressure %d -> %d",
+		oldState.pod.CapacityPressure, oldState.node.CapacityPressure, r.node.CapacityPressure,
+	)
+	return verdict
+}
+
+// handleBurstConsumed converts the part of r.pod's Burst that the pod is using into normal reserved
+// resources, and releases the rest. The amount in use is determined by how far the requested amount
+// is above what the pod was permitted.
+//
+// This must be called before handleRequested, so that the request is handled relative to only what
+// the pod has been permitted.
+//
+// A pretty-formatted summary of the outcome is returned as the verdict, for logging.
+func (r resourceTransitioner[T]) handleBurstConsumed(requested T) (verdict string) {
+	oldState := r.snapshotState()
+
+	permitted := r.pod.Reserved - r.pod.Burst
+	consumed := util.Min(util.SaturatingSub(requested, permitted), r.pod.Burst)
+	released := r.pod.Burst - consumed
+
+	r.pod.Reserved -= released
+	r.node.Reserved -= released
+	r.node.Burst -= r.pod.Burst
+	r.pod.Burst = 0
+
+	verdict = fmt.Sprintf(
+		"pod burst %d (consumed %d, released %d); pod reserved %d -> %d, "+
+			"node reserved %d [burst %d] -> %d [burst %d]",
+		oldState.pod.Burst, consumed, released, oldState.pod.Reserved, r.pod.Reserved,
+		oldState.node.Reserved, oldState.node.Burst, r.node.Reserved, r.node.Burst,
+	)
+	return verdict
+}
+
+// handleBurstGranted reserves up to amount as burst headroom for r.pod, above what it's been
+// permitted. The burst never takes the pod above its maximum, and is limited to the room left on
+// the node below its Watermark, after the node's capacity pressure. Otherwise, the burst could
+// itself cause migrations, or take room that pods already waiting to grow should get first.
+//
+// The burst is always a multiple of factor.
+//
+// A pretty-formatted summary of the outcome is returned as the verdict, for logging.
+func (r resourceTransitioner[T]) handleBurstGranted(amount T, factor T) (verdict string) {
+	oldState := r.snapshotState()
+
+	remainingReservable := util.SaturatingSub(r.node.Watermark, r.node.Reserved+r.node.CapacityPressure)
+	belowMax := util.SaturatingSub(r.pod.Max, r.pod.Reserved)
+	burst := util.Min(amount, util.Min(remainingReservable, belowMax)) / factor * factor
+
+	r.pod.Burst += burst
+	r.pod.Reserved += burst
+	r.node.Burst += burst
+	r.node.Reserved += burst
+
+	var wanted string
+	if burst != amount {
+		wanted = fmt.Sprintf(" (wanted %d)", amount)
+	}
+
+	verdict = fmt.Sprintf(
+		"pod burst %d -> %d%s, reserved %d -> %d; node reserved %d [burst %d] -> %d [burst %d] (watermark %d, pressure %d)",
+		oldState.pod.Burst, r.pod.Burst, wanted, oldState.pod.Reserved, r.pod.Reserved,
+		oldState.node.Reserved, oldState.node.Burst, r.node.Reserved, r.node.Burst, r.node.Watermark, r.node.CapacityPressure,
+	)
+	return verdict
+}
+
 // handleDeleted updates r.node with changes to match the removal of r.pod
 //
 // A pretty-formatted summary of the changes is returned as the verdict, for logging.
@@ -261,6 +400,7 @@ func (r resourceTransitioner[T]) handleDeleted(currentlyMigrating bool) (verdict
 	oldState := r.snapshotState()
 
 	r.node.Reserved -= r.pod.Reserved
+	r.node.Burst -= r.pod.Burst
 	r.node.CapacityPressure -= r.pod.CapacityPressure
 
 	if currentlyMigrating {
@@ -316,6 +456,12 @@ func (r resourceTransitioner[T]) handleAutoscalingDisabled() (verdict string) {
 	for _, v := range valuesToReduce {
 		*v -= buffer
 	}
+	// ... and the same for burst, which the pod will no longer be able to use.
+	burst := r.pod.Burst
+	valuesToReduce = []*T{&r.node.Reserved, &r.node.Burst, &r.pod.Reserved, &r.pod.Burst}
+	for _, v := range valuesToReduce {
+		*v -= burst
+	}
 
 	r.node.CapacityPressure -= r.pod.CapacityPressure
 	r.pod.CapacityPressure = 0
@@ -356,6 +502,12 @@ func (r resourceTransitioner[T]) handleStartMigration(source bool) (verdict stri
 	for _, v := range valuesToReduce {
 		*v -= buffer
 	}
+	// ... and the same for burst, which the pod will no longer be able to use.
+	burst := r.pod.Burst
+	valuesToReduce = []*T{&r.node.Reserved, &r.node.Burst, &r.pod.Reserved, &r.pod.Burst}
+	for _, v := range valuesToReduce {
+		*v -= burst
+	}
 
 	r.node.CapacityPressure -= r.pod.CapacityPressure
 	r.pod.CapacityPressure = 0
@@ -374,12 +526,29 @@ func (r resourceTransitioner[T]) handleStartMigration(source bool) (verdict stri
 	return verdict
 }
 
+// handleMigrationAborted updates r.node to no longer expect that r.pod's migration will relieve any
+// pressure, reversing the change to PressureAccountedFor from handleStartMigration.
+//
+// A pretty-formatted summary of the changes is returned as the verdict, for logging.
+func (r resourceTransitioner[T]) handleMigrationAborted() (verdict string) {
+	oldState := r.snapshotState()
+
+	r.node.PressureAccountedFor -= r.pod.Reserved + r.pod.CapacityPressure
+
+	verdict = fmt.Sprintf(
+		"pod reserved %d, capacityPressure %d; node pressureAccountedFor %d -> %d",
+		r.pod.Reserved, r.pod.CapacityPressure, oldState.node.PressureAccountedFor, r.node.PressureAccountedFor,
+	)
+	return verdict
+}
+
 func handleUpdatedLimits[T constraints.Unsigned](
 	node *nodeResourceState[T],
 	pod *podResourceState[T],
 	receivedContact bool,
 	newMin T,
 	newMax T,
+	maxBuffer T,
 ) (verdict string) {
 	if newMin == pod.Min && newMax == pod.Max {
 		return fmt.Sprintf("limits unchanged (min = %d, max = %d)", newMin, newMax)
@@ -426,12 +595,21 @@ func handleUpdatedLimits[T constraints.Unsigned](
 		pod.Reserved = util.Max(newMax, using)
 		pod.Buffer = pod.Reserved - using
 
+		// If there's already too much buffer across the cluster, fall back towards what the VM is
+		// using. See Config.MaxClusterBufferCPU and MaxClusterBufferMem.
+		var limitedVerdict string
+		if pod.Buffer > maxBuffer {
+			limitedVerdict = fmt.Sprintf(" [limited from %d by cluster buffer cap]", pod.Buffer)
+			pod.Buffer = maxBuffer
+			pod.Reserved = using + maxBuffer
+		}
+
 		node.Reserved = node.Reserved + pod.Reserved - oldPodReserved
 		node.Buffer = node.Buffer + pod.Buffer - oldPodBuffer
 
 		bufferVerdict = fmt.Sprintf(
-			". no contact yet: pod reserved %d -> %d (buffer %d -> %d), node reserved %d -> %d (buffer %d -> %d)",
-			oldPodReserved, pod.Reserved, oldPodBuffer, pod.Buffer,
+			". no contact yet: pod reserved %d -> %d (buffer %d -> %d%s), node reserved %d -> %d (buffer %d -> %d)",
+			oldPodReserved, pod.Reserved, oldPodBuffer, pod.Buffer, limitedVerdict,
 			oldNodeReserved, node.Reserved, oldNodeBuffer, node.Buffer,
 		)
 	}
@@ -21,10 +21,12 @@ import (
 
 type nodeWatchCallbacks struct {
 	submitNodeDeletion func(*zap.Logger, string)
+	submitNodeUpdate   func(*zap.Logger, *corev1.Node)
 }
 
 // watchNodeEvents watches for any deleted Nodes, so that we can clean up the resources that were
-// associated with them.
+// associated with them, and for changes to the Nodes' extra reservation and score multiplier
+// annotations, or whether they're cordoned.
 func (e *AutoscaleEnforcer) watchNodeEvents(
 	ctx context.Context,
 	parentLogger *zap.Logger,
@@ -53,6 +55,30 @@ func (e *AutoscaleEnforcer) watchNodeEvents(
 		watch.InitModeSync,
 		metav1.ListOptions{},
 		watch.HandlerFuncs[*corev1.Node]{
+			UpdateFunc: func(oldNode, newNode *corev1.Node) {
+				changed := false
+				annotations := []string{
+					AnnotationNodeExtraReservedCPU,
+					AnnotationNodeExtraReservedMem,
+					AnnotationNodeScoreMultiplier,
+				}
+				for _, a := range annotations {
+					if oldNode.Annotations[a] != newNode.Annotations[a] {
+						changed = true
+					}
+				}
+				if changed {
+					logger.Info("Received update changing node annotations", zap.String("node", newNode.Name))
+					callbacks.submitNodeUpdate(logger, newNode)
+				} else if oldNode.Spec.Unschedulable != newNode.Spec.Unschedulable {
+					logger.Info(
+						"Received update changing node schedulability",
+						zap.String("node", newNode.Name),
+						zap.Bool("unschedulable", newNode.Spec.Unschedulable),
+					)
+					callbacks.submitNodeUpdate(logger, newNode)
+				}
+			},
 			DeleteFunc: func(node *corev1.Node, mayBeStale bool) {
 				logger.Info("Received delete event for node", zap.String("node", node.Name))
 				callbacks.submitNodeDeletion(logger, node.Name)
@@ -147,6 +173,12 @@ func (e *AutoscaleEnforcer) watchPodEvents(
 					return // no other handling worthwhile if the pod's done.
 				}
 
+				// Migrations of VMs belonging to other schedulers aren't our concern; we don't track
+				// those pods as VMs.
+				if newPod.Spec.SchedulerName != e.state.conf.SchedulerName {
+					return
+				}
+
 				// Check if the pod is part of a new migration, or if a migration it *was* part of
 				// has now ended.
 				oldMigration := util.TryPodOwnerVirtualMachineMigration(oldPod)
@@ -288,6 +320,20 @@ func (e *AutoscaleEnforcer) watchVMEvents(
 					return
 				}
 
+				// VM pods belonging to other schedulers aren't tracked as VMs, so there's nothing
+				// to update. If the pod isn't in the store, carry on as usual.
+				runnerPod, ok := podIndex.GetIndexed(func(index *watch.NameIndex[corev1.Pod]) (*corev1.Pod, bool) {
+					return index.Get(newVM.Namespace, newVM.Status.PodName)
+				})
+				if ok && runnerPod.Spec.SchedulerName != e.state.conf.SchedulerName {
+					logger.Info(
+						"Skipping update for VM because its pod belongs to a different scheduler",
+						util.VMNameFields(newVM),
+						zap.String("schedulerName", runnerPod.Spec.SchedulerName),
+					)
+					return
+				}
+
 				if oldInfo.ScalingEnabled && !newInfo.ScalingEnabled {
 					logger.Info("Received update to disable autoscaling for VM", util.VMNameFields(newVM))
 					name := util.NamespacedName{Namespace: newInfo.Namespace, Name: newVM.Status.PodName}
@@ -320,6 +366,7 @@ func (e *AutoscaleEnforcer) watchVMEvents(
 }
 
 type migrationWatchCallbacks struct {
+	submitPhaseChanged      func(*zap.Logger, *vmapi.VirtualMachineMigration)
 	submitMigrationFinished func(*vmapi.VirtualMachineMigration)
 }
 
@@ -376,6 +423,10 @@ func (e *AutoscaleEnforcer) watchMigrationEvents(
 					return
 				}
 
+				if newObj.Status.Phase != oldObj.Status.Phase {
+					callbacks.submitPhaseChanged(logger, newObj)
+				}
+
 				shouldDelete := newObj.Status.Phase != oldObj.Status.Phase &&
 					(newObj.Status.Phase == vmapi.VmmSucceeded || newObj.Status.Phase == vmapi.VmmFailed)
 